@@ -9,14 +9,20 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
 )
 
-var sessionSecret []byte
+// sessionKey derives the HMAC key for session tokens from the configured
+// secret.
+func sessionKey(secret string) []byte {
+	sum := sha256.Sum256([]byte(strings.TrimSpace(secret)))
+	return sum[:]
+}
 
-func verifyGoogleToken(token string) (string, error) {
+func (s *Server) verifyGoogleToken(token string) (string, error) {
 	resp, err := http.Get("https://oauth2.googleapis.com/tokeninfo?id_token=" + token)
 	if err != nil {
 		return "", err
@@ -35,12 +41,7 @@ func verifyGoogleToken(token string) (string, error) {
 		return "", err
 	}
 
-	validClients := map[string]bool{
-		"588653192623-aqs0s01hv62pbp5p7pe3r0h7mce8m10l.apps.googleusercontent.com": true, // Electron
-		"588653192623-3lkl6bqaa77lk1g3l89uideuqf083g1o.apps.googleusercontent.com": true, // Android
-	}
-
-	if !validClients[claims.Aud] {
+	if !slices.Contains(s.cfg.GoogleClientIDs, claims.Aud) {
 		return "", fmt.Errorf("invalid token audience: %s", claims.Aud)
 	}
 
@@ -57,18 +58,18 @@ func GenerateTurnCreds(userId, secret string) (string, string) {
 	return username, password
 }
 
-func generateSessionToken(email string) string {
+func generateSessionToken(key []byte, email string) string {
 	exp := time.Now().Add(30 * 24 * time.Hour).Unix()
 	data := fmt.Sprintf("sess:%d:%s", exp, email)
 
-	h := hmac.New(sha256.New, sessionSecret)
+	h := hmac.New(sha256.New, key)
 	h.Write([]byte(data))
 	sig := hex.EncodeToString(h.Sum(nil))
 
 	return fmt.Sprintf("%s:%s", data, sig)
 }
 
-func verifyAuthToken(token string) (string, string, error) {
+func (s *Server) verifyAuthToken(token string) (string, string, error) {
 	if strings.HasPrefix(token, "sess:") {
 		parts := strings.Split(token, ":")
 		if len(parts) != 4 {
@@ -79,7 +80,7 @@ func verifyAuthToken(token string) (string, string, error) {
 		sig := parts[3]
 
 		data := fmt.Sprintf("sess:%s:%s", expStr, email)
-		h := hmac.New(sha256.New, sessionSecret)
+		h := hmac.New(sha256.New, s.sessionKey)
 		h.Write([]byte(data))
 		expectedSig := hex.EncodeToString(h.Sum(nil))
 
@@ -95,11 +96,11 @@ func verifyAuthToken(token string) (string, string, error) {
 		return email, token, nil
 	}
 
-	email, err := verifyGoogleToken(token)
+	email, err := s.verifyGoogleToken(token)
 	if err != nil {
 		return "", "", err
 	}
 
-	newToken := generateSessionToken(email)
+	newToken := generateSessionToken(s.sessionKey, email)
 	return email, newToken, nil
 }
@@ -20,30 +20,41 @@ const mockAuthToken = "mock_token"
 func init() {
 	// Suppress global logs from socket.go specific calls (log.Printf)
 	log.SetOutput(io.Discard)
-	// Increase rate limit for benchmarks
-	maxMsgsPerSecond = 1000000
+}
+
+// testConfig is the default config with test secrets and the rate limit
+// raised for benchmarks.
+func testConfig() *Config {
+	cfg := defaultConfig()
+	cfg.AuthSessionSecret = "test-session-secret"
+	cfg.TurnSecret = "test-turn-secret"
+	cfg.MaxMsgsPerSecond = 1000000
+	return cfg
 }
 
 // Setup a test server
 func setupTestServer() *httptest.Server {
 	// Initialize server with mocked components if necessary
-	s := &Server{
-		clients:         make(map[string]*Client),
-		sessions:        make(map[string]*Session),
-		// Use a discard logger to avoid cluttering test output
-		logger: log.New(io.Discard, "", 0),
-		rateLimiter: &RateLimiter{
-			ipAttempts: make(map[string][]time.Time),
-		},
-	}
+	s := newServer(testConfig(), newMemoryStore(), log.New(io.Discard, "", 0))
 
 	return httptest.NewServer(http.HandlerFunc(s.handle))
 }
 
+// newTestServer starts a server on a fresh memory store for the length of
+// the test, and returns it, the store and its WebSocket URL.
+func newTestServer(t *testing.T) (*Server, *memoryStore, string) {
+	t.Helper()
+	store := newMemoryStore()
+	s := newServer(testConfig(), store, log.New(io.Discard, "", 0))
+	ts := httptest.NewServer(http.HandlerFunc(s.handle))
+	t.Cleanup(ts.Close)
+	return s, store, "ws" + strings.TrimPrefix(ts.URL, "http")
+}
+
 // Helper to generate a valid session token for testing
 func getTestSessionToken(email string) string {
 	// Calling the internal function from socket.go since we are in package main
-	return generateSessionToken(email)
+	return generateSessionToken(sessionKey(testConfig().AuthSessionSecret), email)
 }
 
 func connectClient(url, email string) (*websocket.Conn, error) {
@@ -56,7 +67,7 @@ func connectClient(url, email string) (*websocket.Conn, error) {
 	token := getTestSessionToken(email)
 	authFrame := Frame{
 		T:    "AUTH",
-		Data: json.RawMessage(fmt.Sprintf(`{"token": "%s"}`, token)),
+		Data: json.RawMessage(fmt.Sprintf(`{"token": "%s", "publicKey": "pk-%s"}`, token, email)),
 	}
 	if err := conn.WriteJSON(authFrame); err != nil {
 		return nil, err
@@ -92,15 +103,7 @@ func readMSG(conn *websocket.Conn) (*Frame, error) {
 // This measures how fast we can open a websocket and authenticate.
 func BenchmarkConnectionHandshake(b *testing.B) {
 	// Suppress logs
-	s := &Server{
-		clients:         make(map[string]*Client),
-		sessions:        make(map[string]*Session),
-		// Use a dummy logger that writes to nowhere
-		logger: log.New(io.Discard, "", 0),
-		rateLimiter: &RateLimiter{
-			ipAttempts: make(map[string][]time.Time),
-		},
-	}
+	s := newServer(testConfig(), newMemoryStore(), log.New(io.Discard, "", 0))
 
 	ts := httptest.NewServer(http.HandlerFunc(s.handle))
 	defer ts.Close()
@@ -118,7 +121,7 @@ func BenchmarkConnectionHandshake(b *testing.B) {
 		// Send Auth
 		authFrame := Frame{
 			T:    "AUTH",
-			Data: json.RawMessage(fmt.Sprintf(`{"token": "%s"}`, token)),
+			Data: json.RawMessage(fmt.Sprintf(`{"token": "%s", "publicKey": "pk-bench"}`, token)),
 		}
 		if err := conn.WriteJSON(authFrame); err != nil {
 			b.Fatal(err)
@@ -137,14 +140,7 @@ func BenchmarkConnectionHandshake(b *testing.B) {
 // Benchmark: Message Relay Latency (Round Trip)
 // Measures time for User A -> Server -> User B
 func BenchmarkMessageRelayLatency(b *testing.B) {
-	s := &Server{
-		clients:         make(map[string]*Client),
-		sessions:        make(map[string]*Session),
-		logger:          log.New(io.Discard, "", 0),
-		rateLimiter: &RateLimiter{
-			ipAttempts: make(map[string][]time.Time),
-		},
-	}
+	s := newServer(testConfig(), newMemoryStore(), log.New(io.Discard, "", 0))
 
 	ts := httptest.NewServer(http.HandlerFunc(s.handle))
 	defer ts.Close()
@@ -218,14 +214,7 @@ func BenchmarkMessageRelayLatency(b *testing.B) {
 // Benchmark: Throughput (Messages Per Second)
 // We'll use parallel benchmark to simulate load
 func BenchmarkMessageThroughput(b *testing.B) {
-	s := &Server{
-		clients:         make(map[string]*Client),
-		sessions:        make(map[string]*Session),
-		logger:          log.New(io.Discard, "", 0),
-		rateLimiter: &RateLimiter{
-			ipAttempts: make(map[string][]time.Time),
-		},
-	}
+	s := newServer(testConfig(), newMemoryStore(), log.New(io.Discard, "", 0))
 	ts := httptest.NewServer(http.HandlerFunc(s.handle))
 	defer ts.Close()
 	wsUrl := "ws" + strings.TrimPrefix(ts.URL, "http")
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Bus carries messages between relay nodes. Delivery is at most once: a
+// message published while a node is disconnected from the bus is lost, so
+// everything sent over it must be safe to miss (see Cluster).
+type Bus interface {
+	Publish(topic string, payload []byte) error
+	// Subscribe calls handler for every message published to topic until
+	// the returned function is called. Handlers for one subscription run
+	// one at a time and in publish order.
+	Subscribe(topic string, handler func(payload []byte)) (unsubscribe func(), err error)
+	Close() error
+}
+
+// openBus connects to the bus named by kind. An empty kind means the relay
+// runs on its own and returns a nil Bus.
+func openBus(kind, url string) (Bus, error) {
+	switch kind {
+	case "":
+		return nil, nil
+	case "redis":
+		return dialRedisBus(url)
+	default:
+		return nil, fmt.Errorf("unknown cluster bus %q", kind)
+	}
+}
+
+// localBus delivers in-process. Each subscription has its own goroutine
+// and unbounded queue, so handlers may publish without deadlocking and
+// publishers never wait on handlers. Several Servers sharing one localBus
+// behave like a cluster, which is how the cluster tests run.
+type localBus struct {
+	mu     sync.RWMutex
+	subs   map[string]map[int]*localSub
+	nextID int
+}
+
+type localSub struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	queue   [][]byte
+	stopped bool
+}
+
+func newLocalBus() *localBus {
+	return &localBus{subs: make(map[string]map[int]*localSub)}
+}
+
+func (b *localBus) Publish(topic string, payload []byte) error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for _, sub := range b.subs[topic] {
+		sub.mu.Lock()
+		sub.queue = append(sub.queue, append([]byte(nil), payload...))
+		sub.cond.Signal()
+		sub.mu.Unlock()
+	}
+	return nil
+}
+
+func (b *localBus) Subscribe(topic string, handler func([]byte)) (func(), error) {
+	sub := &localSub{}
+	sub.cond = sync.NewCond(&sub.mu)
+	go sub.run(handler)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	id := b.nextID
+	b.nextID++
+	if b.subs[topic] == nil {
+		b.subs[topic] = make(map[int]*localSub)
+	}
+	b.subs[topic][id] = sub
+	return func() {
+		b.mu.Lock()
+		delete(b.subs[topic], id)
+		if len(b.subs[topic]) == 0 {
+			delete(b.subs, topic)
+		}
+		b.mu.Unlock()
+		sub.stop()
+	}, nil
+}
+
+func (sub *localSub) run(handler func([]byte)) {
+	for {
+		sub.mu.Lock()
+		for len(sub.queue) == 0 && !sub.stopped {
+			sub.cond.Wait()
+		}
+		if sub.stopped {
+			sub.mu.Unlock()
+			return
+		}
+		msg := sub.queue[0]
+		sub.queue = sub.queue[1:]
+		sub.mu.Unlock()
+		handler(msg)
+	}
+}
+
+func (sub *localSub) stop() {
+	sub.mu.Lock()
+	sub.stopped = true
+	sub.cond.Broadcast()
+	sub.mu.Unlock()
+}
+
+func (b *localBus) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, subs := range b.subs {
+		for _, sub := range subs {
+			sub.stop()
+		}
+	}
+	b.subs = make(map[string]map[int]*localSub)
+	return nil
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// redisBus implements Bus with Redis PUBLISH/SUBSCRIBE, speaking RESP
+// directly so the relay needs no client library. It uses one connection for
+// publishing and one for subscriptions, and redials either when it drops;
+// subscriptions are restored after a reconnect.
+type redisBus struct {
+	addr     string
+	password string
+
+	pubMu sync.Mutex
+	pub   *respConn
+
+	subMu    sync.Mutex
+	sub      *respConn
+	handlers map[string]map[int]func([]byte)
+	nextID   int
+	closed   bool
+}
+
+// dialRedisBus connects to rawURL, either host:port or
+// redis://[:password@]host:port.
+func dialRedisBus(rawURL string) (*redisBus, error) {
+	b := &redisBus{addr: rawURL, handlers: make(map[string]map[int]func([]byte))}
+	if strings.Contains(rawURL, "://") {
+		u, err := url.Parse(rawURL)
+		if err != nil {
+			return nil, fmt.Errorf("cluster URL: %v", err)
+		}
+		if u.Scheme != "redis" {
+			return nil, fmt.Errorf("cluster URL: unsupported scheme %q", u.Scheme)
+		}
+		b.addr = u.Host
+		if pw, ok := u.User.Password(); ok {
+			b.password = pw
+		}
+	}
+	if _, _, err := net.SplitHostPort(b.addr); err != nil {
+		b.addr = net.JoinHostPort(b.addr, "6379")
+	}
+
+	sub, err := b.dial()
+	if err != nil {
+		return nil, err
+	}
+	b.sub = sub
+	go b.readLoop(sub)
+	return b, nil
+}
+
+func (b *redisBus) dial() (*respConn, error) {
+	c, err := net.DialTimeout("tcp", b.addr, 5*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	rc := &respConn{c: c, r: bufio.NewReader(c), w: bufio.NewWriter(c)}
+	if b.password != "" {
+		if _, err := rc.do("AUTH", b.password); err != nil {
+			c.Close()
+			return nil, fmt.Errorf("redis AUTH: %v", err)
+		}
+	}
+	return rc, nil
+}
+
+func (b *redisBus) Publish(topic string, payload []byte) error {
+	b.pubMu.Lock()
+	defer b.pubMu.Unlock()
+
+	// One retry covers a connection that went stale since the last publish.
+	var err error
+	for attempt := 0; attempt < 2; attempt++ {
+		if b.pub == nil {
+			if b.pub, err = b.dial(); err != nil {
+				continue
+			}
+		}
+		if _, err = b.pub.do("PUBLISH", topic, string(payload)); err == nil {
+			return nil
+		}
+		var rerr redisError
+		if errors.As(err, &rerr) {
+			return err
+		}
+		b.pub.c.Close()
+		b.pub = nil
+	}
+	return err
+}
+
+func (b *redisBus) Subscribe(topic string, handler func([]byte)) (func(), error) {
+	b.subMu.Lock()
+	defer b.subMu.Unlock()
+	if b.closed {
+		return nil, errors.New("bus closed")
+	}
+	id := b.nextID
+	b.nextID++
+	if b.handlers[topic] == nil {
+		b.handlers[topic] = make(map[int]func([]byte))
+		// A failed write surfaces in readLoop, which resubscribes.
+		b.sub.send("SUBSCRIBE", topic)
+	}
+	b.handlers[topic][id] = handler
+
+	return func() {
+		b.subMu.Lock()
+		defer b.subMu.Unlock()
+		delete(b.handlers[topic], id)
+		if len(b.handlers[topic]) == 0 {
+			delete(b.handlers, topic)
+			if !b.closed {
+				b.sub.send("UNSUBSCRIBE", topic)
+			}
+		}
+	}, nil
+}
+
+// readLoop dispatches pushed messages until the bus is closed, redialing
+// with backoff whenever the subscription connection fails.
+func (b *redisBus) readLoop(conn *respConn) {
+	backoff := 100 * time.Millisecond
+	for {
+		reply, err := conn.read()
+		if err == nil {
+			backoff = 100 * time.Millisecond
+			b.dispatch(reply)
+			continue
+		}
+
+		conn.c.Close()
+		for {
+			b.subMu.Lock()
+			closed := b.closed
+			b.subMu.Unlock()
+			if closed {
+				return
+			}
+			time.Sleep(backoff)
+			backoff = min(2*backoff, 5*time.Second)
+			if conn, err = b.dial(); err == nil {
+				break
+			}
+		}
+
+		b.subMu.Lock()
+		b.sub = conn
+		for topic := range b.handlers {
+			conn.send("SUBSCRIBE", topic)
+		}
+		b.subMu.Unlock()
+	}
+}
+
+func (b *redisBus) dispatch(reply any) {
+	msg, ok := reply.([]any)
+	if !ok || len(msg) != 3 {
+		return
+	}
+	if kind, _ := msg[0].([]byte); string(kind) != "message" {
+		return
+	}
+	topic, _ := msg[1].([]byte)
+	payload, _ := msg[2].([]byte)
+
+	b.subMu.Lock()
+	handlers := make([]func([]byte), 0, len(b.handlers[string(topic)]))
+	for _, h := range b.handlers[string(topic)] {
+		handlers = append(handlers, h)
+	}
+	b.subMu.Unlock()
+
+	for _, h := range handlers {
+		h(payload)
+	}
+}
+
+func (b *redisBus) Close() error {
+	b.subMu.Lock()
+	b.closed = true
+	b.sub.c.Close()
+	b.subMu.Unlock()
+
+	b.pubMu.Lock()
+	defer b.pubMu.Unlock()
+	if b.pub != nil {
+		b.pub.c.Close()
+		b.pub = nil
+	}
+	return nil
+}
+
+// redisError is an error reply (-ERR ...) from the server.
+type redisError string
+
+func (e redisError) Error() string { return "redis: " + string(e) }
+
+// respConn reads and writes the Redis serialization protocol.
+type respConn struct {
+	c net.Conn
+	r *bufio.Reader
+	w *bufio.Writer
+}
+
+func (rc *respConn) send(args ...string) error {
+	fmt.Fprintf(rc.w, "*%d\r\n", len(args))
+	for _, a := range args {
+		fmt.Fprintf(rc.w, "$%d\r\n%s\r\n", len(a), a)
+	}
+	return rc.w.Flush()
+}
+
+func (rc *respConn) do(args ...string) (any, error) {
+	rc.c.SetDeadline(time.Now().Add(5 * time.Second))
+	defer rc.c.SetDeadline(time.Time{})
+	if err := rc.send(args...); err != nil {
+		return nil, err
+	}
+	reply, err := rc.read()
+	if err != nil {
+		return nil, err
+	}
+	if rerr, ok := reply.(redisError); ok {
+		return nil, rerr
+	}
+	return reply, nil
+}
+
+// read returns one reply: a string for simple strings, int64, []byte for
+// bulk strings (nil when null), []any for arrays, or a redisError.
+func (rc *respConn) read() (any, error) {
+	line, err := rc.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || !strings.HasSuffix(line, "\r\n") {
+		return nil, fmt.Errorf("redis: malformed reply %q", line)
+	}
+	kind, body := line[0], line[1:len(line)-2]
+	switch kind {
+	case '+':
+		return body, nil
+	case '-':
+		return redisError(body), nil
+	case ':':
+		return strconv.ParseInt(body, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(body)
+		if err != nil {
+			return nil, fmt.Errorf("redis: bad bulk length %q", body)
+		}
+		if n < 0 {
+			return []byte(nil), nil
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(rc.r, buf); err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	case '*':
+		n, err := strconv.Atoi(body)
+		if err != nil {
+			return nil, fmt.Errorf("redis: bad array length %q", body)
+		}
+		if n < 0 {
+			return []any(nil), nil
+		}
+		out := make([]any, n)
+		for i := range out {
+			if out[i], err = rc.read(); err != nil {
+				return nil, err
+			}
+		}
+		return out, nil
+	default:
+		return nil, fmt.Errorf("redis: unexpected reply type %q", kind)
+	}
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRedis is a local stand-in for a Redis server that understands just
+// enough of RESP pub/sub for redisBus: PING, AUTH, SUBSCRIBE, UNSUBSCRIBE and
+// PUBLISH.
+type fakeRedis struct {
+	ln    net.Listener
+	mu    sync.Mutex
+	conns map[*fakeRedisConn]bool
+	subs  map[string]map[*fakeRedisConn]bool
+}
+
+type fakeRedisConn struct {
+	c  net.Conn
+	mu sync.Mutex
+	w  *bufio.Writer
+}
+
+func (fc *fakeRedisConn) write(parts ...string) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	for _, p := range parts {
+		fc.w.WriteString(p)
+	}
+	fc.w.Flush()
+}
+
+func bulk(s string) string { return "$" + strconv.Itoa(len(s)) + "\r\n" + s + "\r\n" }
+
+func startFakeRedis(t *testing.T) *fakeRedis {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fr := &fakeRedis{ln: ln, conns: make(map[*fakeRedisConn]bool), subs: make(map[string]map[*fakeRedisConn]bool)}
+	t.Cleanup(func() { ln.Close(); fr.dropAll() })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go fr.serve(c)
+		}
+	}()
+	return fr
+}
+
+func (fr *fakeRedis) addr() string { return fr.ln.Addr().String() }
+
+// dropAll closes every client connection, as a Redis restart would.
+func (fr *fakeRedis) dropAll() {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+	for fc := range fr.conns {
+		fc.c.Close()
+	}
+}
+
+func (fr *fakeRedis) serve(c net.Conn) {
+	fc := &fakeRedisConn{c: c, w: bufio.NewWriter(c)}
+	rc := &respConn{c: c, r: bufio.NewReader(c)}
+	fr.mu.Lock()
+	fr.conns[fc] = true
+	fr.mu.Unlock()
+	defer func() {
+		c.Close()
+		fr.mu.Lock()
+		delete(fr.conns, fc)
+		for _, subs := range fr.subs {
+			delete(subs, fc)
+		}
+		fr.mu.Unlock()
+	}()
+
+	for {
+		reply, err := rc.read()
+		if err != nil {
+			return
+		}
+		parts, _ := reply.([]any)
+		var args []string
+		for _, p := range parts {
+			b, _ := p.([]byte)
+			args = append(args, string(b))
+		}
+		if len(args) == 0 {
+			fc.write("-ERR empty command\r\n")
+			continue
+		}
+
+		switch strings.ToUpper(args[0]) {
+		case "PING":
+			fc.write("+PONG\r\n")
+		case "AUTH":
+			fc.write("+OK\r\n")
+		case "SUBSCRIBE", "UNSUBSCRIBE":
+			kind := strings.ToLower(args[0])
+			for _, topic := range args[1:] {
+				fr.mu.Lock()
+				if kind == "subscribe" {
+					if fr.subs[topic] == nil {
+						fr.subs[topic] = make(map[*fakeRedisConn]bool)
+					}
+					fr.subs[topic][fc] = true
+				} else {
+					delete(fr.subs[topic], fc)
+				}
+				fr.mu.Unlock()
+				fc.write("*3\r\n", bulk(kind), bulk(topic), ":1\r\n")
+			}
+		case "PUBLISH":
+			if len(args) != 3 {
+				fc.write("-ERR wrong number of arguments\r\n")
+				continue
+			}
+			fr.mu.Lock()
+			var targets []*fakeRedisConn
+			for sub := range fr.subs[args[1]] {
+				targets = append(targets, sub)
+			}
+			fr.mu.Unlock()
+			for _, sub := range targets {
+				sub.write("*3\r\n", bulk("message"), bulk(args[1]), bulk(args[2]))
+			}
+			fc.write(":" + strconv.Itoa(len(targets)) + "\r\n")
+		default:
+			fc.write("-ERR unknown command\r\n")
+		}
+	}
+}
+
+func busImpls(t *testing.T) map[string]func(t *testing.T) Bus {
+	return map[string]func(t *testing.T) Bus{
+		"local": func(t *testing.T) Bus { return newLocalBus() },
+		"redis": func(t *testing.T) Bus {
+			fr := startFakeRedis(t)
+			b, err := dialRedisBus("redis://:secret@" + fr.addr())
+			if err != nil {
+				t.Fatal(err)
+			}
+			return b
+		},
+	}
+}
+
+func recvWithin(t *testing.T, ch <-chan string, want string) {
+	t.Helper()
+	select {
+	case got := <-ch:
+		if got != want {
+			t.Fatalf("received %q, want %q", got, want)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatalf("timed out waiting for %q", want)
+	}
+}
+
+// waitSubscribed publishes probes until one arrives, since a subscription
+// over the network is not in effect the moment Subscribe returns.
+func waitSubscribed(t *testing.T, b Bus, topic string, ch <-chan string) {
+	t.Helper()
+	deadline := time.Now().Add(3 * time.Second)
+	for time.Now().Before(deadline) {
+		b.Publish(topic, []byte("probe"))
+		select {
+		case <-ch:
+			// Drain any probes still in flight.
+			time.Sleep(20 * time.Millisecond)
+			for len(ch) > 0 {
+				<-ch
+			}
+			return
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+	t.Fatalf("subscription to %s never became active", topic)
+}
+
+func TestBusConformance(t *testing.T) {
+	for name, open := range busImpls(t) {
+		t.Run(name, func(t *testing.T) {
+			b := open(t)
+			defer b.Close()
+
+			a := make(chan string, 16)
+			unsubA, err := b.Subscribe("a", func(p []byte) { a <- string(p) })
+			if err != nil {
+				t.Fatal(err)
+			}
+			other := make(chan string, 16)
+			b.Subscribe("b", func(p []byte) { other <- string(p) })
+			waitSubscribed(t, b, "a", a)
+			waitSubscribed(t, b, "b", other)
+
+			for _, msg := range []string{"one", "two", "three"} {
+				if err := b.Publish("a", []byte(msg)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			recvWithin(t, a, "one")
+			recvWithin(t, a, "two")
+			recvWithin(t, a, "three")
+			if len(other) != 0 {
+				t.Fatal("message leaked to another topic")
+			}
+
+			unsubA()
+			b.Publish("a", []byte("after"))
+			b.Publish("b", []byte("marker"))
+			recvWithin(t, other, "marker")
+			if len(a) != 0 {
+				t.Fatalf("received %q after unsubscribe", <-a)
+			}
+		})
+	}
+}
+
+func TestRedisBusReconnects(t *testing.T) {
+	fr := startFakeRedis(t)
+	b, err := dialRedisBus(fr.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	ch := make(chan string, 16)
+	b.Subscribe("t", func(p []byte) { ch <- string(p) })
+	waitSubscribed(t, b, "t", ch)
+
+	fr.dropAll()
+	waitSubscribed(t, b, "t", ch)
+	b.Publish("t", []byte("back"))
+	recvWithin(t, ch, "back")
+}
+
+func TestRedisErrorReply(t *testing.T) {
+	fr := startFakeRedis(t)
+	b, err := dialRedisBus(fr.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	conn, err := b.dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.c.Close()
+	if _, err := conn.do("NOPE"); err == nil || !strings.Contains(err.Error(), "unknown command") {
+		t.Fatalf("error reply = %v", err)
+	}
+}
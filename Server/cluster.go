@@ -0,0 +1,443 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	crand "crypto/rand"
+)
+
+// Cluster mode lets several relay nodes share one Bus. Each node keeps its
+// own clients and sessions and tells the others which users, device keys and
+// sessions it hosts: small deltas as they change, plus a full snapshot every
+// heartbeat that also repairs anything a delta missed. Fan-out then goes
+// straight to the nodes that need it, over a per-node topic.
+//
+// A node that stops sending heartbeats is forgotten after three intervals.
+
+const (
+	clusterTopic    = "relay.cluster"
+	nodeTopicPrefix = "relay.node."
+)
+
+// Messages on clusterTopic.
+const (
+	clusterHello    = "hello"    // node started; peers answer with a snapshot
+	clusterSnapshot = "snapshot" // full state, doubles as the heartbeat
+	clusterBye      = "bye"      // node is shutting down
+	clusterPresence = "presence" // a socket came online or went away
+	clusterSession  = "session"  // a session gained or lost its last local member
+)
+
+// Messages on a node topic.
+const (
+	deliverUser    = "user"    // sockets of EmailHash's approved devices
+	deliverAccount = "account" // every socket of EmailHash, pending or not
+	deliverSession = "members" // every member of SID
+	deliverKey     = "key"     // members of SID authenticated as PublicKey
+	deliverDevice  = "device"  // sockets of EmailHash authenticated as PublicKey
+	deliverDrop    = "drop"    // like deliverDevice, then close the sockets
+
+	deliverSync  = "sync"  // EmailHash has new notifications or mail
+	deliverLeave = "leave" // sockets of EmailHash leave SID
+)
+
+type clusterMessage struct {
+	Node      string                    `json:"node"`
+	Kind      string                    `json:"kind"`
+	EmailHash string                    `json:"eh,omitempty"`
+	PublicKey string                    `json:"pk,omitempty"`
+	SID       string                    `json:"sid,omitempty"`
+	Online    bool                      `json:"online,omitempty"`
+	Users     map[string]map[string]int `json:"users,omitempty"`
+	Sessions  []string                  `json:"sessions,omitempty"`
+	Frame     *Frame                    `json:"frame,omitempty"`
+}
+
+// remoteNode is what this node knows about another one.
+type remoteNode struct {
+	seen     time.Time
+	users    map[string]map[string]int // email hash -> device key -> sockets
+	keys     map[string]int            // device key -> sockets
+	sessions map[string]bool
+}
+
+func newRemoteNode() *remoteNode {
+	return &remoteNode{
+		users:    make(map[string]map[string]int),
+		keys:     make(map[string]int),
+		sessions: make(map[string]bool),
+	}
+}
+
+func (n *remoteNode) addSocket(emailHash, publicKey string, delta int) {
+	if n.users[emailHash] == nil {
+		n.users[emailHash] = make(map[string]int)
+	}
+	n.users[emailHash][publicKey] += delta
+	if n.users[emailHash][publicKey] <= 0 {
+		delete(n.users[emailHash], publicKey)
+		if len(n.users[emailHash]) == 0 {
+			delete(n.users, emailHash)
+		}
+	}
+	if publicKey != "" {
+		n.keys[publicKey] += delta
+		if n.keys[publicKey] <= 0 {
+			delete(n.keys, publicKey)
+		}
+	}
+}
+
+type Cluster struct {
+	nodeID    string
+	bus       Bus
+	s         *Server
+	heartbeat time.Duration
+
+	mu    sync.RWMutex
+	nodes map[string]*remoteNode
+
+	unsubscribe []func()
+	stop        chan struct{}
+	stopOnce    sync.Once
+}
+
+// joinCluster connects s to the other nodes on bus. It must be called
+// before s serves any connection.
+func (s *Server) joinCluster(bus Bus) error {
+	nodeID := s.cfg.NodeID
+	if nodeID == "" {
+		nodeID = defaultNodeID()
+	}
+	cl := &Cluster{
+		nodeID:    nodeID,
+		bus:       bus,
+		s:         s,
+		heartbeat: time.Duration(s.cfg.ClusterHeartbeatSeconds) * time.Second,
+		nodes:     make(map[string]*remoteNode),
+		stop:      make(chan struct{}),
+	}
+
+	for topic, handler := range map[string]func([]byte){
+		clusterTopic:             cl.handleClusterMessage,
+		nodeTopicPrefix + nodeID: cl.handleDelivery,
+	} {
+		unsub, err := bus.Subscribe(topic, handler)
+		if err != nil {
+			cl.close()
+			return err
+		}
+		cl.unsubscribe = append(cl.unsubscribe, unsub)
+	}
+
+	s.cluster = cl
+	s.sessions.watch = cl.sessionChanged
+	cl.unsubscribe = append(cl.unsubscribe, s.presence.Subscribe(cl.presenceChanged))
+
+	cl.publish(clusterTopic, clusterMessage{Kind: clusterHello})
+	go cl.heartbeatLoop()
+	s.logger.Printf("CLUSTER: node %s joined", nodeID)
+	return nil
+}
+
+func defaultNodeID() string {
+	host, _ := os.Hostname()
+	b := make([]byte, 4)
+	crand.Read(b)
+	return host + "-" + hex.EncodeToString(b)
+}
+
+// close announces that the node is leaving and stops all cluster traffic.
+func (cl *Cluster) close() {
+	if cl == nil {
+		return
+	}
+	cl.stopOnce.Do(func() {
+		close(cl.stop)
+		cl.publish(clusterTopic, clusterMessage{Kind: clusterBye})
+		for _, unsub := range cl.unsubscribe {
+			unsub()
+		}
+	})
+}
+
+func (cl *Cluster) publish(topic string, m clusterMessage) bool {
+	m.Node = cl.nodeID
+	payload, err := json.Marshal(m)
+	if err != nil {
+		return false
+	}
+	if err := cl.bus.Publish(topic, payload); err != nil {
+		cl.s.logger.Printf("CLUSTER: publish to %s failed: %v", topic, err)
+		return false
+	}
+	return true
+}
+
+func (cl *Cluster) snapshot() clusterMessage {
+	return clusterMessage{
+		Kind:     clusterSnapshot,
+		Users:    cl.s.presence.Snapshot(),
+		Sessions: cl.s.sessions.sids(),
+	}
+}
+
+func (cl *Cluster) heartbeatLoop() {
+	ticker := time.NewTicker(cl.heartbeat)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-cl.stop:
+			return
+		case <-ticker.C:
+			cl.publish(clusterTopic, cl.snapshot())
+			cl.expireNodes(time.Now().Add(-3 * cl.heartbeat))
+		}
+	}
+}
+
+func (cl *Cluster) expireNodes(before time.Time) {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	for id, n := range cl.nodes {
+		if n.seen.Before(before) {
+			delete(cl.nodes, id)
+			cl.s.logger.Printf("CLUSTER: node %s timed out", id)
+		}
+	}
+}
+
+func (cl *Cluster) presenceChanged(ev PresenceEvent) {
+	cl.publish(clusterTopic, clusterMessage{
+		Kind:      clusterPresence,
+		EmailHash: ev.EmailHash,
+		PublicKey: ev.PublicKey,
+		Online:    ev.Online,
+	})
+}
+
+func (cl *Cluster) sessionChanged(sid string, live bool) {
+	cl.publish(clusterTopic, clusterMessage{Kind: clusterSession, SID: sid, Online: live})
+}
+
+func (cl *Cluster) handleClusterMessage(payload []byte) {
+	var m clusterMessage
+	if err := json.Unmarshal(payload, &m); err != nil || m.Node == cl.nodeID {
+		return
+	}
+
+	cl.mu.Lock()
+	if m.Kind == clusterBye {
+		delete(cl.nodes, m.Node)
+		cl.mu.Unlock()
+		return
+	}
+	n, ok := cl.nodes[m.Node]
+	if !ok || m.Kind == clusterSnapshot {
+		n = newRemoteNode()
+		cl.nodes[m.Node] = n
+	}
+	n.seen = time.Now()
+	switch m.Kind {
+	case clusterSnapshot:
+		for eh, keys := range m.Users {
+			for pk, count := range keys {
+				n.addSocket(eh, pk, count)
+			}
+		}
+		for _, sid := range m.Sessions {
+			n.sessions[sid] = true
+		}
+	case clusterPresence:
+		delta := -1
+		if m.Online {
+			delta = 1
+		}
+		n.addSocket(m.EmailHash, m.PublicKey, delta)
+	case clusterSession:
+		if m.Online {
+			n.sessions[m.SID] = true
+		} else {
+			delete(n.sessions, m.SID)
+		}
+	}
+	cl.mu.Unlock()
+
+	if m.Kind == clusterHello {
+		cl.publish(clusterTopic, cl.snapshot())
+	}
+}
+
+func (cl *Cluster) handleDelivery(payload []byte) {
+	var m clusterMessage
+	if err := json.Unmarshal(payload, &m); err != nil {
+		return
+	}
+	s := cl.s
+	switch m.Kind {
+	case deliverSync:
+		s.syncLocal(m.EmailHash)
+		return
+	case deliverLeave:
+		for _, c := range s.presence.Clients(m.EmailHash) {
+			s.sessions.leave(m.SID, c)
+		}
+		return
+	}
+	if m.Frame == nil {
+		return
+	}
+	switch m.Kind {
+	case deliverUser, deliverAccount:
+		s.sendToLocalUser(m.EmailHash, *m.Frame, m.Kind == deliverAccount)
+	case deliverSession:
+		for _, c := range s.sessions.peers(m.SID, nil) {
+			s.send(c, *m.Frame)
+		}
+	case deliverKey:
+		for _, c := range s.presence.ClientsForKey(m.PublicKey) {
+			if s.sessions.isMember(m.SID, c) {
+				s.send(c, *m.Frame)
+			}
+		}
+	case deliverDevice:
+		s.sendToLocalDevice(m.EmailHash, m.PublicKey, *m.Frame, false)
+	case deliverDrop:
+		s.sendToLocalDevice(m.EmailHash, m.PublicKey, *m.Frame, true)
+	}
+}
+
+// nodesWhere returns the IDs of remote nodes matching has.
+func (cl *Cluster) nodesWhere(has func(*remoteNode) bool) []string {
+	if cl == nil {
+		return nil
+	}
+	cl.mu.RLock()
+	defer cl.mu.RUnlock()
+	var out []string
+	for id, n := range cl.nodes {
+		if has(n) {
+			out = append(out, id)
+		}
+	}
+	return out
+}
+
+// deliver publishes m to each node and reports whether any publish worked.
+func (cl *Cluster) deliver(nodes []string, m clusterMessage) bool {
+	delivered := false
+	for _, id := range nodes {
+		if cl.publish(nodeTopicPrefix+id, m) {
+			delivered = true
+		}
+	}
+	return delivered
+}
+
+// userKeys returns the device keys emailHash is connected with on other
+// nodes.
+func (cl *Cluster) userKeys(emailHash string) []string {
+	if cl == nil {
+		return nil
+	}
+	cl.mu.RLock()
+	defer cl.mu.RUnlock()
+	var out []string
+	for _, n := range cl.nodes {
+		for pk := range n.users[emailHash] {
+			if pk != "" && !slices.Contains(out, pk) {
+				out = append(out, pk)
+			}
+		}
+	}
+	return out
+}
+
+// sendToUser forwards f to the sockets of emailHash on other nodes, those of
+// pending devices only if pending is set.
+func (cl *Cluster) sendToUser(emailHash string, f Frame, pending bool) bool {
+	kind := deliverUser
+	if pending {
+		kind = deliverAccount
+	}
+	nodes := cl.nodesWhere(func(n *remoteNode) bool { return len(n.users[emailHash]) > 0 })
+	return cl.deliver(nodes, clusterMessage{Kind: kind, EmailHash: emailHash, Frame: &f})
+}
+
+// syncUser has the other nodes push emailHash's new notifications and mail
+// to its sockets. Both live in the shared store, so only the nudge travels
+// over the bus.
+func (cl *Cluster) syncUser(emailHash string) {
+	nodes := cl.nodesWhere(func(n *remoteNode) bool { return len(n.users[emailHash]) > 0 })
+	cl.deliver(nodes, clusterMessage{Kind: deliverSync, EmailHash: emailHash})
+}
+
+// leaveSession has the other nodes detach emailHash's sockets from sid.
+func (cl *Cluster) leaveSession(sid, emailHash string) {
+	nodes := cl.nodesWhere(func(n *remoteNode) bool { return n.sessions[sid] && len(n.users[emailHash]) > 0 })
+	cl.deliver(nodes, clusterMessage{Kind: deliverLeave, SID: sid, EmailHash: emailHash})
+}
+
+// hasSession reports whether sid has members on another node.
+func (cl *Cluster) hasSession(sid string) bool {
+	return len(cl.nodesWhere(func(n *remoteNode) bool { return n.sessions[sid] })) > 0
+}
+
+// sendToSession forwards f to the members of sid on other nodes.
+func (cl *Cluster) sendToSession(sid string, f Frame) bool {
+	nodes := cl.nodesWhere(func(n *remoteNode) bool { return n.sessions[sid] })
+	return cl.deliver(nodes, clusterMessage{Kind: deliverSession, SID: sid, Frame: &f})
+}
+
+// sendToKey forwards f to members of sid on other nodes that authenticated
+// with publicKey.
+func (cl *Cluster) sendToKey(sid, publicKey string, f Frame) bool {
+	nodes := cl.nodesWhere(func(n *remoteNode) bool { return n.sessions[sid] && n.keys[publicKey] > 0 })
+	return cl.deliver(nodes, clusterMessage{Kind: deliverKey, SID: sid, PublicKey: publicKey, Frame: &f})
+}
+
+// sendToDevice forwards f to the sockets of emailHash on other nodes that
+// authenticated with publicKey, closing them afterwards if drop is set.
+// Pending devices are not indexed by key, so this goes to every node the
+// user is on and each picks the sockets out itself.
+func (cl *Cluster) sendToDevice(emailHash, publicKey string, f Frame, drop bool) bool {
+	kind := deliverDevice
+	if drop {
+		kind = deliverDrop
+	}
+	nodes := cl.nodesWhere(func(n *remoteNode) bool { return len(n.users[emailHash]) > 0 })
+	return cl.deliver(nodes, clusterMessage{Kind: kind, EmailHash: emailHash, PublicKey: publicKey, Frame: &f})
+}
+
+// onlineKeys returns the device keys emailHash is connected with anywhere
+// in the cluster, sorted.
+func (s *Server) onlineKeys(emailHash string) []string {
+	keys := s.presence.Keys(emailHash)
+	for _, pk := range s.cluster.userKeys(emailHash) {
+		if !slices.Contains(keys, pk) {
+			keys = append(keys, pk)
+		}
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+// sendToSession sends f to every member of sid except one, on this node and
+// any other, and reports whether anyone was reached.
+func (s *Server) sendToSession(sid string, except *Client, f Frame) bool {
+	delivered := false
+	for _, c := range s.sessions.peers(sid, except) {
+		if s.send(c, f) == nil {
+			delivered = true
+		}
+	}
+	if s.cluster.sendToSession(sid, f) {
+		delivered = true
+	}
+	return delivered
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func startClusterNode(t *testing.T, nodeID string, store Store, bus Bus) (*Server, string) {
+	t.Helper()
+	cfg := testConfig()
+	cfg.NodeID = nodeID
+	cfg.ClusterHeartbeatSeconds = 1
+	s := newServer(cfg, store, log.New(io.Discard, "", 0))
+	if err := s.joinCluster(bus); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.cluster.close)
+	ts := httptest.NewServer(http.HandlerFunc(s.handle))
+	t.Cleanup(ts.Close)
+	return s, "ws" + strings.TrimPrefix(ts.URL, "http")
+}
+
+func eventually(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// waitFrame reads until a frame of type typ arrives.
+func waitFrame(t *testing.T, conn *websocket.Conn, typ string) Frame {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	defer conn.SetReadDeadline(time.Time{})
+	for {
+		var f Frame
+		if err := conn.ReadJSON(&f); err != nil {
+			t.Fatalf("waiting for %s: %v", typ, err)
+		}
+		if f.T == typ {
+			return f
+		}
+	}
+}
+
+func TestClusterFanOut(t *testing.T) {
+	for name, open := range busImpls(t) {
+		t.Run(name, func(t *testing.T) {
+			bus := open(t)
+			defer bus.Close()
+
+			// Nodes share the database, as they would in production.
+			store := newMemoryStore()
+			const alice, bob = "alice@example.com", "bob@example.com"
+			aliceHash, bobHash := emailHash(alice), emailHash(bob)
+			store.AddFriendship(Friendship{User1Hash: aliceHash, User2Hash: bobHash, SID: "sid-ab", Since: time.Now()})
+			addLinkedDevice(store, bob, "pk-bob-2")
+
+			n1, url1 := startClusterNode(t, "n1", store, bus)
+			n2, url2 := startClusterNode(t, "n2", store, bus)
+
+			aliceConn, _, err := authedTestDevice(url1, alice, "pk-alice")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer aliceConn.Close()
+			eventually(t, "n2 to see alice", func() bool { return len(n2.onlineKeys(aliceHash)) == 1 })
+
+			// Bob's first device is on the other node but still sees alice.
+			bob1, list, err := authedTestDevice(url2, bob, "pk-bob-1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer bob1.Close()
+			var sessions []struct {
+				Online      bool     `json:"online"`
+				PeerPubKeys []string `json:"peerPubKeys"`
+			}
+			json.Unmarshal(list.Data, &sessions)
+			if len(sessions) != 1 || !sessions[0].Online || !sameStrings(sessions[0].PeerPubKeys, []string{"pk-alice"}) {
+				t.Fatalf("SESSION_LIST on n2 = %s", list.Data)
+			}
+			waitFrame(t, aliceConn, "PEER_ONLINE")
+
+			// Bob's second device is on alice's node.
+			bob2, _, err := authedTestDevice(url1, bob, "pk-bob-2")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer bob2.Close()
+			eventually(t, "n2 to see both bob devices", func() bool { return len(n2.onlineKeys(bobHash)) == 2 })
+
+			// Each of bob's devices gets only its own payload, on either node,
+			// and alice learns which keys nobody took.
+			aliceConn.WriteJSON(Frame{T: "MSG", SID: "sid-ab", C: true, Data: json.RawMessage(`{"payloads":{"pk-bob-1":"x","pk-bob-2":"y","pk-bob-3":"z"}}`)})
+			if f := waitFrame(t, aliceConn, "DELIVERED"); string(f.Data) != `{"offline":["pk-bob-3"]}` {
+				t.Fatalf("DELIVERED data = %s", f.Data)
+			}
+			for conn, want := range map[*websocket.Conn]string{bob1: `{"payloads":{"pk-bob-1":"x"}}`, bob2: `{"payloads":{"pk-bob-2":"y"}}`} {
+				if f := waitFrame(t, conn, "MSG"); f.SH != aliceHash || string(f.Data) != want {
+					t.Fatalf("MSG = %+v %s", f, f.Data)
+				}
+			}
+
+			// So does user fan-out.
+			req, _ := json.Marshal(map[string]string{"targetEmail": bob, "encryptedPacket": "pkt"})
+			aliceConn.WriteJSON(Frame{T: "FRIEND_REQUEST", Data: req})
+			waitFrame(t, bob1, "FRIEND_REQUEST")
+			waitFrame(t, bob2, "FRIEND_REQUEST")
+
+			// RTC reaches only the targeted device, across nodes.
+			bob2.WriteJSON(Frame{T: "RTC_OFFER", SID: "sid-ab", TargetPubKey: "pk-alice", Data: json.RawMessage(`{}`)})
+			waitFrame(t, aliceConn, "RTC_OFFER")
+			aliceConn.WriteJSON(Frame{T: "RTC_ANSWER", SID: "sid-ab", TargetPubKey: "pk-bob-1", Data: json.RawMessage(`{}`)})
+			waitFrame(t, bob1, "RTC_ANSWER")
+
+			bob1.Close()
+			waitFrame(t, aliceConn, "PEER_OFFLINE")
+			eventually(t, "n1 to forget bob's first device", func() bool {
+				return sameStrings(n1.onlineKeys(bobHash), []string{"pk-bob-2"})
+			})
+		})
+	}
+}
+
+func TestClusterForgetsSilentNodes(t *testing.T) {
+	bus := newLocalBus()
+	n1, _ := startClusterNode(t, "n1", newMemoryStore(), bus)
+
+	// A node that says hello and then never sends a heartbeat.
+	payload, _ := json.Marshal(clusterMessage{Node: "ghost", Kind: clusterPresence, EmailHash: "eh", PublicKey: "pk", Online: true})
+	bus.Publish(clusterTopic, payload)
+	eventually(t, "n1 to see the ghost node", func() bool { return len(n1.onlineKeys("eh")) == 1 })
+
+	n1.cluster.expireNodes(time.Now().Add(time.Second))
+	if keys := n1.onlineKeys("eh"); len(keys) != 0 {
+		t.Fatalf("keys from an expired node: %v", keys)
+	}
+
+	// A clean shutdown is noticed straight away.
+	bus.Publish(clusterTopic, payload)
+	eventually(t, "the ghost to return", func() bool { return len(n1.onlineKeys("eh")) == 1 })
+	bye, _ := json.Marshal(clusterMessage{Node: "ghost", Kind: clusterBye})
+	bus.Publish(clusterTopic, bye)
+	eventually(t, "n1 to drop the ghost", func() bool { return len(n1.onlineKeys("eh")) == 0 })
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/gorilla/websocket"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// Clients choose a wire format with the WebSocket subprotocol. Inside the
+// relay every Frame stays JSON, so handlers, the store and the cluster bus
+// never see the difference; binary codecs translate at the socket.
+//
+// Binary frames are maps with the same keys as JSON frames, except that data
+// is a native map instead of nested JSON and ciphertext travels as raw bytes.
+// Binary data decoded from a client becomes JSON with byte strings as
+// standard base64, which is what JSON clients already send. On the way out,
+// the fields listed in binaryFields are turned back into bytes, so a JSON
+// sender and a binary recipient (or the reverse) share a session unchanged.
+const (
+	subprotocolJSON    = "relay.json"
+	subprotocolMsgpack = "relay.msgpack"
+	subprotocolCBOR    = "relay.cbor"
+)
+
+// binaryFields lists, per frame type, the data fields that hold base64
+// ciphertext in JSON. Paths are dotted keys and "*" matches every key of a
+// map.
+var binaryFields = map[string][]string{
+	"MSG":          {"payloads.*"},
+	"KEY_PACKAGES": {"keyPackages.*"},
+	"MLS_COMMIT":   {"commit"},
+	"MLS_WELCOME":  {"welcome"},
+}
+
+type frameCodec interface {
+	encode(f Frame) ([]byte, error)
+	decode(msg []byte) (Frame, error)
+	// messageType is the WebSocket message type frames are written as.
+	messageType() int
+}
+
+// codecs maps a negotiated subprotocol to its codec. Clients that ask for no
+// subprotocol get JSON.
+var codecs = map[string]frameCodec{
+	"":                 jsonCodec{},
+	subprotocolJSON:    jsonCodec{},
+	subprotocolMsgpack: binaryCodec{marshal: msgpack.Marshal, unmarshal: msgpack.Unmarshal},
+	subprotocolCBOR:    binaryCodec{marshal: cborEnc.Marshal, unmarshal: cborDec.Unmarshal},
+}
+
+var (
+	cborEnc, _ = cbor.CoreDetEncOptions().EncMode()
+	cborDec, _ = cbor.DecOptions{
+		DefaultMapType: reflect.TypeOf(map[string]any(nil)),
+		TagsMd:         cbor.TagsForbidden,
+	}.DecMode()
+)
+
+func init() {
+	// Offered in order of preference.
+	upgrader.Subprotocols = []string{subprotocolMsgpack, subprotocolCBOR, subprotocolJSON}
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) encode(f Frame) ([]byte, error) { return json.Marshal(f) }
+
+func (jsonCodec) decode(msg []byte) (Frame, error) {
+	var f Frame
+	err := json.Unmarshal(msg, &f)
+	return f, err
+}
+
+func (jsonCodec) messageType() int { return websocket.TextMessage }
+
+// binaryFrame is Frame as it appears in MessagePack and CBOR.
+type binaryFrame struct {
+	T            string `msgpack:"t" cbor:"t"`
+	ID           string `msgpack:"id,omitempty" cbor:"id,omitempty"`
+	Seq          int64  `msgpack:"seq,omitempty" cbor:"seq,omitempty"`
+	SID          string `msgpack:"sid,omitempty" cbor:"sid,omitempty"`
+	C            bool   `msgpack:"c,omitempty" cbor:"c,omitempty"`
+	P            int    `msgpack:"p,omitempty" cbor:"p,omitempty"`
+	SH           string `msgpack:"sh,omitempty" cbor:"sh,omitempty"`
+	TargetPubKey string `msgpack:"targetPubKey,omitempty" cbor:"targetPubKey,omitempty"`
+	Data         any    `msgpack:"data,omitempty" cbor:"data,omitempty"`
+}
+
+type binaryCodec struct {
+	marshal   func(any) ([]byte, error)
+	unmarshal func([]byte, any) error
+}
+
+func (bc binaryCodec) encode(f Frame) ([]byte, error) {
+	bf := binaryFrame{T: f.T, ID: f.ID, Seq: f.Seq, SID: f.SID, C: f.C, P: f.P, SH: f.SH, TargetPubKey: f.TargetPubKey}
+	if len(f.Data) > 0 {
+		dec := json.NewDecoder(bytes.NewReader(f.Data))
+		dec.UseNumber()
+		var data any
+		if err := dec.Decode(&data); err != nil {
+			return nil, err
+		}
+		data = fromJSONNumbers(data)
+		for _, path := range binaryFields[f.T] {
+			data = decodeBytesAt(data, strings.Split(path, "."))
+		}
+		bf.Data = data
+	}
+	return bc.marshal(bf)
+}
+
+func (bc binaryCodec) decode(msg []byte) (Frame, error) {
+	var bf binaryFrame
+	if err := bc.unmarshal(msg, &bf); err != nil {
+		return Frame{}, err
+	}
+	f := Frame{T: bf.T, ID: bf.ID, Seq: bf.Seq, SID: bf.SID, C: bf.C, P: bf.P, SH: bf.SH, TargetPubKey: bf.TargetPubKey}
+	if bf.Data != nil {
+		// encoding/json writes []byte as standard base64.
+		data, err := json.Marshal(bf.Data)
+		if err != nil {
+			return Frame{}, errors.New("frame data has no JSON form")
+		}
+		f.Data = data
+	}
+	return f, nil
+}
+
+func (binaryCodec) messageType() int { return websocket.BinaryMessage }
+
+// fromJSONNumbers replaces json.Numbers with int64 where they fit and
+// float64 otherwise, so binary clients get native integers.
+func fromJSONNumbers(v any) any {
+	switch v := v.(type) {
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i
+		}
+		f, _ := v.Float64()
+		return f
+	case map[string]any:
+		for k, e := range v {
+			v[k] = fromJSONNumbers(e)
+		}
+	case []any:
+		for i, e := range v {
+			v[i] = fromJSONNumbers(e)
+		}
+	}
+	return v
+}
+
+// decodeBytesAt replaces the base64 strings at path with their bytes. A
+// string that is not canonical base64 is left alone, so the bridge never
+// changes what a recipient sees.
+func decodeBytesAt(v any, path []string) any {
+	if len(path) == 0 {
+		s, ok := v.(string)
+		if !ok || strings.ContainsAny(s, "\r\n") {
+			return v
+		}
+		if b, err := base64.StdEncoding.Strict().DecodeString(s); err == nil {
+			return b
+		}
+		return v
+	}
+	m, ok := v.(map[string]any)
+	if !ok {
+		return v
+	}
+	if path[0] == "*" {
+		for k, e := range m {
+			m[k] = decodeBytesAt(e, path[1:])
+		}
+	} else if e, ok := m[path[0]]; ok {
+		m[path[0]] = decodeBytesAt(e, path[1:])
+	}
+	return v
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/gorilla/websocket"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+var binaryUnmarshalers = map[string]func([]byte, any) error{
+	subprotocolMsgpack: msgpack.Unmarshal,
+	subprotocolCBOR:    cbor.Unmarshal,
+}
+
+func TestBinaryCodecsCarryRawPayloads(t *testing.T) {
+	ciphertext := []byte{0, 1, 2, 0xfe, 0xff}
+	b64 := base64.StdEncoding.EncodeToString(ciphertext)
+	in := Frame{
+		T:    "MSG",
+		SID:  "s1",
+		P:    2,
+		SH:   "eh",
+		Data: json.RawMessage(`{"payloads":{"pk1":"` + b64 + `","pk2":"not base64!"},"seq":9007199254740993}`),
+	}
+
+	for name, unmarshal := range binaryUnmarshalers {
+		t.Run(name, func(t *testing.T) {
+			c := codecs[name]
+			msg, err := c.encode(in)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var wire struct {
+				Data struct {
+					Payloads map[string]any `msgpack:"payloads" cbor:"payloads"`
+					Seq      int64          `msgpack:"seq" cbor:"seq"`
+				} `msgpack:"data" cbor:"data"`
+			}
+			if err := unmarshal(msg, &wire); err != nil {
+				t.Fatal(err)
+			}
+			if b, ok := wire.Data.Payloads["pk1"].([]byte); !ok || !bytes.Equal(b, ciphertext) {
+				t.Fatalf("pk1 on the wire = %#v, want raw bytes", wire.Data.Payloads["pk1"])
+			}
+			if s, ok := wire.Data.Payloads["pk2"].(string); !ok || s != "not base64!" {
+				t.Fatalf("pk2 on the wire = %#v, want the original string", wire.Data.Payloads["pk2"])
+			}
+			if wire.Data.Seq != 9007199254740993 {
+				t.Fatalf("seq = %d", wire.Data.Seq)
+			}
+
+			out, err := c.decode(msg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got, want any
+			json.Unmarshal(out.Data, &got)
+			json.Unmarshal(in.Data, &want)
+			if out.T != in.T || out.SID != in.SID || out.P != in.P || out.SH != in.SH || !jsonEqual(got, want) {
+				t.Fatalf("round trip = %+v %s", out, out.Data)
+			}
+		})
+	}
+}
+
+func jsonEqual(a, b any) bool {
+	x, _ := json.Marshal(a)
+	y, _ := json.Marshal(b)
+	return bytes.Equal(x, y)
+}
+
+func TestBinaryCodecRejectsGarbage(t *testing.T) {
+	for name := range binaryUnmarshalers {
+		if _, err := codecs[name].decode([]byte{0xc1, 0xff, 0x00}); err == nil {
+			t.Errorf("%s decoded garbage", name)
+		}
+	}
+}
+
+// codecConn is a test client speaking one subprotocol.
+type codecConn struct {
+	t     *testing.T
+	conn  *websocket.Conn
+	codec frameCodec
+}
+
+func dialCodec(t *testing.T, url, subprotocol, email, publicKey string) *codecConn {
+	t.Helper()
+	dialer := websocket.Dialer{Subprotocols: []string{subprotocol}}
+	conn, _, err := dialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	if conn.Subprotocol() != subprotocol {
+		t.Fatalf("negotiated %q, want %q", conn.Subprotocol(), subprotocol)
+	}
+	cc := &codecConn{t: t, conn: conn, codec: codecs[subprotocol]}
+	auth, _ := json.Marshal(map[string]string{"token": getTestSessionToken(email), "publicKey": publicKey})
+	cc.send(Frame{T: "AUTH", Data: auth})
+	cc.recv("SESSION_LIST")
+	return cc
+}
+
+func (cc *codecConn) send(f Frame) {
+	msg, err := cc.codec.encode(f)
+	if err != nil {
+		cc.t.Fatal(err)
+	}
+	cc.conn.WriteMessage(cc.codec.messageType(), msg)
+}
+
+// recv returns the next frame of type typ.
+func (cc *codecConn) recv(typ string) Frame {
+	cc.t.Helper()
+	cc.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		mt, msg, err := cc.conn.ReadMessage()
+		if err != nil {
+			cc.t.Fatalf("waiting for %s: %v", typ, err)
+		}
+		if mt != cc.codec.messageType() {
+			cc.t.Fatalf("got message type %d", mt)
+		}
+		f, err := cc.codec.decode(msg)
+		if err != nil {
+			cc.t.Fatal(err)
+		}
+		if f.T == typ {
+			return f
+		}
+	}
+}
+
+func TestMixedCodecSession(t *testing.T) {
+	_, store, url := newTestServer(t)
+	alice, bob := "alice@example.com", "bob@example.com"
+	store.AddFriendship(Friendship{User1Hash: emailHash(alice), User2Hash: emailHash(bob), SID: "sid-ab", Since: time.Now()})
+
+	for binary, marshal := range map[string]func(any) ([]byte, error){
+		subprotocolMsgpack: msgpack.Marshal,
+		subprotocolCBOR:    cbor.Marshal,
+	} {
+		t.Run(binary, func(t *testing.T) {
+			a := dialCodec(t, url, subprotocolJSON, alice, "pk-alice")
+			b := dialCodec(t, url, binary, bob, "pk-bob")
+
+			// JSON to binary: base64 in, raw bytes out, base64 again once
+			// decoded back into a Frame.
+			a.send(Frame{T: "MSG", SID: "sid-ab", Data: json.RawMessage(`{"payloads":{"pk-bob":"AAEC"}}`)})
+			if got := b.recv("MSG"); string(got.Data) != `{"payloads":{"pk-bob":"AAEC"}}` {
+				t.Fatalf("binary client got %s", got.Data)
+			}
+
+			// Binary to JSON: raw bytes in, base64 out.
+			raw, err := marshal(map[string]any{
+				"t":    "MSG",
+				"sid":  "sid-ab",
+				"data": map[string]any{"payloads": map[string][]byte{"pk-alice": {0xff, 0xfe}}},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			b.conn.WriteMessage(websocket.BinaryMessage, raw)
+			if got := a.recv("MSG"); string(got.Data) != `{"payloads":{"pk-alice":"//4="}}` {
+				t.Fatalf("JSON client got %s", got.Data)
+			}
+		})
+	}
+}
+
+func TestUnknownSubprotocolFallsBackToJSON(t *testing.T) {
+	ts := setupTestServer()
+	defer ts.Close()
+	dialer := websocket.Dialer{Subprotocols: []string{"relay.protobuf"}}
+	conn, _, err := dialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if conn.Subprotocol() != "" {
+		t.Fatalf("negotiated %q", conn.Subprotocol())
+	}
+	conn.WriteJSON(Frame{T: "GET_DEVICES"})
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var f Frame
+	if err := conn.ReadJSON(&f); err != nil || f.T != "ERROR" {
+		t.Fatalf("got %+v, %v", f, err)
+	}
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Config is the relay's runtime configuration. Values are layered, each
+// overriding the previous one: built-in defaults, the JSON config file,
+// environment variables, then command-line flags.
+type Config struct {
+	ListenAddr        string `json:"listenAddr"`
+	StoreDriver       string `json:"storeDriver"`
+	StoreDSN          string `json:"storeDSN"`
+	ConnectionLogPath string `json:"connectionLogPath"`
+
+	GoogleClientIDs   []string `json:"googleClientIds"`
+	AuthSessionSecret string   `json:"authSessionSecret"`
+	KeyLogSecret      string   `json:"keyLogSecret"`
+
+	TurnSecret string `json:"turnSecret"`
+	TurnHost   string `json:"turnHost"`
+	TurnPort   int    `json:"turnPort"`
+
+	MaxMsgsPerSecond      int `json:"maxMsgsPerSecond"`
+	MaxFrameBytes         int `json:"maxFrameBytes"`
+	MaxEncryptedDataBytes int `json:"maxEncryptedDataBytes"`
+	RetentionDays         int `json:"retentionDays"`
+	MasterRecoveryDays    int `json:"masterRecoveryDays"`
+	MinProtocolVersion    int `json:"minProtocolVersion"`
+
+	SendQueueSize       int    `json:"sendQueueSize"`
+	SlowConsumerPolicy  string `json:"slowConsumerPolicy"`
+	SpillBytes          int    `json:"spillBytes"`
+	WriteTimeoutSeconds int    `json:"writeTimeoutSeconds"`
+
+	PersistPresence bool `json:"persistPresence"`
+
+	MailboxQuotaBytes int `json:"mailboxQuotaBytes"`
+	MailboxTTLHours   int `json:"mailboxTTLHours"`
+
+	NodeID                  string `json:"nodeId"`
+	ClusterBus              string `json:"clusterBus"`
+	ClusterURL              string `json:"clusterURL"`
+	ClusterHeartbeatSeconds int    `json:"clusterHeartbeatSeconds"`
+}
+
+func defaultConfig() *Config {
+	return &Config{
+		ListenAddr:        ":9000",
+		StoreDriver:       "sqlite",
+		StoreDSN:          "./server.db",
+		ConnectionLogPath: "connections.log",
+		GoogleClientIDs: []string{
+			"588653192623-aqs0s01hv62pbp5p7pe3r0h7mce8m10l.apps.googleusercontent.com", // Electron
+			"588653192623-3lkl6bqaa77lk1g3l89uideuqf083g1o.apps.googleusercontent.com", // Android
+		},
+		TurnPort:              3478,
+		MaxMsgsPerSecond:      100,
+		MaxFrameBytes:         1024 * 1024,
+		MaxEncryptedDataBytes: 400 * 1024,
+		RetentionDays:         30,
+		MasterRecoveryDays:    7,
+		SendQueueSize:         256,
+		SlowConsumerPolicy:    slowConsumerDisconnect,
+		SpillBytes:            8 * 1024 * 1024,
+		WriteTimeoutSeconds:   10,
+
+		MailboxTTLHours: 72,
+
+		ClusterURL:              "localhost:6379",
+		ClusterHeartbeatSeconds: 5,
+	}
+}
+
+// configField binds one setting to its environment variable and flag. Flag
+// is empty for secrets, which should not appear in process listings.
+type configField struct {
+	env   string
+	flag  string
+	usage string
+	value flag.Value
+}
+
+func (c *Config) fields() []configField {
+	return []configField{
+		{"LISTEN_ADDR", "listen", "address to listen on", (*stringValue)(&c.ListenAddr)},
+		{"STORE_DRIVER", "store-driver", "sqlite, postgres or memory", (*stringValue)(&c.StoreDriver)},
+		{"STORE_DSN", "store-dsn", "sqlite file or postgres connection string", (*stringValue)(&c.StoreDSN)},
+		{"CONNECTION_LOG", "connection-log", "path of the connection log", (*stringValue)(&c.ConnectionLogPath)},
+		{"GOOGLE_CLIENT_IDS", "google-client-ids", "comma separated OAuth client IDs accepted as token audience", (*listValue)(&c.GoogleClientIDs)},
+		{"AUTH_SESSION_SECRET", "", "", (*stringValue)(&c.AuthSessionSecret)},
+		{"KEY_LOG_SECRET", "", "", (*stringValue)(&c.KeyLogSecret)},
+		{"TURN_SECRET", "", "", (*stringValue)(&c.TurnSecret)},
+		{"TURN_HOST", "turn-host", "TURN server host handed to clients", (*stringValue)(&c.TurnHost)},
+		{"TURN_PORT", "turn-port", "TURN server port handed to clients", (*intValue)(&c.TurnPort)},
+		{"MAX_MSGS_PER_SECOND", "max-msgs-per-second", "per-client MSG and RTC rate limit", (*intValue)(&c.MaxMsgsPerSecond)},
+		{"MAX_FRAME_BYTES", "max-frame-bytes", "largest websocket frame accepted", (*intValue)(&c.MaxFrameBytes)},
+		{"MAX_ENCRYPTED_DATA_BYTES", "max-encrypted-data-bytes", "largest total ciphertext in one MSG", (*intValue)(&c.MaxEncryptedDataBytes)},
+		{"RETENTION_DAYS", "retention-days", "days before idle devices, requests and notifications are deleted", (*intValue)(&c.RetentionDays)},
+		{"MASTER_RECOVERY_DAYS", "master-recovery-days", "days the master must stay offline before another device's claim to it is granted", (*intValue)(&c.MasterRecoveryDays)},
+		{"MIN_PROTOCOL_VERSION", "min-protocol-version", "oldest client protocol version allowed to AUTH", (*intValue)(&c.MinProtocolVersion)},
+		{"SEND_QUEUE_SIZE", "send-queue-size", "frames queued per client before the slow-consumer policy applies", (*intValue)(&c.SendQueueSize)},
+		{"SLOW_CONSUMER_POLICY", "slow-consumer-policy", "drop, disconnect or spill", (*stringValue)(&c.SlowConsumerPolicy)},
+		{"SPILL_BYTES", "spill-bytes", "per-client overflow budget for the spill policy", (*intValue)(&c.SpillBytes)},
+		{"WRITE_TIMEOUT_SECONDS", "write-timeout-seconds", "socket write deadline", (*intValue)(&c.WriteTimeoutSeconds)},
+		{"PERSIST_PRESENCE", "persist-presence", "mirror online sockets into the store", (*boolValue)(&c.PersistPresence)},
+		{"MAILBOX_QUOTA_BYTES", "mailbox-quota-bytes", "ciphertext held per offline account; 0 disables the mailbox", (*intValue)(&c.MailboxQuotaBytes)},
+		{"MAILBOX_TTL_HOURS", "mailbox-ttl-hours", "how long the mailbox holds a message", (*intValue)(&c.MailboxTTLHours)},
+		{"NODE_ID", "node-id", "this node's name in a cluster; generated when empty", (*stringValue)(&c.NodeID)},
+		{"CLUSTER_BUS", "cluster-bus", "empty to run alone, or redis", (*stringValue)(&c.ClusterBus)},
+		{"CLUSTER_URL", "cluster-url", "bus address, e.g. redis://:password@host:6379", (*stringValue)(&c.ClusterURL)},
+		{"CLUSTER_HEARTBEAT_SECONDS", "cluster-heartbeat-seconds", "interval between node snapshots", (*intValue)(&c.ClusterHeartbeatSeconds)},
+	}
+}
+
+// loadConfig builds the effective configuration from args (without the
+// program name) and the environment. It returns the arguments left after
+// flag parsing and whether -dump-config was given.
+func loadConfig(args []string, getenv func(string) string) (*Config, []string, bool, error) {
+	fs := flag.NewFlagSet("relay", flag.ContinueOnError)
+	configPath := fs.String("config", getenv("RELAY_CONFIG"), "JSON config file")
+	dump := fs.Bool("dump-config", false, "print the effective config and exit")
+
+	// Flags are parsed into a scratch config first so they can be applied
+	// last, after the file and environment.
+	scratch := &Config{}
+	for _, f := range scratch.fields() {
+		if f.flag != "" {
+			fs.Var(f.value, f.flag, f.usage)
+		}
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, nil, false, err
+	}
+
+	cfg := defaultConfig()
+	if *configPath != "" {
+		data, err := os.ReadFile(*configPath)
+		if err != nil {
+			return nil, nil, false, fmt.Errorf("reading config file: %v", err)
+		}
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(cfg); err != nil {
+			return nil, nil, false, fmt.Errorf("parsing config file %s: %v", *configPath, err)
+		}
+	}
+
+	fields := cfg.fields()
+	for _, f := range fields {
+		if v := getenv(f.env); v != "" {
+			if err := f.value.Set(v); err != nil {
+				return nil, nil, false, fmt.Errorf("%s: %v", f.env, err)
+			}
+		}
+	}
+
+	set := make(map[string]string)
+	fs.Visit(func(fl *flag.Flag) { set[fl.Name] = fl.Value.String() })
+	for _, f := range fields {
+		if v, ok := set[f.flag]; ok && f.flag != "" {
+			f.value.Set(v)
+		}
+	}
+
+	return cfg, fs.Args(), *dump, nil
+}
+
+// validateStore checks only what is needed to open the store, which is all
+// the migrate command requires.
+func (c *Config) validateStore() error {
+	switch c.StoreDriver {
+	case "sqlite", "sqlite3", "postgres", "postgresql", "memory":
+	default:
+		return fmt.Errorf("storeDriver: unknown driver %q", c.StoreDriver)
+	}
+	if c.StoreDriver != "memory" && c.StoreDSN == "" {
+		return errors.New("storeDSN must be set")
+	}
+	return nil
+}
+
+// validate fails closed: a relay with a missing secret or a nonsensical
+// limit refuses to start instead of running insecurely.
+func (c *Config) validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...any) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+
+	errs = append(errs, c.validateStore())
+	check(c.ListenAddr != "", "listenAddr must be set")
+	check(c.ConnectionLogPath != "", "connectionLogPath must be set")
+	check(strings.TrimSpace(c.AuthSessionSecret) != "", "AUTH_SESSION_SECRET must be set")
+	check(c.TurnSecret != "", "TURN_SECRET must be set")
+	check(len(c.GoogleClientIDs) > 0, "googleClientIds must list at least one client ID")
+	check(c.TurnPort > 0 && c.TurnPort < 65536, "turnPort %d is out of range", c.TurnPort)
+	check(c.MaxMsgsPerSecond > 0, "maxMsgsPerSecond must be positive")
+	check(c.MaxFrameBytes > 0, "maxFrameBytes must be positive")
+	check(c.MaxEncryptedDataBytes > 0 && c.MaxEncryptedDataBytes < c.MaxFrameBytes,
+		"maxEncryptedDataBytes must be positive and below maxFrameBytes")
+	check(c.RetentionDays > 0, "retentionDays must be positive")
+	check(c.MasterRecoveryDays > 0 && c.MasterRecoveryDays < c.RetentionDays,
+		"masterRecoveryDays must be positive and below retentionDays")
+	check(c.MinProtocolVersion >= 0 && c.MinProtocolVersion <= protocolVersion,
+		"minProtocolVersion must be between 0 and %d", protocolVersion)
+	check(c.SendQueueSize > 0, "sendQueueSize must be positive")
+	switch c.SlowConsumerPolicy {
+	case slowConsumerDrop, slowConsumerDisconnect:
+	case slowConsumerSpill:
+		check(c.SpillBytes > 0, "spillBytes must be positive with the spill policy")
+	default:
+		check(false, "slowConsumerPolicy: unknown policy %q", c.SlowConsumerPolicy)
+	}
+	check(c.WriteTimeoutSeconds > 0, "writeTimeoutSeconds must be positive")
+	check(c.MailboxQuotaBytes >= 0, "mailboxQuotaBytes must not be negative")
+	check(c.MailboxTTLHours > 0, "mailboxTTLHours must be positive")
+	switch c.ClusterBus {
+	case "":
+	case "redis":
+		check(c.ClusterURL != "", "clusterURL must be set with a cluster bus")
+		check(c.ClusterHeartbeatSeconds > 0, "clusterHeartbeatSeconds must be positive")
+	default:
+		check(false, "clusterBus: unknown bus %q", c.ClusterBus)
+	}
+	return errors.Join(errs...)
+}
+
+// dump writes the effective config as JSON with secrets redacted.
+func (c *Config) dump(w io.Writer) error {
+	redacted := *c
+	for _, secret := range []*string{&redacted.AuthSessionSecret, &redacted.KeyLogSecret, &redacted.TurnSecret} {
+		if *secret != "" {
+			*secret = "<redacted>"
+		}
+	}
+	if redacted.StoreDriver == "postgres" || redacted.StoreDriver == "postgresql" {
+		redacted.StoreDSN = "<redacted>"
+	}
+	if strings.Contains(redacted.ClusterURL, "@") {
+		redacted.ClusterURL = "<redacted>"
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(redacted)
+}
+
+type stringValue string
+
+func (v *stringValue) Set(s string) error { *v = stringValue(s); return nil }
+func (v *stringValue) String() string     { return string(*v) }
+
+type boolValue bool
+
+func (v *boolValue) Set(s string) error {
+	b, err := strconv.ParseBool(strings.TrimSpace(s))
+	if err != nil {
+		return fmt.Errorf("invalid boolean %q", s)
+	}
+	*v = boolValue(b)
+	return nil
+}
+func (v *boolValue) String() string   { return strconv.FormatBool(bool(*v)) }
+func (v *boolValue) IsBoolFlag() bool { return true }
+
+type intValue int
+
+func (v *intValue) Set(s string) error {
+	n, err := strconv.Atoi(strings.TrimSpace(s))
+	if err != nil {
+		return fmt.Errorf("invalid number %q", s)
+	}
+	*v = intValue(n)
+	return nil
+}
+func (v *intValue) String() string { return strconv.Itoa(int(*v)) }
+
+type listValue []string
+
+func (v *listValue) Set(s string) error {
+	var out []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			out = append(out, item)
+		}
+	}
+	*v = out
+	return nil
+}
+func (v *listValue) String() string { return strings.Join(*v, ",") }
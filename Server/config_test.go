@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestConfigPrecedence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "relay.json")
+	os.WriteFile(path, []byte(`{"listenAddr": ":7000", "turnPort": 5000, "maxMsgsPerSecond": 10}`), 0o600)
+
+	env := map[string]string{
+		"RELAY_CONFIG":        path,
+		"TURN_PORT":           "5001",
+		"MAX_MSGS_PER_SECOND": "20",
+		"GOOGLE_CLIENT_IDS":   "a, b",
+	}
+	cfg, rest, dump, err := loadConfig([]string{"-max-msgs-per-second", "30", "migrate", "status"}, func(k string) string { return env[k] })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dump {
+		t.Fatal("dump set without -dump-config")
+	}
+	if strings.Join(rest, " ") != "migrate status" {
+		t.Fatalf("rest args = %v", rest)
+	}
+	if cfg.ListenAddr != ":7000" {
+		t.Fatalf("file not applied: listenAddr = %q", cfg.ListenAddr)
+	}
+	if cfg.TurnPort != 5001 {
+		t.Fatalf("env does not override file: turnPort = %d", cfg.TurnPort)
+	}
+	if cfg.MaxMsgsPerSecond != 30 {
+		t.Fatalf("flag does not override env: maxMsgsPerSecond = %d", cfg.MaxMsgsPerSecond)
+	}
+	if !sameStrings(cfg.GoogleClientIDs, []string{"a", "b"}) {
+		t.Fatalf("googleClientIds = %v", cfg.GoogleClientIDs)
+	}
+	if cfg.RetentionDays != 30 {
+		t.Fatalf("default lost: retentionDays = %d", cfg.RetentionDays)
+	}
+}
+
+func TestConfigRejectsBadInput(t *testing.T) {
+	none := func(string) string { return "" }
+	if _, _, _, err := loadConfig([]string{"-turn-port", "abc"}, none); err == nil {
+		t.Fatal("expected error for non-numeric flag")
+	}
+
+	path := filepath.Join(t.TempDir(), "relay.json")
+	os.WriteFile(path, []byte(`{"listenAdr": ":7000"}`), 0o600)
+	if _, _, _, err := loadConfig([]string{"-config", path}, none); err == nil {
+		t.Fatal("expected error for unknown config key")
+	}
+}
+
+func TestConfigValidateFailsClosed(t *testing.T) {
+	cfg := defaultConfig()
+	err := cfg.validate()
+	if err == nil {
+		t.Fatal("config without secrets validated")
+	}
+	for _, want := range []string{"AUTH_SESSION_SECRET", "TURN_SECRET"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Fatalf("error %q does not mention %s", err, want)
+		}
+	}
+
+	cfg = testConfig()
+	if err := cfg.validate(); err != nil {
+		t.Fatalf("test config invalid: %v", err)
+	}
+	cfg.MaxEncryptedDataBytes = cfg.MaxFrameBytes
+	if err := cfg.validate(); err == nil {
+		t.Fatal("ciphertext limit above frame limit validated")
+	}
+	cfg = testConfig()
+	cfg.MinProtocolVersion = protocolVersion + 1
+	if err := cfg.validate(); err == nil {
+		t.Fatal("minimum protocol version newer than the server validated")
+	}
+}
+
+func TestConfigDumpRedactsSecrets(t *testing.T) {
+	cfg := testConfig()
+	cfg.StoreDriver = "postgres"
+	cfg.StoreDSN = "postgres://relay:hunter2@db/relay"
+
+	var buf bytes.Buffer
+	cfg.dump(&buf)
+	for _, secret := range []string{cfg.AuthSessionSecret, cfg.TurnSecret, "hunter2"} {
+		if strings.Contains(buf.String(), secret) {
+			t.Fatalf("dump leaks %q:\n%s", secret, buf.String())
+		}
+	}
+}
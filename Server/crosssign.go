@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+)
+
+// The master cross-signs every other device key of its user: a standing
+// signature by the master key over signedMessage("CROSS_SIGN", emailHash,
+// key). DEVICE_LINK_ACCEPT must carry it, and the server checks it before the
+// device becomes active. Key lookups (KEY_DIRECTORY, GET_PUBLIC_KEY and
+// PREKEY_BUNDLE) serve it with the key that made it, so a peer that trusts
+// the master can tell a new key is really one of the user's devices.
+//
+// Devices approved before cross-signing, or by an earlier master, are
+// re-signed with CROSS_SIGN. The master is told which ones with
+// CROSS_SIGN_NEEDED on AUTH and when it takes the role over.
+
+func init() {
+	RegisterFrame("CROSS_SIGN", (*Server).handleCrossSign, requireAuth, rateLimit(defaultFramesPerSecond))
+}
+
+func crossSignMessage(emailHash, publicKey string) []byte {
+	return signedMessage("CROSS_SIGN", emailHash, publicKey)
+}
+
+func (s *Server) handleCrossSign(client *Client, frame Frame) {
+	var d struct {
+		Signatures map[string]string `json:"signatures"` // by device key
+	}
+	if err := json.Unmarshal(frame.Data, &d); err != nil || len(d.Signatures) == 0 {
+		s.sendError(client, frame, ErrInvalidFrame, "Invalid CROSS_SIGN")
+		return
+	}
+	email, publicKey := client.identity()
+	eh := emailHash(email)
+	master, err := s.store.MasterDevice(eh)
+	if err != nil || publicKey == "" || master.PublicKey != publicKey {
+		s.sendError(client, frame, ErrNotMasterDevice, "Only the master device can do that")
+		return
+	}
+	keys := make([]string, 0, len(d.Signatures))
+	for pk, sig := range d.Signatures {
+		if dev, err := s.store.Device(eh, pk); err != nil || dev.Status != DeviceActive || dev.IsMaster {
+			s.sendError(client, frame, ErrInvalidFrame, "No such approved device")
+			return
+		}
+		if verifyDeviceSignature(publicKey, crossSignMessage(eh, pk), sig) != nil {
+			s.sendError(client, frame, ErrBadSignature, "Signature does not match the master device key")
+			return
+		}
+		keys = append(keys, pk)
+	}
+	for _, pk := range keys {
+		if err := s.store.SetCrossSignature(eh, pk, publicKey, d.Signatures[pk]); err != nil {
+			log.Printf("[Error] Failed to store cross-signature for %s: %v", client.id, err)
+			s.sendError(client, frame, ErrInternal, "Failed to store cross-signatures")
+			return
+		}
+	}
+	data, _ := json.Marshal(map[string]any{"publicKeys": keys})
+	s.reply(client, frame, Frame{T: "CROSS_SIGNED", Data: data})
+}
+
+// crossSignNeeded returns CROSS_SIGN_NEEDED for master, listing the active
+// devices of emailHash it has not signed, and whether there are any.
+func (s *Server) crossSignNeeded(emailHash, master string) (Frame, bool) {
+	devices, err := s.store.ListDevices(emailHash)
+	if err != nil {
+		log.Printf("[Error] Failed to load devices for %s: %v", emailHash, err)
+		return Frame{}, false
+	}
+	var keys []string
+	for _, d := range devices {
+		if d.Status == DeviceActive && !d.IsMaster && d.PublicKey != "" && d.CrossSignedBy != master {
+			keys = append(keys, d.PublicKey)
+		}
+	}
+	if len(keys) == 0 {
+		return Frame{}, false
+	}
+	data, _ := json.Marshal(map[string]any{"publicKeys": keys})
+	return Frame{T: "CROSS_SIGN_NEEDED", Data: data}, true
+}
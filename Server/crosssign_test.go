@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestCrossSigning(t *testing.T) {
+	_, store, url := newTestServer(t)
+	const alice, bob = "alice@example.com", "bob@example.com"
+	aliceHash, bobHash := emailHash(alice), emailHash(bob)
+	laptop, tablet := newTestDeviceKey(t), newTestDeviceKey(t)
+	store.AddFriendship(Friendship{User1Hash: aliceHash, User2Hash: bobHash, SID: "sid-ab", Since: time.Now()})
+
+	// The tablet was approved before cross-signing, so the master is asked
+	// to sign it when it signs in.
+	m := authDevice(t, url, alice, laptop.pub, protocolVersion)
+	addLinkedDevice(store, alice, tablet.pub)
+	m.Close()
+	m = authDevice(t, url, alice, laptop.pub, protocolVersion)
+	var needed struct{ PublicKeys []string }
+	json.Unmarshal(waitFrame(t, m, "CROSS_SIGN_NEEDED").Data, &needed)
+	if len(needed.PublicKeys) != 1 || needed.PublicKeys[0] != tablet.pub {
+		t.Fatalf("CROSS_SIGN_NEEDED = %+v", needed)
+	}
+
+	crossSign := func(sig string) {
+		d, _ := json.Marshal(map[string]any{"signatures": map[string]string{tablet.pub: sig}})
+		m.WriteJSON(Frame{T: "CROSS_SIGN", ID: "x", Data: d})
+	}
+	crossSign(tablet.sign(crossSignMessage(aliceHash, tablet.pub)))
+	if e := errorOf(t, waitFrame(t, m, "ERROR")); e.Code != ErrBadSignature {
+		t.Fatalf("self-signed cross-signature = %+v", e)
+	}
+	crossSign(laptop.sign(crossSignMessage(aliceHash, tablet.pub)))
+	waitFrame(t, m, "CROSS_SIGNED")
+
+	// Peers get the signature with the key.
+	b := authDevice(t, url, bob, "pk-bob", protocolVersion)
+	d, _ := json.Marshal(map[string]string{"targetEmail": alice})
+	b.WriteJSON(Frame{T: "KEY_DIRECTORY", ID: "k", Data: d})
+	var dir struct {
+		Devices []struct{ PublicKey, CrossSignature, CrossSignedBy string }
+	}
+	json.Unmarshal(waitFrame(t, b, "KEY_DIRECTORY").Data, &dir)
+	signed := false
+	for _, dev := range dir.Devices {
+		if dev.PublicKey == tablet.pub {
+			signed = dev.CrossSignedBy == laptop.pub && verifyDeviceSignature(laptop.pub, crossSignMessage(aliceHash, tablet.pub), dev.CrossSignature) == nil
+		}
+	}
+	if !signed {
+		t.Fatalf("directory = %+v", dir.Devices)
+	}
+
+	// A new master is asked to sign the devices the old one signed.
+	tab := authDevice(t, url, alice, tablet.pub, protocolVersion)
+	d, _ = json.Marshal(map[string]string{"targetPubKey": tablet.pub, "signature": laptop.sign(signedMessage("TRANSFER_MASTER", aliceHash, tablet.pub))})
+	m.WriteJSON(Frame{T: "TRANSFER_MASTER", ID: "t", Data: d})
+	json.Unmarshal(waitFrame(t, tab, "CROSS_SIGN_NEEDED").Data, &needed)
+	if len(needed.PublicKeys) != 1 || needed.PublicKeys[0] != laptop.pub {
+		t.Fatalf("CROSS_SIGN_NEEDED after transfer = %+v", needed)
+	}
+}
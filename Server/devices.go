@@ -0,0 +1,358 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// A user's first device becomes the master. Every device after that starts
+// out pending: it may authenticate, but it is not announced to friends, gets
+// no sessions and may not send MSG or RTC frames. The pending device sends
+// DEVICE_LINK_REQUEST with a description of itself encrypted to the master
+// key; the master gets it straight away, or on its next AUTH, and answers
+// DEVICE_LINK_ACCEPT or DEVICE_LINK_REJECT signed with its key (see
+// signatures.go). An accepted device authenticates again to get its
+// sessions; a rejected one is forgotten and disconnected. Every change goes
+// out as DEVICE_LIST to all of the user's sockets.
+//
+// The master can also revoke any other device with a signed DEVICE_REVOKE.
+// The device is forgotten, its sockets are closed, and the user's friends
+// and groups get PEER_KEYS with the keys left. With wipe set, the device is
+// also told to erase its local data with REMOTE_WIPE: right away if it is
+// connected, and on its next AUTH in any case, for up to retentionDays.
+
+// maxLinkSpecsBytes bounds the encrypted device description.
+const maxLinkSpecsBytes = 4 * 1024
+
+func init() {
+	RegisterFrame("DEVICE_LINK_REQUEST", (*Server).handleDeviceLinkRequest, requireAuth, rateLimit(defaultFramesPerSecond), maxPayload(2*maxLinkSpecsBytes))
+	RegisterFrame("DEVICE_LINK_ACCEPT", (*Server).handleDeviceLinkAccept, requireAuth, rateLimit(defaultFramesPerSecond))
+	RegisterFrame("DEVICE_LINK_REJECT", (*Server).handleDeviceLinkReject, requireAuth, rateLimit(defaultFramesPerSecond))
+	RegisterFrame("DEVICE_REVOKE", (*Server).handleDeviceRevoke, requireAuth, rateLimit(defaultFramesPerSecond))
+}
+
+// devicePending reports whether c authenticated as a device that is still
+// waiting for approval.
+func (c *Client) devicePending() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.deviceStatus == DevicePending
+}
+
+// requireApprovedDevice rejects frames from pending devices.
+func requireApprovedDevice(next FrameHandler) FrameHandler {
+	return func(s *Server, c *Client, f Frame) {
+		if c.devicePending() {
+			s.sendError(c, f, ErrDevicePending, "This device is waiting for approval")
+			return
+		}
+		next(s, c, f)
+	}
+}
+
+// registerDevice records publicKey as a device of emailHash, or marks it
+// active now if it is known, and returns it. A new device is pending when
+// the account has a master to approve it; otherwise it is the first device
+// and becomes the master. Masters are never pruned, so a lost master is only
+// replaced by TRANSFER_MASTER or a MASTER_CLAIM (see master.go).
+func (s *Server) registerDevice(emailHash, publicKey string) Device {
+	now := time.Now()
+	if d, err := s.store.Device(emailHash, publicKey); err == nil {
+		s.store.TouchDevice(emailHash, publicKey, now)
+		return d
+	}
+	d, added, err := s.store.RegisterDevice(Device{EmailHash: emailHash, PublicKey: publicKey, LastActive: now})
+	if err != nil {
+		log.Printf("[Error] Failed to add device for %s: %v", emailHash, err)
+		return Device{EmailHash: emailHash, PublicKey: publicKey, LastActive: now, Status: DevicePending}
+	}
+	if !added {
+		return d
+	}
+	if d.Status == DeviceActive {
+		s.logKey(emailHash, publicKey, KeyAdded)
+	}
+	s.broadcastDeviceList(emailHash)
+	return d
+}
+
+// sendToDevice sends f to the sockets of emailHash that authenticated with
+// publicKey, on this node or another.
+func (s *Server) sendToDevice(emailHash, publicKey string, f Frame) {
+	s.sendToLocalDevice(emailHash, publicKey, f, false)
+	s.cluster.sendToDevice(emailHash, publicKey, f, false)
+}
+
+// dropDevice sends f to the sockets of emailHash that authenticated with
+// publicKey and closes them, on this node or another.
+func (s *Server) dropDevice(emailHash, publicKey string, f Frame) {
+	s.sendToLocalDevice(emailHash, publicKey, f, true)
+	s.cluster.sendToDevice(emailHash, publicKey, f, true)
+}
+
+func (s *Server) sendToLocalDevice(emailHash, publicKey string, f Frame, drop bool) {
+	for _, c := range s.presence.Clients(emailHash) {
+		if _, pk := c.identity(); pk != publicKey {
+			continue
+		}
+		s.send(c, f)
+		if drop {
+			c.out.closeAfterFlush()
+		}
+	}
+}
+
+func linkRequestFrame(d Device) Frame {
+	data, _ := json.Marshal(map[string]string{
+		"senderPubKey":   d.PublicKey,
+		"encryptedSpecs": d.LinkSpecs,
+	})
+	return Frame{T: "DEVICE_LINK_REQUEST", Data: data}
+}
+
+// sendLinkRequests sends the master device c every pending link request of
+// its user.
+func (s *Server) sendLinkRequests(c *Client, emailHash string) {
+	devices, err := s.store.ListDevices(emailHash)
+	if err != nil {
+		log.Printf("[Error] Failed to load devices for %s: %v", c.id, err)
+		return
+	}
+	for _, d := range devices {
+		if d.Status == DevicePending && d.LinkSpecs != "" {
+			s.send(c, linkRequestFrame(d))
+		}
+	}
+}
+
+func (s *Server) handleDeviceLinkRequest(client *Client, frame Frame) {
+	var d struct {
+		TargetPubKey   string `json:"targetPubKey"`
+		EncryptedSpecs string `json:"encryptedSpecs"`
+	}
+	if err := json.Unmarshal(frame.Data, &d); err != nil || d.EncryptedSpecs == "" || len(d.EncryptedSpecs) > maxLinkSpecsBytes {
+		s.sendError(client, frame, ErrInvalidFrame, "Invalid DEVICE_LINK_REQUEST")
+		return
+	}
+	if !client.devicePending() {
+		s.sendError(client, frame, ErrInvalidFrame, "This device is already approved")
+		return
+	}
+	email, publicKey := client.identity()
+	eh := emailHash(email)
+	master, err := s.store.MasterDevice(eh)
+	if err != nil {
+		s.sendError(client, frame, ErrInternal, "Failed to load the master device")
+		return
+	}
+	if d.TargetPubKey != "" && d.TargetPubKey != master.PublicKey {
+		s.sendError(client, frame, ErrNotMasterDevice, "That is not the master device")
+		return
+	}
+	if err := s.store.SetLinkSpecs(eh, publicKey, d.EncryptedSpecs); err != nil {
+		log.Printf("[Error] Failed to store link request for %s: %v", client.id, err)
+		s.sendError(client, frame, ErrInternal, "Failed to store link request")
+		return
+	}
+	s.sendToDevice(eh, master.PublicKey, linkRequestFrame(Device{PublicKey: publicKey, LinkSpecs: d.EncryptedSpecs}))
+	s.reply(client, frame, Frame{T: "DEVICE_LINK_SENT"})
+}
+
+// linkDecision checks a DEVICE_LINK_ACCEPT or DEVICE_LINK_REJECT: it must
+// come from the master device, be signed by it, and name a pending device.
+// It returns the master's signature.
+func (s *Server) linkDecision(client *Client, frame Frame) (eh, target, sig string, ok bool) {
+	var d struct {
+		TargetPubKey string `json:"targetPubKey"`
+		Signature    string `json:"signature"`
+	}
+	if err := json.Unmarshal(frame.Data, &d); err != nil || d.TargetPubKey == "" {
+		s.sendError(client, frame, ErrInvalidFrame, "Invalid "+frame.T)
+		return "", "", "", false
+	}
+	email, publicKey := client.identity()
+	eh = emailHash(email)
+	master, err := s.store.MasterDevice(eh)
+	if err != nil || publicKey == "" || master.PublicKey != publicKey {
+		s.sendError(client, frame, ErrNotMasterDevice, "Only the master device can do that")
+		return "", "", "", false
+	}
+	if verifyDeviceSignature(publicKey, signedMessage(frame.T, eh, d.TargetPubKey), d.Signature) != nil {
+		s.sendError(client, frame, ErrBadSignature, "Signature does not match the master device key")
+		return "", "", "", false
+	}
+	if dev, err := s.store.Device(eh, d.TargetPubKey); err != nil || dev.Status != DevicePending {
+		s.sendError(client, frame, ErrInvalidFrame, "No such pending device")
+		return "", "", "", false
+	}
+	return eh, d.TargetPubKey, d.Signature, true
+}
+
+func (s *Server) handleDeviceLinkAccept(client *Client, frame Frame) {
+	eh, target, sig, ok := s.linkDecision(client, frame)
+	if !ok {
+		return
+	}
+	var d struct {
+		CrossSignature string `json:"crossSignature"`
+	}
+	json.Unmarshal(frame.Data, &d)
+	_, master := client.identity()
+	if verifyDeviceSignature(master, crossSignMessage(eh, target), d.CrossSignature) != nil {
+		s.sendError(client, frame, ErrBadSignature, "Cross-signature does not match the master device key")
+		return
+	}
+	approval := DeviceSignature{EmailHash: eh, Signer: master, Subject: target, Kind: frame.T, Signature: sig, CreatedAt: time.Now()}
+	if err := s.store.ApproveDevice(approval, d.CrossSignature); err == ErrNotFound {
+		s.sendError(client, frame, ErrInvalidFrame, "No such pending device")
+		return
+	} else if err != nil {
+		log.Printf("[Error] Failed to approve device for %s: %v", eh, err)
+		s.sendError(client, frame, ErrInternal, "Failed to approve device")
+		return
+	}
+	s.logKey(eh, target, KeyAdded)
+	data, _ := json.Marshal(map[string]string{"publicKey": target})
+	s.sendToDevice(eh, target, Frame{T: "DEVICE_LINK_ACCEPTED", Data: data})
+	s.reply(client, frame, Frame{T: "DEVICE_LINK_ACCEPTED", Data: data})
+	s.broadcastDeviceList(eh)
+	log.Printf("[Server] Device approved for %s", eh)
+}
+
+func (s *Server) handleDeviceLinkReject(client *Client, frame Frame) {
+	eh, target, _, ok := s.linkDecision(client, frame)
+	if !ok {
+		return
+	}
+	if err := s.store.DeleteDevice(eh, target); err != nil {
+		log.Printf("[Error] Failed to reject device for %s: %v", eh, err)
+		s.sendError(client, frame, ErrInternal, "Failed to reject device")
+		return
+	}
+	data, _ := json.Marshal(map[string]string{"publicKey": target})
+	s.dropDevice(eh, target, Frame{T: "DEVICE_LINK_REJECTED", Data: data})
+	s.reply(client, frame, Frame{T: "DEVICE_LINK_REJECTED", Data: data})
+	s.broadcastDeviceList(eh)
+}
+
+func (s *Server) handleDeviceRevoke(client *Client, frame Frame) {
+	var d struct {
+		TargetPubKey string `json:"targetPubKey"`
+		Wipe         bool   `json:"wipe"`
+		Signature    string `json:"signature"`
+	}
+	if err := json.Unmarshal(frame.Data, &d); err != nil || d.TargetPubKey == "" {
+		s.sendError(client, frame, ErrInvalidFrame, "Invalid DEVICE_REVOKE")
+		return
+	}
+	email, publicKey := client.identity()
+	eh := emailHash(email)
+	master, err := s.store.MasterDevice(eh)
+	if err != nil || publicKey == "" || master.PublicKey != publicKey {
+		s.sendError(client, frame, ErrNotMasterDevice, "Only the master device can do that")
+		return
+	}
+	msg := signedMessage(frame.T, eh, d.TargetPubKey, strconv.FormatBool(d.Wipe))
+	if verifyDeviceSignature(publicKey, msg, d.Signature) != nil {
+		s.sendError(client, frame, ErrBadSignature, "Signature does not match the master device key")
+		return
+	}
+	if d.TargetPubKey == publicKey {
+		s.sendError(client, frame, ErrInvalidFrame, "The master device cannot revoke itself")
+		return
+	}
+	if _, err := s.store.Device(eh, d.TargetPubKey); err != nil {
+		s.sendError(client, frame, ErrInvalidFrame, "No such device")
+		return
+	}
+	if err := s.revokeDevice(eh, d.TargetPubKey, d.Wipe); err != nil {
+		log.Printf("[Error] Failed to revoke device for %s: %v", eh, err)
+		s.sendError(client, frame, ErrInternal, "Failed to revoke device")
+		return
+	}
+	data, _ := json.Marshal(map[string]any{"publicKey": d.TargetPubKey, "wipe": d.Wipe})
+	s.reply(client, frame, Frame{T: "DEVICE_NUCLEAR_SUCCESS", Data: data})
+	log.Printf("[Server] Device revoked for %s (wipe: %v)", eh, d.Wipe)
+}
+
+// revokeDevice forgets publicKey, disconnects it and tells everyone who
+// encrypts to emailHash. Only a key that was approved, and so logged as
+// added, is logged as removed.
+func (s *Server) revokeDevice(emailHash, publicKey string, wipe bool) error {
+	dev, err := s.store.Device(emailHash, publicKey)
+	if err != nil {
+		return err
+	}
+	if wipe {
+		if err := s.store.AddWipe(emailHash, publicKey, time.Now()); err != nil {
+			return err
+		}
+	}
+	if err := s.store.DeleteDevice(emailHash, publicKey); err != nil {
+		return err
+	}
+	if err := s.store.RemoveDeviceSockets(emailHash, publicKey); err != nil {
+		return err
+	}
+	if dev.Status == DeviceActive {
+		s.logKey(emailHash, publicKey, KeyRemoved)
+	}
+	data, _ := json.Marshal(map[string]string{"publicKey": publicKey})
+	if wipe {
+		s.sendToDevice(emailHash, publicKey, Frame{T: "REMOTE_WIPE", Data: data})
+	}
+	s.dropDevice(emailHash, publicKey, Frame{T: "DEVICE_REVOKED", Data: data})
+	s.sendPeerKeys(emailHash, publicKey)
+	s.broadcastDeviceList(emailHash)
+	return nil
+}
+
+// sendPeerKeys sends PEER_KEYS to every friend and group session of
+// emailHash, with the device keys it has online now and the one that is
+// gone.
+func (s *Server) sendPeerKeys(emailHash, removed string) {
+	keys := slices.DeleteFunc(s.onlineKeys(emailHash), func(pk string) bool { return pk == removed })
+	data, _ := json.Marshal(map[string]any{
+		"peerPubKeys":   keys,
+		"removedPubKey": removed,
+		"keyProof":      s.keyProof(emailHash, keys, 0),
+	})
+	for _, sid := range s.userSessions(emailHash) {
+		s.sendToSession(sid, nil, Frame{T: "PEER_KEYS", SID: sid, SH: emailHash, Data: data})
+	}
+}
+
+// userSessions returns the sids of emailHash's friendships and groups.
+func (s *Server) userSessions(emailHash string) []string {
+	var sids []string
+	if friendships, err := s.store.Friendships(emailHash); err == nil {
+		for _, f := range friendships {
+			sids = append(sids, f.SID)
+		}
+	}
+	if groups, err := s.store.UserGroups(emailHash); err == nil {
+		for _, g := range groups {
+			sids = append(sids, g.ID)
+		}
+	}
+	return sids
+}
+
+// remoteWipe answers the AUTH of a revoked device that has a wipe waiting
+// with REMOTE_WIPE and disconnects it. It reports whether it did.
+func (s *Server) remoteWipe(client *Client, frame Frame, emailHash, publicKey string) bool {
+	if publicKey == "" {
+		return false
+	}
+	if ok, err := s.store.TakeWipe(emailHash, publicKey); err != nil || !ok {
+		return false
+	}
+	data, _ := json.Marshal(map[string]string{"publicKey": publicKey})
+	s.reply(client, frame, Frame{T: "REMOTE_WIPE", Data: data})
+	client.out.closeAfterFlush()
+	log.Printf("[Server] Sent queued remote wipe to %s", client.id)
+	return true
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+// addLinkedDevice stores publicKey as an approved, non-master device of
+// email, so AUTH with it does not wait for the master.
+func addLinkedDevice(st Store, email, publicKey string) {
+	st.AddDevice(Device{EmailHash: emailHash(email), PublicKey: publicKey, LastActive: time.Now(), Status: DeviceActive})
+}
+
+// testDeviceKey is a device key pair that can sign like a client does.
+type testDeviceKey struct {
+	priv *ecdsa.PrivateKey
+	pub  string
+}
+
+func newTestDeviceKey(t *testing.T) testDeviceKey {
+	t.Helper()
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ek, err := priv.PublicKey.ECDH()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return testDeviceKey{priv: priv, pub: base64.StdEncoding.EncodeToString(ek.Bytes())}
+}
+
+// sign returns the raw r||s signature WebCrypto would produce.
+func (k testDeviceKey) sign(msg []byte) string {
+	digest := sha256.Sum256(msg)
+	r, s, _ := ecdsa.Sign(rand.Reader, k.priv, digest[:])
+	sig := make([]byte, 64)
+	r.FillBytes(sig[:32])
+	s.FillBytes(sig[32:])
+	return base64.StdEncoding.EncodeToString(sig)
+}
+
+func TestVerifyDeviceSignature(t *testing.T) {
+	k := newTestDeviceKey(t)
+	msg := signedMessage("DEVICE_LINK_ACCEPT", "eh", "pk")
+	if err := verifyDeviceSignature(k.pub, msg, k.sign(msg)); err != nil {
+		t.Fatalf("raw signature: %v", err)
+	}
+	digest := sha256.Sum256(msg)
+	der, _ := ecdsa.SignASN1(rand.Reader, k.priv, digest[:])
+	if err := verifyDeviceSignature(k.pub, msg, base64.StdEncoding.EncodeToString(der)); err != nil {
+		t.Fatalf("DER signature: %v", err)
+	}
+	if err := verifyDeviceSignature(k.pub, signedMessage("DEVICE_LINK_REJECT", "eh", "pk"), k.sign(msg)); err == nil {
+		t.Fatal("signature verified for another message")
+	}
+	if err := verifyDeviceSignature("pk-alice", msg, k.sign(msg)); err == nil {
+		t.Fatal("signature verified for a key that is not a P-256 point")
+	}
+}
+
+func TestDeviceLinking(t *testing.T) {
+	s, store, url := newTestServer(t)
+	const alice = "alice@example.com"
+	aliceHash := emailHash(alice)
+	master := newTestDeviceKey(t)
+
+	m := authDevice(t, url, alice, master.pub, protocolVersion)
+	if d, _ := store.Device(aliceHash, master.pub); !d.IsMaster || d.Status != DeviceActive {
+		t.Fatalf("first device = %+v", d)
+	}
+
+	// A second device is pending and may not send.
+	phone := dialTest(t, url)
+	auth, _ := json.Marshal(map[string]string{"token": getTestSessionToken(alice), "publicKey": "phone"})
+	phone.WriteJSON(Frame{T: "AUTH", Data: auth})
+	var ad struct{ DeviceStatus, MasterPubKey string }
+	json.Unmarshal(waitFrame(t, phone, "AUTH_SUCCESS").Data, &ad)
+	if ad.DeviceStatus != DevicePending || ad.MasterPubKey != master.pub {
+		t.Fatalf("pending AUTH_SUCCESS = %+v", ad)
+	}
+	var list struct{ Devices []map[string]any }
+	json.Unmarshal(waitFrame(t, m, "DEVICE_LIST").Data, &list)
+	if len(list.Devices) != 2 {
+		t.Fatalf("DEVICE_LIST = %+v", list)
+	}
+	for _, f := range []Frame{
+		{T: "MSG", ID: "m1", SID: "sid", Data: json.RawMessage(`{"payloads":{"x":"eA=="}}`)},
+		{T: "READ_RECEIPT", ID: "r1", SID: "sid", Data: json.RawMessage(`{"msgIds":["m"]}`)},
+		{T: "CREATE_GROUP", ID: "g1", Data: json.RawMessage(`{"name":"g"}`)},
+		{T: "MLS_FETCH", ID: "f1", Data: json.RawMessage(`{"groupId":"g"}`)},
+		{T: "FRIEND_REQUEST", ID: "q1", Data: json.RawMessage(`{"targetEmail":"bob@example.com"}`)},
+		{T: "DELETE_ACCOUNT", ID: "x1"},
+	} {
+		phone.WriteJSON(f)
+		if e := errorOf(t, waitFrame(t, phone, "ERROR")); e.Code != ErrDevicePending {
+			t.Fatalf("%s from pending device = %+v", f.T, e)
+		}
+	}
+	if _, err := store.Device(aliceHash, master.pub); err != nil {
+		t.Fatalf("account deleted by a pending device: %v", err)
+	}
+	if keys := s.onlineKeys(aliceHash); len(keys) != 1 || keys[0] != master.pub {
+		t.Fatalf("online keys = %v, want only the master", keys)
+	}
+
+	// Nor does it hear what is sent to the account's approved devices.
+	b := authDevice(t, url, "bob@example.com", "pk-bob", protocolVersion)
+	b.WriteJSON(Frame{T: "FRIEND_REQUEST", ID: "q1", Data: json.RawMessage(`{"targetEmail":"alice@example.com","encryptedPacket":"eA=="}`)})
+	waitFrame(t, b, "REQUEST_SENT")
+	waitFrame(t, m, "FRIEND_REQUEST")
+
+	phone.WriteJSON(Frame{T: "DEVICE_LINK_REQUEST", ID: "l1", Data: json.RawMessage(`{"targetPubKey":"` + master.pub + `","encryptedSpecs":"aXY=.c3BlY3M="}`)})
+	for f := (Frame{}); f.T != "DEVICE_LINK_SENT"; {
+		if err := phone.ReadJSON(&f); err != nil || f.T == "FRIEND_REQUEST" {
+			t.Fatalf("pending device got %+v, %v", f, err)
+		}
+	}
+	var req struct{ SenderPubKey, EncryptedSpecs string }
+	json.Unmarshal(waitFrame(t, m, "DEVICE_LINK_REQUEST").Data, &req)
+	if req.SenderPubKey != "phone" || req.EncryptedSpecs != "aXY=.c3BlY3M=" {
+		t.Fatalf("DEVICE_LINK_REQUEST = %+v", req)
+	}
+
+	// The master gets the request again when it reconnects.
+	m.Close()
+	m = authDevice(t, url, alice, master.pub, protocolVersion)
+	waitFrame(t, m, "DEVICE_LINK_REQUEST")
+
+	decide := func(typ, target, sig string) {
+		d, _ := json.Marshal(map[string]string{"targetPubKey": target, "signature": sig, "crossSignature": master.sign(crossSignMessage(aliceHash, target))})
+		m.WriteJSON(Frame{T: typ, ID: "d1", Data: d})
+	}
+	// A signature for rejecting does not approve.
+	decide("DEVICE_LINK_ACCEPT", "phone", master.sign(signedMessage("DEVICE_LINK_REJECT", aliceHash, "phone")))
+	if e := errorOf(t, waitFrame(t, m, "ERROR")); e.Code != ErrBadSignature {
+		t.Fatalf("mis-signed accept = %+v", e)
+	}
+	// Nor does one without the master's cross-signature of the key.
+	d, _ := json.Marshal(map[string]string{"targetPubKey": "phone", "signature": master.sign(signedMessage("DEVICE_LINK_ACCEPT", aliceHash, "phone"))})
+	m.WriteJSON(Frame{T: "DEVICE_LINK_ACCEPT", ID: "d1", Data: d})
+	if e := errorOf(t, waitFrame(t, m, "ERROR")); e.Code != ErrBadSignature {
+		t.Fatalf("accept without a cross-signature = %+v", e)
+	}
+	if dev, _ := store.Device(aliceHash, "phone"); dev.Status != DevicePending {
+		t.Fatalf("device without a cross-signature = %+v", dev)
+	}
+	decide("DEVICE_LINK_ACCEPT", "phone", master.sign(signedMessage("DEVICE_LINK_ACCEPT", aliceHash, "phone")))
+	if f := waitFrame(t, m, "DEVICE_LINK_ACCEPTED"); f.ID != "d1" {
+		t.Fatalf("DEVICE_LINK_ACCEPTED = %+v", f)
+	}
+	waitFrame(t, phone, "DEVICE_LINK_ACCEPTED")
+	if d, _ := store.Device(aliceHash, "phone"); d.Status != DeviceActive || d.LinkSpecs != "" || d.CrossSignedBy != master.pub {
+		t.Fatalf("approved device = %+v", d)
+	}
+
+	// Only the master decides.
+	phone.WriteJSON(Frame{T: "AUTH", Data: auth})
+	json.Unmarshal(waitFrame(t, phone, "AUTH_SUCCESS").Data, &ad)
+	if ad.DeviceStatus != DeviceActive {
+		t.Fatalf("approved AUTH_SUCCESS = %+v", ad)
+	}
+	tablet := authDevice(t, url, alice, "tablet", protocolVersion)
+	d, _ = json.Marshal(map[string]string{"targetPubKey": "tablet", "signature": "eA=="})
+	phone.WriteJSON(Frame{T: "DEVICE_LINK_ACCEPT", Data: d})
+	if e := errorOf(t, waitFrame(t, phone, "ERROR")); e.Code != ErrNotMasterDevice {
+		t.Fatalf("accept from a non-master = %+v", e)
+	}
+
+	// A rejected device is forgotten and disconnected.
+	decide("DEVICE_LINK_REJECT", "tablet", master.sign(signedMessage("DEVICE_LINK_REJECT", aliceHash, "tablet")))
+	waitFrame(t, m, "DEVICE_LINK_REJECTED")
+	waitFrame(t, tablet, "DEVICE_LINK_REJECTED")
+	tablet.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		if _, _, err := tablet.ReadMessage(); err != nil {
+			break
+		}
+	}
+	if _, err := store.Device(aliceHash, "tablet"); err != ErrNotFound {
+		t.Fatalf("rejected device still stored: %v", err)
+	}
+}
+
+func TestDeviceRevoke(t *testing.T) {
+	_, store, url := newTestServer(t)
+	const alice, bob = "alice@example.com", "bob@example.com"
+	aliceHash := emailHash(alice)
+	master := newTestDeviceKey(t)
+	store.AddFriendship(Friendship{User1Hash: aliceHash, User2Hash: emailHash(bob), SID: "sid-ab", Since: time.Now()})
+
+	m := authDevice(t, url, alice, master.pub, protocolVersion)
+	waitFrame(t, m, "SESSION_LIST")
+	addLinkedDevice(store, alice, "phone")
+	addLinkedDevice(store, alice, "laptop")
+	phone := authDevice(t, url, alice, "phone", protocolVersion)
+	waitFrame(t, phone, "SESSION_LIST")
+	b := authDevice(t, url, bob, "pk-bob", protocolVersion)
+	waitFrame(t, b, "SESSION_LIST")
+
+	revoke := func(target string, wipe bool, sig string) {
+		d, _ := json.Marshal(map[string]any{"targetPubKey": target, "wipe": wipe, "signature": sig})
+		m.WriteJSON(Frame{T: "DEVICE_REVOKE", ID: "r1", Data: d})
+	}
+	// The signature covers the wipe flag.
+	revoke("phone", true, master.sign(signedMessage("DEVICE_REVOKE", aliceHash, "phone", "false")))
+	if e := errorOf(t, waitFrame(t, m, "ERROR")); e.Code != ErrBadSignature {
+		t.Fatalf("mis-signed revoke = %+v", e)
+	}
+
+	// An online device is wiped, disconnected and dropped from the keys
+	// friends encrypt to.
+	revoke("phone", true, master.sign(signedMessage("DEVICE_REVOKE", aliceHash, "phone", "true")))
+	var done struct {
+		PublicKey string
+		Wipe      bool
+	}
+	json.Unmarshal(waitFrame(t, m, "DEVICE_NUCLEAR_SUCCESS").Data, &done)
+	if done.PublicKey != "phone" || !done.Wipe {
+		t.Fatalf("DEVICE_NUCLEAR_SUCCESS = %+v", done)
+	}
+	waitFrame(t, phone, "REMOTE_WIPE")
+	waitFrame(t, phone, "DEVICE_REVOKED")
+	phone.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		if _, _, err := phone.ReadMessage(); err != nil {
+			break
+		}
+	}
+	var keys struct {
+		PeerPubKeys   []string
+		RemovedPubKey string
+	}
+	json.Unmarshal(waitFrame(t, b, "PEER_KEYS").Data, &keys)
+	if keys.RemovedPubKey != "phone" || len(keys.PeerPubKeys) != 1 || keys.PeerPubKeys[0] != master.pub {
+		t.Fatalf("PEER_KEYS = %+v", keys)
+	}
+	if _, err := store.Device(aliceHash, "phone"); err != ErrNotFound {
+		t.Fatalf("revoked device still stored: %v", err)
+	}
+
+	// An offline device gets the wipe when it next connects, instead of
+	// registering again.
+	revoke("laptop", true, master.sign(signedMessage("DEVICE_REVOKE", aliceHash, "laptop", "true")))
+	waitFrame(t, m, "DEVICE_NUCLEAR_SUCCESS")
+	laptop := dialTest(t, url)
+	auth, _ := json.Marshal(map[string]string{"token": getTestSessionToken(alice), "publicKey": "laptop"})
+	laptop.WriteJSON(Frame{T: "AUTH", Data: auth})
+	waitFrame(t, laptop, "REMOTE_WIPE")
+	if _, err := store.Device(aliceHash, "laptop"); err != ErrNotFound {
+		t.Fatalf("wiped device registered again: %v", err)
+	}
+
+	revoke(master.pub, false, master.sign(signedMessage("DEVICE_REVOKE", aliceHash, master.pub, "false")))
+	if e := errorOf(t, waitFrame(t, m, "ERROR")); e.Code != ErrInvalidFrame {
+		t.Fatalf("master revoking itself = %+v", e)
+	}
+}
+
+func TestRevokePendingDevice(t *testing.T) {
+	s, _, url := newTestServer(t)
+	const alice = "alice@example.com"
+	aliceHash := emailHash(alice)
+	master, phone := newTestDeviceKey(t), newTestDeviceKey(t)
+
+	m := authDevice(t, url, alice, master.pub, protocolVersion)
+	authDevice(t, url, alice, phone.pub, protocolVersion)
+	waitFrame(t, m, "DEVICE_LIST")
+	d, _ := json.Marshal(map[string]any{
+		"targetPubKey": phone.pub,
+		"signature":    master.sign(signedMessage("DEVICE_REVOKE", aliceHash, phone.pub, "false")),
+	})
+	m.WriteJSON(Frame{T: "DEVICE_REVOKE", ID: "r1", Data: d})
+	waitFrame(t, m, "DEVICE_NUCLEAR_SUCCESS")
+
+	// The pending key was never logged as added, so its revocation is not
+	// logged as a removal and the log still passes an audit.
+	var buf bytes.Buffer
+	if err := exportKeyLog(s.keyLog, &buf); err != nil {
+		t.Fatal(err)
+	}
+	var saved savedKeyLog
+	if err := json.Unmarshal(buf.Bytes(), &saved); err != nil {
+		t.Fatal(err)
+	}
+	if err := auditKeyLog(&saved, nil); err != nil {
+		t.Fatalf("audit after revoking a pending device: %v", err)
+	}
+}
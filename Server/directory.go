@@ -0,0 +1,163 @@
+package main
+
+import "encoding/json"
+
+// KEY_DIRECTORY lists every approved device key of a user, so a sender can
+// encrypt to devices that are offline instead of only the one key
+// GET_PUBLIC_KEY returns. Each entry carries the signatures that tie its key
+// to the current master: the DEVICE_LINK_ACCEPT by the master that approved
+// it, then each TRANSFER_MASTER from that master on to the current one and
+// each UPDATE_PUBKEY by which the device or a master rotated its key. The
+// master's own chain is empty. A chain that does not end at the master
+// (a device approved before chains were kept, or a master that came back
+// through MASTER_CLAIM) is served as far as it goes, for the client to
+// judge.
+
+func init() {
+	RegisterFrame("KEY_DIRECTORY", (*Server).handleKeyDirectory, requireAuth, rateLimit(defaultFramesPerSecond))
+}
+
+type chainLink struct {
+	Kind          string `json:"kind"`
+	SignerPubKey  string `json:"signerPubKey"`
+	SubjectPubKey string `json:"subjectPubKey"`
+	Signature     string `json:"signature"`
+	SignedAt      int64  `json:"signedAt"`
+}
+
+func (s *Server) handleKeyDirectory(client *Client, frame Frame) {
+	var d struct {
+		TargetEmail string `json:"targetEmail"`
+		TreeSize    int64  `json:"treeSize"`
+	}
+	if err := json.Unmarshal(frame.Data, &d); err != nil || d.TargetEmail == "" {
+		s.sendError(client, frame, ErrInvalidFrame, "Invalid KEY_DIRECTORY")
+		return
+	}
+	targetEmail := normalizeEmail(d.TargetEmail)
+	targetHash := emailHash(targetEmail)
+	eh := emailHash(client.email)
+	if targetHash != eh && !s.areFriends(eh, targetHash) && !s.hasPendingRequest(eh, targetHash) {
+		s.sendError(client, frame, ErrNotFriends, "Not a friend or pending request")
+		return
+	}
+	devices, err := s.store.ListDevices(targetHash)
+	if err != nil {
+		s.sendError(client, frame, ErrInternal, "Failed to load devices")
+		return
+	}
+	sigs, err := s.store.DeviceSignatures(targetHash)
+	if err != nil {
+		s.sendError(client, frame, ErrInternal, "Failed to load device signatures")
+		return
+	}
+	rotations, err := s.store.KeyRotations(targetHash)
+	if err != nil {
+		s.sendError(client, frame, ErrInternal, "Failed to load key history")
+		return
+	}
+	previous := make(map[string][]map[string]any)
+	for _, r := range rotations {
+		previous[r.DeviceID] = append(previous[r.DeviceID], map[string]any{"publicKey": r.OldKey, "rotatedAt": r.RotatedAt.Unix()})
+	}
+	master := ""
+	for _, dev := range devices {
+		if dev.IsMaster {
+			master = dev.PublicKey
+		}
+	}
+	entries := make([]map[string]any, 0, len(devices))
+	keys := make([]string, 0, len(devices))
+	for _, dev := range devices {
+		if dev.Status != DeviceActive || dev.PublicKey == "" {
+			continue
+		}
+		entries = append(entries, map[string]any{
+			"deviceId":       dev.DeviceID,
+			"publicKey":      dev.PublicKey,
+			"createdAt":      dev.CreatedAt.Unix(),
+			"lastActive":     dev.LastActive.Unix(),
+			"isMaster":       dev.IsMaster,
+			"crossSignature": dev.CrossSignature,
+			"crossSignedBy":  dev.CrossSignedBy,
+			"signatureChain": signatureChain(sigs, dev.PublicKey, master),
+			"previousKeys":   previous[dev.DeviceID],
+		})
+		keys = append(keys, dev.PublicKey)
+	}
+	resp := map[string]any{"targetEmail": targetEmail, "devices": entries}
+	if len(keys) > 0 {
+		resp["keyProof"] = s.keyProof(targetHash, keys, d.TreeSize)
+	}
+	data, _ := json.Marshal(resp)
+	s.reply(client, frame, Frame{T: "KEY_DIRECTORY", Data: data})
+}
+
+// signatureChain walks sigs, oldest first, from the newest approval of
+// publicKey, or of the key it was rotated from, through the master transfers
+// and key rotations made after it, stopping at publicKey and master.
+func signatureChain(sigs []DeviceSignature, publicKey, master string) []chainLink {
+	chain := []chainLink{}
+	if publicKey == master {
+		return chain
+	}
+	// The keys this device has had, newest first.
+	lineage := map[string]bool{publicKey: true}
+	for i := len(sigs) - 1; i >= 0; i-- {
+		if sigs[i].Kind == "UPDATE_PUBKEY" && lineage[sigs[i].Subject] {
+			lineage[sigs[i].Signer] = true
+		}
+	}
+	start := -1
+	for i, sig := range sigs {
+		if sig.Kind == "DEVICE_LINK_ACCEPT" && lineage[sig.Subject] {
+			start = i
+		}
+	}
+	if start < 0 {
+		return chain
+	}
+	// The device's key and whoever holds the master role that vouched for
+	// it, so far.
+	device, signer := sigs[start].Subject, sigs[start].Signer
+	for i, sig := range sigs[start:] {
+		switch {
+		case i == 0:
+		case sig.Kind == "UPDATE_PUBKEY" && sig.Signer == device:
+			device = sig.Subject
+		case sig.Kind == "UPDATE_PUBKEY" && sig.Signer == signer,
+			sig.Kind == "TRANSFER_MASTER" && sig.Signer == signer:
+			signer = sig.Subject
+		default:
+			continue
+		}
+		chain = append(chain, chainLink{
+			Kind:          sig.Kind,
+			SignerPubKey:  sig.Signer,
+			SubjectPubKey: sig.Subject,
+			Signature:     sig.Signature,
+			SignedAt:      sig.CreatedAt.Unix(),
+		})
+		if device == publicKey && signer == master {
+			break
+		}
+	}
+	return chain
+}
+
+// hasPendingRequest reports whether a or b has a friend request waiting for
+// the other.
+func (s *Server) hasPendingRequest(a, b string) bool {
+	for _, pair := range [][2]string{{a, b}, {b, a}} {
+		requests, err := s.store.PendingRequests(pair[1])
+		if err != nil {
+			continue
+		}
+		for _, r := range requests {
+			if r.SenderHash == pair[0] {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestKeyDirectory(t *testing.T) {
+	s, store, url := newTestServer(t)
+	const alice, bob = "alice@example.com", "bob@example.com"
+	aliceHash, bobHash := emailHash(alice), emailHash(bob)
+	laptop, tablet, phone := newTestDeviceKey(t), newTestDeviceKey(t), newTestDeviceKey(t)
+
+	// The laptop approves the tablet and the phone, then hands the master
+	// role to the phone.
+	m := authDevice(t, url, alice, laptop.pub, protocolVersion)
+	for _, k := range []testDeviceKey{tablet, phone} {
+		authDevice(t, url, alice, k.pub, protocolVersion)
+		d, _ := json.Marshal(map[string]string{
+			"targetPubKey":   k.pub,
+			"signature":      laptop.sign(signedMessage("DEVICE_LINK_ACCEPT", aliceHash, k.pub)),
+			"crossSignature": laptop.sign(crossSignMessage(aliceHash, k.pub)),
+		})
+		m.WriteJSON(Frame{T: "DEVICE_LINK_ACCEPT", ID: "a", Data: d})
+		waitFrame(t, m, "DEVICE_LINK_ACCEPTED")
+	}
+	d, _ := json.Marshal(map[string]string{"targetPubKey": phone.pub, "signature": laptop.sign(signedMessage("TRANSFER_MASTER", aliceHash, phone.pub))})
+	m.WriteJSON(Frame{T: "TRANSFER_MASTER", ID: "t", Data: d})
+	waitFrame(t, m, "MASTER_TRANSFERRED")
+
+	b := authDevice(t, url, bob, "pk-bob", protocolVersion)
+	lookup := func() {
+		d, _ := json.Marshal(map[string]string{"targetEmail": alice})
+		b.WriteJSON(Frame{T: "KEY_DIRECTORY", ID: "k", Data: d})
+	}
+	lookup()
+	if e := errorOf(t, waitFrame(t, b, "ERROR")); e.Code != ErrNotFriends {
+		t.Fatalf("stranger lookup = %+v", e)
+	}
+
+	store.PutRequest(FriendRequest{SenderHash: aliceHash, TargetHash: bobHash, Timestamp: time.Now()})
+	lookup()
+	var dir struct {
+		Devices []struct {
+			DeviceID       string
+			PublicKey      string
+			CreatedAt      int64
+			IsMaster       bool
+			SignatureChain []chainLink
+		}
+		KeyProof keyProof
+	}
+	json.Unmarshal(waitFrame(t, b, "KEY_DIRECTORY").Data, &dir)
+	if len(dir.Devices) != 3 {
+		t.Fatalf("directory = %+v", dir.Devices)
+	}
+	chains := make(map[string][]chainLink)
+	for _, dev := range dir.Devices {
+		if dev.DeviceID == "" || dev.CreatedAt == 0 || dev.IsMaster != (dev.PublicKey == phone.pub) {
+			t.Fatalf("entry = %+v", dev)
+		}
+		for _, link := range dev.SignatureChain {
+			if verifyDeviceSignature(link.SignerPubKey, signedMessage(link.Kind, aliceHash, link.SubjectPubKey), link.Signature) != nil {
+				t.Fatalf("bad link in chain of %s: %+v", dev.PublicKey, link)
+			}
+		}
+		chains[dev.PublicKey] = dev.SignatureChain
+	}
+	checkKeyProof(t, dir.KeyProof, s.keyLog.publicKey(), aliceHash, laptop.pub, tablet.pub, phone.pub)
+
+	// The tablet's chain runs from its approval through the transfer to the
+	// current master; the master needs none, and the laptop was never
+	// approved by anyone.
+	chain := chains[tablet.pub]
+	if len(chain) != 2 || chain[0].Kind != "DEVICE_LINK_ACCEPT" || chain[0].SubjectPubKey != tablet.pub ||
+		chain[1].Kind != "TRANSFER_MASTER" || chain[1].SubjectPubKey != phone.pub {
+		t.Fatalf("tablet chain = %+v", chain)
+	}
+	if len(chains[phone.pub]) != 0 || len(chains[laptop.pub]) != 0 {
+		t.Fatalf("chains = %+v", chains)
+	}
+}
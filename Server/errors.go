@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// ErrorCode is the stable, machine-readable reason in an ERROR frame. The
+// message next to it is for people and may change; clients should branch on
+// the code.
+type ErrorCode string
+
+const (
+	ErrAuthRequired        ErrorCode = "AUTH_REQUIRED"
+	ErrAuthFailed          ErrorCode = "AUTH_FAILED"
+	ErrAlreadyAuthed       ErrorCode = "ALREADY_AUTHENTICATED"
+	ErrUnsupportedProtocol ErrorCode = "UNSUPPORTED_PROTOCOL_VERSION"
+	ErrRateLimited         ErrorCode = "RATE_LIMITED"
+	ErrPayloadTooLarge     ErrorCode = "PAYLOAD_TOO_LARGE"
+	ErrInvalidFrame        ErrorCode = "INVALID_FRAME"
+	ErrInvalidSID          ErrorCode = "INVALID_SID"
+	ErrUnknownFrame        ErrorCode = "UNKNOWN_FRAME"
+	ErrNotFriends          ErrorCode = "NOT_FRIENDS"
+	ErrNotSessionMember    ErrorCode = "NOT_SESSION_MEMBER"
+	ErrSessionNotFound     ErrorCode = "SESSION_NOT_FOUND"
+	ErrMailboxFull         ErrorCode = "MAILBOX_FULL"
+	ErrGroupNotFound       ErrorCode = "GROUP_NOT_FOUND"
+	ErrNotGroupAdmin       ErrorCode = "NOT_GROUP_ADMIN"
+	ErrGroupFull           ErrorCode = "GROUP_FULL"
+	ErrStaleEpoch          ErrorCode = "STALE_EPOCH"
+	ErrDevicePending       ErrorCode = "DEVICE_PENDING"
+	ErrNotMasterDevice     ErrorCode = "NOT_MASTER_DEVICE"
+	ErrBadSignature        ErrorCode = "BAD_SIGNATURE"
+	ErrMasterOnline        ErrorCode = "MASTER_ONLINE"
+	ErrInternal            ErrorCode = "INTERNAL"
+)
+
+// Retry hints.
+const (
+	retryNever     = "never"      // the same request will fail again
+	retryBackoff   = "backoff"    // try again later, after retryAfterMs if set
+	retryAfterAuth = "after_auth" // authenticate, then try again
+)
+
+func (code ErrorCode) retry() string {
+	switch code {
+	case ErrRateLimited, ErrMailboxFull, ErrInternal:
+		return retryBackoff
+	case ErrAuthRequired:
+		return retryAfterAuth
+	default:
+		return retryNever
+	}
+}
+
+// errorBody is the data of an ERROR frame.
+type errorBody struct {
+	Code         ErrorCode `json:"code"`
+	Message      string    `json:"message"`
+	Retry        string    `json:"retry"`
+	RetryAfterMs int64     `json:"retryAfterMs,omitempty"`
+}
+
+// sendError answers req with an ERROR frame.
+func (s *Server) sendError(c *Client, req Frame, code ErrorCode, message string) error {
+	return s.sendRetryError(c, req, code, message, 0)
+}
+
+// sendRetryError is sendError with a hint of how long to wait before
+// retrying.
+func (s *Server) sendRetryError(c *Client, req Frame, code ErrorCode, message string, after time.Duration) error {
+	data, _ := json.Marshal(errorBody{
+		Code:         code,
+		Message:      message,
+		Retry:        code.retry(),
+		RetryAfterMs: after.Milliseconds(),
+	})
+	return s.reply(c, req, Frame{T: "ERROR", Data: data})
+}
+
+// reply sends f to c as the response to req, echoing req's ID so the client
+// can match it to the request.
+func (s *Server) reply(c *Client, req Frame, f Frame) error {
+	f.ID = req.ID
+	return s.send(c, f)
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func errorOf(t *testing.T, f Frame) errorBody {
+	t.Helper()
+	if f.T != "ERROR" {
+		t.Fatalf("got %s, want ERROR", f.T)
+	}
+	var e errorBody
+	if err := json.Unmarshal(f.Data, &e); err != nil {
+		t.Fatal(err)
+	}
+	return e
+}
+
+func TestResponsesEchoRequestID(t *testing.T) {
+	ts := setupTestServer()
+	defer ts.Close()
+	url := "ws" + strings.TrimPrefix(ts.URL, "http")
+
+	conn := dialTest(t, url)
+	conn.WriteJSON(Frame{T: "GET_DEVICES", ID: "r1"})
+	f := waitFrame(t, conn, "ERROR")
+	if e := errorOf(t, f); f.ID != "r1" || e.Code != ErrAuthRequired || e.Retry != retryAfterAuth || e.Message != "Auth required" {
+		t.Fatalf("unauthenticated GET_DEVICES = %+v %+v", f, e)
+	}
+
+	auth, _ := json.Marshal(map[string]string{"token": getTestSessionToken("ids@example.com"), "publicKey": "pk"})
+	conn.WriteJSON(Frame{T: "AUTH", ID: "r2", Data: auth})
+	if f := waitFrame(t, conn, "AUTH_SUCCESS"); f.ID != "r2" {
+		t.Fatalf("AUTH_SUCCESS id = %q", f.ID)
+	}
+
+	conn.WriteJSON(Frame{T: "GET_TURN_CREDS", ID: "r3"})
+	if f := waitFrame(t, conn, "TURN_CREDS"); f.ID != "r3" {
+		t.Fatalf("TURN_CREDS id = %q", f.ID)
+	}
+
+	conn.WriteJSON(Frame{T: "MSG", ID: "r4", Data: json.RawMessage(`{"payloads":{"pk":"x"}}`)})
+	f = waitFrame(t, conn, "ERROR")
+	if e := errorOf(t, f); f.ID != "r4" || e.Code != ErrInvalidSID || e.Retry != retryNever {
+		t.Fatalf("MSG without sid = %+v %+v", f, e)
+	}
+
+	conn.WriteJSON(Frame{T: "MSG", ID: "r5", SID: "not-a-friend", Data: json.RawMessage(`{"payloads":{"pk":"x"}}`)})
+	if e := errorOf(t, waitFrame(t, conn, "ERROR")); e.Code != ErrNotFriends {
+		t.Fatalf("MSG to a stranger = %+v", e)
+	}
+
+	// Unknown frames are still ignored unless the client waits for an answer.
+	conn.WriteJSON(Frame{T: "NO_SUCH_FRAME"})
+	conn.WriteJSON(Frame{T: "NO_SUCH_FRAME", ID: "r6"})
+	f = waitFrame(t, conn, "ERROR")
+	if e := errorOf(t, f); f.ID != "r6" || e.Code != ErrUnknownFrame {
+		t.Fatalf("unknown frame = %+v %+v", f, e)
+	}
+}
+
+func TestRateLimitErrorHasRetryHint(t *testing.T) {
+	ts := setupTestServer()
+	defer ts.Close()
+	conn, err := connectClient("ws"+strings.TrimPrefix(ts.URL, "http"), "limited@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	for i := 0; i <= defaultFramesPerSecond; i++ {
+		conn.WriteJSON(Frame{T: "GET_TURN_CREDS"})
+	}
+	e := errorOf(t, waitFrame(t, conn, "ERROR"))
+	if e.Code != ErrRateLimited || e.Retry != retryBackoff || e.RetryAfterMs != time.Second.Milliseconds() {
+		t.Fatalf("rate limit error = %+v", e)
+	}
+}
+
+func TestRelayedFramesDropSenderID(t *testing.T) {
+	store := newMemoryStore()
+	alice, bob := "alice@example.com", "bob@example.com"
+	store.AddFriendship(Friendship{User1Hash: emailHash(alice), User2Hash: emailHash(bob), SID: "sid-ab", Since: time.Now()})
+	_, url := startClusterNode(t, "solo", store, newLocalBus())
+
+	a, _, err := authedTestDevice(url, alice, "pk-alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	b, _, err := authedTestDevice(url, bob, "pk-bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	a.WriteJSON(Frame{T: "RTC_OFFER", ID: "alice-1", SID: "sid-ab", TargetPubKey: "pk-bob", Data: json.RawMessage(`{}`)})
+	if f := waitFrame(t, b, "RTC_OFFER"); f.ID != "" {
+		t.Fatalf("relayed RTC_OFFER carries the sender's id %q", f.ID)
+	}
+}
@@ -7,3 +7,14 @@ require github.com/gorilla/websocket v1.5.3
 require github.com/joho/godotenv v1.5.1
 
 require github.com/mattn/go-sqlite3 v1.14.34
+
+require github.com/lib/pq v1.10.9
+
+require github.com/vmihailenco/msgpack/v5 v5.4.1
+
+require github.com/fxamacker/cbor/v2 v2.9.4
+
+require (
+	github.com/vmihailenco/tagparser/v2 v2.0.0 // indirect
+	github.com/x448/float16 v0.8.4 // indirect
+)
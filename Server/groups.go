@@ -0,0 +1,355 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"slices"
+	"time"
+)
+
+// Groups are sessions with server-managed membership. A group's id is its
+// sid, so MSG, READ_RECEIPT and REATTACH work on groups as they do between
+// friends, and MSG payloads fan out to every member device by key. Admins
+// invite, kick and set roles; anyone may leave. Only friends of the inviter
+// can be added.
+//
+// Every membership change bumps the group's epoch and reaches all members,
+// including the one who joined or left, as a GROUP_UPDATE notification. That
+// is the cue for clients to rotate the group key.
+
+// maxGroupMembers bounds the size of a group.
+const maxGroupMembers = 256
+
+// Group changes in GROUP_UPDATE.
+const (
+	groupCreated = "created"
+	groupJoined  = "joined"
+	groupLeft    = "left"
+	groupKicked  = "kicked"
+	groupRole    = "role"
+)
+
+func init() {
+	for t, h := range map[string]FrameHandler{
+		"CREATE_GROUP":   (*Server).handleCreateGroup,
+		"GROUP_INVITE":   (*Server).handleGroupInvite,
+		"GROUP_LEAVE":    (*Server).handleGroupLeave,
+		"GROUP_KICK":     (*Server).handleGroupKick,
+		"GROUP_SET_ROLE": (*Server).handleGroupSetRole,
+	} {
+		RegisterFrame(t, h, requireAuth, requireApprovedDevice, rateLimit(defaultFramesPerSecond))
+	}
+}
+
+// groupRequest is the data of the group frames; each uses the fields it
+// needs.
+type groupRequest struct {
+	GroupID string   `json:"groupId"`
+	Member  string   `json:"member"`
+	Members []string `json:"members"`
+	Role    string   `json:"role"`
+}
+
+func newGroupID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return "g_" + hex.EncodeToString(b)
+}
+
+// areFriends reports whether a and b have accepted each other.
+func (s *Server) areFriends(a, b string) bool {
+	friendships, err := s.store.Friendships(a)
+	if err != nil {
+		return false
+	}
+	return slices.ContainsFunc(friendships, func(f Friendship) bool { return f.Peer(a) == b })
+}
+
+// sessionUsers returns the email hashes that belong to sid as seen by
+// member: the group's members, or member and the friend sid belongs to.
+func (s *Server) sessionUsers(sid, member string) []string {
+	if members, err := s.store.GroupMembers(sid); err == nil && len(members) > 0 {
+		users := make([]string, len(members))
+		for i, m := range members {
+			users[i] = m.EmailHash
+		}
+		return users
+	}
+	users := []string{member}
+	if friendships, err := s.store.Friendships(member); err == nil {
+		for _, f := range friendships {
+			if f.SID == sid {
+				users = append(users, f.Peer(member))
+			}
+		}
+	}
+	return users
+}
+
+// groupMember loads groupID and the caller's membership. Non-members are
+// told the group does not exist.
+func (s *Server) groupMember(client *Client, frame Frame) (groupRequest, GroupMember, []GroupMember, bool) {
+	var d groupRequest
+	if err := json.Unmarshal(frame.Data, &d); err != nil || d.GroupID == "" {
+		s.sendError(client, frame, ErrInvalidFrame, "Invalid group request")
+		return d, GroupMember{}, nil, false
+	}
+	members, err := s.store.GroupMembers(d.GroupID)
+	if err != nil {
+		log.Printf("[Error] Failed to load group %s: %v", d.GroupID, err)
+		s.sendError(client, frame, ErrInternal, "Failed to load group")
+		return d, GroupMember{}, nil, false
+	}
+	eh := emailHash(client.email)
+	i := slices.IndexFunc(members, func(m GroupMember) bool { return m.EmailHash == eh })
+	if i < 0 {
+		s.sendError(client, frame, ErrGroupNotFound, "No such group")
+		return d, GroupMember{}, nil, false
+	}
+	return d, members[i], members, true
+}
+
+// groupAdmin is groupMember for frames only admins may send.
+func (s *Server) groupAdmin(client *Client, frame Frame) (groupRequest, []GroupMember, bool) {
+	d, me, members, ok := s.groupMember(client, frame)
+	if ok && me.Role != RoleAdmin {
+		s.sendError(client, frame, ErrNotGroupAdmin, "Only group admins can do that")
+		return d, nil, false
+	}
+	return d, members, ok
+}
+
+func (s *Server) handleCreateGroup(client *Client, frame Frame) {
+	var d groupRequest
+	if err := json.Unmarshal(frame.Data, &d); err != nil {
+		s.sendError(client, frame, ErrInvalidFrame, "Invalid group request")
+		return
+	}
+	eh := emailHash(client.email)
+	now := time.Now()
+	members := []GroupMember{{EmailHash: eh, Role: RoleAdmin, JoinedAt: now}}
+	for _, m := range d.Members {
+		if m == eh || slices.ContainsFunc(members, func(gm GroupMember) bool { return gm.EmailHash == m }) {
+			continue
+		}
+		if !s.areFriends(eh, m) {
+			s.sendError(client, frame, ErrNotFriends, "Only friends can be added to a group")
+			return
+		}
+		members = append(members, GroupMember{EmailHash: m, Role: RoleMember, JoinedAt: now})
+	}
+	if len(members) > maxGroupMembers {
+		s.sendError(client, frame, ErrGroupFull, "Too many group members")
+		return
+	}
+
+	g := Group{ID: newGroupID(), CreatedBy: eh, CreatedAt: now}
+	if err := s.store.CreateGroup(g, members); err != nil {
+		log.Printf("[Error] Failed to create group: %v", err)
+		s.sendError(client, frame, ErrInternal, "Failed to create group")
+		return
+	}
+	s.sessions.join(g.ID, client, true)
+
+	data, _ := json.Marshal(map[string]any{"groupId": g.ID, "epoch": 1})
+	s.reply(client, frame, Frame{T: "GROUP_CREATED", SID: g.ID, Data: data})
+	s.announceGroup(g.ID, 1, groupCreated, eh, eh)
+	log.Printf("[Server] Group %s created with %d members", g.ID, len(members))
+}
+
+func (s *Server) handleGroupInvite(client *Client, frame Frame) {
+	d, members, ok := s.groupAdmin(client, frame)
+	if !ok {
+		return
+	}
+	eh := emailHash(client.email)
+	if slices.ContainsFunc(members, func(m GroupMember) bool { return m.EmailHash == d.Member }) {
+		s.sendError(client, frame, ErrInvalidFrame, "Already a member")
+		return
+	}
+	if !s.areFriends(eh, d.Member) {
+		s.sendError(client, frame, ErrNotFriends, "Only friends can be added to a group")
+		return
+	}
+	if len(members) >= maxGroupMembers {
+		s.sendError(client, frame, ErrGroupFull, "The group is full")
+		return
+	}
+	epoch, err := s.store.AddGroupMember(GroupMember{GroupID: d.GroupID, EmailHash: d.Member, Role: RoleMember, JoinedAt: time.Now()})
+	if err != nil {
+		log.Printf("[Error] Failed to add group member: %v", err)
+		s.sendError(client, frame, ErrInternal, "Failed to add group member")
+		return
+	}
+	s.announceGroup(d.GroupID, epoch, groupJoined, d.Member, eh)
+}
+
+func (s *Server) handleGroupLeave(client *Client, frame Frame) {
+	d, _, _, ok := s.groupMember(client, frame)
+	if !ok {
+		return
+	}
+	eh := emailHash(client.email)
+	if err := s.removeFromGroup(d.GroupID, eh, eh, groupLeft); err != nil {
+		s.sendError(client, frame, ErrInternal, "Failed to leave group")
+	}
+}
+
+func (s *Server) handleGroupKick(client *Client, frame Frame) {
+	d, members, ok := s.groupAdmin(client, frame)
+	if !ok {
+		return
+	}
+	eh := emailHash(client.email)
+	if d.Member == eh {
+		s.sendError(client, frame, ErrInvalidFrame, "Use GROUP_LEAVE to leave a group")
+		return
+	}
+	if !slices.ContainsFunc(members, func(m GroupMember) bool { return m.EmailHash == d.Member }) {
+		s.sendError(client, frame, ErrInvalidFrame, "Not a member")
+		return
+	}
+	if err := s.removeFromGroup(d.GroupID, d.Member, eh, groupKicked); err != nil {
+		s.sendError(client, frame, ErrInternal, "Failed to remove group member")
+	}
+}
+
+func (s *Server) handleGroupSetRole(client *Client, frame Frame) {
+	d, members, ok := s.groupAdmin(client, frame)
+	if !ok {
+		return
+	}
+	if d.Role != RoleAdmin && d.Role != RoleMember {
+		s.sendError(client, frame, ErrInvalidFrame, "Role must be admin or member")
+		return
+	}
+	i := slices.IndexFunc(members, func(m GroupMember) bool { return m.EmailHash == d.Member })
+	if i < 0 {
+		s.sendError(client, frame, ErrInvalidFrame, "Not a member")
+		return
+	}
+	admins := 0
+	for _, m := range members {
+		if m.Role == RoleAdmin {
+			admins++
+		}
+	}
+	if d.Role == RoleMember && members[i].Role == RoleAdmin && admins == 1 {
+		s.sendError(client, frame, ErrInvalidFrame, "A group needs an admin")
+		return
+	}
+	if err := s.store.SetGroupRole(d.GroupID, d.Member, d.Role); err != nil {
+		log.Printf("[Error] Failed to set group role: %v", err)
+		s.sendError(client, frame, ErrInternal, "Failed to set role")
+		return
+	}
+	g, err := s.store.Group(d.GroupID)
+	if err != nil {
+		return
+	}
+	s.announceGroup(d.GroupID, g.Epoch, groupRole, d.Member, emailHash(client.email))
+}
+
+// removeFromGroup takes member out of groupID, detaches its sockets from the
+// group session and tells everyone. The longest-standing member becomes
+// admin when the last admin leaves; the last member to leave deletes the
+// group.
+func (s *Server) removeFromGroup(groupID, member, by, change string) error {
+	epoch, err := s.store.RemoveGroupMember(groupID, member)
+	if errors.Is(err, ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		log.Printf("[Error] Failed to remove %s from group %s: %v", member, groupID, err)
+		return err
+	}
+	for _, c := range s.presence.Clients(member) {
+		s.sessions.leave(groupID, c)
+	}
+	s.cluster.leaveSession(groupID, member)
+
+	rest, err := s.store.GroupMembers(groupID)
+	if err == nil && len(rest) == 0 {
+		s.store.DeleteGroup(groupID)
+	} else if err == nil && !slices.ContainsFunc(rest, func(m GroupMember) bool { return m.Role == RoleAdmin }) {
+		s.store.SetGroupRole(groupID, rest[0].EmailHash, RoleAdmin)
+	}
+	s.announceGroup(groupID, epoch, change, member, by, member)
+	return nil
+}
+
+// announceGroup sends GROUP_UPDATE, with the current member list, to every
+// member of groupID and to also.
+func (s *Server) announceGroup(groupID string, epoch int64, change, member, by string, also ...string) {
+	members, err := s.store.GroupMembers(groupID)
+	if err != nil {
+		log.Printf("[Error] Failed to load group %s: %v", groupID, err)
+		return
+	}
+	list := make([]map[string]string, len(members))
+	targets := slices.Clone(also)
+	for i, m := range members {
+		list[i] = map[string]string{"hash": m.EmailHash, "role": m.Role}
+		targets = append(targets, m.EmailHash)
+	}
+	data, _ := json.Marshal(map[string]any{
+		"groupId": groupID,
+		"epoch":   epoch,
+		"change":  change,
+		"member":  member,
+		"by":      by,
+		"members": list,
+	})
+	update := Frame{T: "GROUP_UPDATE", SID: groupID, Data: data}
+	for _, eh := range targets {
+		s.notifyUser(eh, update)
+	}
+}
+
+// groupSessions attaches c to the sessions of its user's groups, tells the
+// other members it is online, and returns the SESSION_LIST entries.
+func (s *Server) groupSessions(c *Client, eh string, ownPubKeys []string, ownProof *keyProof, treeSize int64) []map[string]any {
+	groups, err := s.store.UserGroups(eh)
+	if err != nil {
+		log.Printf("Error querying groups for %s: %v", eh, err)
+		return nil
+	}
+	entries := make([]map[string]any, 0, len(groups))
+	for _, g := range groups {
+		members, err := s.store.GroupMembers(g.ID)
+		if err != nil {
+			continue
+		}
+		list := make([]map[string]any, 0, len(members))
+		role := RoleMember
+		for _, m := range members {
+			if m.EmailHash == eh {
+				role = m.Role
+				continue
+			}
+			keys := s.onlineKeys(m.EmailHash)
+			list = append(list, map[string]any{
+				"hash":     m.EmailHash,
+				"role":     m.Role,
+				"pubKeys":  keys,
+				"keyProof": s.keyProof(m.EmailHash, keys, treeSize),
+			})
+		}
+		entries = append(entries, map[string]any{
+			"sid":        g.ID,
+			"group":      true,
+			"epoch":      g.Epoch,
+			"role":       role,
+			"members":    list,
+			"ownPubKeys": ownPubKeys,
+		})
+
+		s.sessions.join(g.ID, c, true)
+		onlineData, _ := json.Marshal(map[string]any{"peerPubKeys": ownPubKeys, "keyProof": ownProof})
+		s.sendToSession(g.ID, c, Frame{T: "PEER_ONLINE", SID: g.ID, Data: onlineData})
+	}
+	return entries
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+type groupUpdate struct {
+	GroupID string              `json:"groupId"`
+	Epoch   int64               `json:"epoch"`
+	Change  string              `json:"change"`
+	Member  string              `json:"member"`
+	By      string              `json:"by"`
+	Members []map[string]string `json:"members"`
+}
+
+// roles maps each member of u to its role.
+func (u groupUpdate) roles() map[string]string {
+	out := make(map[string]string, len(u.Members))
+	for _, m := range u.Members {
+		out[m["hash"]] = m["role"]
+	}
+	return out
+}
+
+// waitGroupUpdate skips frames until a GROUP_UPDATE for change arrives.
+func waitGroupUpdate(t *testing.T, conn *websocket.Conn, change string) groupUpdate {
+	t.Helper()
+	for {
+		var u groupUpdate
+		json.Unmarshal(waitFrame(t, conn, "GROUP_UPDATE").Data, &u)
+		if u.Change == change {
+			return u
+		}
+	}
+}
+
+func TestGroupLifecycle(t *testing.T) {
+	_, store, url := newTestServer(t)
+	const alice, bob, carol = "alice@example.com", "bob@example.com", "carol@example.com"
+	aliceHash, bobHash, carolHash := emailHash(alice), emailHash(bob), emailHash(carol)
+	store.AddFriendship(Friendship{User1Hash: aliceHash, User2Hash: bobHash, SID: "sid-ab", Since: time.Now()})
+	store.AddFriendship(Friendship{User1Hash: aliceHash, User2Hash: carolHash, SID: "sid-ac", Since: time.Now()})
+
+	a := authDevice(t, url, alice, "pk-alice", protocolVersion)
+	b := authDevice(t, url, bob, "pk-bob", protocolVersion)
+
+	// Only friends can be added.
+	create, _ := json.Marshal(map[string]any{"members": []string{bobHash, emailHash("dave@example.com")}})
+	a.WriteJSON(Frame{T: "CREATE_GROUP", ID: "c0", Data: create})
+	if e := errorOf(t, waitFrame(t, a, "ERROR")); e.Code != ErrNotFriends {
+		t.Fatalf("CREATE_GROUP with a stranger = %+v", e)
+	}
+
+	create, _ = json.Marshal(map[string]any{"members": []string{bobHash}})
+	a.WriteJSON(Frame{T: "CREATE_GROUP", ID: "c1", Data: create})
+	created := waitFrame(t, a, "GROUP_CREATED")
+	gid := created.SID
+	if created.ID != "c1" || !strings.HasPrefix(gid, "g_") {
+		t.Fatalf("GROUP_CREATED = %+v", created)
+	}
+	u := waitGroupUpdate(t, b, groupCreated)
+	want := map[string]string{aliceHash: RoleAdmin, bobHash: RoleMember}
+	if u.GroupID != gid || u.Epoch != 1 || u.By != aliceHash || !reflect.DeepEqual(u.roles(), want) {
+		t.Fatalf("GROUP_UPDATE = %+v", u)
+	}
+	b.WriteJSON(Frame{T: "REATTACH", SID: gid})
+	waitFrame(t, b, "PEER_ONLINE")
+
+	// Carol is offline when invited; she learns on her next AUTH.
+	invite, _ := json.Marshal(map[string]string{"groupId": gid, "member": carolHash})
+	a.WriteJSON(Frame{T: "GROUP_INVITE", Data: invite})
+	if u := waitGroupUpdate(t, b, groupJoined); u.Epoch != 2 || u.Member != carolHash {
+		t.Fatalf("GROUP_UPDATE = %+v", u)
+	}
+	c := authDevice(t, url, carol, "pk-carol", protocolVersion)
+	var list []struct {
+		SID   string `json:"sid"`
+		Group bool   `json:"group"`
+		Epoch int64  `json:"epoch"`
+		Role  string `json:"role"`
+	}
+	// The notification and the session list race each other.
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for got := 0; got < 2; {
+		var f Frame
+		if err := c.ReadJSON(&f); err != nil {
+			t.Fatal(err)
+		}
+		switch f.T {
+		case "SESSION_LIST":
+			json.Unmarshal(f.Data, &list)
+			got++
+		case "GROUP_UPDATE":
+			got++
+		}
+	}
+	c.SetReadDeadline(time.Time{})
+	if len(list) != 2 || list[1].SID != gid || !list[1].Group || list[1].Epoch != 2 || list[1].Role != RoleMember {
+		t.Fatalf("SESSION_LIST = %+v", list)
+	}
+
+	// MSG fans out to every member device.
+	msg := json.RawMessage(`{"payloads":{"pk-bob":"Yg==","pk-carol":"Yw=="}}`)
+	a.WriteJSON(Frame{T: "MSG", SID: gid, C: true, Data: msg})
+	var report struct{ Devices map[string]string }
+	json.Unmarshal(waitFrame(t, a, "DELIVERY_REPORT").Data, &report)
+	if report.Devices["pk-bob"] != deliveryDelivered || report.Devices["pk-carol"] != deliveryDelivered {
+		t.Fatalf("DELIVERY_REPORT = %+v", report)
+	}
+
+	// Members cannot kick; admins can, and the kicked member stops
+	// receiving.
+	kick, _ := json.Marshal(map[string]string{"groupId": gid, "member": carolHash})
+	b.WriteJSON(Frame{T: "GROUP_KICK", ID: "k1", Data: kick})
+	if e := errorOf(t, waitFrame(t, b, "ERROR")); e.Code != ErrNotGroupAdmin {
+		t.Fatalf("GROUP_KICK by a member = %+v", e)
+	}
+	a.WriteJSON(Frame{T: "GROUP_KICK", Data: kick})
+	if u := waitGroupUpdate(t, c, groupKicked); u.Epoch != 3 || u.Member != carolHash {
+		t.Fatalf("GROUP_UPDATE = %+v", u)
+	}
+	a.WriteJSON(Frame{T: "MSG", SID: gid, C: true, Data: msg})
+	json.Unmarshal(waitFrame(t, a, "DELIVERY_REPORT").Data, &report)
+	if report.Devices["pk-bob"] != deliveryDelivered || report.Devices["pk-carol"] != deliveryFailed {
+		t.Fatalf("DELIVERY_REPORT after kick = %+v", report)
+	}
+	c.WriteJSON(Frame{T: "REATTACH", ID: "r1", SID: gid})
+	if e := errorOf(t, waitFrame(t, c, "ERROR")); e.Code != ErrNotFriends {
+		t.Fatalf("REATTACH after kick = %+v", e)
+	}
+
+	// When the last admin leaves, the remaining member takes over.
+	leave, _ := json.Marshal(map[string]string{"groupId": gid})
+	a.WriteJSON(Frame{T: "GROUP_LEAVE", Data: leave})
+	u = waitGroupUpdate(t, b, groupLeft)
+	if u.Epoch != 4 || !reflect.DeepEqual(u.roles(), map[string]string{bobHash: RoleAdmin}) {
+		t.Fatalf("GROUP_UPDATE = %+v", u)
+	}
+
+	// The last member out deletes the group.
+	b.WriteJSON(Frame{T: "GROUP_LEAVE", Data: leave})
+	eventually(t, "the group to be deleted", func() bool {
+		_, err := store.Group(gid)
+		return err == ErrNotFound
+	})
+}
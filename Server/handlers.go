@@ -5,24 +5,73 @@ import (
 	"encoding/hex"
 	"encoding/json"
 	"log"
+	"net"
 	"net/http"
-	"os"
+	"slices"
+	"strconv"
 	"strings"
 	"time"
 )
 
+// Frame types that share the RTC relay logic.
+var rtcFrameTypes = []string{"RTC_OFFER", "RTC_ANSWER", "RTC_ICE"}
+
+const (
+	defaultFramesPerSecond = 20
+	maxAuthDataBytes       = 16 * 1024
+	// Room for the JSON envelope and device keys around the ciphertexts.
+	maxMsgEnvelopeBytes = 64 * 1024
+)
+
+func (s *Server) registerFrames() {
+	r := s.frames
+	r.Use(recoverPanics)
+
+	authed := []Middleware{requireAuth, rateLimit(defaultFramesPerSecond)}
+	// Frames that touch sessions, friends or the account are refused to
+	// devices still waiting for the master's approval.
+	approved := []Middleware{requireAuth, requireApprovedDevice, rateLimit(defaultFramesPerSecond)}
+
+	r.Handle("AUTH", (*Server).handleAuth, requireProtocol, rateLimit(defaultFramesPerSecond), maxPayload(maxAuthDataBytes))
+	r.Handle("GET_DEVICES", (*Server).handleGetDevices, authed...)
+	r.Handle("FRIEND_REQUEST", (*Server).handleFriendRequest, approved...)
+	r.Handle("FRIEND_ACCEPT", (*Server).handleFriendAccept, approved...)
+	r.Handle("FRIEND_DENY", (*Server).handleFriendDeny, approved...)
+	r.Handle("BLOCK_USER", (*Server).handleBlockUser, approved...)
+	r.Handle("UNBLOCK_USER", (*Server).handleUnblockUser, approved...)
+	r.Handle("GET_PENDING_REQUESTS", (*Server).handleGetPendingRequests, approved...)
+	r.Handle("JOIN_ACCEPT", (*Server).handleJoinAccept, approved...)
+	r.Handle("JOIN_DENY", (*Server).handleJoinDeny, approved...)
+	r.Handle("DELETE_ACCOUNT", (*Server).handleDeleteAccount, approved...)
+	r.Handle("REATTACH", (*Server).handleReattach, approved...)
+	r.Handle("MSG", (*Server).handleMsg, requireAuth, requireApprovedDevice, rateLimit(s.cfg.MaxMsgsPerSecond), maxPayload(s.cfg.MaxEncryptedDataBytes+maxMsgEnvelopeBytes))
+	for _, t := range rtcFrameTypes {
+		r.Handle(t, (*Server).handleRTC, requireAuth, requireApprovedDevice, rateLimit(s.cfg.MaxMsgsPerSecond))
+	}
+	r.Handle("GET_TURN_CREDS", (*Server).handleGetTurnCreds, approved...)
+	r.Handle("GET_PUBLIC_KEY", (*Server).handleGetPublicKey, authed...)
+}
+
 func (s *Server) handle(w http.ResponseWriter, r *http.Request) {
 	ws, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		return
 	}
-	ws.SetReadLimit(maxWSFrameBytes)
-
-	client := &Client{id: s.newID(), conn: ws}
+	ws.SetReadLimit(int64(s.cfg.MaxFrameBytes))
+
+	client := &Client{
+		id:    s.newID(),
+		ip:    strings.Split(r.RemoteAddr, ":")[0],
+		conn:  ws,
+		codec: codecs[ws.Subprotocol()],
+		out:   newSendQueue(s.cfg, s.queueMetrics),
+	}
 	s.mu.Lock()
 	s.clients[client.id] = client
 	s.mu.Unlock()
 
+	go s.writePump(client)
+
 	// Heartbeat
 	go func() {
 		ticker := time.NewTicker(10 * time.Second)
@@ -44,1042 +93,657 @@ func (s *Server) handle(w http.ResponseWriter, r *http.Request) {
 		delete(s.clients, client.id)
 		s.mu.Unlock()
 
-		if client.email != "" {
-			s.db.Exec("DELETE FROM sockets WHERE socket_id = ?", client.id)
-		}
+		s.presence.Disconnect(client)
 
-		for _, sess := range s.sessions {
-			sess.mu.Lock()
-			_, wasMember := sess.clients[client.id]
-			if wasMember {
-				for _, c := range sess.clients {
-					if c.id != client.id {
-						s.send(c, Frame{
-							T:   "PEER_OFFLINE",
-							SID: sess.id,
-						})
-					}
-				}
-				delete(sess.clients, client.id)
+		for sid, peers := range s.sessions.leaveAll(client) {
+			offline := Frame{
+				T:   "PEER_OFFLINE",
+				SID: sid,
+			}
+			for _, c := range peers {
+				s.send(c, offline)
 			}
-			sess.mu.Unlock()
+			s.cluster.sendToSession(sid, offline)
 		}
 
-		ws.Close()
+		client.out.close()
 	}()
 
 	for {
-		var frame Frame
-		if err := ws.ReadJSON(&frame); err != nil {
+		_, msg, err := ws.ReadMessage()
+		if err != nil {
+			break
+		}
+		frame, err := client.codec.decode(msg)
+		if err != nil {
 			break
 		}
+		if !s.frames.Dispatch(s, client, frame) && frame.ID != "" {
+			// Only clients that send IDs wait for an answer.
+			s.sendError(client, frame, ErrUnknownFrame, "Unknown frame type "+frame.T)
+		}
+	}
+}
 
-		switch frame.T {
-		case "AUTH":
-			var d struct {
-				Token     string `json:"token"`
-				PublicKey string `json:"publicKey"`
-			}
-			json.Unmarshal(frame.Data, &d)
-			d.Token = strings.TrimSpace(d.Token)
-
-			if !strings.HasPrefix(d.Token, "sess:") {
-				ip := strings.Split(r.RemoteAddr, ":")[0]
-				if !s.rateLimiter.checkAuthRateLimit(ip) {
-					s.send(client, Frame{T: "ERROR", Data: json.RawMessage(`{"message":"Too many login attempts. Try again later."}`)})
-					client.conn.Close()
-					return
-				}
-			}
+func (s *Server) handleAuth(client *Client, frame Frame) {
+	var d struct {
+		Token     string `json:"token"`
+		PublicKey string `json:"publicKey"`
+		TreeSize  int64  `json:"treeSize"` // of the last key log head the client saw
+	}
+	json.Unmarshal(frame.Data, &d)
+	d.Token = strings.TrimSpace(d.Token)
+	// Every socket is a device: without a key there is nothing for the
+	// master to approve.
+	if d.PublicKey == "" {
+		s.sendError(client, frame, ErrInvalidFrame, "AUTH needs a device publicKey")
+		client.out.closeAfterFlush()
+		return
+	}
 
-			email, sessionToken, err := verifyAuthToken(d.Token)
-			if err != nil {
-				s.send(client, Frame{T: "ERROR", Data: json.RawMessage(`{"message":"Auth failed"}`)})
-				continue
-			}
-			client.mu.Lock()
-			client.email = email
-			client.mu.Unlock()
-
-			eh := emailHash(email)
-
-			var isMaster int
-			err = s.db.QueryRow("SELECT is_master FROM devices WHERE email_hash = ? AND public_key = ?", eh, d.PublicKey).Scan(&isMaster)
-			if err != nil {
-				var deviceCount int
-				s.db.QueryRow("SELECT COUNT(*) FROM devices WHERE email_hash = ? AND last_active >= datetime('now', '-30 days')", eh).Scan(&deviceCount)
-				isMaster = 0
-				if deviceCount == 0 {
-					isMaster = 1
-				}
-				if d.PublicKey != "" {
-					s.db.Exec(`
-						INSERT INTO devices (email_hash, public_key, last_active, is_master) 
-						VALUES (?, ?, ?, ?)`,
-						eh, d.PublicKey, time.Now(), isMaster)
-				}
-			} else {
-				s.db.Exec("UPDATE devices SET last_active = ? WHERE email_hash = ? AND public_key = ?", time.Now(), eh, d.PublicKey)
-			}
+	if !strings.HasPrefix(d.Token, "sess:") {
+		if !s.rateLimiter.checkAuthRateLimit(client.ip) {
+			s.sendRetryError(client, frame, ErrRateLimited, "Too many login attempts. Try again later.", time.Minute)
+			client.out.closeAfterFlush()
+			return
+		}
+	}
 
-			s.db.Exec("INSERT INTO sockets (email_hash, socket_id, public_key) VALUES (?, ?, ?)", eh, client.id, d.PublicKey)
+	email, sessionToken, err := s.verifyAuthToken(d.Token)
+	if err != nil {
+		s.sendError(client, frame, ErrAuthFailed, "Auth failed")
+		return
+	}
+	eh := emailHash(email)
+	if s.remoteWipe(client, frame, eh, d.PublicKey) {
+		return
+	}
+	device := s.registerDevice(eh, d.PublicKey)
+
+	client.mu.Lock()
+	client.email = email
+	client.publicKey = d.PublicKey
+	client.deviceStatus = device.Status
+	client.mu.Unlock()
+
+	resp := map[string]string{
+		"email":        email,
+		"token":        sessionToken,
+		"deviceStatus": device.Status,
+	}
 
-			resp := map[string]string{
-				"email": email,
-				"token": sessionToken,
-			}
-			respBytes, _ := json.Marshal(resp)
-			s.send(client, Frame{T: "AUTH_SUCCESS", Data: json.RawMessage(respBytes)})
-
-			go func() {
-				rows, err := s.db.Query("SELECT id, event_data FROM offline_notifications WHERE email_hash = ?", eh)
-				if err == nil {
-					var idsToDelete []int
-					for rows.Next() {
-						var id int
-						var data string
-						if err := rows.Scan(&id, &data); err == nil {
-							var notif Frame
-							if json.Unmarshal([]byte(data), &notif) == nil {
-								s.send(client, notif)
-								idsToDelete = append(idsToDelete, id)
-							}
-						}
-					}
-					rows.Close()
-
-					for _, id := range idsToDelete {
-						s.db.Exec("DELETE FROM offline_notifications WHERE id = ?", id)
-					}
-				}
-			}()
-
-			go func() {
-				rows, err := s.db.Query(`
-					SELECT sid, user1_hash, user2_hash 
-					FROM friends 
-					WHERE (user1_hash = ? OR user2_hash = ?) AND sid IS NOT NULL
-				`, eh, eh)
-				if err != nil {
-					log.Printf("Error querying sessions for %s: %v", email, err)
-					return
-				}
-				defer rows.Close()
-
-				var sessions []map[string]any
-
-				for rows.Next() {
-					var sid, u1, u2 string
-					if err := rows.Scan(&sid, &u1, &u2); err != nil {
-						continue
-					}
-
-					peerHash := u1
-					if peerHash == eh {
-						peerHash = u2
-					}
-
-					isOnline := false
-					var onlineCount int
-					s.db.QueryRow("SELECT COUNT(*) FROM sockets s JOIN devices d ON s.public_key = d.public_key WHERE s.email_hash = ?", peerHash).Scan(&onlineCount)
-					isOnline = onlineCount > 0
-
-					var peerPubKeys []string
-					if isOnline {
-						// Only transmit keys that are actively connected right now
-						keyRows, err := s.db.Query("SELECT DISTINCT s.public_key FROM sockets s JOIN devices d ON s.public_key = d.public_key WHERE s.email_hash = ? AND s.public_key IS NOT NULL AND s.public_key != ''", peerHash)
-						if err == nil {
-							for keyRows.Next() {
-								var pk string
-								if err := keyRows.Scan(&pk); err == nil {
-									peerPubKeys = append(peerPubKeys, pk)
-								}
-							}
-							keyRows.Close()
-						}
-					}
-
-					var ownPubKeys []string
-					ownKeyRows, err := s.db.Query("SELECT DISTINCT s.public_key FROM sockets s JOIN devices d ON s.public_key = d.public_key WHERE s.email_hash = ? AND s.public_key IS NOT NULL AND s.public_key != ''", eh)
-					if err == nil {
-						for ownKeyRows.Next() {
-							var pk string
-							if err := ownKeyRows.Scan(&pk); err == nil {
-								ownPubKeys = append(ownPubKeys, pk)
-							}
-						}
-						ownKeyRows.Close()
-					}
-
-					sessions = append(sessions, map[string]any{
-						"sid":         sid,
-						"online":      isOnline,
-						"peerHash":    peerHash,
-						"peerPubKeys": peerPubKeys,
-						"ownPubKeys":  ownPubKeys,
-					})
-
-					s.mu.Lock()
-					sess, ok := s.sessions[sid]
-					if !ok {
-						sess = &Session{
-							id:      sid,
-							clients: map[string]*Client{client.id: client},
-						}
-						s.sessions[sid] = sess
-					} else {
-						sess.mu.Lock()
-						sess.clients[client.id] = client
-						for _, c := range sess.clients {
-							if c.id != client.id {
-
-								// Calculate sender's current active keys to broadcast to friends
-								var senderPubKeys []string
-								keyRows, err := s.db.Query("SELECT DISTINCT s.public_key FROM sockets s JOIN devices d ON s.public_key = d.public_key WHERE s.email_hash = ? AND s.public_key IS NOT NULL AND s.public_key != ''", eh)
-								if err == nil {
-									for keyRows.Next() {
-										var pk string
-										if err := keyRows.Scan(&pk); err == nil {
-											senderPubKeys = append(senderPubKeys, pk)
-										}
-									}
-									keyRows.Close()
-								}
-
-								onlineData, _ := json.Marshal(map[string]any{
-									"peerPubKeys": senderPubKeys,
-								})
-
-								s.send(c, Frame{
-									T:    "PEER_ONLINE",
-									SID:  sid,
-									Data: json.RawMessage(onlineData),
-								})
-							}
-						}
-						sess.mu.Unlock()
-					}
-					s.mu.Unlock()
-				}
-
-				if sessions == nil {
-					sessions = make([]map[string]any, 0)
-				}
-				listData, _ := json.Marshal(sessions)
-				s.send(client, Frame{T: "SESSION_LIST", Data: json.RawMessage(listData)})
-			}()
-
-		case "UPDATE_PUBKEY":
-			if client.email == "" {
-				s.send(client, Frame{T: "ERROR", Data: json.RawMessage(`{"message":"Auth required"}`)})
-				continue
-			}
-			var d struct {
-				PublicKey string `json:"publicKey"`
-			}
-			json.Unmarshal(frame.Data, &d)
-			if d.PublicKey != "" {
-				s.db.Exec("UPDATE users SET public_key = ? WHERE email_hash = ?", d.PublicKey, emailHash(client.email))
-			}
+	if device.Status == DevicePending {
+		// Connected for DEVICE_LIST and the link answer, but not by key, so
+		// nobody can route to it or learn its key.
+		s.presence.Connect(client, eh, "")
+		if master, err := s.store.MasterDevice(eh); err == nil {
+			resp["masterPubKey"] = master.PublicKey
+		}
+		respBytes, _ := json.Marshal(resp)
+		s.reply(client, frame, Frame{T: "AUTH_SUCCESS", Data: json.RawMessage(respBytes)})
+		return
+	}
 
-		case "GET_DEVICES":
-			eh := emailHash(client.email)
-			rows, err := s.db.Query("SELECT public_key, last_active, is_master, status FROM devices WHERE email_hash = ?", eh)
-			if err != nil {
-				s.send(client, Frame{T: "ERROR", Data: json.RawMessage(`{"message":"Failed to get devices"}`)})
-				continue
-			}
+	s.presence.Connect(client, eh, d.PublicKey)
 
-			var devicesList []map[string]any
-			for rows.Next() {
-				var pk, status string
-				var lastActive time.Time
-				var isMaster int
-				if err := rows.Scan(&pk, &lastActive, &isMaster, &status); err == nil {
-					devicesList = append(devicesList, map[string]any{
-						"publicKey":  pk,
-						"lastActive": lastActive.Format(time.RFC3339),
-						"isMaster":   isMaster == 1,
-						"status":     status,
-					})
-				}
-			}
-			rows.Close()
+	respBytes, _ := json.Marshal(resp)
+	s.reply(client, frame, Frame{T: "AUTH_SUCCESS", Data: json.RawMessage(respBytes)})
 
-			respBytes, _ := json.Marshal(map[string]any{"devices": devicesList})
-			s.send(client, Frame{T: "DEVICE_LIST", Data: json.RawMessage(respBytes)})
+	if device.IsMaster {
+		s.cancelMasterClaim(eh)
+		go s.sendLinkRequests(client, eh)
+		if f, ok := s.crossSignNeeded(eh, d.PublicKey); ok {
+			s.send(client, f)
+		}
+	}
+	go s.syncNotifications(client)
+	go s.checkPreKeys(eh, d.PublicKey)
 
-		case "FRIEND_REQUEST":
-			if client.email == "" {
-				s.send(client, Frame{T: "ERROR", Data: json.RawMessage(`{"message":"Auth required"}`)})
-				continue
-			}
-			var d struct {
-				TargetEmail     string `json:"targetEmail"`
-				EncryptedPacket string `json:"encryptedPacket"`
-			}
-			json.Unmarshal(frame.Data, &d)
+	go func() {
+		friendships, err := s.store.Friendships(eh)
+		if err != nil {
+			log.Printf("Error querying sessions for %s: %v", email, err)
+			return
+		}
 
-			targetEmail := normalizeEmail(d.TargetEmail)
-			targetHash := emailHash(targetEmail)
-			senderHash := emailHash(client.email)
+		sessions := make([]map[string]any, 0, len(friendships))
+		ownPubKeys := s.onlineKeys(eh)
+		ownProof := s.keyProof(eh, ownPubKeys, 0)
+
+		for _, f := range friendships {
+			sid := f.SID
+			peerHash := f.Peer(eh)
+
+			// Only transmit keys that are actively connected right now
+			peerPubKeys := s.onlineKeys(peerHash)
+			isOnline := len(peerPubKeys) > 0
+
+			sessions = append(sessions, map[string]any{
+				"sid":         sid,
+				"online":      isOnline,
+				"peerHash":    peerHash,
+				"peerPubKeys": peerPubKeys,
+				"ownPubKeys":  ownPubKeys,
+				"keyProof":    s.keyProof(peerHash, peerPubKeys, d.TreeSize),
+			})
 
-			_, err := s.db.Exec(`INSERT OR REPLACE INTO requests (sender_hash, target_hash, encrypted_packet, timestamp) 
-				VALUES (?, ?, ?, ?)`, senderHash, targetHash, d.EncryptedPacket, time.Now())
-			if err != nil {
-				s.logger.Printf("Error storing request: %v", err)
-				s.send(client, Frame{T: "ERROR", Data: json.RawMessage(`{"message":"Failed to store request"}`)})
-				continue
-			}
+			s.sessions.join(sid, client, true)
+			// Broadcast the sender's current active keys to friends
+			onlineData, _ := json.Marshal(map[string]any{
+				"peerPubKeys": ownPubKeys,
+				"keyProof":    ownProof,
+			})
+			s.sendToSession(sid, client, Frame{
+				T:    "PEER_ONLINE",
+				SID:  sid,
+				Data: json.RawMessage(onlineData),
+			})
+		}
 
-			// We don't send individual public keys via `FRIEND_REQUEST` anymore
-			// Instead we can send the sender's current active keys:
-			var senderPubKeys []string
-			keyRows, err := s.db.Query("SELECT DISTINCT public_key FROM sockets WHERE email_hash = ? AND public_key IS NOT NULL AND public_key != ''", senderHash)
-			if err == nil {
-				for keyRows.Next() {
-					var pk string
-					if err := keyRows.Scan(&pk); err == nil {
-						senderPubKeys = append(senderPubKeys, pk)
-					}
-				}
-				keyRows.Close()
-			}
+		sessions = append(sessions, s.groupSessions(client, eh, ownPubKeys, ownProof, d.TreeSize)...)
 
-			var singlePubKey string
-			if len(senderPubKeys) > 0 {
-				singlePubKey = senderPubKeys[0]
-			} else {
-				s.db.QueryRow("SELECT public_key FROM devices WHERE email_hash = ? AND is_master = 1 LIMIT 1", senderHash).Scan(&singlePubKey)
-				if singlePubKey == "" {
-					s.db.QueryRow("SELECT public_key FROM devices WHERE email_hash = ? ORDER BY last_active DESC LIMIT 1", senderHash).Scan(&singlePubKey)
-				}
-			}
+		listData, _ := json.Marshal(sessions)
+		s.reply(client, frame, Frame{T: "SESSION_LIST", Data: json.RawMessage(listData)})
+		// Mail is sent after the list so the client knows its sessions.
+		s.syncMailbox(client)
+	}()
+}
 
-			rows, _ := s.db.Query("SELECT socket_id FROM sockets WHERE email_hash = ?", targetHash)
-			for rows.Next() {
-				var socketID string
-				rows.Scan(&socketID)
-
-				s.mu.Lock()
-				if targetClient, ok := s.clients[socketID]; ok {
-					reqData, _ := json.Marshal(map[string]any{
-						"senderHash":      senderHash,
-						"encryptedPacket": d.EncryptedPacket,
-						"publicKeys":      senderPubKeys,
-						"publicKey":       singlePubKey,
-					})
-					s.send(targetClient, Frame{T: "FRIEND_REQUEST", Data: json.RawMessage(reqData)})
-				}
-				s.mu.Unlock()
-			}
-			rows.Close()
+func (s *Server) handleGetDevices(client *Client, frame Frame) {
+	devices, err := s.store.ListDevices(emailHash(client.email))
+	if err != nil {
+		s.sendError(client, frame, ErrInternal, "Failed to get devices")
+		return
+	}
+	s.reply(client, frame, deviceListFrame(devices))
+}
 
-			s.send(client, Frame{T: "REQUEST_SENT", Data: json.RawMessage(`{"success":true}`)})
+func (s *Server) handleFriendRequest(client *Client, frame Frame) {
+	var d struct {
+		TargetEmail     string `json:"targetEmail"`
+		EncryptedPacket string `json:"encryptedPacket"`
+	}
+	json.Unmarshal(frame.Data, &d)
+
+	targetEmail := normalizeEmail(d.TargetEmail)
+	targetHash := emailHash(targetEmail)
+	senderHash := emailHash(client.email)
+
+	err := s.store.PutRequest(FriendRequest{
+		SenderHash:      senderHash,
+		TargetHash:      targetHash,
+		EncryptedPacket: d.EncryptedPacket,
+		Timestamp:       time.Now(),
+	})
+	if err != nil {
+		s.logger.Printf("Error storing request: %v", err)
+		s.sendError(client, frame, ErrInternal, "Failed to store request")
+		return
+	}
 
-		case "FRIEND_ACCEPT":
-			if client.email == "" {
-				s.send(client, Frame{T: "ERROR", Data: json.RawMessage(`{"message":"Auth required"}`)})
-				continue
-			}
-			var d struct {
-				TargetEmail     string `json:"targetEmail"`
-				EncryptedPacket string `json:"encryptedPacket"`
-			}
-			json.Unmarshal(frame.Data, &d)
+	// We don't send individual public keys via `FRIEND_REQUEST` anymore
+	// Instead we can send the sender's current active keys:
+	senderPubKeys, singlePubKey := s.announceKeys(senderHash)
 
-			targetEmail := normalizeEmail(d.TargetEmail)
-			targetHash := emailHash(targetEmail)
-			senderHash := emailHash(client.email)
+	reqData, _ := json.Marshal(map[string]any{
+		"senderHash":      senderHash,
+		"encryptedPacket": d.EncryptedPacket,
+		"publicKeys":      senderPubKeys,
+		"publicKey":       singlePubKey,
+		"keyProof":        s.announceProof(senderHash, senderPubKeys, singlePubKey),
+	})
+	s.sendToUser(targetHash, Frame{T: "FRIEND_REQUEST", Data: json.RawMessage(reqData)})
 
-			u1, u2 := senderHash, targetHash
-			if u1 > u2 {
-				u1, u2 = u2, u1
-			}
+	s.reply(client, frame, Frame{T: "REQUEST_SENT", Data: json.RawMessage(`{"success":true}`)})
+}
 
-			e1, e2 := client.email, targetEmail
-			if e1 > e2 {
-				e1, e2 = e2, e1
-			}
-			sidSum := sha256.Sum256([]byte(e1 + ":" + e2))
-			sid := hex.EncodeToString(sidSum[:])
+// announceKeys returns the keys of emailHash's connected sockets and a single
+// representative key, falling back to the primary device when none are online.
+func (s *Server) announceKeys(emailHash string) ([]string, string) {
+	keys := s.onlineKeys(emailHash)
+	if len(keys) > 0 {
+		return keys, keys[0]
+	}
+	primary, _ := s.store.PrimaryDeviceKey(emailHash)
+	return keys, primary
+}
 
-			_, err = s.db.Exec("INSERT OR IGNORE INTO friends (user1_hash, user2_hash, since, sid) VALUES (?, ?, ?, ?)", u1, u2, time.Now(), sid)
-			if err != nil {
-				s.logger.Printf("Error adding friend: %v", err)
-			}
+// announceProof proves the keys announceKeys returned: the online keys, or
+// the primary device key when none are online.
+func (s *Server) announceProof(emailHash string, keys []string, single string) *keyProof {
+	if len(keys) == 0 && single != "" {
+		keys = []string{single}
+	}
+	return s.keyProof(emailHash, keys, 0)
+}
 
-			s.db.Exec("DELETE FROM requests WHERE sender_hash = ? AND target_hash = ?", targetHash, senderHash)
+// sendToUser sends f to every connected socket of emailHash, other than
+// those of pending devices, and reports whether the user had any.
+func (s *Server) sendToUser(emailHash string, f Frame) bool {
+	local := s.sendToLocalUser(emailHash, f, false)
+	remote := s.cluster.sendToUser(emailHash, f, false)
+	return local || remote
+}
 
-			var myPubKeys []string
-			keyRows, _ := s.db.Query("SELECT DISTINCT public_key FROM sockets WHERE email_hash = ? AND public_key IS NOT NULL AND public_key != ''", senderHash)
-			for keyRows.Next() {
-				var pk string
-				if err := keyRows.Scan(&pk); err == nil {
-					myPubKeys = append(myPubKeys, pk)
-				}
-			}
-			keyRows.Close()
+// sendToAccount is sendToUser with pending devices included, for the few
+// frames they may see, such as DEVICE_LIST.
+func (s *Server) sendToAccount(emailHash string, f Frame) {
+	s.sendToLocalUser(emailHash, f, true)
+	s.cluster.sendToUser(emailHash, f, true)
+}
 
-			var singlePubKey string
-			if len(myPubKeys) > 0 {
-				singlePubKey = myPubKeys[0]
-			} else {
-				s.db.QueryRow("SELECT public_key FROM devices WHERE email_hash = ? AND is_master = 1 LIMIT 1", senderHash).Scan(&singlePubKey)
-				if singlePubKey == "" {
-					s.db.QueryRow("SELECT public_key FROM devices WHERE email_hash = ? ORDER BY last_active DESC LIMIT 1", senderHash).Scan(&singlePubKey)
-				}
-			}
+func (s *Server) sendToLocalUser(emailHash string, f Frame, pending bool) bool {
+	sent := false
+	for _, c := range s.presence.Clients(emailHash) {
+		if !pending && c.devicePending() {
+			continue
+		}
+		s.send(c, f)
+		sent = true
+	}
+	return sent
+}
 
-			rows, _ := s.db.Query("SELECT socket_id FROM sockets WHERE email_hash = ?", targetHash)
-			for rows.Next() {
-				var socketID string
-				rows.Scan(&socketID)
-				s.mu.Lock()
-				if targetClient, ok := s.clients[socketID]; ok {
-					respData, _ := json.Marshal(map[string]any{
-						"senderHash":      senderHash,
-						"encryptedPacket": d.EncryptedPacket,
-						"publicKeys":      myPubKeys,
-						"publicKey":       singlePubKey,
-					})
-					s.send(targetClient, Frame{T: "FRIEND_ACCEPTED", Data: json.RawMessage(respData)})
-				}
-				s.mu.Unlock()
-			}
-			rows.Close()
+func (s *Server) handleFriendAccept(client *Client, frame Frame) {
+	var d struct {
+		TargetEmail     string `json:"targetEmail"`
+		EncryptedPacket string `json:"encryptedPacket"`
+	}
+	json.Unmarshal(frame.Data, &d)
 
-			s.send(client, Frame{T: "FRIEND_ACCEPTED_ACK", Data: json.RawMessage(`{"targetEmail":"`+targetEmail+`"}`)})
+	targetEmail := normalizeEmail(d.TargetEmail)
+	targetHash := emailHash(targetEmail)
+	senderHash := emailHash(client.email)
 
-		case "FRIEND_DENY":
-			if client.email == "" {
-				s.send(client, Frame{T: "ERROR", Data: json.RawMessage(`{"message":"Auth required"}`)})
-				continue
-			}
-			var d struct {
-				TargetEmail string `json:"targetEmail"`
-			}
-			json.Unmarshal(frame.Data, &d)
-			targetHash := emailHash(normalizeEmail(d.TargetEmail))
-			senderHash := emailHash(client.email)
-
-			s.db.Exec("DELETE FROM requests WHERE sender_hash = ? AND target_hash = ?", targetHash, senderHash)
-			// Notify target they were denied.
-			rows, err := s.db.Query("SELECT socket_id FROM sockets WHERE email_hash = ?", targetHash)
-			hasSockets := false
-			if err == nil {
-				for rows.Next() {
-					hasSockets = true
-					var socketID string
-					rows.Scan(&socketID)
-					s.mu.Lock()
-					if targetClient, ok := s.clients[socketID]; ok {
-						respData, _ := json.Marshal(map[string]string{"senderHash": senderHash})
-						s.send(targetClient, Frame{T: "FRIEND_DENIED", Data: json.RawMessage(respData)})
-					}
-					s.mu.Unlock()
-				}
-				rows.Close()
-			}
+	u1, u2 := senderHash, targetHash
+	if u1 > u2 {
+		u1, u2 = u2, u1
+	}
 
-			if !hasSockets {
-				respData, _ := json.Marshal(map[string]string{"senderHash": senderHash})
-				frame, _ := json.Marshal(Frame{T: "FRIEND_DENIED", Data: json.RawMessage(respData)})
-				s.db.Exec("INSERT INTO offline_notifications (email_hash, event_data, timestamp) VALUES (?, ?, ?)", targetHash, string(frame), time.Now())
-			}
+	e1, e2 := client.email, targetEmail
+	if e1 > e2 {
+		e1, e2 = e2, e1
+	}
+	sidSum := sha256.Sum256([]byte(e1 + ":" + e2))
+	sid := hex.EncodeToString(sidSum[:])
 
-		case "BLOCK_USER":
-			if client.email == "" {
-				s.send(client, Frame{T: "ERROR", Data: json.RawMessage(`{"message":"Auth required"}`)})
-				continue
-			}
-			var d struct {
-				TargetEmail string `json:"targetEmail"`
-			}
-			json.Unmarshal(frame.Data, &d)
-			targetHash := emailHash(normalizeEmail(d.TargetEmail))
-			senderHash := emailHash(client.email)
-
-			s.db.Exec("DELETE FROM requests WHERE sender_hash = ? AND target_hash = ?", targetHash, senderHash)
-			s.db.Exec("DELETE FROM requests WHERE sender_hash = ? AND target_hash = ?", senderHash, targetHash)
-
-			s.db.Exec("DELETE FROM friends WHERE (user1_hash = ? AND user2_hash = ?) OR (user1_hash = ? AND user2_hash = ?)", senderHash, targetHash, targetHash, senderHash)
-
-			rows, err := s.db.Query("SELECT socket_id FROM sockets WHERE email_hash = ?", targetHash)
-			hasSockets := false
-			if err == nil {
-				for rows.Next() {
-					hasSockets = true
-					var socketID string
-					rows.Scan(&socketID)
-					s.mu.Lock()
-					if targetClient, ok := s.clients[socketID]; ok {
-						respData, _ := json.Marshal(map[string]string{"senderHash": senderHash})
-						s.send(targetClient, Frame{T: "USER_BLOCKED_EVENT", Data: json.RawMessage(respData)})
-					}
-					s.mu.Unlock()
-				}
-				rows.Close()
-			}
+	err := s.store.AddFriendship(Friendship{User1Hash: u1, User2Hash: u2, SID: sid, Since: time.Now()})
+	if err != nil {
+		s.logger.Printf("Error adding friend: %v", err)
+		s.sendError(client, frame, ErrInternal, "Failed to add friend")
+		return
+	}
 
-			if !hasSockets {
-				respData, _ := json.Marshal(map[string]string{"senderHash": senderHash})
-				frameEvent, _ := json.Marshal(Frame{T: "USER_BLOCKED_EVENT", Data: json.RawMessage(respData)})
-				s.db.Exec("INSERT INTO offline_notifications (email_hash, event_data, timestamp) VALUES (?, ?, ?)", targetHash, string(frameEvent), time.Now())
-			}
+	s.store.DeleteRequest(targetHash, senderHash)
 
-			s.send(client, Frame{T: "USER_BLOCKED", Data: json.RawMessage(`{"success":true, "targetEmail":"`+d.TargetEmail+`"}`)})
+	myPubKeys, singlePubKey := s.announceKeys(senderHash)
 
-		case "UNBLOCK_USER":
-			if client.email == "" {
-				s.send(client, Frame{T: "ERROR", Data: json.RawMessage(`{"message":"Auth required"}`)})
-				continue
-			}
-			var d struct {
-				TargetEmail string `json:"targetEmail"`
-			}
-			json.Unmarshal(frame.Data, &d)
-			targetHash := emailHash(normalizeEmail(d.TargetEmail))
-			senderHash := emailHash(client.email)
-
-			rows, err := s.db.Query("SELECT socket_id FROM sockets WHERE email_hash = ?", targetHash)
-			hasSockets := false
-			if err == nil {
-				for rows.Next() {
-					hasSockets = true
-					var socketID string
-					rows.Scan(&socketID)
-					s.mu.Lock()
-					if targetClient, ok := s.clients[socketID]; ok {
-						respData, _ := json.Marshal(map[string]string{"senderHash": senderHash})
-						s.send(targetClient, Frame{T: "USER_UNBLOCKED_EVENT", Data: json.RawMessage(respData)})
-					}
-					s.mu.Unlock()
-				}
-				rows.Close()
-			}
+	respData, _ := json.Marshal(map[string]any{
+		"senderHash":      senderHash,
+		"encryptedPacket": d.EncryptedPacket,
+		"publicKeys":      myPubKeys,
+		"publicKey":       singlePubKey,
+		"keyProof":        s.announceProof(senderHash, myPubKeys, singlePubKey),
+	})
+	s.sendToUser(targetHash, Frame{T: "FRIEND_ACCEPTED", Data: json.RawMessage(respData)})
 
-			if !hasSockets {
-				respData, _ := json.Marshal(map[string]string{"senderHash": senderHash})
-				frameEvent, _ := json.Marshal(Frame{T: "USER_UNBLOCKED_EVENT", Data: json.RawMessage(respData)})
-				s.db.Exec("INSERT INTO offline_notifications (email_hash, event_data, timestamp) VALUES (?, ?, ?)", targetHash, string(frameEvent), time.Now())
-			}
+	ackData, _ := json.Marshal(map[string]string{"targetEmail": targetEmail})
+	s.reply(client, frame, Frame{T: "FRIEND_ACCEPTED_ACK", Data: json.RawMessage(ackData)})
+}
 
-			s.send(client, Frame{T: "USER_UNBLOCKED", Data: json.RawMessage(`{"success":true, "targetEmail":"`+d.TargetEmail+`"}`)})
+func (s *Server) handleFriendDeny(client *Client, frame Frame) {
+	var d struct {
+		TargetEmail string `json:"targetEmail"`
+	}
+	json.Unmarshal(frame.Data, &d)
+	targetHash := emailHash(normalizeEmail(d.TargetEmail))
+	senderHash := emailHash(client.email)
+
+	s.store.DeleteRequest(targetHash, senderHash)
+	// Notify target they were denied.
+	respData, _ := json.Marshal(map[string]string{"senderHash": senderHash})
+	s.notifyUser(targetHash, Frame{T: "FRIEND_DENIED", Data: json.RawMessage(respData)})
+}
 
-		case "GET_PENDING_REQUESTS":
-			if client.email == "" {
-				s.send(client, Frame{T: "ERROR", Data: json.RawMessage(`{"message":"Auth required"}`)})
-				continue
-			}
-			myHash := emailHash(client.email)
-			rows, err := s.db.Query(`
-				SELECT r.sender_hash, r.encrypted_packet, r.timestamp 
-				FROM requests r 
-				WHERE r.target_hash = ?`, myHash)
-			if err != nil {
-				continue
-			}
-			var pending []map[string]any
-			for rows.Next() {
-				var senderHash, packet string
-				var ts time.Time
-				rows.Scan(&senderHash, &packet, &ts)
-
-				var pubKey string
-				err := s.db.QueryRow("SELECT public_key FROM devices WHERE email_hash = ? AND is_master = 1 LIMIT 1", senderHash).Scan(&pubKey)
-				if err != nil || pubKey == "" {
-					s.db.QueryRow("SELECT public_key FROM devices WHERE email_hash = ? ORDER BY last_active DESC LIMIT 1", senderHash).Scan(&pubKey)
-				}
-
-				pending = append(pending, map[string]any{
-					"senderHash":      senderHash,
-					"encryptedPacket": packet,
-					"timestamp":       ts,
-					"publicKey":       pubKey,
-				})
-			}
-			rows.Close()
-			respBytes, _ := json.Marshal(pending)
-			s.send(client, Frame{T: "PENDING_REQUESTS", Data: json.RawMessage(respBytes)})
-
-		case "JOIN_ACCEPT":
-			if client.email == "" {
-				s.send(client, Frame{
-					T:    "ERROR",
-					Data: json.RawMessage(`{"message":"Auth required"}`),
-				})
-				continue
-			}
-			s.mu.Lock()
-			if sess, ok := s.sessions[frame.SID]; ok {
-				sess.mu.Lock()
-				sess.clients[client.id] = client
-				var req struct {
-					PublicKey       string `json:"publicKey"`
-					SenderEmail     string `json:"senderEmail"`
-					SenderEmailHash string `json:"senderEmailHash"`
-					SenderName      string `json:"senderName"`
-					SenderAvatar    string `json:"senderAvatar"`
-					SenderNameVer   int    `json:"senderNameVer"`
-					SenderAvatarVer int    `json:"senderAvatarVer"`
-				}
-				_ = json.Unmarshal(frame.Data, &req)
-				joinData, _ := json.Marshal(map[string]any{
-					"publicKey":     req.PublicKey,
-					"email":         normalizeEmail(client.email),
-					"emailHash":     emailHash(client.email),
-					"name":          req.SenderName,
-					"avatar":        req.SenderAvatar,
-					"nameVersion":   req.SenderNameVer,
-					"avatarVersion": req.SenderAvatarVer,
-				})
-				for _, c := range sess.clients {
-					if c.id != client.id {
-						s.send(c, Frame{
-							T:    "JOIN_ACCEPT",
-							SID:  frame.SID,
-							Data: json.RawMessage(joinData),
-						})
-					}
-				}
-				sess.mu.Unlock()
-			}
-			s.mu.Unlock()
+func (s *Server) handleBlockUser(client *Client, frame Frame) {
+	var d struct {
+		TargetEmail string `json:"targetEmail"`
+	}
+	json.Unmarshal(frame.Data, &d)
+	targetHash := emailHash(normalizeEmail(d.TargetEmail))
+	senderHash := emailHash(client.email)
 
-		case "JOIN_DENY":
-			if client.email == "" {
-				s.send(client, Frame{
-					T:    "ERROR",
-					Data: json.RawMessage(`{"message":"Auth required"}`),
-				})
-				continue
-			}
-			s.mu.Lock()
-			if sess, ok := s.sessions[frame.SID]; ok {
-				sess.mu.Lock()
-				for _, c := range sess.clients {
-					if c.id != client.id {
-						s.send(c, Frame{T: "JOIN_DENIED", SID: frame.SID})
-					}
-				}
-				sess.mu.Unlock()
-			}
-			s.mu.Unlock()
+	s.store.DeleteRequest(targetHash, senderHash)
+	s.store.DeleteRequest(senderHash, targetHash)
 
-		case "DELETE_ACCOUNT":
-			if client.email == "" {
-				s.send(client, Frame{T: "ERROR", Data: json.RawMessage(`{"message":"Authentication required"}`)})
-				continue
-			}
-			eh := emailHash(client.email)
-
-			s.db.Exec("DELETE FROM public_keys WHERE email_hash = ?", eh)
-			s.db.Exec("DELETE FROM sockets WHERE email_hash = ?", eh)
-
-			rows, err := s.db.Query("SELECT sid FROM friends WHERE user1_hash = ? OR user2_hash = ?", eh, eh)
-			if err == nil {
-				var sids []string
-				for rows.Next() {
-					var sid string
-					if err := rows.Scan(&sid); err == nil {
-						sids = append(sids, sid)
-					}
-				}
-				rows.Close()
-
-				s.mu.Lock()
-				for _, sid := range sids {
-					sess, ok := s.sessions[sid]
-					if ok {
-						sess.mu.Lock()
-						for _, c := range sess.clients {
-							if c.id != client.id {
-								s.send(c, Frame{T: "PEER_OFFLINE", SID: sid})
-							}
-						}
-						sess.mu.Unlock()
-					}
-				}
-				s.mu.Unlock()
-
-				s.db.Exec("DELETE FROM friends WHERE user1_hash = ? OR user2_hash = ?", eh, eh)
-			}
-
-			log.Printf("[Server] Deleted account for %s", client.email)
-			client.conn.Close()
+	s.store.RemoveFriendship(senderHash, targetHash)
 
-		case "REATTACH":
-			if client.email == "" {
-				s.send(client, Frame{T: "ERROR", Data: json.RawMessage(`{"message":"Authentication required"}`)})
-				continue
-			}
-			s.mu.Lock()
+	respData, _ := json.Marshal(map[string]string{"senderHash": senderHash})
+	s.notifyUser(targetHash, Frame{T: "USER_BLOCKED_EVENT", Data: json.RawMessage(respData)})
 
-			sess, ok := s.sessions[frame.SID]
-			if !ok {
-				sess = &Session{
-					id:      frame.SID,
-					clients: map[string]*Client{client.id: client},
-				}
-				s.sessions[frame.SID] = sess
-			}
-			s.mu.Unlock()
+	ackData, _ := json.Marshal(map[string]any{"success": true, "targetEmail": d.TargetEmail})
+	s.reply(client, frame, Frame{T: "USER_BLOCKED", Data: json.RawMessage(ackData)})
+}
 
-			sess.mu.Lock()
-			sess.clients[client.id] = client
-
-			for _, c := range sess.clients {
-				if c.id != client.id {
-					s.send(c, Frame{
-						T:   "PEER_ONLINE",
-						SID: frame.SID,
-					})
-					s.send(client, Frame{
-						T:   "PEER_ONLINE",
-						SID: frame.SID,
-					})
-				}
-			}
+func (s *Server) handleUnblockUser(client *Client, frame Frame) {
+	var d struct {
+		TargetEmail string `json:"targetEmail"`
+	}
+	json.Unmarshal(frame.Data, &d)
+	targetHash := emailHash(normalizeEmail(d.TargetEmail))
+	senderHash := emailHash(client.email)
 
-			sess.mu.Unlock()
+	respData, _ := json.Marshal(map[string]string{"senderHash": senderHash})
+	s.notifyUser(targetHash, Frame{T: "USER_UNBLOCKED_EVENT", Data: json.RawMessage(respData)})
 
-			log.Printf(
-				"[Server] Client %s reattached to session %s",
-				client.id,
-				frame.SID,
-			)
+	ackData, _ := json.Marshal(map[string]any{"success": true, "targetEmail": d.TargetEmail})
+	s.reply(client, frame, Frame{T: "USER_UNBLOCKED", Data: json.RawMessage(ackData)})
+}
 
-		case "MSG":
-			if client.email == "" {
-				s.send(client, Frame{
-					T:    "ERROR",
-					Data: json.RawMessage(`{"message":"Auth required"}`),
-				})
-				continue
-			}
-			if len(frame.SID) == 0 || len(frame.SID) > maxSIDLength {
-				s.send(client, Frame{
-					T:    "ERROR",
-					Data: json.RawMessage(`{"message":"Invalid session id"}`),
-				})
-				continue
-			}
-			if !s.allowMessage(client) {
-				s.send(client, Frame{
-					T:    "ERROR",
-					Data: json.RawMessage(`{"message":"Rate limit exceeded: Too many messages per second"}`),
-				})
-				continue
-			}
-			var msgData struct {
-				Payloads map[string]string `json:"payloads"`
-			}
-			if err := json.Unmarshal(frame.Data, &msgData); err != nil {
-				s.send(client, Frame{
-					T:    "ERROR",
-					Data: json.RawMessage(`{"message":"Invalid message format"}`),
-				})
-				continue
-			}
-			if len(msgData.Payloads) == 0 {
-				s.send(client, Frame{
-					T:    "ERROR",
-					Data: json.RawMessage(`{"message":"Message payloads missing"}`),
-				})
-				continue
-			}
+func (s *Server) handleGetPendingRequests(client *Client, frame Frame) {
+	requests, err := s.store.PendingRequests(emailHash(client.email))
+	if err != nil {
+		s.sendError(client, frame, ErrInternal, "Failed to get pending requests")
+		return
+	}
+	var pending []map[string]any
+	for _, r := range requests {
+		pubKey, _ := s.store.PrimaryDeviceKey(r.SenderHash)
+		pending = append(pending, map[string]any{
+			"senderHash":      r.SenderHash,
+			"encryptedPacket": r.EncryptedPacket,
+			"timestamp":       r.Timestamp,
+			"publicKey":       pubKey,
+			"keyProof":        s.keyProof(r.SenderHash, []string{pubKey}, 0),
+		})
+	}
+	respBytes, _ := json.Marshal(pending)
+	s.reply(client, frame, Frame{T: "PENDING_REQUESTS", Data: json.RawMessage(respBytes)})
+}
 
-			totalSize := 0
-			for _, p := range msgData.Payloads {
-				totalSize += len(p)
-			}
-			if totalSize > maxEncryptedDataBytes {
-				s.send(client, Frame{
-					T:    "ERROR",
-					Data: json.RawMessage(`{"message":"Message payload too large"}`),
-				})
-				continue
-			}
+func (s *Server) handleJoinAccept(client *Client, frame Frame) {
+	// The session may only have members on other nodes.
+	if _, ok := s.sessions.join(frame.SID, client, s.cluster.hasSession(frame.SID)); !ok {
+		s.sendError(client, frame, ErrSessionNotFound, "Session not found")
+		return
+	}
+	var req struct {
+		PublicKey       string `json:"publicKey"`
+		SenderEmail     string `json:"senderEmail"`
+		SenderEmailHash string `json:"senderEmailHash"`
+		SenderName      string `json:"senderName"`
+		SenderAvatar    string `json:"senderAvatar"`
+		SenderNameVer   int    `json:"senderNameVer"`
+		SenderAvatarVer int    `json:"senderAvatarVer"`
+	}
+	_ = json.Unmarshal(frame.Data, &req)
+	joinData, _ := json.Marshal(map[string]any{
+		"publicKey":     req.PublicKey,
+		"email":         normalizeEmail(client.email),
+		"emailHash":     emailHash(client.email),
+		"name":          req.SenderName,
+		"avatar":        req.SenderAvatar,
+		"nameVersion":   req.SenderNameVer,
+		"avatarVersion": req.SenderAvatarVer,
+	})
+	s.sendToSession(frame.SID, client, Frame{
+		T:    "JOIN_ACCEPT",
+		SID:  frame.SID,
+		Data: json.RawMessage(joinData),
+	})
+}
 
-			// Verify if users are actually connected (friends)
-			var friendCount int
-			senderHash := emailHash(client.email)
-			s.db.QueryRow("SELECT COUNT(*) FROM friends WHERE sid = ? AND (user1_hash = ? OR user2_hash = ?)", frame.SID, senderHash, senderHash).Scan(&friendCount)
-			if friendCount == 0 {
-				s.send(client, Frame{
-					T:    "ERROR",
-					Data: json.RawMessage(`{"message":"You cannot send messages to this user because you are not connected."}`),
-				})
-				continue
-			}
+func (s *Server) handleJoinDeny(client *Client, frame Frame) {
+	s.sendToSession(frame.SID, client, Frame{T: "JOIN_DENIED", SID: frame.SID})
+}
 
-			delivered := false
-			s.mu.Lock()
+func (s *Server) handleDeleteAccount(client *Client, frame Frame) {
+	eh := emailHash(client.email)
 
-			sess, ok := s.sessions[frame.SID]
-			if !ok {
-				sess = &Session{
-					id:      frame.SID,
-					clients: map[string]*Client{client.id: client},
-				}
-				s.sessions[frame.SID] = sess
-				log.Printf("[Server] Auto-created session %s from MSG", frame.SID)
-			}
-			s.mu.Unlock()
+	devices, _ := s.store.ListDevices(eh)
+	s.store.DeleteDevices(eh)
+	for _, d := range devices {
+		if d.Status == DeviceActive {
+			s.logKey(eh, d.PublicKey, KeyRemoved)
+		}
+	}
+	s.presence.DisconnectUser(eh)
 
-			sess.mu.Lock()
-			if _, exists := sess.clients[client.id]; !exists {
-				sess.mu.Unlock()
-				s.send(client, Frame{
-					T:    "ERROR",
-					Data: json.RawMessage(`{"message":"Not a member of this session"}`),
-				})
-				continue
-			}
+	friendships, err := s.store.Friendships(eh)
+	if err == nil {
+		for _, f := range friendships {
+			s.sendToSession(f.SID, client, Frame{T: "PEER_OFFLINE", SID: f.SID})
+		}
 
-			recipientCount := 0
-			relayData, _ := json.Marshal(map[string]any{
-				"payloads": msgData.Payloads,
-			})
-			relayFrame := Frame{
-				T:    "MSG",
-				SID:  frame.SID,
-				SH:   emailHash(client.email),
-				Data: json.RawMessage(relayData),
-			}
-			for _, c := range sess.clients {
-				if c.id != client.id {
-					recipientCount++
-					if err := s.send(c, relayFrame); err == nil {
-						delivered = true
-					} else {
-						log.Printf("[Error] Failed to send to %s: %v", c.id, err)
-					}
-				}
-			}
+		s.store.RemoveFriendships(eh)
+	}
+	if groups, err := s.store.UserGroups(eh); err == nil {
+		for _, g := range groups {
+			s.removeFromGroup(g.ID, eh, eh, groupLeft)
+		}
+	}
 
-			log.Printf("[Server] Relayed MSG in %s to %d recipients (Delivered: %v)", frame.SID, recipientCount, delivered)
-			sess.mu.Unlock()
+	log.Printf("[Server] Deleted account for %s", client.email)
+	client.out.closeAfterFlush()
+}
 
-			if frame.C {
-				if delivered {
-					s.send(client, Frame{T: "DELIVERED", SID: frame.SID})
-				} else {
-					s.send(client, Frame{T: "DELIVERED_FAILED", SID: frame.SID})
-				}
-			}
+func (s *Server) handleReattach(client *Client, frame Frame) {
+	if ok, _ := s.store.IsSessionMember(frame.SID, emailHash(client.email)); !ok {
+		s.sendError(client, frame, ErrNotFriends, "Not part of this session")
+		return
+	}
+	peers, _ := s.sessions.join(frame.SID, client, true)
+	online := Frame{
+		T:   "PEER_ONLINE",
+		SID: frame.SID,
+	}
+	for _, c := range peers {
+		s.send(c, online)
+		s.send(client, online)
+	}
+	if s.cluster.sendToSession(frame.SID, online) {
+		s.send(client, online)
+	}
+	s.syncMailbox(client)
 
-		case "RTC_OFFER":
-			if client.email == "" {
-				s.send(client, Frame{
-					T:    "ERROR",
-					Data: json.RawMessage(`{"message":"Auth required"}`),
-				})
-				continue
-			}
-			s.mu.Lock()
-			sess := s.sessions[frame.SID]
-			s.mu.Unlock()
+	log.Printf(
+		"[Server] Client %s reattached to session %s",
+		client.id,
+		frame.SID,
+	)
+}
 
-			if sess == nil {
-				break
-			}
+func (s *Server) handleMsg(client *Client, frame Frame) {
+	if len(frame.SID) == 0 || len(frame.SID) > maxSIDLength {
+		s.sendError(client, frame, ErrInvalidSID, "Invalid session id")
+		return
+	}
+	var msgData struct {
+		Payloads map[string]string `json:"payloads"`
+		Mailbox  bool              `json:"mailbox"`
+		MsgID    string            `json:"msgId"`
+	}
+	if err := json.Unmarshal(frame.Data, &msgData); err != nil || len(msgData.MsgID) > maxMsgIDLength {
+		s.sendError(client, frame, ErrInvalidFrame, "Invalid message format")
+		return
+	}
+	if len(msgData.Payloads) == 0 {
+		s.sendError(client, frame, ErrInvalidFrame, "Message payloads missing")
+		return
+	}
 
-			var targetSocketIDs []string
-			if frame.TargetPubKey != "" {
-				rows, err := s.db.Query("SELECT socket_id FROM sockets WHERE public_key = ?", frame.TargetPubKey)
-				if err == nil {
-					for rows.Next() {
-						var sid string
-						if err := rows.Scan(&sid); err == nil {
-							targetSocketIDs = append(targetSocketIDs, sid)
-						}
-					}
-					rows.Close()
-				}
-			}
+	totalSize := 0
+	for _, p := range msgData.Payloads {
+		totalSize += len(p)
+	}
+	if totalSize > s.cfg.MaxEncryptedDataBytes {
+		s.sendError(client, frame, ErrPayloadTooLarge, "Message payload too large")
+		return
+	}
 
-			sess.mu.Lock()
-			for _, c := range sess.clients {
-				if c.id != client.id {
-					isTarget := false
-					for _, tsid := range targetSocketIDs {
-						if c.id == tsid {
-							isTarget = true
-							break
-						}
-					}
-					if isTarget {
-						s.send(c, frame)
-					}
-				}
-			}
-			sess.mu.Unlock()
-
-		case "RTC_ANSWER":
-			if client.email == "" {
-				s.send(client, Frame{
-					T:    "ERROR",
-					Data: json.RawMessage(`{"message":"Auth required"}`),
-				})
-				continue
-			}
-			s.mu.Lock()
-			sess := s.sessions[frame.SID]
-			s.mu.Unlock()
+	// Verify if users are actually connected (friends)
+	if ok, _ := s.store.IsSessionMember(frame.SID, emailHash(client.email)); !ok {
+		s.sendError(client, frame, ErrNotFriends, "You cannot send messages to this user because you are not connected.")
+		return
+	}
 
-			if sess == nil {
-				break
-			}
+	member, created := s.sessions.ensure(frame.SID, client)
+	if created {
+		log.Printf("[Server] Auto-created session %s from MSG", frame.SID)
+	}
+	if !member {
+		s.sendError(client, frame, ErrNotSessionMember, "Not a member of this session")
+		return
+	}
 
-			var targetSocketIDs []string
-			if frame.TargetPubKey != "" {
-				rows, err := s.db.Query("SELECT socket_id FROM sockets WHERE public_key = ?", frame.TargetPubKey)
-				if err == nil {
-					for rows.Next() {
-						var sid string
-						if err := rows.Scan(&sid); err == nil {
-							targetSocketIDs = append(targetSocketIDs, sid)
-						}
-					}
-					rows.Close()
-				}
-			}
+	reached, offline := s.routePayloads(client, frame.SID, msgData.Payloads)
+	delivered := len(reached) > 0
 
-			sess.mu.Lock()
-			for _, c := range sess.clients {
-				if c.id != client.id {
-					isTarget := false
-					for _, tsid := range targetSocketIDs {
-						if c.id == tsid {
-							isTarget = true
-							break
-						}
-					}
-					if isTarget {
-						s.send(c, frame)
-					}
-				}
-			}
-			sess.mu.Unlock()
-
-		case "RTC_ICE":
-			if client.email == "" {
-				s.send(client, Frame{
-					T:    "ERROR",
-					Data: json.RawMessage(`{"message":"Auth required"}`),
-				})
-				continue
-			}
-			s.mu.Lock()
-			sess := s.sessions[frame.SID]
-			s.mu.Unlock()
+	var queued, full []string
+	if msgData.Mailbox {
+		held := make(map[string]string, len(offline))
+		for _, pk := range offline {
+			held[pk] = msgData.Payloads[pk]
+		}
+		queued, full = s.mailOffline(client, frame, held)
+	}
 
-			if sess == nil {
-				break
-			}
+	log.Printf("[Server] Relayed MSG in %s to %d of %d devices (Queued: %d)", frame.SID, len(reached), len(msgData.Payloads), len(queued))
 
-			var targetSocketIDs []string
-			if frame.TargetPubKey != "" {
-				rows, err := s.db.Query("SELECT socket_id FROM sockets WHERE public_key = ?", frame.TargetPubKey)
-				if err == nil {
-					for rows.Next() {
-						var sid string
-						if err := rows.Scan(&sid); err == nil {
-							targetSocketIDs = append(targetSocketIDs, sid)
-						}
-					}
-					rows.Close()
-				}
-			}
+	if frame.C && client.protocolVersion() >= receiptsProtocolVersion {
+		s.sendDeliveryReport(client, frame, msgData.MsgID, msgData.Payloads, reached, queued)
+		return
+	}
+	if !delivered && len(queued) == 0 && len(full) > 0 {
+		s.sendError(client, frame, ErrMailboxFull, "Recipient mailbox is full")
+		return
+	}
+	if frame.C {
+		result := map[string]any{}
+		if len(offline) > 0 {
+			result["offline"] = offline
+		}
+		if len(queued) > 0 {
+			result["queued"] = queued
+		}
+		if len(full) > 0 {
+			result["full"] = full
+		}
+		var data json.RawMessage
+		if len(result) > 0 {
+			data, _ = json.Marshal(result)
+		}
+		switch {
+		case delivered:
+			s.reply(client, frame, Frame{T: "DELIVERED", SID: frame.SID, Data: data})
+		case len(queued) > 0:
+			s.reply(client, frame, Frame{T: "QUEUED", SID: frame.SID, Data: data})
+		default:
+			s.reply(client, frame, Frame{T: "DELIVERED_FAILED", SID: frame.SID, Data: data})
+		}
+	}
+}
 
-			sess.mu.Lock()
-			for _, c := range sess.clients {
-				if c.id != client.id {
-					isTarget := false
-					for _, tsid := range targetSocketIDs {
-						if c.id == tsid {
-							isTarget = true
-							break
-						}
-					}
-					if isTarget {
-						s.send(c, frame)
-					}
-				}
-			}
-			sess.mu.Unlock()
-
-		case "GET_TURN_CREDS":
-			if client.email == "" {
-				s.send(client, Frame{
-					T:    "ERROR",
-					Data: json.RawMessage(`{"message":"Auth required"}`),
-				})
+// routePayloads sends each session member only the payload keyed by its own
+// device key, on this node or another. It returns the keys that reached a
+// socket and the keys that none took, both sorted. The sender's own key
+// never counts as offline.
+func (s *Server) routePayloads(client *Client, sid string, payloads map[string]string) (reached, offline []string) {
+	_, senderKey := client.identity()
+	sh := emailHash(client.email)
+	peers := s.sessions.peers(sid, client)
+	for pk, payload := range payloads {
+		data, _ := json.Marshal(map[string]any{
+			"payloads": map[string]string{pk: payload},
+		})
+		f := Frame{T: "MSG", SID: sid, SH: sh, Data: json.RawMessage(data)}
+		ok := false
+		for _, c := range s.presence.ClientsForKey(pk) {
+			if !slices.Contains(peers, c) {
 				continue
 			}
-
-			username, password := GenerateTurnCreds(client.email, os.Getenv("TURN_SECRET"))
-			turnHost := os.Getenv("TURN_HOST")
-
-			resp := map[string]any{
-				"urls": []string{
-					"turn:" + turnHost + ":3478?transport=udp",
-					"turn:" + turnHost + ":3478?transport=tcp",
-				},
-				"username":   username,
-				"credential": password,
-				"ttl":        600,
-			}
-
-			respBytes, _ := json.Marshal(resp)
-			s.send(client, Frame{
-				T:    "TURN_CREDS",
-				Data: json.RawMessage(respBytes),
-			})
-
-		case "GET_PUBLIC_KEY":
-			if client.email == "" {
-				s.send(client, Frame{
-					T:    "ERROR",
-					Data: json.RawMessage(`{"message":"Auth required"}`),
-				})
-				continue
+			if err := s.send(c, f); err == nil {
+				ok = true
+			} else {
+				log.Printf("[Error] Failed to send to %s: %v", c.id, err)
 			}
+		}
+		if s.cluster.sendToKey(sid, pk, f) {
+			ok = true
+		}
+		switch {
+		case ok:
+			reached = append(reached, pk)
+		case pk != senderKey:
+			offline = append(offline, pk)
+		}
+	}
+	slices.Sort(reached)
+	slices.Sort(offline)
+	return reached, offline
+}
 
-			var d struct {
-				TargetEmail string `json:"targetEmail"`
-			}
-			json.Unmarshal(frame.Data, &d)
+// handleRTC relays RTC_OFFER, RTC_ANSWER and RTC_ICE to the session member
+// that owns frame.TargetPubKey.
+func (s *Server) handleRTC(client *Client, frame Frame) {
+	if frame.TargetPubKey == "" {
+		return
+	}
+	// The request ID belongs to the sender.
+	frame.ID = ""
 
-			targetHash := emailHash(d.TargetEmail)
+	peers := s.sessions.peers(frame.SID, client)
+	for _, c := range s.presence.ClientsForKey(frame.TargetPubKey) {
+		if slices.Contains(peers, c) {
+			s.send(c, frame)
+		}
+	}
+	s.cluster.sendToKey(frame.SID, frame.TargetPubKey, frame)
+}
 
-			var pubKey string
-			err := s.db.QueryRow("SELECT public_key FROM devices WHERE email_hash = ? AND is_master = 1 LIMIT 1", targetHash).Scan(&pubKey)
-			if err != nil {
-				err = s.db.QueryRow("SELECT public_key FROM devices WHERE email_hash = ? ORDER BY last_active DESC LIMIT 1", targetHash).Scan(&pubKey)
-			}
+func (s *Server) handleGetTurnCreds(client *Client, frame Frame) {
+	username, password := GenerateTurnCreds(client.email, s.cfg.TurnSecret)
+	turnAddr := net.JoinHostPort(s.cfg.TurnHost, strconv.Itoa(s.cfg.TurnPort))
+
+	resp := map[string]any{
+		"urls": []string{
+			"turn:" + turnAddr + "?transport=udp",
+			"turn:" + turnAddr + "?transport=tcp",
+		},
+		"username":   username,
+		"credential": password,
+		"ttl":        600,
+	}
 
-			if pubKey != "" {
-				resp, _ := json.Marshal(map[string]any{
-					"publicKey":   pubKey,
-					"targetEmail": d.TargetEmail,
-				})
-				s.send(client, Frame{
-					T:    "PUBLIC_KEY",
-					Data: json.RawMessage(resp),
-				})
-			} else {
-				resp, _ := json.Marshal(map[string]any{
-					"targetEmail": d.TargetEmail,
-				})
-				s.send(client, Frame{
-					T:    "PUBLIC_KEY",
-					Data: json.RawMessage(resp),
-				})
-			}
+	respBytes, _ := json.Marshal(resp)
+	s.reply(client, frame, Frame{
+		T:    "TURN_CREDS",
+		Data: json.RawMessage(respBytes),
+	})
+}
 
+func (s *Server) handleGetPublicKey(client *Client, frame Frame) {
+	var d struct {
+		TargetEmail string `json:"targetEmail"`
+		TreeSize    int64  `json:"treeSize"`
+	}
+	json.Unmarshal(frame.Data, &d)
+
+	targetHash := emailHash(d.TargetEmail)
+	pubKey, _ := s.store.PrimaryDeviceKey(targetHash)
+
+	resp := map[string]any{"targetEmail": d.TargetEmail}
+	if pubKey != "" {
+		resp["publicKey"] = pubKey
+		resp["keyProof"] = s.keyProof(targetHash, []string{pubKey}, d.TreeSize)
+		if dev, err := s.store.Device(targetHash, pubKey); err == nil && dev.CrossSignature != "" {
+			resp["crossSignature"] = dev.CrossSignature
+			resp["crossSignedBy"] = dev.CrossSignedBy
 		}
 	}
+	respBytes, _ := json.Marshal(resp)
+	s.reply(client, frame, Frame{
+		T:    "PUBLIC_KEY",
+		Data: json.RawMessage(respBytes),
+	})
 }
@@ -0,0 +1,125 @@
+package main
+
+import "encoding/json"
+
+// Clients open with HELLO, before AUTH, to say which protocol version,
+// frame types and codecs they speak. The server answers WELCOME with its own
+// version, frame types and limits, or HELLO_REJECTED if the client is older
+// than minProtocolVersion. A client that goes straight to AUTH is taken to
+// speak version 0, the protocol from before the handshake existed.
+
+// protocolVersion is the newest protocol this server speaks.
+//
+//	1: HELLO/WELCOME, request IDs and error codes
+//	2: notification seq numbers and NOTIF_ACK
+//	3: store-and-forward mailbox and MAILBOX_ACK
+//	4: DELIVERY_REPORT and READ_RECEIPT
+//	5: groups
+//	6: MLS delivery service
+//	7: device linking and approval
+//	8: device revocation and remote wipe
+//	9: master transfer and recovery
+//	10: key transparency log
+//	11: X3DH prekey bundles
+//	12: key directory
+//	13: cross-signed device keys
+//	14: device key rotation
+const protocolVersion = 14
+
+const maxHelloDataBytes = 16 * 1024
+
+// buildVersion identifies the server build in WELCOME. Release builds set it
+// with -ldflags "-X main.buildVersion=...".
+var buildVersion = "dev"
+
+type clientHello struct {
+	ProtocolVersion int      `json:"protocolVersion"`
+	ClientBuild     string   `json:"clientBuild"`
+	Frames          []string `json:"frames"`
+	Codecs          []string `json:"codecs"`
+}
+
+func init() {
+	RegisterFrame("HELLO", (*Server).handleHello, rateLimit(defaultFramesPerSecond), maxPayload(maxHelloDataBytes))
+}
+
+// protocolVersion returns the version c announced in HELLO, or 0.
+func (c *Client) protocolVersion() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.hello == nil {
+		return 0
+	}
+	return c.hello.ProtocolVersion
+}
+
+func (s *Server) handleHello(client *Client, frame Frame) {
+	if client.authedEmail() != "" {
+		s.sendError(client, frame, ErrAlreadyAuthed, "HELLO must be sent before AUTH")
+		return
+	}
+	var hello clientHello
+	if err := json.Unmarshal(frame.Data, &hello); err != nil {
+		s.sendError(client, frame, ErrInvalidFrame, "Invalid HELLO")
+		return
+	}
+	if hello.ProtocolVersion < s.cfg.MinProtocolVersion {
+		s.rejectProtocol(client, frame, hello.ProtocolVersion)
+		return
+	}
+
+	client.mu.Lock()
+	client.hello = &hello
+	client.mu.Unlock()
+	s.logger.Printf("HELLO: %s speaks protocol %d, build %q", client.id, hello.ProtocolVersion, hello.ClientBuild)
+
+	codec := subprotocolJSON
+	if client.conn != nil && client.conn.Subprotocol() != "" {
+		codec = client.conn.Subprotocol()
+	}
+	welcome, _ := json.Marshal(map[string]any{
+		"protocolVersion":    protocolVersion,
+		"minProtocolVersion": s.cfg.MinProtocolVersion,
+		"serverBuild":        buildVersion,
+		"codec":              codec,
+		"codecs":             upgrader.Subprotocols,
+		"frames":             s.frames.Types(),
+		"keyLogPublicKey":    s.keyLog.publicKey(),
+		"limits": map[string]int{
+			"maxFrameBytes":     s.cfg.MaxFrameBytes,
+			"maxPayloadBytes":   s.cfg.MaxEncryptedDataBytes,
+			"framesPerSecond":   defaultFramesPerSecond,
+			"msgsPerSecond":     s.cfg.MaxMsgsPerSecond,
+			"mailboxQuotaBytes": s.cfg.MailboxQuotaBytes,
+			"groupMembers":      maxGroupMembers,
+		},
+	})
+	s.reply(client, frame, Frame{T: "WELCOME", Data: welcome})
+}
+
+// rejectProtocol tells a client its protocol version is too old and closes
+// the connection.
+func (s *Server) rejectProtocol(client *Client, req Frame, version int) {
+	code := ErrUnsupportedProtocol
+	data, _ := json.Marshal(map[string]any{
+		"code":               code,
+		"message":            "This app is too old for the server. Please update it.",
+		"retry":              code.retry(),
+		"protocolVersion":    version,
+		"minProtocolVersion": s.cfg.MinProtocolVersion,
+	})
+	s.reply(client, req, Frame{T: "HELLO_REJECTED", Data: data})
+	client.out.closeAfterFlush()
+}
+
+// requireProtocol rejects frames from clients below minProtocolVersion,
+// including clients that never sent HELLO.
+func requireProtocol(next FrameHandler) FrameHandler {
+	return func(s *Server, c *Client, f Frame) {
+		if v := c.protocolVersion(); v < s.cfg.MinProtocolVersion {
+			s.rejectProtocol(c, f, v)
+			return
+		}
+		next(s, c, f)
+	}
+}
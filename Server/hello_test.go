@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func startHelloServer(t *testing.T, minVersion int) string {
+	t.Helper()
+	cfg := testConfig()
+	cfg.MinProtocolVersion = minVersion
+	s := newServer(cfg, newMemoryStore(), log.New(io.Discard, "", 0))
+	ts := httptest.NewServer(http.HandlerFunc(s.handle))
+	t.Cleanup(ts.Close)
+	return "ws" + strings.TrimPrefix(ts.URL, "http")
+}
+
+func dialTest(t *testing.T, url string) *websocket.Conn {
+	t.Helper()
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func sendHello(conn *websocket.Conn, version int) {
+	data, _ := json.Marshal(clientHello{
+		ProtocolVersion: version,
+		ClientBuild:     "test-1.0",
+		Frames:          []string{"WELCOME", "MSG"},
+		Codecs:          []string{subprotocolJSON},
+	})
+	conn.WriteJSON(Frame{T: "HELLO", Data: data})
+}
+
+func TestHelloWelcome(t *testing.T) {
+	conn := dialTest(t, startHelloServer(t, 0))
+	sendHello(conn, protocolVersion)
+
+	var welcome struct {
+		ProtocolVersion int            `json:"protocolVersion"`
+		Codec           string         `json:"codec"`
+		Codecs          []string       `json:"codecs"`
+		Frames          []string       `json:"frames"`
+		Limits          map[string]int `json:"limits"`
+	}
+	json.Unmarshal(waitFrame(t, conn, "WELCOME").Data, &welcome)
+	if welcome.ProtocolVersion != protocolVersion || welcome.Codec != subprotocolJSON {
+		t.Fatalf("WELCOME = %+v", welcome)
+	}
+	for _, frame := range []string{"HELLO", "AUTH", "MSG"} {
+		if !slices.Contains(welcome.Frames, frame) {
+			t.Errorf("WELCOME frames missing %s: %v", frame, welcome.Frames)
+		}
+	}
+	if !slices.Contains(welcome.Codecs, subprotocolMsgpack) {
+		t.Errorf("WELCOME codecs = %v", welcome.Codecs)
+	}
+	cfg := testConfig()
+	if welcome.Limits["maxFrameBytes"] != cfg.MaxFrameBytes || welcome.Limits["msgsPerSecond"] != cfg.MaxMsgsPerSecond {
+		t.Errorf("WELCOME limits = %v", welcome.Limits)
+	}
+
+	auth, _ := json.Marshal(map[string]string{"token": getTestSessionToken("hello@example.com"), "publicKey": "pk"})
+	conn.WriteJSON(Frame{T: "AUTH", Data: auth})
+	waitFrame(t, conn, "AUTH_SUCCESS")
+
+	sendHello(conn, protocolVersion)
+	if f := waitFrame(t, conn, "ERROR"); !strings.Contains(string(f.Data), string(ErrAlreadyAuthed)) {
+		t.Fatalf("HELLO after AUTH: %s", f.Data)
+	}
+}
+
+func TestLegacyClientsSkipHello(t *testing.T) {
+	conn := dialTest(t, startHelloServer(t, 0))
+	auth, _ := json.Marshal(map[string]string{"token": getTestSessionToken("legacy@example.com"), "publicKey": "pk-legacy"})
+	conn.WriteJSON(Frame{T: "AUTH", Data: auth})
+	waitFrame(t, conn, "AUTH_SUCCESS")
+}
+
+func TestOldProtocolRejected(t *testing.T) {
+	url := startHelloServer(t, protocolVersion)
+	auth, _ := json.Marshal(map[string]string{"token": getTestSessionToken("old@example.com")})
+
+	for name, open := range map[string]func(*websocket.Conn){
+		"old HELLO": func(conn *websocket.Conn) { sendHello(conn, protocolVersion-1) },
+		"no HELLO":  func(conn *websocket.Conn) { conn.WriteJSON(Frame{T: "AUTH", Data: auth}) },
+	} {
+		t.Run(name, func(t *testing.T) {
+			conn := dialTest(t, url)
+			open(conn)
+			var reason struct {
+				Code               ErrorCode `json:"code"`
+				MinProtocolVersion int       `json:"minProtocolVersion"`
+			}
+			json.Unmarshal(waitFrame(t, conn, "HELLO_REJECTED").Data, &reason)
+			if reason.Code != ErrUnsupportedProtocol || reason.MinProtocolVersion != protocolVersion {
+				t.Fatalf("rejection = %+v", reason)
+			}
+			var f Frame
+			if err := conn.ReadJSON(&f); err == nil {
+				t.Fatalf("connection still open, got %s", f.T)
+			}
+		})
+	}
+}
@@ -0,0 +1,360 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Every device key the server hands out is in an append-only key
+// transparency log (see merkle.go). A key is added when its device is
+// approved, removed when it is revoked or its account deleted, and marked
+// when it becomes master. Frames that carry keys also carry a keyProof: a
+// tree head signed with the log key, an inclusion proof for each key, and a
+// consistency proof from the tree size the client last saw, when it says
+// which. A client that keeps the heads it has seen can tell if the server
+// shows it a key that is not in the log, or rewrites the log.
+
+func init() {
+	RegisterFrame("GET_KEY_LOG_HEAD", (*Server).handleGetKeyLogHead, requireAuth, rateLimit(defaultFramesPerSecond))
+}
+
+// keyLog is this node's copy of the log's Merkle tree. The store is the
+// source of truth; other nodes append to it too, so the tree catches up
+// before every use.
+type keyLog struct {
+	mu    sync.Mutex
+	store Store
+	key   ed25519.PrivateKey
+	tree  merkleTree
+	head  *treeHead // signed head of the tree as it is, nil after it grew
+}
+
+// treeHead is a signed tree head. Byte slices are base64 in JSON.
+type treeHead struct {
+	TreeSize  int64  `json:"treeSize"`
+	RootHash  []byte `json:"rootHash"`
+	Timestamp int64  `json:"timestamp"` // Unix milliseconds
+	Signature []byte `json:"signature"`
+}
+
+func (h treeHead) signedMessage() []byte {
+	return signedMessage("TREE_HEAD", strconv.FormatInt(h.TreeSize, 10), strconv.FormatInt(h.Timestamp, 10),
+		base64.StdEncoding.EncodeToString(h.RootHash))
+}
+
+// keyProof is what frames with keys carry.
+type keyProof struct {
+	TreeHead    treeHead                `json:"treeHead"`
+	Consistency [][]byte                `json:"consistency,omitempty"`
+	Inclusion   map[string]keyInclusion `json:"inclusion,omitempty"` // by public key
+}
+
+// keyInclusion proves the newest KeyAdded entry of a key. The client
+// rebuilds the leaf from the entry's fields and the key it was given.
+type keyInclusion struct {
+	LeafIndex int64    `json:"leafIndex"`
+	Timestamp int64    `json:"timestamp"` // of the entry, Unix seconds
+	Path      [][]byte `json:"path"`
+}
+
+// leaf is the entry as hashed into the tree.
+func (e KeyLogEntry) leaf() []byte {
+	return []byte(fmt.Sprintf("%s\n%s\n%s\n%d", e.Action, e.EmailHash, e.PublicKey, e.CreatedAt.Unix()))
+}
+
+// keyLogKey derives the tree head signing key from keyLogSecret, or from
+// the session secret when that is not set, so every node signs with the
+// same key.
+func keyLogKey(cfg *Config) ed25519.PrivateKey {
+	secret := cfg.KeyLogSecret
+	if strings.TrimSpace(secret) == "" {
+		secret = "session:" + cfg.AuthSessionSecret
+	}
+	seed := sha256.Sum256([]byte("cryptnode key log\n" + strings.TrimSpace(secret)))
+	return ed25519.NewKeyFromSeed(seed[:])
+}
+
+func newKeyLog(store Store, key ed25519.PrivateKey) *keyLog {
+	return &keyLog{store: store, key: key}
+}
+
+func (l *keyLog) publicKey() string {
+	return base64.StdEncoding.EncodeToString(l.key.Public().(ed25519.PublicKey))
+}
+
+// syncLocked adds the entries other nodes appended.
+func (l *keyLog) syncLocked() error {
+	entries, err := l.store.KeyLogEntries(l.tree.size())
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if e.Index != l.tree.size() {
+			return fmt.Errorf("key log entry %d out of order", e.Index)
+		}
+		l.tree.append(e.leaf())
+		l.head = nil
+	}
+	return nil
+}
+
+func (l *keyLog) append(e KeyLogEntry) error {
+	if _, err := l.store.AppendKeyLog(e); err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.syncLocked()
+}
+
+func (l *keyLog) headLocked() treeHead {
+	if l.head == nil {
+		n := l.tree.size()
+		h := treeHead{TreeSize: n, RootHash: l.tree.root(n), Timestamp: time.Now().UnixMilli()}
+		h.Signature = ed25519.Sign(l.key, h.signedMessage())
+		l.head = &h
+	}
+	return *l.head
+}
+
+// proof builds a keyProof for keys of emailHash against the current tree,
+// with a consistency proof from fromSize when it is a smaller tree. Keys
+// without an entry are left out.
+func (l *keyLog) proof(emailHash string, keys []string, fromSize int64) (*keyProof, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.syncLocked(); err != nil {
+		return nil, err
+	}
+	n := l.tree.size()
+	p := &keyProof{TreeHead: l.headLocked(), Consistency: l.tree.consistencyProof(fromSize, n)}
+	for _, pk := range keys {
+		if pk == "" {
+			continue
+		}
+		e, err := l.store.LastKeyAdded(emailHash, pk)
+		if err != nil || e.Index >= n {
+			continue
+		}
+		if p.Inclusion == nil {
+			p.Inclusion = make(map[string]keyInclusion)
+		}
+		p.Inclusion[pk] = keyInclusion{LeafIndex: e.Index, Timestamp: e.CreatedAt.Unix(), Path: l.tree.inclusionProof(e.Index, n)}
+	}
+	return p, nil
+}
+
+// logKey appends an entry for a device key.
+func (s *Server) logKey(emailHash, publicKey, action string) {
+	if publicKey == "" {
+		return
+	}
+	e := KeyLogEntry{EmailHash: emailHash, PublicKey: publicKey, Action: action, CreatedAt: time.Now()}
+	if err := s.keyLog.append(e); err != nil {
+		log.Printf("[Error] Failed to log %s of a key for %s: %v", action, emailHash, err)
+	}
+}
+
+// keyProof returns the proof to send with keys of emailHash, or nil when the
+// log cannot be read.
+func (s *Server) keyProof(emailHash string, keys []string, fromSize int64) *keyProof {
+	p, err := s.keyLog.proof(emailHash, keys, fromSize)
+	if err != nil {
+		log.Printf("[Error] Failed to build key proof for %s: %v", emailHash, err)
+		return nil
+	}
+	return p
+}
+
+func (s *Server) handleGetKeyLogHead(client *Client, frame Frame) {
+	var d struct {
+		TreeSize int64 `json:"treeSize"`
+	}
+	json.Unmarshal(frame.Data, &d)
+	p := s.keyProof("", nil, d.TreeSize)
+	if p == nil {
+		s.sendError(client, frame, ErrInternal, "Failed to read the key log")
+		return
+	}
+	data, _ := json.Marshal(p)
+	s.reply(client, frame, Frame{T: "KEY_LOG_HEAD", Data: data})
+}
+
+// savedKeyLog is the file format of keylog export and audit.
+type savedKeyLog struct {
+	PublicKey string          `json:"publicKey"`
+	TreeHead  treeHead        `json:"treeHead"`
+	Entries   []savedLogEntry `json:"entries"`
+}
+
+type savedLogEntry struct {
+	Index     int64  `json:"index"`
+	EmailHash string `json:"emailHash"`
+	PublicKey string `json:"publicKey"`
+	Action    string `json:"action"`
+	Timestamp int64  `json:"timestamp"` // Unix seconds
+}
+
+func (e savedLogEntry) entry() KeyLogEntry {
+	return KeyLogEntry{Index: e.Index, EmailHash: e.EmailHash, PublicKey: e.PublicKey, Action: e.Action, CreatedAt: time.Unix(e.Timestamp, 0)}
+}
+
+// runKeyLogCommand runs "keylog export [file]", which saves the log with a
+// fresh signed head, and "keylog audit <file> [older file]", which checks a
+// saved log and, given an older copy, that the log only grew since.
+func runKeyLogCommand(cfg *Config, args []string, out io.Writer) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: keylog export [file] | audit <file> [older file]")
+	}
+	switch args[0] {
+	case "export":
+		if err := cfg.validateStore(); err != nil {
+			return err
+		}
+		store, err := connectSQLStore(cfg.StoreDriver, cfg.StoreDSN)
+		if err != nil {
+			return err
+		}
+		defer store.Close()
+		w := out
+		if len(args) > 1 {
+			f, err := os.Create(args[1])
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			w = f
+		}
+		return exportKeyLog(newKeyLog(store, keyLogKey(cfg)), w)
+	case "audit":
+		if len(args) < 2 {
+			return fmt.Errorf("usage: keylog audit <file> [older file]")
+		}
+		saved, err := readSavedKeyLog(args[1])
+		if err != nil {
+			return err
+		}
+		var older *savedKeyLog
+		if len(args) > 2 {
+			if older, err = readSavedKeyLog(args[2]); err != nil {
+				return err
+			}
+		}
+		if err := auditKeyLog(saved, older); err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "key log OK: %d entries, root %x, signed by %s\n",
+			saved.TreeHead.TreeSize, saved.TreeHead.RootHash, saved.PublicKey)
+		return nil
+	default:
+		return fmt.Errorf("unknown keylog command %q", args[0])
+	}
+}
+
+func exportKeyLog(l *keyLog, w io.Writer) error {
+	l.mu.Lock()
+	err := l.syncLocked()
+	head := l.headLocked()
+	l.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	entries, err := l.store.KeyLogEntries(0)
+	if err != nil {
+		return err
+	}
+
+	saved := savedKeyLog{PublicKey: l.publicKey(), TreeHead: head}
+	for _, e := range entries[:head.TreeSize] {
+		saved.Entries = append(saved.Entries, savedLogEntry{
+			Index: e.Index, EmailHash: e.EmailHash, PublicKey: e.PublicKey, Action: e.Action, Timestamp: e.CreatedAt.Unix(),
+		})
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(saved)
+}
+
+func readSavedKeyLog(path string) (*savedKeyLog, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var saved savedKeyLog
+	if err := json.Unmarshal(b, &saved); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return &saved, nil
+}
+
+// auditKeyLog checks that saved is a well-formed log whose signed head
+// matches its entries, and that older, if given, is a prefix of it.
+func auditKeyLog(saved, older *savedKeyLog) error {
+	raw, err := base64.StdEncoding.DecodeString(saved.PublicKey)
+	if err != nil || len(raw) != ed25519.PublicKeySize {
+		return errors.New("bad log public key")
+	}
+	pub := ed25519.PublicKey(raw)
+
+	var tree merkleTree
+	live := make(map[[2]string]bool) // email hash, public key
+	for i, se := range saved.Entries {
+		e := se.entry()
+		if e.Index != int64(i) {
+			return fmt.Errorf("entry %d has index %d", i, e.Index)
+		}
+		key := [2]string{e.EmailHash, e.PublicKey}
+		switch e.Action {
+		case KeyAdded:
+			// A key pruned for inactivity is added again when it comes back.
+			live[key] = true
+		case KeyRemoved, KeyMaster:
+			if !live[key] {
+				return fmt.Errorf("entry %d: %s of a key that was never added", i, e.Action)
+			}
+			if e.Action == KeyRemoved {
+				delete(live, key)
+			}
+		default:
+			return fmt.Errorf("entry %d: unknown action %q", i, e.Action)
+		}
+		tree.append(e.leaf())
+	}
+
+	head := saved.TreeHead
+	if !ed25519.Verify(pub, head.signedMessage(), head.Signature) {
+		return errors.New("tree head signature does not verify")
+	}
+	if head.TreeSize != tree.size() || string(head.RootHash) != string(tree.root(head.TreeSize)) {
+		return fmt.Errorf("tree head (size %d) does not match the %d entries", head.TreeSize, tree.size())
+	}
+
+	if older != nil {
+		old := older.TreeHead
+		if older.PublicKey != saved.PublicKey {
+			return errors.New("older log was signed with another key")
+		}
+		if !ed25519.Verify(pub, old.signedMessage(), old.Signature) {
+			return errors.New("older tree head signature does not verify")
+		}
+		if old.TreeSize > head.TreeSize {
+			return fmt.Errorf("log shrank from %d to %d entries", old.TreeSize, head.TreeSize)
+		}
+		proof := tree.consistencyProof(old.TreeSize, head.TreeSize)
+		if err := verifyConsistency(old.TreeSize, head.TreeSize, old.RootHash, head.RootHash, proof); err != nil {
+			return fmt.Errorf("log is not an extension of the older one: %w", err)
+		}
+	}
+	return nil
+}
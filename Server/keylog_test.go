@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+// checkKeyProof verifies p the way a client would: the head is signed by
+// the log key and each key in keys is in the tree.
+func checkKeyProof(t *testing.T, p keyProof, logKey, emailHash string, keys ...string) {
+	t.Helper()
+	pub, _ := base64.StdEncoding.DecodeString(logKey)
+	if !ed25519.Verify(pub, p.TreeHead.signedMessage(), p.TreeHead.Signature) {
+		t.Fatal("tree head signature does not verify")
+	}
+	for _, pk := range keys {
+		inc, ok := p.Inclusion[pk]
+		if !ok {
+			t.Fatalf("no inclusion proof for %s", pk)
+		}
+		leaf := KeyLogEntry{EmailHash: emailHash, PublicKey: pk, Action: KeyAdded, CreatedAt: time.Unix(inc.Timestamp, 0)}.leaf()
+		if err := verifyInclusion(leaf, inc.LeafIndex, p.TreeHead.TreeSize, inc.Path, p.TreeHead.RootHash); err != nil {
+			t.Fatalf("inclusion of %s: %v", pk, err)
+		}
+	}
+}
+
+func TestKeyLogProofs(t *testing.T) {
+	s, store, url := newTestServer(t)
+	const alice, bob = "alice@example.com", "bob@example.com"
+	aliceHash, bobHash := emailHash(alice), emailHash(bob)
+	store.AddFriendship(Friendship{User1Hash: aliceHash, User2Hash: bobHash, SID: "sid-ab", Since: time.Now()})
+
+	conn := dialTest(t, url)
+	sendHello(conn, protocolVersion)
+	var welcome struct{ KeyLogPublicKey string }
+	json.Unmarshal(waitFrame(t, conn, "WELCOME").Data, &welcome)
+	if welcome.KeyLogPublicKey != s.keyLog.publicKey() {
+		t.Fatalf("WELCOME keyLogPublicKey = %q", welcome.KeyLogPublicKey)
+	}
+	b := authDevice(t, url, bob, "pk-bob", protocolVersion)
+	waitFrame(t, b, "SESSION_LIST")
+
+	// Alice's first key is logged and proven in her session list.
+	auth, _ := json.Marshal(map[string]any{"token": getTestSessionToken(alice), "publicKey": "pk-alice"})
+	conn.WriteJSON(Frame{T: "AUTH", Data: auth})
+	var sessions []struct {
+		PeerPubKeys []string
+		KeyProof    keyProof
+	}
+	json.Unmarshal(waitFrame(t, conn, "SESSION_LIST").Data, &sessions)
+	if len(sessions) != 1 {
+		t.Fatalf("SESSION_LIST = %+v", sessions)
+	}
+	checkKeyProof(t, sessions[0].KeyProof, welcome.KeyLogPublicKey, bobHash, "pk-bob")
+	old := sessions[0].KeyProof.TreeHead
+
+	// Bob sees her key proven in PEER_ONLINE.
+	var online struct{ KeyProof keyProof }
+	json.Unmarshal(waitFrame(t, b, "PEER_ONLINE").Data, &online)
+	checkKeyProof(t, online.KeyProof, welcome.KeyLogPublicKey, aliceHash, "pk-alice")
+
+	// A lookup after the tree grew comes with a consistency proof from the
+	// head the client saw.
+	s.logKey(emailHash("carol@example.com"), "pk-carol", KeyAdded)
+	d, _ := json.Marshal(map[string]any{"targetEmail": bob, "treeSize": old.TreeSize})
+	conn.WriteJSON(Frame{T: "GET_PUBLIC_KEY", ID: "k1", Data: d})
+	var lookup struct {
+		PublicKey string
+		KeyProof  keyProof
+	}
+	json.Unmarshal(waitFrame(t, conn, "PUBLIC_KEY").Data, &lookup)
+	checkKeyProof(t, lookup.KeyProof, welcome.KeyLogPublicKey, bobHash, lookup.PublicKey)
+	head := lookup.KeyProof.TreeHead
+	if head.TreeSize != old.TreeSize+1 {
+		t.Fatalf("tree size %d after one append to %d", head.TreeSize, old.TreeSize)
+	}
+	if err := verifyConsistency(old.TreeSize, head.TreeSize, old.RootHash, head.RootHash, lookup.KeyProof.Consistency); err != nil {
+		t.Fatalf("consistency: %v", err)
+	}
+
+	d, _ = json.Marshal(map[string]any{"treeSize": 1})
+	conn.WriteJSON(Frame{T: "GET_KEY_LOG_HEAD", ID: "h1", Data: d})
+	var latest keyProof
+	json.Unmarshal(waitFrame(t, conn, "KEY_LOG_HEAD").Data, &latest)
+	first := s.keyLog.tree.root(1)
+	if err := verifyConsistency(1, latest.TreeHead.TreeSize, first, latest.TreeHead.RootHash, latest.Consistency); err != nil {
+		t.Fatalf("KEY_LOG_HEAD consistency: %v", err)
+	}
+}
+
+func TestKeyLogAudit(t *testing.T) {
+	store := newMemoryStore()
+	l := newKeyLog(store, keyLogKey(testConfig()))
+	add := func(eh, pk, action string) {
+		if err := l.append(KeyLogEntry{EmailHash: eh, PublicKey: pk, Action: action, CreatedAt: time.Now()}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	save := func() *savedKeyLog {
+		var buf bytes.Buffer
+		if err := exportKeyLog(l, &buf); err != nil {
+			t.Fatal(err)
+		}
+		var saved savedKeyLog
+		if err := json.Unmarshal(buf.Bytes(), &saved); err != nil {
+			t.Fatal(err)
+		}
+		return &saved
+	}
+
+	add("a", "k1", KeyAdded)
+	add("a", "k2", KeyAdded)
+	older := save()
+	add("a", "k2", KeyMaster)
+	add("a", "k1", KeyRemoved)
+	saved := save()
+	if err := auditKeyLog(saved, older); err != nil {
+		t.Fatalf("audit of an honest log: %v", err)
+	}
+
+	// A key slipped into the history is caught.
+	forged := *saved
+	forged.Entries = append([]savedLogEntry(nil), saved.Entries...)
+	forged.Entries[1].PublicKey = "evil"
+	if auditKeyLog(&forged, nil) == nil {
+		t.Fatal("audit passed a rewritten entry")
+	}
+	// So is a history rewritten and re-signed with the log key, against an
+	// older copy.
+	rewritten := newKeyLog(newMemoryStore(), l.key)
+	for i, e := range saved.Entries {
+		rewritten.append(e.entry())
+		if i == 0 {
+			rewritten.append(KeyLogEntry{EmailHash: "a", PublicKey: "evil", Action: KeyAdded, CreatedAt: time.Now()})
+		}
+	}
+	var buf bytes.Buffer
+	exportKeyLog(rewritten, &buf)
+	var resigned savedKeyLog
+	json.Unmarshal(buf.Bytes(), &resigned)
+	if err := auditKeyLog(&resigned, nil); err != nil {
+		t.Fatalf("re-signed log should be well-formed: %v", err)
+	}
+	if auditKeyLog(&resigned, older) == nil {
+		t.Fatal("audit passed a log that does not extend the older copy")
+	}
+	// Removing a key that was never added is malformed.
+	bad := *saved
+	bad.Entries = append(append([]savedLogEntry(nil), saved.Entries...), savedLogEntry{Index: 4, EmailHash: "a", PublicKey: "k9", Action: KeyRemoved})
+	if auditKeyLog(&bad, nil) == nil {
+		t.Fatal("audit passed the removal of an unknown key")
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"slices"
+	"time"
+)
+
+// The mailbox holds MSG ciphertexts for devices that are offline when the
+// message is sent. Senders opt in per message with "mailbox": true; the
+// server opts in with a non-zero mailboxQuotaBytes. Each device's payload is
+// stored on its own, delivered as an ordinary MSG with a mailboxId on the
+// device's next AUTH or REATTACH, and deleted when the device sends
+// MAILBOX_ACK. Clients older than protocol 3 cannot ack, so for them
+// delivery counts as the ack. Mail that is never acked expires after
+// mailboxTTLHours.
+
+// mailboxProtocolVersion is the first protocol version that sends
+// MAILBOX_ACK.
+const mailboxProtocolVersion = 3
+
+func init() {
+	RegisterFrame("MAILBOX_ACK", (*Server).handleMailboxAck, requireAuth, requireApprovedDevice, rateLimit(defaultFramesPerSecond))
+}
+
+// mailOffline stores the payloads addressed to devices of the session's
+// users that no socket took. It returns the keys it stored mail
+// for and the keys whose payload was refused because the owner's mailbox is
+// full.
+func (s *Server) mailOffline(sender *Client, frame Frame, payloads map[string]string) (queued, full []string) {
+	if s.cfg.MailboxQuotaBytes == 0 {
+		return nil, nil
+	}
+	email, senderKey := sender.identity()
+	senderHash := emailHash(email)
+
+	now := time.Now()
+	for _, u := range s.sessionUsers(frame.SID, senderHash) {
+		devices, err := s.store.ListDevices(u)
+		if err != nil {
+			log.Printf("[Error] Failed to list devices for mailbox: %v", err)
+			continue
+		}
+		stored := false
+		for _, d := range devices {
+			payload, ok := payloads[d.PublicKey]
+			if !ok || d.PublicKey == senderKey || d.Status != DeviceActive {
+				continue
+			}
+			ok, err := s.store.PutMail(Mail{
+				RecipientHash: u,
+				PublicKey:     d.PublicKey,
+				SID:           frame.SID,
+				SenderHash:    senderHash,
+				Payload:       payload,
+				Priority:      frame.P,
+				CreatedAt:     now,
+				ExpiresAt:     now.Add(time.Duration(s.cfg.MailboxTTLHours) * time.Hour),
+			}, s.cfg.MailboxQuotaBytes)
+			switch {
+			case err != nil:
+				log.Printf("[Error] Failed to store mail for %s: %v", u, err)
+			case !ok:
+				full = append(full, d.PublicKey)
+			default:
+				queued = append(queued, d.PublicKey)
+				stored = true
+			}
+		}
+		if stored {
+			// The device may have connected since the message was routed.
+			s.syncUser(u)
+		}
+	}
+	slices.Sort(queued)
+	slices.Sort(full)
+	return queued, full
+}
+
+// syncMailbox sends c the mail held for its device that this connection has
+// not already sent.
+func (s *Server) syncMailbox(c *Client) {
+	email, publicKey := c.identity()
+	if email == "" || c.devicePending() || s.cfg.MailboxQuotaBytes == 0 {
+		return
+	}
+	eh := emailHash(email)
+
+	c.syncMu.Lock()
+	defer c.syncMu.Unlock()
+	mail, err := s.store.PendingMail(eh, publicKey, time.Now())
+	if err != nil {
+		log.Printf("[Error] Failed to load mail for %s: %v", c.id, err)
+		return
+	}
+	acks := c.protocolVersion() >= mailboxProtocolVersion
+	for _, m := range mail {
+		if c.mailSent[m.ID] {
+			continue
+		}
+		data, _ := json.Marshal(map[string]any{
+			"payloads":  map[string]string{publicKey: m.Payload},
+			"mailboxId": m.ID,
+			"sentAt":    m.CreatedAt,
+		})
+		if s.send(c, Frame{T: "MSG", SID: m.SID, SH: m.SenderHash, P: m.Priority, Data: data}) != nil {
+			return
+		}
+		if !acks {
+			s.store.DeleteMail(eh, publicKey, m.ID)
+			continue
+		}
+		if c.mailSent == nil {
+			c.mailSent = make(map[int64]bool)
+		}
+		c.mailSent[m.ID] = true
+	}
+}
+
+// syncUser pushes anything stored for emailHash (notifications and mail) to
+// its sockets on every node.
+func (s *Server) syncUser(emailHash string) {
+	s.syncLocal(emailHash)
+	s.cluster.syncUser(emailHash)
+}
+
+// syncLocal is syncUser for the sockets on this node.
+func (s *Server) syncLocal(emailHash string) {
+	for _, c := range s.presence.Clients(emailHash) {
+		s.syncNotifications(c)
+		s.syncMailbox(c)
+	}
+}
+
+func (s *Server) handleMailboxAck(client *Client, frame Frame) {
+	var d struct {
+		ID  int64   `json:"id"`
+		IDs []int64 `json:"ids"`
+	}
+	if err := json.Unmarshal(frame.Data, &d); err != nil {
+		s.sendError(client, frame, ErrInvalidFrame, "Invalid MAILBOX_ACK")
+		return
+	}
+	ids := d.IDs
+	if d.ID != 0 {
+		ids = append(ids, d.ID)
+	}
+	if len(ids) == 0 || len(ids) > maxNotifAckBatch {
+		s.sendError(client, frame, ErrInvalidFrame, "MAILBOX_ACK needs between 1 and 256 ids")
+		return
+	}
+
+	email, publicKey := client.identity()
+	for _, id := range ids {
+		if err := s.store.DeleteMail(emailHash(email), publicKey, id); err != nil {
+			log.Printf("[Error] Failed to delete mail %d for %s: %v", id, client.id, err)
+			s.sendError(client, frame, ErrInternal, "Failed to ack mail")
+			return
+		}
+	}
+	client.syncMu.Lock()
+	for _, id := range ids {
+		delete(client.mailSent, id)
+	}
+	client.syncMu.Unlock()
+}
+
+// startMailboxPruner deletes expired mail every hour.
+func (s *Server) startMailboxPruner() {
+	for range time.Tick(time.Hour) {
+		if err := s.store.PruneMail(time.Now()); err != nil {
+			s.logger.Printf("Mailbox cleanup failed: %v", err)
+		}
+	}
+}
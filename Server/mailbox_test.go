@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startMailboxServer runs a server with a mailbox of quota bytes per user
+// and makes alice and bob friends in sid-ab.
+func startMailboxServer(t *testing.T, quota int) (*Server, Store, string) {
+	t.Helper()
+	cfg := testConfig()
+	cfg.MailboxQuotaBytes = quota
+	store := newMemoryStore()
+	s := newServer(cfg, store, log.New(io.Discard, "", 0))
+	ts := httptest.NewServer(http.HandlerFunc(s.handle))
+	t.Cleanup(ts.Close)
+	store.AddFriendship(Friendship{User1Hash: emailHash("alice@example.com"), User2Hash: emailHash("bob@example.com"), SID: "sid-ab", Since: time.Now()})
+	return s, store, "ws" + strings.TrimPrefix(ts.URL, "http")
+}
+
+func TestMailboxDeliversToOfflineDevice(t *testing.T) {
+	const alice, bob = "alice@example.com", "bob@example.com"
+	bobHash := emailHash(bob)
+	s, store, url := startMailboxServer(t, 1024)
+
+	authDevice(t, url, bob, "phone", protocolVersion).Close()
+	eventually(t, "bob to go offline", func() bool { return len(s.onlineKeys(bobHash)) == 0 })
+
+	a := authDevice(t, url, alice, "pk-alice", mailboxProtocolVersion)
+	msg, _ := json.Marshal(map[string]any{
+		"payloads": map[string]string{"phone": "Y2lwaGVydGV4dA==", "pk-alice": "c2VsZg=="},
+		"mailbox":  true,
+	})
+	a.WriteJSON(Frame{T: "MSG", ID: "m1", SID: "sid-ab", C: true, Data: msg})
+	queued := waitFrame(t, a, "QUEUED")
+	var qd struct{ Queued []string }
+	json.Unmarshal(queued.Data, &qd)
+	if queued.ID != "m1" || len(qd.Queued) != 1 || qd.Queued[0] != "phone" {
+		t.Fatalf("QUEUED = %+v", queued)
+	}
+
+	// Without an ack the phone gets the message again on the next connection.
+	var first Frame
+	for range 2 {
+		phone := authDevice(t, url, bob, "phone", protocolVersion)
+		first = waitFrame(t, phone, "MSG")
+		phone.Close()
+	}
+	var d struct {
+		Payloads  map[string]string
+		MailboxID int64
+	}
+	json.Unmarshal(first.Data, &d)
+	if first.SID != "sid-ab" || first.SH != emailHash(alice) || d.MailboxID == 0 || len(d.Payloads) != 1 || d.Payloads["phone"] != "Y2lwaGVydGV4dA==" {
+		t.Fatalf("mail = %+v %s", first, first.Data)
+	}
+
+	phone := authDevice(t, url, bob, "phone", protocolVersion)
+	waitFrame(t, phone, "MSG")
+	ack, _ := json.Marshal(map[string]int64{"id": d.MailboxID})
+	phone.WriteJSON(Frame{T: "MAILBOX_ACK", Data: ack})
+	eventually(t, "the mail to be deleted", func() bool {
+		pending, _ := store.PendingMail(bobHash, "phone", time.Now())
+		return len(pending) == 0
+	})
+}
+
+func TestMailboxFull(t *testing.T) {
+	const alice, bob = "alice@example.com", "bob@example.com"
+	s, _, url := startMailboxServer(t, 8)
+
+	authDevice(t, url, bob, "phone", protocolVersion).Close()
+	eventually(t, "bob to go offline", func() bool { return len(s.onlineKeys(emailHash(bob))) == 0 })
+
+	a := authDevice(t, url, alice, "pk-alice", mailboxProtocolVersion)
+	msg, _ := json.Marshal(map[string]any{
+		"payloads": map[string]string{"phone": "dG9vIGxvbmcgZm9yIHRoZSBxdW90YQ=="},
+		"mailbox":  true,
+	})
+	a.WriteJSON(Frame{T: "MSG", ID: "m1", SID: "sid-ab", C: true, Data: msg})
+	f := waitFrame(t, a, "ERROR")
+	if e := errorOf(t, f); f.ID != "m1" || e.Code != ErrMailboxFull || e.Retry != retryBackoff {
+		t.Fatalf("over-quota MSG = %+v", e)
+	}
+}
@@ -1,12 +1,9 @@
 package main
 
 import (
-	"crypto/sha256"
 	"log"
 	"net/http"
 	"os"
-	"strings"
-	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/joho/godotenv"
@@ -16,50 +13,84 @@ var upgrader = websocket.Upgrader{
 	CheckOrigin: func(r *http.Request) bool { return true },
 }
 
-const (
-	maxWSFrameBytes       = 1024 * 1024
-	maxEncryptedDataBytes = 400 * 1024
-	maxSIDLength          = 128
-)
+const maxSIDLength = 128
 
-func init() {
+func main() {
 	if err := godotenv.Load(); err != nil {
 		log.Println("⚠️ No .env file found, relying on environment variables")
 	}
 
-	if os.Getenv("TURN_SECRET") == "" {
-		log.Fatal("❌ TURN_SECRET is not set")
+	cfg, args, dump, err := loadConfig(os.Args[1:], os.Getenv)
+	if err != nil {
+		log.Fatalf("❌ %v", err)
+	}
+	if dump {
+		cfg.dump(os.Stdout)
+		return
 	}
 
-	seed := strings.TrimSpace(os.Getenv("AUTH_SESSION_SECRET"))
-	sum := sha256.Sum256([]byte(seed))
-	sessionSecret = sum[:]
-}
+	if len(args) > 0 && args[0] == "migrate" {
+		if err := cfg.validateStore(); err != nil {
+			log.Fatalf("❌ Invalid configuration: %v", err)
+		}
+		store, err := connectSQLStore(cfg.StoreDriver, cfg.StoreDSN)
+		if err != nil {
+			log.Fatalf("❌ %v", err)
+		}
+		defer store.Close()
+		if err := runMigrateCommand(store, args[1:], os.Stdout); err != nil {
+			log.Fatalf("❌ migrate: %v", err)
+		}
+		return
+	}
+	if len(args) > 0 && args[0] == "keylog" {
+		if err := runKeyLogCommand(cfg, args[1:], os.Stdout); err != nil {
+			log.Fatalf("❌ keylog: %v", err)
+		}
+		return
+	}
+	if len(args) > 0 {
+		log.Fatalf("❌ unknown command %q", args[0])
+	}
 
-func main() {
-	f, err := os.OpenFile("connections.log", os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+	if err := cfg.validate(); err != nil {
+		log.Fatalf("❌ Invalid configuration:\n%v", err)
+	}
+
+	f, err := os.OpenFile(cfg.ConnectionLogPath, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
 	if err != nil {
 		log.Fatalf("error opening file: %v", err)
 	}
 	defer f.Close()
 
-	s := &Server{
-		clients:  make(map[string]*Client),
-		sessions: make(map[string]*Session),
-		logger:   log.New(f, "", 0),
-		rateLimiter: &RateLimiter{
-			ipAttempts: make(map[string][]time.Time),
-		},
+	store, err := openStore(cfg.StoreDriver, cfg.StoreDSN)
+	if err != nil {
+		log.Fatalf("❌ Failed to initialize database: %v", err)
 	}
+	defer store.Close()
 
-	if err := s.initDB(); err != nil {
-		log.Fatalf("❌ Failed to initialize database: %v", err)
+	s := newServer(cfg, store, log.New(f, "", 0))
+
+	bus, err := openBus(cfg.ClusterBus, cfg.ClusterURL)
+	if err != nil {
+		log.Fatalf("❌ Failed to connect to cluster bus: %v", err)
+	}
+	if bus != nil {
+		defer bus.Close()
+		if err := s.joinCluster(bus); err != nil {
+			log.Fatalf("❌ Failed to join cluster: %v", err)
+		}
+		defer s.cluster.close()
 	}
+
 	go s.startMonthlyCleanupWorker()
-	defer s.db.Close()
+	if cfg.MailboxQuotaBytes > 0 {
+		go s.startMailboxPruner()
+	}
 
 	http.HandleFunc("/", s.handle)
+	http.HandleFunc("/metrics", s.handleMetrics)
 
-	log.Println("✅ Secure E2E Relay Server running on :9000")
-	http.ListenAndServe(":9000", nil)
+	log.Printf("✅ Secure E2E Relay Server running on %s", cfg.ListenAddr)
+	http.ListenAndServe(cfg.ListenAddr, nil)
 }
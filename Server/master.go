@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"slices"
+	"time"
+)
+
+// The master role moves in one of two ways. The master hands it to another
+// approved device with TRANSFER_MASTER, signed by its key. When the master
+// is lost, any other device may send MASTER_CLAIM, signed by its own key.
+// The claim is granted when the claimant asks again after
+// masterRecoveryDays, as long as the master has not connected since the
+// claim was made. Every step is a notification to all of the user's
+// devices, so someone who only holds the user's Google token cannot take
+// the account over without the real master being warned and having days to
+// cancel the claim by coming back online.
+
+func init() {
+	RegisterFrame("TRANSFER_MASTER", (*Server).handleTransferMaster, requireAuth, rateLimit(defaultFramesPerSecond))
+	RegisterFrame("MASTER_CLAIM", (*Server).handleMasterClaim, requireAuth, rateLimit(defaultFramesPerSecond))
+}
+
+// Reasons given in MASTER_CHANGED.
+const (
+	masterTransferred = "transfer"
+	masterRecovered   = "recovery"
+)
+
+func (s *Server) masterRecovery() time.Duration {
+	return time.Duration(s.cfg.MasterRecoveryDays) * 24 * time.Hour
+}
+
+func (s *Server) handleTransferMaster(client *Client, frame Frame) {
+	var d struct {
+		TargetPubKey string `json:"targetPubKey"`
+		Signature    string `json:"signature"`
+	}
+	if err := json.Unmarshal(frame.Data, &d); err != nil || d.TargetPubKey == "" {
+		s.sendError(client, frame, ErrInvalidFrame, "Invalid TRANSFER_MASTER")
+		return
+	}
+	email, publicKey := client.identity()
+	eh := emailHash(email)
+	master, err := s.store.MasterDevice(eh)
+	if err != nil || publicKey == "" || master.PublicKey != publicKey {
+		s.sendError(client, frame, ErrNotMasterDevice, "Only the master device can do that")
+		return
+	}
+	if verifyDeviceSignature(publicKey, signedMessage(frame.T, eh, d.TargetPubKey), d.Signature) != nil {
+		s.sendError(client, frame, ErrBadSignature, "Signature does not match the master device key")
+		return
+	}
+	if dev, err := s.store.Device(eh, d.TargetPubKey); err != nil || dev.Status != DeviceActive || dev.IsMaster {
+		s.sendError(client, frame, ErrInvalidFrame, "No such approved device")
+		return
+	}
+	sig := DeviceSignature{EmailHash: eh, Signer: publicKey, Subject: d.TargetPubKey, Kind: frame.T, Signature: d.Signature, CreatedAt: time.Now()}
+	if err := s.store.AddDeviceSignature(sig); err != nil {
+		log.Printf("[Error] Failed to store master transfer for %s: %v", client.id, err)
+		s.sendError(client, frame, ErrInternal, "Failed to transfer master")
+		return
+	}
+	if err := s.setMaster(eh, d.TargetPubKey, publicKey, masterTransferred); err != nil {
+		log.Printf("[Error] Failed to transfer master for %s: %v", client.id, err)
+		s.sendError(client, frame, ErrInternal, "Failed to transfer master")
+		return
+	}
+	data, _ := json.Marshal(map[string]string{"masterPubKey": d.TargetPubKey})
+	s.reply(client, frame, Frame{T: "MASTER_TRANSFERRED", Data: data})
+}
+
+func (s *Server) handleMasterClaim(client *Client, frame Frame) {
+	var d struct {
+		Signature string `json:"signature"`
+	}
+	if err := json.Unmarshal(frame.Data, &d); err != nil {
+		s.sendError(client, frame, ErrInvalidFrame, "Invalid MASTER_CLAIM")
+		return
+	}
+	email, publicKey := client.identity()
+	eh := emailHash(email)
+	if publicKey == "" {
+		s.sendError(client, frame, ErrInvalidFrame, "Only a device with a key can claim master")
+		return
+	}
+	// AUTH does not prove the device holds its key; the claim does.
+	if verifyDeviceSignature(publicKey, signedMessage(frame.T, eh, publicKey), d.Signature) != nil {
+		s.sendError(client, frame, ErrBadSignature, "Signature does not match the device key")
+		return
+	}
+	// No master at all means no account to recover; the claimant would have
+	// become master on AUTH.
+	master, err := s.store.MasterDevice(eh)
+	if err != nil || master.PublicKey == publicKey {
+		s.sendError(client, frame, ErrInvalidFrame, "There is no master to replace")
+		return
+	}
+	if slices.Contains(s.onlineKeys(eh), master.PublicKey) {
+		s.sendError(client, frame, ErrMasterOnline, "The master device is online; ask it to transfer")
+		return
+	}
+
+	now := time.Now()
+	claim, err := s.store.MasterClaim(eh)
+	if err != nil || claim.PublicKey != publicKey || master.LastActive.After(claim.ClaimedAt) {
+		claim = MasterClaim{EmailHash: eh, PublicKey: publicKey, ClaimedAt: now}
+		if err := s.store.PutMasterClaim(claim); err != nil {
+			log.Printf("[Error] Failed to store master claim for %s: %v", client.id, err)
+			s.sendError(client, frame, ErrInternal, "Failed to store master claim")
+			return
+		}
+		notice, _ := json.Marshal(map[string]any{"publicKey": publicKey, "claimableAt": now.Add(s.masterRecovery()).Unix()})
+		s.notifyUser(eh, Frame{T: "MASTER_CLAIM_STARTED", Data: notice})
+		log.Printf("[Server] Master claim started for %s", eh)
+	}
+
+	claimableAt := claim.ClaimedAt.Add(s.masterRecovery())
+	if now.Before(claimableAt) {
+		data, _ := json.Marshal(map[string]any{"publicKey": publicKey, "claimableAt": claimableAt.Unix()})
+		s.reply(client, frame, Frame{T: "MASTER_CLAIM_PENDING", Data: data})
+		return
+	}
+	if err := s.setMaster(eh, publicKey, master.PublicKey, masterRecovered); err != nil {
+		log.Printf("[Error] Failed to grant master claim for %s: %v", client.id, err)
+		s.sendError(client, frame, ErrInternal, "Failed to grant master claim")
+		return
+	}
+	data, _ := json.Marshal(map[string]string{"masterPubKey": publicKey})
+	s.reply(client, frame, Frame{T: "MASTER_CLAIMED", Data: data})
+}
+
+// setMaster moves the master role of emailHash to publicKey, drops any open
+// claim and tells every device.
+func (s *Server) setMaster(emailHash, publicKey, previous, reason string) error {
+	d, err := s.store.Device(emailHash, publicKey)
+	if err != nil {
+		return err
+	}
+	if err := s.store.SetMaster(emailHash, publicKey); err != nil {
+		return err
+	}
+	if d.Status == DevicePending {
+		s.logKey(emailHash, publicKey, KeyAdded)
+	}
+	s.logKey(emailHash, publicKey, KeyMaster)
+	s.store.DeleteMasterClaim(emailHash)
+	data, _ := json.Marshal(map[string]string{
+		"masterPubKey":   publicKey,
+		"previousPubKey": previous,
+		"reason":         reason,
+	})
+	s.notifyUser(emailHash, Frame{T: "MASTER_CHANGED", Data: data})
+	s.broadcastDeviceList(emailHash)
+	if f, ok := s.crossSignNeeded(emailHash, publicKey); ok {
+		s.sendToDevice(emailHash, publicKey, f)
+	}
+	log.Printf("[Server] Master of %s changed (%s)", emailHash, reason)
+	return nil
+}
+
+// cancelMasterClaim drops the open claim on emailHash's master, if any,
+// because the master has come back.
+func (s *Server) cancelMasterClaim(emailHash string) {
+	claim, err := s.store.MasterClaim(emailHash)
+	if err != nil {
+		return
+	}
+	if err := s.store.DeleteMasterClaim(emailHash); err != nil {
+		log.Printf("[Error] Failed to cancel master claim for %s: %v", emailHash, err)
+		return
+	}
+	data, _ := json.Marshal(map[string]string{"publicKey": claim.PublicKey})
+	s.notifyUser(emailHash, Frame{T: "MASTER_CLAIM_CANCELLED", Data: data})
+	log.Printf("[Server] Master claim cancelled for %s", emailHash)
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestMasterTransferAndRecovery(t *testing.T) {
+	s, store, url := newTestServer(t)
+	const alice = "alice@example.com"
+	aliceHash := emailHash(alice)
+	laptop := newTestDeviceKey(t)
+	tabletKey := newTestDeviceKey(t)
+
+	m := authDevice(t, url, alice, laptop.pub, protocolVersion)
+	addLinkedDevice(store, alice, "phone")
+	phone := authDevice(t, url, alice, "phone", protocolVersion)
+
+	transfer := func(target, sig string) {
+		d, _ := json.Marshal(map[string]string{"targetPubKey": target, "signature": sig})
+		m.WriteJSON(Frame{T: "TRANSFER_MASTER", ID: "t1", Data: d})
+	}
+	transfer("phone", laptop.sign(signedMessage("DEVICE_LINK_ACCEPT", aliceHash, "phone")))
+	if e := errorOf(t, waitFrame(t, m, "ERROR")); e.Code != ErrBadSignature {
+		t.Fatalf("mis-signed transfer = %+v", e)
+	}
+	transfer("phone", laptop.sign(signedMessage("TRANSFER_MASTER", aliceHash, "phone")))
+	waitFrame(t, m, "MASTER_TRANSFERRED")
+	var changed struct{ MasterPubKey, PreviousPubKey, Reason string }
+	json.Unmarshal(waitFrame(t, phone, "MASTER_CHANGED").Data, &changed)
+	if changed.MasterPubKey != "phone" || changed.PreviousPubKey != laptop.pub || changed.Reason != masterTransferred {
+		t.Fatalf("MASTER_CHANGED = %+v", changed)
+	}
+	if master, _ := store.MasterDevice(aliceHash); master.PublicKey != "phone" {
+		t.Fatalf("master after transfer = %+v", master)
+	}
+
+	// The phone is lost. A new tablet may not take over straight away.
+	phone.Close()
+	tablet := authDevice(t, url, alice, tabletKey.pub, protocolVersion)
+	claim := func(k testDeviceKey) {
+		d, _ := json.Marshal(map[string]string{"signature": k.sign(signedMessage("MASTER_CLAIM", aliceHash, k.pub))})
+		tablet.WriteJSON(Frame{T: "MASTER_CLAIM", ID: "c1", Data: d})
+	}
+	claim(laptop)
+	if e := errorOf(t, waitFrame(t, tablet, "ERROR")); e.Code != ErrBadSignature {
+		t.Fatalf("claim signed by another key = %+v", e)
+	}
+	claim(tabletKey)
+	var pending struct {
+		PublicKey   string
+		ClaimableAt int64
+	}
+	json.Unmarshal(waitFrame(t, tablet, "MASTER_CLAIM_PENDING").Data, &pending)
+	if pending.ClaimableAt < time.Now().Add(s.masterRecovery()-time.Minute).Unix() {
+		t.Fatalf("claim grantable too early: %+v", pending)
+	}
+	json.Unmarshal(waitFrame(t, m, "MASTER_CLAIM_STARTED").Data, &pending)
+	if pending.PublicKey != tabletKey.pub {
+		t.Fatalf("MASTER_CLAIM_STARTED = %+v", pending)
+	}
+	if master, _ := store.MasterDevice(aliceHash); master.PublicKey != "phone" {
+		t.Fatalf("master changed before the recovery period: %+v", master)
+	}
+
+	// After the recovery period with no sign of the phone, it is granted.
+	longAgo := time.Now().Add(-s.masterRecovery() - time.Hour)
+	store.TouchDevice(aliceHash, "phone", longAgo.Add(-time.Hour))
+	store.PutMasterClaim(MasterClaim{EmailHash: aliceHash, PublicKey: tabletKey.pub, ClaimedAt: longAgo})
+	claim(tabletKey)
+	waitFrame(t, tablet, "MASTER_CLAIMED")
+	json.Unmarshal(waitFrame(t, m, "MASTER_CHANGED").Data, &changed)
+	if changed.MasterPubKey != tabletKey.pub || changed.Reason != masterRecovered {
+		t.Fatalf("MASTER_CHANGED = %+v", changed)
+	}
+	if d, _ := store.Device(aliceHash, tabletKey.pub); !d.IsMaster || d.Status != DeviceActive {
+		t.Fatalf("recovered master = %+v", d)
+	}
+
+	// A claim is refused while the master is online and cancelled when it
+	// comes back.
+	tablet = authDevice(t, url, alice, tabletKey.pub, protocolVersion)
+	d, _ := json.Marshal(map[string]string{"signature": laptop.sign(signedMessage("MASTER_CLAIM", aliceHash, laptop.pub))})
+	m.WriteJSON(Frame{T: "MASTER_CLAIM", ID: "c2", Data: d})
+	if e := errorOf(t, waitFrame(t, m, "ERROR")); e.Code != ErrMasterOnline {
+		t.Fatalf("claim while the master is online = %+v", e)
+	}
+	tablet.Close()
+	for len(s.onlineKeys(aliceHash)) != 1 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	m.WriteJSON(Frame{T: "MASTER_CLAIM", ID: "c3", Data: d})
+	waitFrame(t, m, "MASTER_CLAIM_PENDING")
+	authDevice(t, url, alice, tabletKey.pub, protocolVersion)
+	waitFrame(t, m, "MASTER_CLAIM_CANCELLED")
+	if _, err := store.MasterClaim(aliceHash); err != ErrNotFound {
+		t.Fatalf("claim survived the master's return: %v", err)
+	}
+}
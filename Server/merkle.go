@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"math/bits"
+)
+
+// The key log is a Merkle tree as in RFC 6962 (Certificate Transparency):
+// leaves hash as SHA-256(0x00 || leaf) and nodes as SHA-256(0x01 || left ||
+// right), and the tree of n leaves splits at the largest power of two below
+// n. Proofs use the RFC's audit paths and consistency proofs, so any CT
+// verifier can check them.
+
+var errBadProof = errors.New("bad proof")
+
+func leafHash(leaf []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{0})
+	h.Write(leaf)
+	return h.Sum(nil)
+}
+
+func nodeHash(left, right []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{1})
+	h.Write(left)
+	h.Write(right)
+	return h.Sum(nil)
+}
+
+// merkleTree keeps the hash of every complete, aligned subtree:
+// levels[k][i] covers leaves i<<k to (i+1)<<k. Appending is amortised
+// O(1), and any root or proof needs O(log n) hashes.
+type merkleTree struct {
+	levels [][][]byte
+}
+
+func (t *merkleTree) size() int64 {
+	if len(t.levels) == 0 {
+		return 0
+	}
+	return int64(len(t.levels[0]))
+}
+
+func (t *merkleTree) append(leaf []byte) {
+	h := leafHash(leaf)
+	for k := 0; ; k++ {
+		if k == len(t.levels) {
+			t.levels = append(t.levels, nil)
+		}
+		t.levels[k] = append(t.levels[k], h)
+		n := len(t.levels[k])
+		if n%2 == 1 {
+			return
+		}
+		h = nodeHash(t.levels[k][n-2], t.levels[k][n-1])
+	}
+}
+
+// hash returns the root of leaves [lo, hi), which must be non-empty and
+// within the tree.
+func (t *merkleTree) hash(lo, hi int64) []byte {
+	n := hi - lo
+	if n&(n-1) == 0 && lo%n == 0 {
+		return t.levels[bits.TrailingZeros64(uint64(n))][lo/n]
+	}
+	k := splitPoint(n)
+	return nodeHash(t.hash(lo, lo+k), t.hash(lo+k, hi))
+}
+
+// root returns the root of the first n leaves; the empty tree hashes to
+// SHA-256 of nothing.
+func (t *merkleTree) root(n int64) []byte {
+	if n == 0 {
+		sum := sha256.Sum256(nil)
+		return sum[:]
+	}
+	return t.hash(0, n)
+}
+
+// splitPoint is the largest power of two below n, for n > 1.
+func splitPoint(n int64) int64 {
+	return 1 << (bits.Len64(uint64(n-1)) - 1)
+}
+
+// inclusionProof returns the audit path of leaf index in the tree of the
+// first n leaves.
+func (t *merkleTree) inclusionProof(index, n int64) [][]byte {
+	return t.path(index, 0, n)
+}
+
+func (t *merkleTree) path(index, lo, hi int64) [][]byte {
+	if hi-lo <= 1 {
+		return nil
+	}
+	k := splitPoint(hi - lo)
+	if index < lo+k {
+		return append(t.path(index, lo, lo+k), t.hash(lo+k, hi))
+	}
+	return append(t.path(index, lo+k, hi), t.hash(lo, lo+k))
+}
+
+// consistencyProof proves that the tree of the first m leaves is a prefix
+// of the tree of the first n.
+func (t *merkleTree) consistencyProof(m, n int64) [][]byte {
+	if m <= 0 || m >= n {
+		return nil
+	}
+	return t.subproof(m, 0, n, true)
+}
+
+func (t *merkleTree) subproof(m, lo, hi int64, complete bool) [][]byte {
+	if lo+m == hi {
+		if complete {
+			return nil
+		}
+		return [][]byte{t.hash(lo, hi)}
+	}
+	k := splitPoint(hi - lo)
+	if m <= k {
+		return append(t.subproof(m, lo, lo+k, complete), t.hash(lo+k, hi))
+	}
+	return append(t.subproof(m-k, lo+k, hi, false), t.hash(lo, lo+k))
+}
+
+// verifyInclusion checks an audit path from a tree of size n with the given
+// root (RFC 9162, section 2.1.3.2).
+func verifyInclusion(leaf []byte, index, n int64, path [][]byte, root []byte) error {
+	if index < 0 || index >= n {
+		return errBadProof
+	}
+	fn, sn := index, n-1
+	r := leafHash(leaf)
+	for _, p := range path {
+		if sn == 0 {
+			return errBadProof
+		}
+		if fn&1 == 1 || fn == sn {
+			r = nodeHash(p, r)
+			for fn&1 == 0 && fn != 0 {
+				fn >>= 1
+				sn >>= 1
+			}
+		} else {
+			r = nodeHash(r, p)
+		}
+		fn >>= 1
+		sn >>= 1
+	}
+	if sn != 0 || !bytes.Equal(r, root) {
+		return errBadProof
+	}
+	return nil
+}
+
+// verifyConsistency checks that the tree of size m with oldRoot is a prefix
+// of the tree of size n with newRoot (RFC 9162, section 2.1.4.2).
+func verifyConsistency(m, n int64, oldRoot, newRoot []byte, proof [][]byte) error {
+	switch {
+	case m < 0 || m > n:
+		return errBadProof
+	case m == n:
+		if len(proof) != 0 || !bytes.Equal(oldRoot, newRoot) {
+			return errBadProof
+		}
+		return nil
+	case m == 0:
+		if len(proof) != 0 {
+			return errBadProof
+		}
+		return nil
+	}
+	if m&(m-1) == 0 {
+		proof = append([][]byte{oldRoot}, proof...)
+	}
+	if len(proof) == 0 {
+		return errBadProof
+	}
+	fn, sn := m-1, n-1
+	for fn&1 == 1 {
+		fn >>= 1
+		sn >>= 1
+	}
+	fr, sr := proof[0], proof[0]
+	for _, c := range proof[1:] {
+		if sn == 0 {
+			return errBadProof
+		}
+		if fn&1 == 1 || fn == sn {
+			fr = nodeHash(c, fr)
+			sr = nodeHash(c, sr)
+			for fn&1 == 0 && fn != 0 {
+				fn >>= 1
+				sn >>= 1
+			}
+		} else {
+			sr = nodeHash(sr, c)
+		}
+		fn >>= 1
+		sn >>= 1
+	}
+	if sn != 0 || !bytes.Equal(fr, oldRoot) || !bytes.Equal(sr, newRoot) {
+		return errBadProof
+	}
+	return nil
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+// naiveRoot is RFC 6962's MTH, written straight from the definition.
+func naiveRoot(leaves [][]byte) []byte {
+	switch len(leaves) {
+	case 0:
+		return (&merkleTree{}).root(0)
+	case 1:
+		return leafHash(leaves[0])
+	}
+	k := splitPoint(int64(len(leaves)))
+	return nodeHash(naiveRoot(leaves[:k]), naiveRoot(leaves[k:]))
+}
+
+func TestMerkleProofs(t *testing.T) {
+	var tree merkleTree
+	var leaves [][]byte
+	for i := 0; i < 70; i++ {
+		leaves = append(leaves, []byte(fmt.Sprintf("leaf %d", i)))
+		tree.append(leaves[i])
+	}
+	for n := int64(1); n <= tree.size(); n++ {
+		root := tree.root(n)
+		if !bytes.Equal(root, naiveRoot(leaves[:n])) {
+			t.Fatalf("root(%d) differs from the definition", n)
+		}
+		for i := int64(0); i < n; i++ {
+			if err := verifyInclusion(leaves[i], i, n, tree.inclusionProof(i, n), root); err != nil {
+				t.Fatalf("inclusion of %d in %d: %v", i, n, err)
+			}
+		}
+		for m := int64(0); m <= n; m++ {
+			if err := verifyConsistency(m, n, tree.root(m), root, tree.consistencyProof(m, n)); err != nil {
+				t.Fatalf("consistency %d -> %d: %v", m, n, err)
+			}
+		}
+	}
+
+	root := tree.root(10)
+	if verifyInclusion([]byte("leaf 4"), 3, 10, tree.inclusionProof(3, 10), root) == nil {
+		t.Fatal("inclusion verified for the wrong leaf")
+	}
+	if verifyConsistency(5, 10, tree.root(6), root, tree.consistencyProof(5, 10)) == nil {
+		t.Fatal("consistency verified against the wrong old root")
+	}
+}
@@ -0,0 +1,571 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// migration is one numbered schema change. Statements are written in SQLite
+// syntax and translated by ddl for other dialects.
+type migration struct {
+	version int
+	name    string
+	up      []string
+	down    []string
+}
+
+// migrations must stay in ascending version order. Never edit a migration
+// that has shipped; add a new one instead.
+var migrations = []migration{
+	{
+		version: 1,
+		name:    "initial schema",
+		// Matches the schema the old ad-hoc initDB converged to, so existing
+		// databases adopt it as a no-op.
+		up: []string{
+			`CREATE TABLE IF NOT EXISTS devices (
+				email_hash TEXT,
+				public_key TEXT,
+				last_active DATETIME,
+				is_master BOOLEAN DEFAULT 0,
+				PRIMARY KEY (email_hash, public_key)
+			)`,
+			`CREATE TABLE IF NOT EXISTS requests (
+				sender_hash TEXT,
+				target_hash TEXT,
+				encrypted_packet TEXT,
+				timestamp DATETIME,
+				PRIMARY KEY (sender_hash, target_hash)
+			)`,
+			`CREATE TABLE IF NOT EXISTS friends (
+				user1_hash TEXT,
+				user2_hash TEXT,
+				since DATETIME,
+				sid TEXT,
+				PRIMARY KEY (user1_hash, user2_hash)
+			)`,
+			`CREATE TABLE IF NOT EXISTS sockets (
+				email_hash TEXT,
+				socket_id TEXT,
+				public_key TEXT,
+				PRIMARY KEY (email_hash, socket_id)
+			)`,
+			`CREATE TABLE IF NOT EXISTS offline_notifications (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				email_hash TEXT,
+				event_data TEXT,
+				timestamp DATETIME
+			)`,
+		},
+		down: []string{
+			`DROP TABLE offline_notifications`,
+			`DROP TABLE sockets`,
+			`DROP TABLE friends`,
+			`DROP TABLE requests`,
+			`DROP TABLE devices`,
+		},
+	},
+	{
+		version: 2,
+		name:    "device status",
+		up:      []string{`ALTER TABLE devices ADD COLUMN status TEXT NOT NULL DEFAULT 'active'`},
+		down:    []string{`ALTER TABLE devices DROP COLUMN status`},
+	},
+	{
+		version: 3,
+		name:    "notification acks",
+		up: []string{
+			`CREATE TABLE IF NOT EXISTS notification_acks (
+				notification_id BIGINT NOT NULL,
+				public_key TEXT NOT NULL,
+				PRIMARY KEY (notification_id, public_key)
+			)`,
+			`CREATE INDEX IF NOT EXISTS offline_notifications_email_hash ON offline_notifications (email_hash, id)`,
+		},
+		down: []string{
+			`DROP INDEX offline_notifications_email_hash`,
+			`DROP TABLE notification_acks`,
+		},
+	},
+	{
+		version: 4,
+		name:    "mailbox",
+		up: []string{
+			`CREATE TABLE IF NOT EXISTS mailbox (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				recipient_hash TEXT NOT NULL,
+				public_key TEXT NOT NULL,
+				sid TEXT NOT NULL,
+				sender_hash TEXT NOT NULL,
+				payload TEXT NOT NULL,
+				size INTEGER NOT NULL,
+				priority INTEGER NOT NULL DEFAULT 0,
+				created_at DATETIME NOT NULL,
+				expires_at DATETIME NOT NULL
+			)`,
+			`CREATE INDEX IF NOT EXISTS mailbox_recipient ON mailbox (recipient_hash, public_key, id)`,
+		},
+		down: []string{
+			`DROP INDEX mailbox_recipient`,
+			`DROP TABLE mailbox`,
+		},
+	},
+	{
+		version: 5,
+		name:    "groups",
+		up: []string{
+			`CREATE TABLE IF NOT EXISTS groups (
+				id TEXT PRIMARY KEY,
+				created_by TEXT NOT NULL,
+				created_at DATETIME NOT NULL,
+				epoch BIGINT NOT NULL DEFAULT 1
+			)`,
+			`CREATE TABLE IF NOT EXISTS group_members (
+				group_id TEXT NOT NULL,
+				email_hash TEXT NOT NULL,
+				role TEXT NOT NULL,
+				joined_at DATETIME NOT NULL,
+				PRIMARY KEY (group_id, email_hash)
+			)`,
+			`CREATE INDEX IF NOT EXISTS group_members_email_hash ON group_members (email_hash)`,
+		},
+		down: []string{
+			`DROP INDEX group_members_email_hash`,
+			`DROP TABLE group_members`,
+			`DROP TABLE groups`,
+		},
+	},
+	{
+		version: 6,
+		name:    "mls delivery service",
+		up: []string{
+			`ALTER TABLE groups ADD COLUMN mls_epoch BIGINT NOT NULL DEFAULT 0`,
+			`CREATE TABLE IF NOT EXISTS key_packages (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				email_hash TEXT NOT NULL,
+				public_key TEXT NOT NULL,
+				data TEXT NOT NULL,
+				created_at DATETIME NOT NULL
+			)`,
+			`CREATE INDEX IF NOT EXISTS key_packages_device ON key_packages (email_hash, public_key, id)`,
+			`CREATE TABLE IF NOT EXISTS group_commits (
+				group_id TEXT NOT NULL,
+				epoch BIGINT NOT NULL,
+				sender_hash TEXT NOT NULL,
+				data TEXT NOT NULL,
+				created_at DATETIME NOT NULL,
+				PRIMARY KEY (group_id, epoch)
+			)`,
+		},
+		down: []string{
+			`DROP TABLE group_commits`,
+			`DROP INDEX key_packages_device`,
+			`DROP TABLE key_packages`,
+			`ALTER TABLE groups DROP COLUMN mls_epoch`,
+		},
+	},
+	{
+		version: 7,
+		name:    "device linking",
+		up:      []string{`ALTER TABLE devices ADD COLUMN link_specs TEXT NOT NULL DEFAULT ''`},
+		down:    []string{`ALTER TABLE devices DROP COLUMN link_specs`},
+	},
+	{
+		version: 8,
+		name:    "remote wipe",
+		up: []string{
+			`CREATE TABLE IF NOT EXISTS device_wipes (
+				email_hash TEXT NOT NULL,
+				public_key TEXT NOT NULL,
+				requested_at DATETIME NOT NULL,
+				PRIMARY KEY (email_hash, public_key)
+			)`,
+		},
+		down: []string{`DROP TABLE device_wipes`},
+	},
+	{
+		version: 9,
+		name:    "master recovery",
+		up: []string{
+			`CREATE TABLE IF NOT EXISTS master_claims (
+				email_hash TEXT PRIMARY KEY,
+				public_key TEXT NOT NULL,
+				claimed_at DATETIME NOT NULL
+			)`,
+			// Accounts whose master was pruned get their most recently
+			// active device back as master, so that the next new device
+			// does not take the role. The promoted devices are recorded so
+			// that down can demote them again.
+			`CREATE TABLE IF NOT EXISTS master_backfill (
+				email_hash TEXT NOT NULL,
+				public_key TEXT NOT NULL,
+				PRIMARY KEY (email_hash, public_key)
+			)`,
+			`INSERT INTO master_backfill (email_hash, public_key)
+				SELECT email_hash, public_key FROM devices
+				WHERE status = 'active'
+				AND NOT EXISTS (SELECT 1 FROM devices m WHERE m.email_hash = devices.email_hash AND m.is_master)
+				AND public_key = (SELECT d.public_key FROM devices d
+					WHERE d.email_hash = devices.email_hash AND d.status = 'active'
+					ORDER BY d.last_active DESC, d.public_key LIMIT 1)`,
+			`UPDATE devices SET is_master = TRUE
+				WHERE EXISTS (SELECT 1 FROM master_backfill b WHERE b.email_hash = devices.email_hash AND b.public_key = devices.public_key)`,
+		},
+		down: []string{
+			`UPDATE devices SET is_master = FALSE
+				WHERE EXISTS (SELECT 1 FROM master_backfill b WHERE b.email_hash = devices.email_hash AND b.public_key = devices.public_key)`,
+			`DROP TABLE master_backfill`,
+			`DROP TABLE master_claims`,
+		},
+	},
+	{
+		version: 10,
+		name:    "key transparency log",
+		up: []string{
+			`CREATE TABLE IF NOT EXISTS key_log (
+				idx BIGINT PRIMARY KEY,
+				email_hash TEXT NOT NULL,
+				public_key TEXT NOT NULL,
+				action TEXT NOT NULL,
+				created_at DATETIME NOT NULL
+			)`,
+			`CREATE INDEX IF NOT EXISTS key_log_key ON key_log (email_hash, public_key)`,
+			// Keys approved before the log existed are its first entries.
+			`INSERT INTO key_log (idx, email_hash, public_key, action, created_at)
+				SELECT ROW_NUMBER() OVER (ORDER BY last_active, email_hash, public_key) - 1,
+					email_hash, public_key, 'add', last_active
+				FROM devices WHERE status = 'active' AND public_key <> ''`,
+		},
+		down: []string{`DROP TABLE key_log`},
+	},
+	{
+		version: 11,
+		name:    "prekeys",
+		up: []string{
+			`CREATE TABLE IF NOT EXISTS signed_prekeys (
+				email_hash TEXT NOT NULL,
+				public_key TEXT NOT NULL,
+				key_id BIGINT NOT NULL,
+				prekey TEXT NOT NULL,
+				signature TEXT NOT NULL,
+				created_at DATETIME NOT NULL,
+				PRIMARY KEY (email_hash, public_key)
+			)`,
+			`CREATE TABLE IF NOT EXISTS one_time_prekeys (
+				email_hash TEXT NOT NULL,
+				public_key TEXT NOT NULL,
+				key_id BIGINT NOT NULL,
+				prekey TEXT NOT NULL,
+				created_at DATETIME NOT NULL,
+				PRIMARY KEY (email_hash, public_key, key_id)
+			)`,
+		},
+		down: []string{
+			`DROP TABLE one_time_prekeys`,
+			`DROP TABLE signed_prekeys`,
+		},
+	},
+	{
+		version: 12,
+		name:    "key directory",
+		up: []string{
+			`ALTER TABLE devices ADD COLUMN device_id TEXT NOT NULL DEFAULT ''`,
+			`ALTER TABLE devices ADD COLUMN created_at DATETIME`,
+			`UPDATE devices SET device_id = 'd_' || lower(hex(randomblob(8)))`,
+			// The first sign-in was never recorded; the last is the best guess.
+			`UPDATE devices SET created_at = last_active`,
+			`CREATE TABLE IF NOT EXISTS device_signatures (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				email_hash TEXT NOT NULL,
+				signer TEXT NOT NULL,
+				subject TEXT NOT NULL,
+				kind TEXT NOT NULL,
+				signature TEXT NOT NULL,
+				created_at DATETIME NOT NULL
+			)`,
+			`CREATE INDEX IF NOT EXISTS device_signatures_email ON device_signatures (email_hash)`,
+		},
+		down: []string{
+			`DROP TABLE device_signatures`,
+			`ALTER TABLE devices DROP COLUMN created_at`,
+			`ALTER TABLE devices DROP COLUMN device_id`,
+		},
+	},
+	{
+		version: 13,
+		name:    "cross-signing",
+		up: []string{
+			`ALTER TABLE devices ADD COLUMN cross_signature TEXT NOT NULL DEFAULT ''`,
+			`ALTER TABLE devices ADD COLUMN cross_signed_by TEXT NOT NULL DEFAULT ''`,
+		},
+		down: []string{
+			`ALTER TABLE devices DROP COLUMN cross_signed_by`,
+			`ALTER TABLE devices DROP COLUMN cross_signature`,
+		},
+	},
+	{
+		version: 14,
+		name:    "key rotation",
+		up: []string{
+			`CREATE TABLE IF NOT EXISTS key_history (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				email_hash TEXT NOT NULL,
+				device_id TEXT NOT NULL,
+				old_key TEXT NOT NULL,
+				new_key TEXT NOT NULL,
+				signature TEXT NOT NULL,
+				rotated_at DATETIME NOT NULL
+			)`,
+			`CREATE INDEX IF NOT EXISTS key_history_email ON key_history (email_hash)`,
+		},
+		down: []string{`DROP TABLE key_history`},
+	},
+	{
+		version: 15,
+		name:    "one master per account",
+		up: []string{
+			// Concurrent first sign-ins could each store a master. Keep
+			// the most recently active one, and record the others so that
+			// down can restore them.
+			`CREATE TABLE IF NOT EXISTS master_demotions (
+				email_hash TEXT NOT NULL,
+				public_key TEXT NOT NULL,
+				PRIMARY KEY (email_hash, public_key)
+			)`,
+			`INSERT INTO master_demotions (email_hash, public_key)
+				SELECT email_hash, public_key FROM devices
+				WHERE is_master AND EXISTS (SELECT 1 FROM devices m
+					WHERE m.email_hash = devices.email_hash AND m.is_master
+					AND (m.last_active > devices.last_active OR (m.last_active = devices.last_active AND m.public_key < devices.public_key)))`,
+			`UPDATE devices SET is_master = FALSE
+				WHERE EXISTS (SELECT 1 FROM master_demotions d WHERE d.email_hash = devices.email_hash AND d.public_key = devices.public_key)`,
+			`CREATE UNIQUE INDEX IF NOT EXISTS devices_one_master ON devices (email_hash) WHERE is_master`,
+		},
+		down: []string{
+			`DROP INDEX devices_one_master`,
+			`UPDATE devices SET is_master = TRUE
+				WHERE EXISTS (SELECT 1 FROM master_demotions d WHERE d.email_hash = devices.email_hash AND d.public_key = devices.public_key)`,
+			`DROP TABLE master_demotions`,
+		},
+	},
+}
+
+func latestSchemaVersion() int {
+	return migrations[len(migrations)-1].version
+}
+
+// ErrSchemaTooNew means the database was migrated by a newer build.
+var ErrSchemaTooNew = errors.New("database schema is newer than this build supports")
+
+func (s *sqlStore) ddl(stmt string) string {
+	if s.dialect != dialectPostgres {
+		return stmt
+	}
+	r := strings.NewReplacer(
+		"INTEGER PRIMARY KEY AUTOINCREMENT", "BIGSERIAL PRIMARY KEY",
+		"DATETIME", "TIMESTAMPTZ",
+		"BOOLEAN DEFAULT 0", "BOOLEAN DEFAULT FALSE",
+		"lower(hex(randomblob(8)))", "substr(md5(random()::text), 1, 16)",
+	)
+	return r.Replace(stmt)
+}
+
+func (s *sqlStore) ensureMigrationsTable() error {
+	return s.exec(s.ddl(`CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INTEGER PRIMARY KEY,
+		name TEXT NOT NULL,
+		applied_at DATETIME NOT NULL
+	)`))
+}
+
+// appliedMigrations returns the applied versions and when they ran.
+func (s *sqlStore) appliedMigrations() (map[int]time.Time, error) {
+	if err := s.ensureMigrationsTable(); err != nil {
+		return nil, err
+	}
+	rows, err := s.db.Query("SELECT version, applied_at FROM schema_migrations")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	applied := make(map[int]time.Time)
+	for rows.Next() {
+		var v int
+		var at time.Time
+		if err := rows.Scan(&v, &at); err != nil {
+			return nil, err
+		}
+		applied[v] = at
+	}
+	return applied, rows.Err()
+}
+
+func (s *sqlStore) schemaVersion() (int, error) {
+	applied, err := s.appliedMigrations()
+	if err != nil {
+		return 0, err
+	}
+	version := 0
+	for v := range applied {
+		if v > version {
+			version = v
+		}
+	}
+	return version, nil
+}
+
+// checkSchemaVersion refuses to run against a schema from a newer build.
+func (s *sqlStore) checkSchemaVersion() error {
+	version, err := s.schemaVersion()
+	if err != nil {
+		return err
+	}
+	if version > latestSchemaVersion() {
+		return fmt.Errorf("%w: database is at version %d, latest known is %d", ErrSchemaTooNew, version, latestSchemaVersion())
+	}
+	return nil
+}
+
+func (s *sqlStore) runMigration(m migration, stmts []string, record func(tx *sql.Tx) error) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, stmt := range stmts {
+		if _, err := tx.Exec(s.ddl(stmt)); err != nil {
+			return fmt.Errorf("migration %d (%s): %v", m.version, m.name, err)
+		}
+	}
+	if err := record(tx); err != nil {
+		return fmt.Errorf("migration %d (%s): %v", m.version, m.name, err)
+	}
+	return tx.Commit()
+}
+
+// migrateUp applies pending migrations up to and including target, each in
+// its own transaction.
+func (s *sqlStore) migrateUp(target int) ([]migration, error) {
+	if err := s.checkSchemaVersion(); err != nil {
+		return nil, err
+	}
+	applied, err := s.appliedMigrations()
+	if err != nil {
+		return nil, err
+	}
+	var done []migration
+	for _, m := range migrations {
+		if m.version > target {
+			break
+		}
+		if _, ok := applied[m.version]; ok {
+			continue
+		}
+		err := s.runMigration(m, m.up, func(tx *sql.Tx) error {
+			_, err := tx.Exec(s.rebind("INSERT INTO schema_migrations (version, name, applied_at) VALUES (?, ?, ?)"), m.version, m.name, time.Now())
+			return err
+		})
+		if err != nil {
+			return done, err
+		}
+		done = append(done, m)
+	}
+	return done, nil
+}
+
+// migrateDown reverts the most recent steps applied migrations.
+func (s *sqlStore) migrateDown(steps int) ([]migration, error) {
+	if err := s.checkSchemaVersion(); err != nil {
+		return nil, err
+	}
+	applied, err := s.appliedMigrations()
+	if err != nil {
+		return nil, err
+	}
+	var done []migration
+	for i := len(migrations) - 1; i >= 0 && len(done) < steps; i-- {
+		m := migrations[i]
+		if _, ok := applied[m.version]; !ok {
+			continue
+		}
+		err := s.runMigration(m, m.down, func(tx *sql.Tx) error {
+			_, err := tx.Exec(s.rebind("DELETE FROM schema_migrations WHERE version = ?"), m.version)
+			return err
+		})
+		if err != nil {
+			return done, err
+		}
+		done = append(done, m)
+	}
+	return done, nil
+}
+
+func (s *sqlStore) writeMigrationStatus(w io.Writer) error {
+	applied, err := s.appliedMigrations()
+	if err != nil {
+		return err
+	}
+	known := make(map[int]bool)
+	for _, m := range migrations {
+		known[m.version] = true
+		if at, ok := applied[m.version]; ok {
+			fmt.Fprintf(w, "%4d  applied  %-25s  %s\n", m.version, at.Format(time.RFC3339), m.name)
+		} else {
+			fmt.Fprintf(w, "%4d  pending  %-25s  %s\n", m.version, "-", m.name)
+		}
+	}
+	for v := range applied {
+		if !known[v] {
+			fmt.Fprintf(w, "%4d  unknown  (applied by a newer build)\n", v)
+		}
+	}
+	return nil
+}
+
+// runMigrateCommand implements `relay migrate up [version] | down [steps] | status`.
+func runMigrateCommand(s *sqlStore, args []string, out io.Writer) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: migrate up [version] | down [steps] | status")
+	}
+	numArg := func(def int) (int, error) {
+		if len(args) < 2 {
+			return def, nil
+		}
+		return strconv.Atoi(args[1])
+	}
+
+	switch args[0] {
+	case "up":
+		target, err := numArg(latestSchemaVersion())
+		if err != nil {
+			return err
+		}
+		done, err := s.migrateUp(target)
+		for _, m := range done {
+			fmt.Fprintf(out, "applied %d: %s\n", m.version, m.name)
+		}
+		if err == nil && len(done) == 0 {
+			fmt.Fprintln(out, "schema is up to date")
+		}
+		return err
+	case "down":
+		steps, err := numArg(1)
+		if err != nil {
+			return err
+		}
+		done, err := s.migrateDown(steps)
+		for _, m := range done {
+			fmt.Fprintf(out, "reverted %d: %s\n", m.version, m.name)
+		}
+		return err
+	case "status":
+		return s.writeMigrationStatus(out)
+	default:
+		return fmt.Errorf("unknown migrate command %q", args[0])
+	}
+}
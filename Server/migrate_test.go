@@ -0,0 +1,163 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMigrationsUpDownStatus(t *testing.T) {
+	s, err := connectSQLite(filepath.Join(t.TempDir(), "migrate.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	done, err := s.migrateUp(latestSchemaVersion())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(done) != len(migrations) {
+		t.Fatalf("applied %d migrations, want %d", len(done), len(migrations))
+	}
+	if v, _ := s.schemaVersion(); v != latestSchemaVersion() {
+		t.Fatalf("version = %d, want %d", v, latestSchemaVersion())
+	}
+	if done, _ := s.migrateUp(latestSchemaVersion()); len(done) != 0 {
+		t.Fatalf("second up applied %d migrations", len(done))
+	}
+
+	var out strings.Builder
+	if err := runMigrateCommand(s, []string{"status"}, &out); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(out.String(), "pending") {
+		t.Fatalf("status shows pending migrations:\n%s", out.String())
+	}
+
+	if _, err := s.migrateDown(len(migrations)); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := s.schemaVersion(); v != 0 {
+		t.Fatalf("version after full down = %d", v)
+	}
+	if _, err := s.db.Exec("SELECT 1 FROM devices"); err == nil {
+		t.Fatal("devices table survived full rollback")
+	}
+
+	if err := s.prepare(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AddDevice(Device{EmailHash: "a", PublicKey: "k"}); err != nil {
+		t.Fatal(err)
+	}
+	if d, err := s.Device("a", "k"); err != nil || d.Status != DeviceActive {
+		t.Fatalf("Device = %+v, %v", d, err)
+	}
+}
+
+func TestMigrationsAdoptLegacySchema(t *testing.T) {
+	s, err := connectSQLite(filepath.Join(t.TempDir(), "legacy.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	// A database written by the old initDB: tables but no schema_migrations.
+	for _, stmt := range migrations[0].up {
+		if _, err := s.db.Exec(stmt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.db.Exec("INSERT INTO devices (email_hash, public_key, last_active, is_master) VALUES ('a', 'k', ?, 1)", time.Now())
+	// b's master was pruned.
+	s.db.Exec("INSERT INTO devices (email_hash, public_key, last_active, is_master) VALUES ('b', 'old', ?, 0)", time.Now().Add(-time.Hour))
+	s.db.Exec("INSERT INTO devices (email_hash, public_key, last_active, is_master) VALUES ('b', 'new', ?, 0)", time.Now())
+
+	if err := s.prepare(); err != nil {
+		t.Fatal(err)
+	}
+	if d, err := s.Device("a", "k"); err != nil || !d.IsMaster || d.Status != DeviceActive {
+		t.Fatalf("legacy device = %+v, %v", d, err)
+	}
+	if m, err := s.MasterDevice("b"); err != nil || m.PublicKey != "new" {
+		t.Fatalf("master of an account without one = %+v, %v", m, err)
+	}
+	if d, _ := s.Device("b", "old"); d.IsMaster {
+		t.Fatal("two masters after backfill")
+	}
+	if entries, _ := s.KeyLogEntries(0); len(entries) != 3 || entries[0].PublicKey != "old" || entries[2].Index != 2 {
+		t.Fatalf("key log after backfill = %+v", entries)
+	}
+	old, _ := s.Device("b", "old")
+	if d, _ := s.Device("b", "new"); d.DeviceID == "" || d.DeviceID == old.DeviceID || !d.CreatedAt.Equal(d.LastActive) {
+		t.Fatalf("device after backfill = %+v", d)
+	}
+
+	// Reverting the master backfill demotes the device it promoted, and
+	// applying it again promotes it again.
+	isMaster := func() (m bool) {
+		s.db.QueryRow("SELECT is_master FROM devices WHERE email_hash = 'b' AND public_key = 'new'").Scan(&m)
+		return m
+	}
+	if _, err := s.migrateDown(latestSchemaVersion() - 8); err != nil {
+		t.Fatal(err)
+	}
+	if isMaster() {
+		t.Fatal("backfilled master survived down")
+	}
+	if _, err := s.migrateUp(latestSchemaVersion()); err != nil {
+		t.Fatal(err)
+	}
+	if !isMaster() {
+		t.Fatal("backfill not reapplied by up")
+	}
+}
+
+func TestMigrationKeepsOneMaster(t *testing.T) {
+	s, err := connectSQLite(filepath.Join(t.TempDir(), "masters.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if _, err := s.migrateUp(14); err != nil {
+		t.Fatal(err)
+	}
+	// c signed in twice at once and got two masters.
+	s.db.Exec("INSERT INTO devices (email_hash, public_key, created_at, last_active, is_master) VALUES ('c', 'early', ?, ?, 1)", time.Now(), time.Now().Add(-time.Hour))
+	s.db.Exec("INSERT INTO devices (email_hash, public_key, created_at, last_active, is_master) VALUES ('c', 'late', ?, ?, 1)", time.Now(), time.Now())
+
+	if err := s.prepare(); err != nil {
+		t.Fatal(err)
+	}
+	if d, _ := s.Device("c", "early"); d.IsMaster {
+		t.Fatal("duplicate master kept")
+	}
+	if m, err := s.MasterDevice("c"); err != nil || m.PublicKey != "late" {
+		t.Fatalf("master after dedup = %+v, %v", m, err)
+	}
+	if _, err := s.migrateDown(1); err != nil {
+		t.Fatal(err)
+	}
+	if d, _ := s.Device("c", "early"); !d.IsMaster {
+		t.Fatal("demoted master not restored by down")
+	}
+}
+
+func TestRefusesFutureSchema(t *testing.T) {
+	s, err := connectSQLite(filepath.Join(t.TempDir(), "future.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if err := s.prepare(); err != nil {
+		t.Fatal(err)
+	}
+	s.db.Exec("INSERT INTO schema_migrations (version, name, applied_at) VALUES (?, 'from the future', CURRENT_TIMESTAMP)", latestSchemaVersion()+1)
+
+	if err := s.prepare(); !errors.Is(err, ErrSchemaTooNew) {
+		t.Fatalf("prepare = %v, want ErrSchemaTooNew", err)
+	}
+}
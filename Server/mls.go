@@ -0,0 +1,226 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"slices"
+	"time"
+)
+
+// The relay is the delivery service for groups that run MLS (RFC 9420).
+// Everything MLS is opaque to it: KeyPackages, Commits and Welcomes are
+// base64 blobs, and application messages are ordinary MSG payloads. What it
+// adds is the ordering MLS needs:
+//
+//   - Devices publish KeyPackages; a member fetching them for a user gets one
+//     per device, each used once, except that a device's last KeyPackage is
+//     handed out again until it uploads more.
+//   - Commits are totally ordered per group. A commit names the epoch it was
+//     made in, and the first commit for the current epoch wins and moves the
+//     group to the next one. Later commits for that epoch get STALE_EPOCH;
+//     the sender fetches the winner, applies it and tries again.
+//   - Accepted commits are kept for retentionDays, so a device that was
+//     offline replays them in order with MLS_FETCH.
+//   - A commit may carry a Welcome for members it adds, which reaches them as
+//     an MLS_WELCOME notification.
+
+const (
+	maxKeyPackagesPerDevice = 100
+	maxCommitsPerFetch      = 100
+)
+
+func init() {
+	for t, h := range map[string]FrameHandler{
+		"KEY_PACKAGE_UPLOAD": (*Server).handleKeyPackageUpload,
+		"KEY_PACKAGE_FETCH":  (*Server).handleKeyPackageFetch,
+		"MLS_COMMIT":         (*Server).handleMLSCommit,
+		"MLS_FETCH":          (*Server).handleMLSFetch,
+	} {
+		RegisterFrame(t, h, requireAuth, requireApprovedDevice, rateLimit(defaultFramesPerSecond))
+	}
+}
+
+func (s *Server) handleKeyPackageUpload(client *Client, frame Frame) {
+	var d struct {
+		KeyPackages []string `json:"keyPackages"`
+	}
+	if err := json.Unmarshal(frame.Data, &d); err != nil || len(d.KeyPackages) == 0 || slices.Contains(d.KeyPackages, "") {
+		s.sendError(client, frame, ErrInvalidFrame, "Invalid KEY_PACKAGE_UPLOAD")
+		return
+	}
+	email, publicKey := client.identity()
+	if publicKey == "" {
+		s.sendError(client, frame, ErrInvalidFrame, "KeyPackages need a device key")
+		return
+	}
+	eh := emailHash(email)
+	have, err := s.store.CountKeyPackages(eh, publicKey)
+	if err != nil {
+		s.sendError(client, frame, ErrInternal, "Failed to store KeyPackages")
+		return
+	}
+	if have+len(d.KeyPackages) > maxKeyPackagesPerDevice {
+		s.sendError(client, frame, ErrInvalidFrame, "A device can hold at most 100 KeyPackages")
+		return
+	}
+	size := 0
+	for _, kp := range d.KeyPackages {
+		size += len(kp)
+	}
+	if size > s.cfg.MaxEncryptedDataBytes {
+		s.sendError(client, frame, ErrPayloadTooLarge, "KeyPackages too large")
+		return
+	}
+	if err := s.store.AddKeyPackages(eh, publicKey, d.KeyPackages, time.Now()); err != nil {
+		log.Printf("[Error] Failed to store KeyPackages for %s: %v", client.id, err)
+		s.sendError(client, frame, ErrInternal, "Failed to store KeyPackages")
+		return
+	}
+	data, _ := json.Marshal(map[string]int{"count": have + len(d.KeyPackages)})
+	s.reply(client, frame, Frame{T: "KEY_PACKAGE_COUNT", Data: data})
+}
+
+// handleKeyPackageFetch returns a KeyPackage for each active device of a
+// friend or fellow group member.
+func (s *Server) handleKeyPackageFetch(client *Client, frame Frame) {
+	var d struct {
+		Member string `json:"member"`
+	}
+	if err := json.Unmarshal(frame.Data, &d); err != nil || d.Member == "" {
+		s.sendError(client, frame, ErrInvalidFrame, "Invalid KEY_PACKAGE_FETCH")
+		return
+	}
+	eh := emailHash(client.email)
+	if !s.areFriends(eh, d.Member) && !s.shareGroup(eh, d.Member) {
+		s.sendError(client, frame, ErrNotFriends, "Not a friend or group member")
+		return
+	}
+	devices, err := s.store.ListDevices(d.Member)
+	if err != nil {
+		s.sendError(client, frame, ErrInternal, "Failed to load devices")
+		return
+	}
+	kps := make(map[string]string)
+	for _, dev := range devices {
+		if dev.Status != DeviceActive {
+			continue
+		}
+		if kp, err := s.store.TakeKeyPackage(d.Member, dev.PublicKey); err == nil {
+			kps[dev.PublicKey] = kp.Data
+		}
+	}
+	data, _ := json.Marshal(map[string]any{"member": d.Member, "keyPackages": kps})
+	s.reply(client, frame, Frame{T: "KEY_PACKAGES", Data: data})
+}
+
+// shareGroup reports whether a and b are in a group together.
+func (s *Server) shareGroup(a, b string) bool {
+	groups, err := s.store.UserGroups(a)
+	if err != nil {
+		return false
+	}
+	for _, g := range groups {
+		if ok, _ := s.store.IsSessionMember(g.ID, b); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Server) handleMLSCommit(client *Client, frame Frame) {
+	var d struct {
+		GroupID   string   `json:"groupId"`
+		Epoch     int64    `json:"epoch"`
+		Commit    string   `json:"commit"`
+		Welcome   string   `json:"welcome"`
+		WelcomeTo []string `json:"welcomeTo"`
+	}
+	if err := json.Unmarshal(frame.Data, &d); err != nil || d.GroupID == "" || d.Commit == "" || d.Epoch < 0 {
+		s.sendError(client, frame, ErrInvalidFrame, "Invalid MLS_COMMIT")
+		return
+	}
+	if len(d.Commit)+len(d.Welcome) > s.cfg.MaxEncryptedDataBytes {
+		s.sendError(client, frame, ErrPayloadTooLarge, "Commit too large")
+		return
+	}
+	eh := emailHash(client.email)
+	members, err := s.store.GroupMembers(d.GroupID)
+	if err != nil {
+		s.sendError(client, frame, ErrInternal, "Failed to load group")
+		return
+	}
+	isMember := func(h string) bool {
+		return slices.ContainsFunc(members, func(m GroupMember) bool { return m.EmailHash == h })
+	}
+	if !isMember(eh) {
+		s.sendError(client, frame, ErrGroupNotFound, "No such group")
+		return
+	}
+	for _, h := range d.WelcomeTo {
+		if !isMember(h) {
+			s.sendError(client, frame, ErrInvalidFrame, "Welcome for someone outside the group")
+			return
+		}
+	}
+
+	ok, err := s.store.AppendCommit(GroupCommit{GroupID: d.GroupID, Epoch: d.Epoch, SenderHash: eh, Data: d.Commit, CreatedAt: time.Now()})
+	if err != nil {
+		log.Printf("[Error] Failed to store commit for %s: %v", d.GroupID, err)
+		s.sendError(client, frame, ErrInternal, "Failed to store commit")
+		return
+	}
+	if !ok {
+		s.sendError(client, frame, ErrStaleEpoch, "Another commit was accepted for this epoch")
+		return
+	}
+
+	accepted, _ := json.Marshal(map[string]any{"groupId": d.GroupID, "epoch": d.Epoch + 1})
+	s.reply(client, frame, Frame{T: "MLS_COMMIT_ACCEPTED", SID: d.GroupID, Data: accepted})
+
+	commit, _ := json.Marshal(map[string]any{"groupId": d.GroupID, "epoch": d.Epoch, "commit": d.Commit})
+	s.sendToSession(d.GroupID, client, Frame{T: "MLS_COMMIT", SID: d.GroupID, SH: eh, Data: commit})
+
+	if d.Welcome != "" {
+		welcome, _ := json.Marshal(map[string]any{"groupId": d.GroupID, "epoch": d.Epoch + 1, "welcome": d.Welcome})
+		for _, h := range d.WelcomeTo {
+			s.notifyUser(h, Frame{T: "MLS_WELCOME", SID: d.GroupID, SH: eh, Data: welcome})
+		}
+	}
+}
+
+// handleMLSFetch returns the commits a device missed, from epoch since on.
+func (s *Server) handleMLSFetch(client *Client, frame Frame) {
+	var d struct {
+		GroupID string `json:"groupId"`
+		Since   int64  `json:"since"`
+	}
+	if err := json.Unmarshal(frame.Data, &d); err != nil || d.GroupID == "" {
+		s.sendError(client, frame, ErrInvalidFrame, "Invalid MLS_FETCH")
+		return
+	}
+	if ok, _ := s.store.IsSessionMember(d.GroupID, emailHash(client.email)); !ok {
+		s.sendError(client, frame, ErrGroupNotFound, "No such group")
+		return
+	}
+	g, err := s.store.Group(d.GroupID)
+	if errors.Is(err, ErrNotFound) {
+		s.sendError(client, frame, ErrGroupNotFound, "No such group")
+		return
+	}
+	if err != nil {
+		s.sendError(client, frame, ErrInternal, "Failed to load group")
+		return
+	}
+	commits, err := s.store.Commits(d.GroupID, d.Since, maxCommitsPerFetch)
+	if err != nil {
+		s.sendError(client, frame, ErrInternal, "Failed to load commits")
+		return
+	}
+	list := make([]map[string]any, len(commits))
+	for i, c := range commits {
+		list[i] = map[string]any{"epoch": c.Epoch, "sender": c.SenderHash, "commit": c.Data}
+	}
+	data, _ := json.Marshal(map[string]any{"groupId": d.GroupID, "epoch": g.MLSEpoch, "commits": list})
+	s.reply(client, frame, Frame{T: "MLS_COMMITS", SID: d.GroupID, Data: data})
+}
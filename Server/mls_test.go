@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestMLSDeliveryService(t *testing.T) {
+	_, store, url := newTestServer(t)
+	const alice, bob = "alice@example.com", "bob@example.com"
+	aliceHash, bobHash := emailHash(alice), emailHash(bob)
+	store.AddFriendship(Friendship{User1Hash: aliceHash, User2Hash: bobHash, SID: "sid-ab", Since: time.Now()})
+
+	a := authDevice(t, url, alice, "pk-alice", protocolVersion)
+	b := authDevice(t, url, bob, "pk-bob", protocolVersion)
+
+	b.WriteJSON(Frame{T: "KEY_PACKAGE_UPLOAD", ID: "u1", Data: json.RawMessage(`{"keyPackages":["a3Ax","a3Ay"]}`)})
+	if f := waitFrame(t, b, "KEY_PACKAGE_COUNT"); f.ID != "u1" || string(f.Data) != `{"count":2}` {
+		t.Fatalf("KEY_PACKAGE_COUNT = %+v %s", f, f.Data)
+	}
+	fetch, _ := json.Marshal(map[string]string{"member": bobHash})
+	a.WriteJSON(Frame{T: "KEY_PACKAGE_FETCH", Data: fetch})
+	var kps struct{ KeyPackages map[string]string }
+	json.Unmarshal(waitFrame(t, a, "KEY_PACKAGES").Data, &kps)
+	if kps.KeyPackages["pk-bob"] != "a3Ax" {
+		t.Fatalf("KEY_PACKAGES = %+v", kps)
+	}
+
+	create, _ := json.Marshal(map[string]any{"members": []string{bobHash}})
+	a.WriteJSON(Frame{T: "CREATE_GROUP", Data: create})
+	gid := waitFrame(t, a, "GROUP_CREATED").SID
+
+	commit := func(conn *websocket.Conn, id string, epoch int64, data string, welcomeTo ...string) {
+		d, _ := json.Marshal(map[string]any{"groupId": gid, "epoch": epoch, "commit": data, "welcome": "d2VsY29tZQ==", "welcomeTo": welcomeTo})
+		conn.WriteJSON(Frame{T: "MLS_COMMIT", ID: id, Data: d})
+	}
+
+	// Alice adds bob; he gets the Welcome.
+	commit(a, "c1", 0, "Y29tbWl0LTA=", bobHash)
+	if f := waitFrame(t, a, "MLS_COMMIT_ACCEPTED"); f.ID != "c1" || string(f.Data) != `{"epoch":1,"groupId":"`+gid+`"}` {
+		t.Fatalf("MLS_COMMIT_ACCEPTED = %+v %s", f, f.Data)
+	}
+	if f := waitFrame(t, b, "MLS_WELCOME"); f.SH != aliceHash || f.Seq == 0 {
+		t.Fatalf("MLS_WELCOME = %+v", f)
+	}
+
+	// A commit for an epoch that already has one is stale.
+	commit(b, "c2", 0, "bGF0ZQ==")
+	if e := errorOf(t, waitFrame(t, b, "ERROR")); e.Code != ErrStaleEpoch || e.Retry != retryNever {
+		t.Fatalf("stale MLS_COMMIT = %+v", e)
+	}
+
+	// Bob catches up and commits on top.
+	b.WriteJSON(Frame{T: "MLS_FETCH", Data: json.RawMessage(`{"groupId":"` + gid + `","since":0}`)})
+	var fetched struct {
+		Epoch   int64
+		Commits []struct {
+			Epoch  int64
+			Sender string
+			Commit string
+		}
+	}
+	json.Unmarshal(waitFrame(t, b, "MLS_COMMITS").Data, &fetched)
+	if fetched.Epoch != 1 || len(fetched.Commits) != 1 || fetched.Commits[0].Sender != aliceHash || fetched.Commits[0].Commit != "Y29tbWl0LTA=" {
+		t.Fatalf("MLS_COMMITS = %+v", fetched)
+	}
+	commit(b, "c3", 1, "Y29tbWl0LTE=")
+	waitFrame(t, b, "MLS_COMMIT_ACCEPTED")
+	if f := waitFrame(t, a, "MLS_COMMIT"); f.SH != bobHash || f.ID != "" {
+		t.Fatalf("MLS_COMMIT fan-out = %+v", f)
+	}
+
+	// Outsiders cannot commit.
+	c := authDevice(t, url, "carol@example.com", "pk-carol", protocolVersion)
+	commit(c, "c4", 2, "eA==")
+	if e := errorOf(t, waitFrame(t, c, "ERROR")); e.Code != ErrGroupNotFound {
+		t.Fatalf("outsider MLS_COMMIT = %+v", e)
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+)
+
+// Notifications are frames a user must not miss, such as FRIEND_DENIED or
+// USER_BLOCKED_EVENT. Each one is stored before it is sent and carries its
+// sequence number in seq; devices confirm it with NOTIF_ACK. Acks are kept
+// per device, so a user's phone and desktop each get every notification, and
+// the row is deleted once all of the user's active devices have acked it.
+//
+// Clients older than protocol 2 cannot ack. For them delivery counts as the
+// ack, which is what the old delete-on-send behaviour promised.
+
+// notifAckProtocolVersion is the first protocol version that sends NOTIF_ACK.
+const notifAckProtocolVersion = 2
+
+// maxNotifAckBatch bounds the seqs in one NOTIF_ACK.
+const maxNotifAckBatch = 256
+
+func init() {
+	RegisterFrame("NOTIF_ACK", (*Server).handleNotifAck, requireAuth, rateLimit(defaultFramesPerSecond))
+}
+
+// notifyUser stores f for every device of targetHash and pushes it to the
+// ones that are connected, on this node or another.
+func (s *Server) notifyUser(targetHash string, f Frame) {
+	event, _ := json.Marshal(f)
+	if _, err := s.store.AddNotification(targetHash, string(event), time.Now()); err != nil {
+		log.Printf("[Error] Failed to store notification for %s: %v", targetHash, err)
+		s.sendToUser(targetHash, f)
+		return
+	}
+	s.syncUser(targetHash)
+}
+
+// syncNotifications sends c, in order, every notification its device has not
+// acked and this connection has not already sent.
+func (s *Server) syncNotifications(c *Client) {
+	email, publicKey := c.identity()
+	if email == "" || c.devicePending() {
+		return
+	}
+	eh := emailHash(email)
+
+	c.syncMu.Lock()
+	defer c.syncMu.Unlock()
+	notifs, err := s.store.PendingNotifications(eh, publicKey)
+	if err != nil {
+		log.Printf("[Error] Failed to load notifications for %s: %v", c.id, err)
+		return
+	}
+	acks := c.protocolVersion() >= notifAckProtocolVersion
+	for _, n := range notifs {
+		if c.notifSent[n.ID] {
+			continue
+		}
+		var f Frame
+		if err := json.Unmarshal([]byte(n.EventData), &f); err != nil {
+			// Nothing will ever be able to read it.
+			s.store.AckNotification(eh, publicKey, n.ID)
+			continue
+		}
+		f.Seq = n.ID
+		if s.send(c, f) != nil {
+			return
+		}
+		if !acks {
+			s.store.AckNotification(eh, publicKey, n.ID)
+			continue
+		}
+		if c.notifSent == nil {
+			c.notifSent = make(map[int64]bool)
+		}
+		c.notifSent[n.ID] = true
+	}
+}
+
+func (s *Server) handleNotifAck(client *Client, frame Frame) {
+	var d struct {
+		Seq  int64   `json:"seq"`
+		Seqs []int64 `json:"seqs"`
+	}
+	if err := json.Unmarshal(frame.Data, &d); err != nil {
+		s.sendError(client, frame, ErrInvalidFrame, "Invalid NOTIF_ACK")
+		return
+	}
+	seqs := d.Seqs
+	if d.Seq != 0 {
+		seqs = append(seqs, d.Seq)
+	}
+	if len(seqs) == 0 || len(seqs) > maxNotifAckBatch {
+		s.sendError(client, frame, ErrInvalidFrame, "NOTIF_ACK needs between 1 and 256 seqs")
+		return
+	}
+
+	email, publicKey := client.identity()
+	for _, seq := range seqs {
+		if err := s.store.AckNotification(emailHash(email), publicKey, seq); err != nil {
+			log.Printf("[Error] Failed to ack notification %d for %s: %v", seq, client.id, err)
+			s.sendError(client, frame, ErrInternal, "Failed to ack notification")
+			return
+		}
+	}
+	client.syncMu.Lock()
+	for _, seq := range seqs {
+		delete(client.notifSent, seq)
+	}
+	client.syncMu.Unlock()
+}
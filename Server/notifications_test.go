@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+// authDevice connects publicKey for email, announcing version in HELLO when
+// it is above zero.
+func authDevice(t *testing.T, url, email, publicKey string, version int) *websocket.Conn {
+	t.Helper()
+	conn := dialTest(t, url)
+	if version > 0 {
+		sendHello(conn, version)
+		waitFrame(t, conn, "WELCOME")
+	}
+	auth, _ := json.Marshal(map[string]string{"token": getTestSessionToken(email), "publicKey": publicKey})
+	conn.WriteJSON(Frame{T: "AUTH", Data: auth})
+	waitFrame(t, conn, "AUTH_SUCCESS")
+	return conn
+}
+
+func TestNotificationsAreAckedPerDevice(t *testing.T) {
+	_, store, url := newTestServer(t)
+	const alice, bob = "alice@example.com", "bob@example.com"
+	bobHash := emailHash(bob)
+
+	// Register both of bob's devices, then leave only the phone online.
+	authDevice(t, url, bob, "desktop", protocolVersion).Close()
+	addLinkedDevice(store, bob, "phone")
+	phone := authDevice(t, url, bob, "phone", protocolVersion)
+
+	a := authDevice(t, url, alice, "pk-alice", protocolVersion)
+	deny, _ := json.Marshal(map[string]string{"targetEmail": bob})
+	a.WriteJSON(Frame{T: "FRIEND_DENY", Data: deny})
+
+	f := waitFrame(t, phone, "FRIEND_DENIED")
+	if f.Seq == 0 {
+		t.Fatal("notification has no seq")
+	}
+
+	// Without an ack the phone gets it again on the next connection.
+	phone.Close()
+	phone = authDevice(t, url, bob, "phone", protocolVersion)
+	if again := waitFrame(t, phone, "FRIEND_DENIED"); again.Seq != f.Seq {
+		t.Fatalf("redelivered seq %d, want %d", again.Seq, f.Seq)
+	}
+	ack, _ := json.Marshal(map[string]int64{"seq": f.Seq})
+	phone.WriteJSON(Frame{T: "NOTIF_ACK", Data: ack})
+	eventually(t, "the phone's ack", func() bool {
+		pending, _ := store.PendingNotifications(bobHash, "phone")
+		return len(pending) == 0
+	})
+
+	// The desktop still gets it, and its ack removes the notification.
+	desktop := authDevice(t, url, bob, "desktop", protocolVersion)
+	if got := waitFrame(t, desktop, "FRIEND_DENIED"); got.Seq != f.Seq {
+		t.Fatalf("desktop got seq %d, want %d", got.Seq, f.Seq)
+	}
+	desktop.WriteJSON(Frame{T: "NOTIF_ACK", Data: ack})
+	eventually(t, "the notification to be deleted", func() bool {
+		pending, _ := store.PendingNotifications(bobHash, "new-device")
+		return len(pending) == 0
+	})
+}
+
+func TestLegacyClientsAckOnDelivery(t *testing.T) {
+	_, store, url := newTestServer(t)
+	const alice, bob = "alice@example.com", "bob@example.com"
+
+	old := authDevice(t, url, bob, "old-phone", 0)
+	a := authDevice(t, url, alice, "pk-alice", protocolVersion)
+	deny, _ := json.Marshal(map[string]string{"targetEmail": bob})
+	a.WriteJSON(Frame{T: "FRIEND_DENY", Data: deny})
+	waitFrame(t, old, "FRIEND_DENIED")
+
+	eventually(t, "delivery to count as the ack", func() bool {
+		pending, _ := store.PendingNotifications(emailHash(bob), "old-phone")
+		return len(pending) == 0
+	})
+}
+
+func TestNotifAckValidation(t *testing.T) {
+	ts := setupTestServer()
+	defer ts.Close()
+	conn := authDevice(t, "ws"+strings.TrimPrefix(ts.URL, "http"), "acks@example.com", "pk", protocolVersion)
+	conn.WriteJSON(Frame{T: "NOTIF_ACK", ID: "a1", Data: json.RawMessage(`{}`)})
+	f := waitFrame(t, conn, "ERROR")
+	if e := errorOf(t, f); f.ID != "a1" || e.Code != ErrInvalidFrame {
+		t.Fatalf("empty NOTIF_ACK = %+v", e)
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"strconv"
+	"time"
+)
+
+// Prekeys let a device start an X3DH session with a user who is offline, so
+// a friend request no longer has to be encrypted to whichever key happens to
+// be connected or was last seen. Each approved device publishes:
+//
+//   - its identity key, which is its device key;
+//   - a signed prekey, signed by the identity key over
+//     signedMessage("SIGNED_PREKEY", emailHash, keyId, prekey), and replaced
+//     by each upload that carries one;
+//   - a pool of one-time prekeys.
+//
+// PREKEY_BUNDLE_FETCH returns a bundle for each active device of the target
+// and takes one one-time prekey out of each pool. An empty pool leaves the
+// bundle without one, which X3DH allows at the cost of weaker replay
+// protection, so devices get PREKEYS_LOW before that happens. Anyone may
+// fetch, so one-time prekeys are rationed: past preKeyTakesPerRequester
+// fetches an hour from one target, or preKeyTakesPerTarget for the target
+// in all, bundles come without them and the pools are left alone.
+
+const (
+	maxOneTimePreKeysPerDevice = 100
+	preKeyLowWater             = 10
+	preKeyTakesPerRequester    = 3
+	preKeyTakesPerTarget       = 30
+)
+
+func init() {
+	RegisterFrame("PREKEY_UPLOAD", (*Server).handlePreKeyUpload, requireAuth, requireApprovedDevice, rateLimit(defaultFramesPerSecond))
+	RegisterFrame("PREKEY_BUNDLE_FETCH", (*Server).handlePreKeyBundleFetch, requireAuth, rateLimit(defaultFramesPerSecond))
+}
+
+type signedPreKey struct {
+	KeyID     int64  `json:"keyId"`
+	PublicKey string `json:"publicKey"`
+	Signature string `json:"signature"`
+}
+
+type oneTimePreKey struct {
+	KeyID     int64  `json:"keyId"`
+	PublicKey string `json:"publicKey"`
+}
+
+func (s *Server) handlePreKeyUpload(client *Client, frame Frame) {
+	var d struct {
+		IdentityKey    string          `json:"identityKey"`
+		SignedPreKey   *signedPreKey   `json:"signedPreKey"`
+		OneTimePreKeys []oneTimePreKey `json:"oneTimePreKeys"`
+	}
+	if err := json.Unmarshal(frame.Data, &d); err != nil || (d.SignedPreKey == nil && len(d.OneTimePreKeys) == 0) {
+		s.sendError(client, frame, ErrInvalidFrame, "Invalid PREKEY_UPLOAD")
+		return
+	}
+	email, publicKey := client.identity()
+	if publicKey == "" || d.IdentityKey != publicKey {
+		s.sendError(client, frame, ErrInvalidFrame, "The identity key must be the device key")
+		return
+	}
+	eh := emailHash(email)
+	now := time.Now()
+
+	if spk := d.SignedPreKey; spk != nil {
+		if _, err := parseDeviceKey(spk.PublicKey); err != nil || spk.KeyID < 0 {
+			s.sendError(client, frame, ErrInvalidFrame, "Invalid signed prekey")
+			return
+		}
+		msg := signedMessage("SIGNED_PREKEY", eh, strconv.FormatInt(spk.KeyID, 10), spk.PublicKey)
+		if verifyDeviceSignature(publicKey, msg, spk.Signature) != nil {
+			s.sendError(client, frame, ErrBadSignature, "Signed prekey signature does not match the identity key")
+			return
+		}
+	} else if _, err := s.store.SignedPreKey(eh, publicKey); err != nil {
+		s.sendError(client, frame, ErrInvalidFrame, "Upload a signed prekey first")
+		return
+	}
+
+	have, err := s.store.CountOneTimePreKeys(eh, publicKey)
+	if err != nil {
+		s.sendError(client, frame, ErrInternal, "Failed to store prekeys")
+		return
+	}
+	if have+len(d.OneTimePreKeys) > maxOneTimePreKeysPerDevice {
+		s.sendError(client, frame, ErrInvalidFrame, "A device can hold at most 100 one-time prekeys")
+		return
+	}
+	keys := make([]PreKey, 0, len(d.OneTimePreKeys))
+	for _, k := range d.OneTimePreKeys {
+		if _, err := parseDeviceKey(k.PublicKey); err != nil || k.KeyID < 0 {
+			s.sendError(client, frame, ErrInvalidFrame, "Invalid one-time prekey")
+			return
+		}
+		keys = append(keys, PreKey{KeyID: k.KeyID, Key: k.PublicKey, CreatedAt: now})
+	}
+
+	if spk := d.SignedPreKey; spk != nil {
+		err = s.store.PutSignedPreKey(PreKey{EmailHash: eh, PublicKey: publicKey, KeyID: spk.KeyID, Key: spk.PublicKey, Signature: spk.Signature, CreatedAt: now})
+	}
+	if err == nil && len(keys) > 0 {
+		err = s.store.AddOneTimePreKeys(eh, publicKey, keys)
+	}
+	if err != nil {
+		log.Printf("[Error] Failed to store prekeys for %s: %v", client.id, err)
+		s.sendError(client, frame, ErrInternal, "Failed to store prekeys")
+		return
+	}
+	count, _ := s.store.CountOneTimePreKeys(eh, publicKey)
+	data, _ := json.Marshal(map[string]int{"count": count})
+	s.reply(client, frame, Frame{T: "PREKEY_COUNT", Data: data})
+}
+
+// handlePreKeyBundleFetch returns a prekey bundle for each active device of
+// targetEmail that has published a signed prekey. Unlike KeyPackages it is
+// open to strangers, because setting up a friendship is what it is for.
+func (s *Server) handlePreKeyBundleFetch(client *Client, frame Frame) {
+	var d struct {
+		TargetEmail string `json:"targetEmail"`
+		TreeSize    int64  `json:"treeSize"`
+	}
+	if err := json.Unmarshal(frame.Data, &d); err != nil || d.TargetEmail == "" {
+		s.sendError(client, frame, ErrInvalidFrame, "Invalid PREKEY_BUNDLE_FETCH")
+		return
+	}
+	targetEmail := normalizeEmail(d.TargetEmail)
+	targetHash := emailHash(targetEmail)
+	devices, err := s.store.ListDevices(targetHash)
+	if err != nil {
+		s.sendError(client, frame, ErrInternal, "Failed to load devices")
+		return
+	}
+	takeOneTime := s.rateLimiter.checkPreKeyQuota(emailHash(client.email), targetHash)
+	bundles := make([]map[string]any, 0, len(devices))
+	keys := make([]string, 0, len(devices))
+	for _, dev := range devices {
+		if dev.Status != DeviceActive {
+			continue
+		}
+		spk, err := s.store.SignedPreKey(targetHash, dev.PublicKey)
+		if err != nil {
+			continue
+		}
+		bundle := map[string]any{
+			"identityKey":    dev.PublicKey,
+			"isMaster":       dev.IsMaster,
+			"crossSignature": dev.CrossSignature,
+			"crossSignedBy":  dev.CrossSignedBy,
+			"signedPreKey": signedPreKey{
+				KeyID:     spk.KeyID,
+				PublicKey: spk.Key,
+				Signature: spk.Signature,
+			},
+		}
+		if takeOneTime {
+			if otk, err := s.store.TakeOneTimePreKey(targetHash, dev.PublicKey); err == nil {
+				bundle["oneTimePreKey"] = oneTimePreKey{KeyID: otk.KeyID, PublicKey: otk.Key}
+			}
+			s.checkPreKeys(targetHash, dev.PublicKey)
+		}
+		bundles = append(bundles, bundle)
+		keys = append(keys, dev.PublicKey)
+	}
+	resp := map[string]any{"targetEmail": targetEmail, "bundles": bundles}
+	if len(keys) > 0 {
+		resp["keyProof"] = s.keyProof(targetHash, keys, d.TreeSize)
+	}
+	data, _ := json.Marshal(resp)
+	s.reply(client, frame, Frame{T: "PREKEY_BUNDLE", Data: data})
+}
+
+// checkPreKeys sends PREKEYS_LOW to a device that publishes prekeys when its
+// one-time pool is below preKeyLowWater. It runs after each fetch and on
+// AUTH, so a device that was offline while its pool drained hears about it
+// when it comes back.
+func (s *Server) checkPreKeys(emailHash, publicKey string) {
+	if _, err := s.store.SignedPreKey(emailHash, publicKey); err != nil {
+		return
+	}
+	n, err := s.store.CountOneTimePreKeys(emailHash, publicKey)
+	if err != nil || n >= preKeyLowWater {
+		return
+	}
+	data, _ := json.Marshal(map[string]int{"remaining": n})
+	s.sendToDevice(emailHash, publicKey, Frame{T: "PREKEYS_LOW", Data: data})
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestPreKeyBundles(t *testing.T) {
+	s, store, url := newTestServer(t)
+	const alice, bob = "alice@example.com", "bob@example.com"
+	aliceHash := emailHash(alice)
+
+	id := newTestDeviceKey(t)
+	a := authDevice(t, url, alice, id.pub, protocolVersion)
+	upload := func(data map[string]any) {
+		d, _ := json.Marshal(data)
+		a.WriteJSON(Frame{T: "PREKEY_UPLOAD", ID: "u", Data: d})
+	}
+	spkKey := newTestDeviceKey(t)
+	spk := map[string]any{
+		"keyId":     7,
+		"publicKey": spkKey.pub,
+		"signature": id.sign(signedMessage("SIGNED_PREKEY", aliceHash, "7", spkKey.pub)),
+	}
+	var otks []map[string]any
+	for i := range preKeyLowWater {
+		otks = append(otks, map[string]any{"keyId": i, "publicKey": newTestDeviceKey(t).pub})
+	}
+
+	// One-time prekeys need a signed prekey, and the signature must be the
+	// identity key's.
+	upload(map[string]any{"identityKey": id.pub, "oneTimePreKeys": otks})
+	if e := errorOf(t, waitFrame(t, a, "ERROR")); e.Code != ErrInvalidFrame {
+		t.Fatalf("upload without a signed prekey: %+v", e)
+	}
+	forged := map[string]any{"keyId": 7, "publicKey": spkKey.pub, "signature": spkKey.sign(signedMessage("SIGNED_PREKEY", aliceHash, "7", spkKey.pub))}
+	upload(map[string]any{"identityKey": id.pub, "signedPreKey": forged})
+	if e := errorOf(t, waitFrame(t, a, "ERROR")); e.Code != ErrBadSignature {
+		t.Fatalf("upload with a forged signature: %+v", e)
+	}
+	upload(map[string]any{"identityKey": spkKey.pub, "signedPreKey": spk})
+	if e := errorOf(t, waitFrame(t, a, "ERROR")); e.Code != ErrInvalidFrame {
+		t.Fatalf("upload with another identity key: %+v", e)
+	}
+	upload(map[string]any{"identityKey": id.pub, "signedPreKey": spk, "oneTimePreKeys": otks})
+	var count struct{ Count int }
+	json.Unmarshal(waitFrame(t, a, "PREKEY_COUNT").Data, &count)
+	if count.Count != preKeyLowWater {
+		t.Fatalf("PREKEY_COUNT = %d", count.Count)
+	}
+
+	// A stranger fetches a bundle, which uses up one one-time prekey and
+	// drops the pool below the low-water mark.
+	b := authDevice(t, url, bob, "pk-bob", protocolVersion)
+	d, _ := json.Marshal(map[string]any{"targetEmail": alice})
+	b.WriteJSON(Frame{T: "PREKEY_BUNDLE_FETCH", ID: "b1", Data: d})
+	var resp struct {
+		Bundles []struct {
+			IdentityKey   string
+			SignedPreKey  signedPreKey
+			OneTimePreKey *oneTimePreKey
+		}
+		KeyProof keyProof
+	}
+	json.Unmarshal(waitFrame(t, b, "PREKEY_BUNDLE").Data, &resp)
+	if len(resp.Bundles) != 1 {
+		t.Fatalf("bundles = %+v", resp.Bundles)
+	}
+	bundle := resp.Bundles[0]
+	msg := signedMessage("SIGNED_PREKEY", aliceHash, strconv.FormatInt(bundle.SignedPreKey.KeyID, 10), bundle.SignedPreKey.PublicKey)
+	if bundle.IdentityKey != id.pub || verifyDeviceSignature(bundle.IdentityKey, msg, bundle.SignedPreKey.Signature) != nil {
+		t.Fatalf("bundle = %+v", bundle)
+	}
+	if bundle.OneTimePreKey == nil || bundle.OneTimePreKey.KeyID != 0 {
+		t.Fatalf("one-time prekey = %+v", bundle.OneTimePreKey)
+	}
+	checkKeyProof(t, resp.KeyProof, s.keyLog.publicKey(), aliceHash, id.pub)
+
+	var low struct{ Remaining int }
+	json.Unmarshal(waitFrame(t, a, "PREKEYS_LOW").Data, &low)
+	if low.Remaining != preKeyLowWater-1 {
+		t.Fatalf("PREKEYS_LOW remaining = %d", low.Remaining)
+	}
+	if n, _ := store.CountOneTimePreKeys(aliceHash, id.pub); n != preKeyLowWater-1 {
+		t.Fatalf("pool = %d after one fetch", n)
+	}
+
+	// Past its quota the stranger still gets bundles, but no one-time
+	// prekeys, so it cannot drain the pool.
+	fetch := func() *oneTimePreKey {
+		b.WriteJSON(Frame{T: "PREKEY_BUNDLE_FETCH", ID: "b", Data: d})
+		resp.Bundles = nil
+		json.Unmarshal(waitFrame(t, b, "PREKEY_BUNDLE").Data, &resp)
+		if len(resp.Bundles) != 1 {
+			t.Fatalf("bundles = %+v", resp.Bundles)
+		}
+		return resp.Bundles[0].OneTimePreKey
+	}
+	for i := 1; i < preKeyTakesPerRequester; i++ {
+		if fetch() == nil {
+			t.Fatalf("fetch %d within quota had no one-time prekey", i+1)
+		}
+	}
+	if otk := fetch(); otk != nil {
+		t.Fatalf("fetch past quota took %+v", otk)
+	}
+	if n, _ := store.CountOneTimePreKeys(aliceHash, id.pub); n != preKeyLowWater-preKeyTakesPerRequester {
+		t.Fatalf("pool = %d after quota ran out", n)
+	}
+
+	// The target's own quota caps what many requesters take together.
+	for i := 0; i < preKeyTakesPerTarget-preKeyTakesPerRequester; i++ {
+		if !s.rateLimiter.checkPreKeyQuota(emailHash("r"+strconv.Itoa(i)), aliceHash) {
+			t.Fatalf("take %d refused within the target quota", i)
+		}
+	}
+	if s.rateLimiter.checkPreKeyQuota(emailHash("late"), aliceHash) {
+		t.Fatal("take past the target quota allowed")
+	}
+
+	// Expired takes are swept out, not only those of pairs seen again.
+	rl := s.rateLimiter
+	for key, takes := range rl.preKeyTakes {
+		for i := range takes {
+			takes[i] = takes[i].Add(-2 * time.Hour)
+		}
+		rl.preKeyTakes[key] = takes
+	}
+	rl.preKeySwept = rl.preKeySwept.Add(-2 * time.Hour)
+	rl.checkPreKeyQuota("x", "y")
+	if len(rl.preKeyTakes) != 2 {
+		t.Fatalf("takes after the sweep = %v", rl.preKeyTakes)
+	}
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"slices"
+	"sync"
+)
+
+// PresenceEvent describes one socket coming online or going away.
+type PresenceEvent struct {
+	EmailHash string
+	PublicKey string
+	SocketID  string
+	Online    bool
+	// UserOnline reports whether the user still has any socket after the
+	// event, so subscribers can tell first-connect and last-disconnect
+	// apart from a second device coming and going.
+	UserOnline bool
+}
+
+type presenceEntry struct {
+	client    *Client
+	emailHash string
+	publicKey string
+}
+
+// Presence tracks authenticated sockets in memory, indexed by email hash and
+// by device public key. Lookups never touch the Store; persistence, if
+// wanted, is just another subscriber (see persistPresence).
+type Presence struct {
+	mu      sync.RWMutex
+	sockets map[string]presenceEntry      // socket id
+	byUser  map[string]map[string]*Client // email hash -> socket id
+	byKey   map[string]map[string]*Client // public key -> socket id
+
+	subMu  sync.RWMutex
+	subs   map[int]func(PresenceEvent)
+	nextID int
+}
+
+func newPresence() *Presence {
+	return &Presence{
+		sockets: make(map[string]presenceEntry),
+		byUser:  make(map[string]map[string]*Client),
+		byKey:   make(map[string]map[string]*Client),
+		subs:    make(map[int]func(PresenceEvent)),
+	}
+}
+
+// Subscribe registers fn for every presence change and returns a function
+// that removes it. fn runs on the goroutine that caused the change, after
+// the registry lock is released, and must not block for long.
+func (p *Presence) Subscribe(fn func(PresenceEvent)) (cancel func()) {
+	p.subMu.Lock()
+	defer p.subMu.Unlock()
+	id := p.nextID
+	p.nextID++
+	p.subs[id] = fn
+	return func() {
+		p.subMu.Lock()
+		defer p.subMu.Unlock()
+		delete(p.subs, id)
+	}
+}
+
+func (p *Presence) notify(events []PresenceEvent) {
+	if len(events) == 0 {
+		return
+	}
+	p.subMu.RLock()
+	subs := make([]func(PresenceEvent), 0, len(p.subs))
+	for _, fn := range p.subs {
+		subs = append(subs, fn)
+	}
+	p.subMu.RUnlock()
+	for _, ev := range events {
+		for _, fn := range subs {
+			fn(ev)
+		}
+	}
+}
+
+// Connect records c as online for emailHash with publicKey. Authenticating
+// again on the same socket replaces the previous entry.
+func (p *Presence) Connect(c *Client, emailHash, publicKey string) {
+	p.mu.Lock()
+	var events []PresenceEvent
+	if _, ok := p.sockets[c.id]; ok {
+		events = append(events, p.removeLocked(c.id))
+	}
+	p.sockets[c.id] = presenceEntry{client: c, emailHash: emailHash, publicKey: publicKey}
+	addIndex(p.byUser, emailHash, c)
+	if publicKey != "" {
+		addIndex(p.byKey, publicKey, c)
+	}
+	events = append(events, PresenceEvent{EmailHash: emailHash, PublicKey: publicKey, SocketID: c.id, Online: true, UserOnline: true})
+	p.mu.Unlock()
+	p.notify(events)
+}
+
+// Disconnect forgets c. It is a no-op for sockets that never authenticated.
+func (p *Presence) Disconnect(c *Client) {
+	p.mu.Lock()
+	if _, ok := p.sockets[c.id]; !ok {
+		p.mu.Unlock()
+		return
+	}
+	ev := p.removeLocked(c.id)
+	p.mu.Unlock()
+	p.notify([]PresenceEvent{ev})
+}
+
+// DisconnectUser forgets every socket of emailHash.
+func (p *Presence) DisconnectUser(emailHash string) {
+	p.mu.Lock()
+	var events []PresenceEvent
+	for id := range p.byUser[emailHash] {
+		events = append(events, p.removeLocked(id))
+	}
+	p.mu.Unlock()
+	p.notify(events)
+}
+
+func (p *Presence) removeLocked(socketID string) PresenceEvent {
+	e := p.sockets[socketID]
+	delete(p.sockets, socketID)
+	removeIndex(p.byUser, e.emailHash, socketID)
+	if e.publicKey != "" {
+		removeIndex(p.byKey, e.publicKey, socketID)
+	}
+	return PresenceEvent{
+		EmailHash:  e.emailHash,
+		PublicKey:  e.publicKey,
+		SocketID:   socketID,
+		UserOnline: len(p.byUser[e.emailHash]) > 0,
+	}
+}
+
+func addIndex(m map[string]map[string]*Client, key string, c *Client) {
+	if m[key] == nil {
+		m[key] = make(map[string]*Client)
+	}
+	m[key][c.id] = c
+}
+
+func removeIndex(m map[string]map[string]*Client, key, socketID string) {
+	delete(m[key], socketID)
+	if len(m[key]) == 0 {
+		delete(m, key)
+	}
+}
+
+// Online reports whether emailHash has any authenticated socket.
+func (p *Presence) Online(emailHash string) bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return len(p.byUser[emailHash]) > 0
+}
+
+// Clients returns the connected sockets of emailHash.
+func (p *Presence) Clients(emailHash string) []*Client {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return mapValues(p.byUser[emailHash])
+}
+
+// ClientsForKey returns the sockets authenticated with publicKey.
+func (p *Presence) ClientsForKey(publicKey string) []*Client {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return mapValues(p.byKey[publicKey])
+}
+
+// Keys returns the distinct device keys emailHash is connected with, sorted.
+func (p *Presence) Keys(emailHash string) []string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	var out []string
+	for id := range p.byUser[emailHash] {
+		if pk := p.sockets[id].publicKey; pk != "" && !slices.Contains(out, pk) {
+			out = append(out, pk)
+		}
+	}
+	slices.Sort(out)
+	return out
+}
+
+func mapValues(m map[string]*Client) []*Client {
+	out := make([]*Client, 0, len(m))
+	for _, c := range m {
+		out = append(out, c)
+	}
+	return out
+}
+
+// persistPresence mirrors presence into the store's sockets table, for
+// operators who want it visible to other tools.
+func persistPresence(store Store, logf func(string, ...any)) func(PresenceEvent) {
+	return func(ev PresenceEvent) {
+		var err error
+		if ev.Online {
+			err = store.AddSocket(ev.EmailHash, ev.SocketID, ev.PublicKey)
+		} else {
+			err = store.RemoveSocket(ev.SocketID)
+		}
+		if err != nil {
+			logf("Failed to persist presence for %s: %v", ev.SocketID, err)
+		}
+	}
+}
+
+// Snapshot returns socket counts per email hash and device key. Keyless
+// sockets are counted under "".
+func (p *Presence) Snapshot() map[string]map[string]int {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	out := make(map[string]map[string]int, len(p.byUser))
+	for _, e := range p.sockets {
+		if out[e.emailHash] == nil {
+			out[e.emailHash] = make(map[string]int)
+		}
+		out[e.emailHash][e.publicKey]++
+	}
+	return out
+}
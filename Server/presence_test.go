@@ -0,0 +1,85 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestPresenceLookups(t *testing.T) {
+	p := newPresence()
+	a1, a2, b := &Client{id: "a1"}, &Client{id: "a2"}, &Client{id: "b"}
+	p.Connect(a1, "alice", "ka")
+	p.Connect(a2, "alice", "ka")
+	p.Connect(b, "bob", "")
+
+	if !p.Online("alice") || !p.Online("bob") || p.Online("carol") {
+		t.Fatal("wrong online state")
+	}
+	if got := p.Keys("alice"); !sameStrings(got, []string{"ka"}) {
+		t.Fatalf("Keys(alice) = %v", got)
+	}
+	if got := p.Keys("bob"); len(got) != 0 {
+		t.Fatalf("Keys(bob) = %v, want none for a keyless socket", got)
+	}
+	if got := p.ClientsForKey("ka"); len(got) != 2 {
+		t.Fatalf("ClientsForKey = %v", got)
+	}
+
+	// Re-authenticating the socket as another device moves it.
+	p.Connect(a2, "alice", "kb")
+	if got := p.Keys("alice"); !sameStrings(got, []string{"ka", "kb"}) {
+		t.Fatalf("Keys after re-auth = %v", got)
+	}
+	if got := p.ClientsForKey("ka"); len(got) != 1 || got[0] != a1 {
+		t.Fatalf("ClientsForKey(ka) after re-auth = %v", got)
+	}
+
+	p.DisconnectUser("alice")
+	if p.Online("alice") || len(p.ClientsForKey("kb")) != 0 {
+		t.Fatal("alice still present after DisconnectUser")
+	}
+	p.Disconnect(b)
+	p.Disconnect(b)
+	if len(p.sockets) != 0 || len(p.byUser) != 0 || len(p.byKey) != 0 {
+		t.Fatalf("indexes not empty: %v %v %v", p.sockets, p.byUser, p.byKey)
+	}
+}
+
+func TestPresenceSubscribe(t *testing.T) {
+	p := newPresence()
+	var events []PresenceEvent
+	cancel := p.Subscribe(func(ev PresenceEvent) { events = append(events, ev) })
+
+	c1, c2 := &Client{id: "c1"}, &Client{id: "c2"}
+	p.Connect(c1, "alice", "k1")
+	p.Connect(c2, "alice", "k2")
+	p.Disconnect(c1)
+	p.Disconnect(c2)
+	cancel()
+	p.Connect(c1, "alice", "k1")
+
+	want := []struct{ online, userOnline bool }{{true, true}, {true, true}, {false, true}, {false, false}}
+	if len(events) != len(want) {
+		t.Fatalf("got %d events, want %d: %+v", len(events), len(want), events)
+	}
+	for i, w := range want {
+		if events[i].Online != w.online || events[i].UserOnline != w.userOnline {
+			t.Fatalf("event %d = %+v, want online=%v userOnline=%v", i, events[i], w.online, w.userOnline)
+		}
+	}
+}
+
+func TestPresencePersistenceHook(t *testing.T) {
+	store := newMemoryStore()
+	p := newPresence()
+	p.Subscribe(persistPresence(store, t.Logf))
+
+	c := &Client{id: "sock"}
+	p.Connect(c, "alice", "k1")
+	if ids, _ := store.SocketIDs("alice"); !sameStrings(ids, []string{"sock"}) {
+		t.Fatalf("persisted sockets = %v", ids)
+	}
+	p.Disconnect(c)
+	if ids, _ := store.SocketIDs("alice"); len(ids) != 0 {
+		t.Fatalf("sockets left after disconnect = %v", ids)
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import "encoding/json"
+
+// Clients from protocol 4 on get a DELIVERY_REPORT for a MSG sent with c,
+// instead of DELIVERED, QUEUED or DELIVERED_FAILED. The report gives the
+// outcome for every recipient key in payloads, and echoes the request id and
+// the msgId the client put in the MSG data.
+//
+// Read receipts travel as READ_RECEIPT, which the relay passes to every
+// other socket in the session, the reader's own devices included, so each
+// of them can update its tick marks.
+
+// receiptsProtocolVersion is the first protocol version that gets
+// DELIVERY_REPORT.
+const receiptsProtocolVersion = 4
+
+// Per-device outcomes in a DELIVERY_REPORT.
+const (
+	deliveryDelivered = "delivered" // a connected device took it
+	deliveryQueued    = "queued"    // the mailbox holds it
+	deliveryFailed    = "failed"    // nobody has it
+)
+
+const (
+	maxMsgIDLength     = 128
+	maxReceiptMsgIDs   = 256
+	maxReceiptDataSize = maxReceiptMsgIDs * (maxMsgIDLength + 3)
+)
+
+func init() {
+	RegisterFrame("READ_RECEIPT", (*Server).handleReadReceipt, requireAuth, requireApprovedDevice, rateLimit(defaultFramesPerSecond), maxPayload(maxReceiptDataSize))
+}
+
+// sendDeliveryReport answers req with the outcome for each key it carried a
+// payload for. The sender's own key is left out.
+func (s *Server) sendDeliveryReport(c *Client, req Frame, msgID string, payloads map[string]string, delivered, queued []string) {
+	_, senderKey := c.identity()
+	devices := make(map[string]string, len(payloads))
+	for pk := range payloads {
+		if pk != senderKey {
+			devices[pk] = deliveryFailed
+		}
+	}
+	for _, pk := range queued {
+		devices[pk] = deliveryQueued
+	}
+	for _, pk := range delivered {
+		devices[pk] = deliveryDelivered
+	}
+	data, _ := json.Marshal(map[string]any{
+		"msgId":   msgID,
+		"devices": devices,
+	})
+	s.reply(c, req, Frame{T: "DELIVERY_REPORT", SID: req.SID, Data: data})
+}
+
+func (s *Server) handleReadReceipt(client *Client, frame Frame) {
+	if len(frame.SID) == 0 || len(frame.SID) > maxSIDLength {
+		s.sendError(client, frame, ErrInvalidSID, "Invalid session id")
+		return
+	}
+	var d struct {
+		MsgIDs []string `json:"msgIds"`
+	}
+	if err := json.Unmarshal(frame.Data, &d); err != nil {
+		s.sendError(client, frame, ErrInvalidFrame, "Invalid READ_RECEIPT")
+		return
+	}
+	if len(d.MsgIDs) == 0 || len(d.MsgIDs) > maxReceiptMsgIDs {
+		s.sendError(client, frame, ErrInvalidFrame, "READ_RECEIPT needs between 1 and 256 msgIds")
+		return
+	}
+	for _, id := range d.MsgIDs {
+		if id == "" || len(id) > maxMsgIDLength {
+			s.sendError(client, frame, ErrInvalidFrame, "Invalid msgId")
+			return
+		}
+	}
+
+	email, publicKey := client.identity()
+	if ok, _ := s.store.IsSessionMember(frame.SID, emailHash(email)); !ok {
+		s.sendError(client, frame, ErrNotFriends, "Not part of this session")
+		return
+	}
+	if member, _ := s.sessions.ensure(frame.SID, client); !member {
+		s.sendError(client, frame, ErrNotSessionMember, "Not a member of this session")
+		return
+	}
+
+	data, _ := json.Marshal(map[string]any{
+		"msgIds":    d.MsgIDs,
+		"publicKey": publicKey,
+	})
+	receipt := Frame{T: "READ_RECEIPT", SID: frame.SID, SH: emailHash(email), Data: data}
+	s.sendToSession(frame.SID, client, receipt)
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestDeliveryReportAndReadReceipts(t *testing.T) {
+	const alice, bob = "alice@example.com", "bob@example.com"
+	s, store, url := startMailboxServer(t, 1024)
+
+	authDevice(t, url, bob, "desktop", protocolVersion).Close()
+	addLinkedDevice(store, bob, "phone")
+	addLinkedDevice(store, bob, "laptop")
+	eventually(t, "bob to go offline", func() bool { return len(s.onlineKeys(emailHash(bob))) == 0 })
+	phone := authDevice(t, url, bob, "phone", protocolVersion)
+	waitFrame(t, phone, "SESSION_LIST")
+	laptop := authDevice(t, url, bob, "laptop", protocolVersion)
+	waitFrame(t, laptop, "SESSION_LIST")
+
+	a := authDevice(t, url, alice, "pk-alice", protocolVersion)
+	msg, _ := json.Marshal(map[string]any{
+		"payloads": map[string]string{"phone": "cA==", "laptop": "bA==", "desktop": "ZA==", "tablet": "dA==", "pk-alice": "YQ=="},
+		"mailbox":  true,
+		"msgId":    "uuid-1",
+	})
+	a.WriteJSON(Frame{T: "MSG", ID: "m1", SID: "sid-ab", C: true, Data: msg})
+	report := waitFrame(t, a, "DELIVERY_REPORT")
+	var rd struct {
+		MsgID   string            `json:"msgId"`
+		Devices map[string]string `json:"devices"`
+	}
+	json.Unmarshal(report.Data, &rd)
+	want := map[string]string{"phone": deliveryDelivered, "laptop": deliveryDelivered, "desktop": deliveryQueued, "tablet": deliveryFailed}
+	if report.ID != "m1" || report.SID != "sid-ab" || rd.MsgID != "uuid-1" || !reflect.DeepEqual(rd.Devices, want) {
+		t.Fatalf("DELIVERY_REPORT = %+v %s", report, report.Data)
+	}
+
+	// The phone's read receipt reaches alice and bob's other devices.
+	waitFrame(t, phone, "MSG")
+	phone.WriteJSON(Frame{T: "READ_RECEIPT", ID: "r1", SID: "sid-ab", Data: json.RawMessage(`{"msgIds":["uuid-1"]}`)})
+	for name, conn := range map[string]*websocket.Conn{"alice": a, "laptop": laptop} {
+		f := waitFrame(t, conn, "READ_RECEIPT")
+		if f.ID != "" || f.SH != emailHash(bob) || string(f.Data) != `{"msgIds":["uuid-1"],"publicKey":"phone"}` {
+			t.Fatalf("%s got %+v %s", name, f, f.Data)
+		}
+	}
+}
+
+func TestReadReceiptValidation(t *testing.T) {
+	_, _, url := startMailboxServer(t, 0)
+	conn := authDevice(t, url, "alice@example.com", "pk-alice", protocolVersion)
+
+	for data, code := range map[string]ErrorCode{
+		`{"msgIds":[]}`:   ErrInvalidFrame,
+		`{"msgIds":[""]}`: ErrInvalidFrame,
+	} {
+		conn.WriteJSON(Frame{T: "READ_RECEIPT", ID: "r1", SID: "sid-ab", Data: json.RawMessage(data)})
+		if e := errorOf(t, waitFrame(t, conn, "ERROR")); e.Code != code {
+			t.Fatalf("READ_RECEIPT %s = %+v", data, e)
+		}
+	}
+	conn.WriteJSON(Frame{T: "READ_RECEIPT", ID: "r2", SID: "sid-xy", Data: json.RawMessage(`{"msgIds":["m"]}`)})
+	if e := errorOf(t, waitFrame(t, conn, "ERROR")); e.Code != ErrNotFriends {
+		t.Fatalf("READ_RECEIPT outside the session = %+v", e)
+	}
+}
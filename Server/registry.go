@@ -0,0 +1,157 @@
+package main
+
+import (
+	"runtime/debug"
+	"sort"
+	"sync"
+	"time"
+)
+
+// FrameHandler processes a single inbound frame for a connected client.
+type FrameHandler func(s *Server, c *Client, f Frame)
+
+// Middleware wraps a FrameHandler with cross-cutting behaviour such as auth
+// checks or rate limiting.
+type Middleware func(FrameHandler) FrameHandler
+
+type frameRoute struct {
+	handler    FrameHandler
+	middleware []Middleware
+}
+
+// FrameRegistry maps frame types to their handlers.
+type FrameRegistry struct {
+	mu     sync.RWMutex
+	routes map[string]FrameHandler
+	global []Middleware
+}
+
+var (
+	customFramesMu sync.Mutex
+	customFrames   = map[string]frameRoute{}
+)
+
+// RegisterFrame adds a frame type to every server created afterwards. It is
+// meant to be called from an init() in its own file so new frame types don't
+// need changes to handlers.go. Registering the same type twice panics.
+func RegisterFrame(t string, h FrameHandler, mw ...Middleware) {
+	customFramesMu.Lock()
+	defer customFramesMu.Unlock()
+	if _, dup := customFrames[t]; dup {
+		panic("relay: duplicate frame registration for " + t)
+	}
+	customFrames[t] = frameRoute{handler: h, middleware: mw}
+}
+
+func NewFrameRegistry() *FrameRegistry {
+	return &FrameRegistry{routes: make(map[string]FrameHandler)}
+}
+
+// Use appends middleware applied to every frame type, outermost first.
+func (r *FrameRegistry) Use(mw ...Middleware) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.global = append(r.global, mw...)
+}
+
+// Handle registers h for frame type t. Per-type middleware runs inside the
+// global middleware, in the order given.
+func (r *FrameRegistry) Handle(t string, h FrameHandler, mw ...Middleware) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, dup := r.routes[t]; dup {
+		panic("relay: duplicate frame registration for " + t)
+	}
+	r.routes[t] = chain(h, mw)
+}
+
+// Types returns the registered frame types in sorted order.
+func (r *FrameRegistry) Types() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	types := make([]string, 0, len(r.routes))
+	for t := range r.routes {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+	return types
+}
+
+// Dispatch runs the handler registered for f.T and reports whether there
+// was one.
+func (r *FrameRegistry) Dispatch(s *Server, c *Client, f Frame) bool {
+	r.mu.RLock()
+	h, ok := r.routes[f.T]
+	global := r.global
+	r.mu.RUnlock()
+	if !ok {
+		return false
+	}
+	chain(h, global)(s, c, f)
+	return true
+}
+
+func chain(h FrameHandler, mw []Middleware) FrameHandler {
+	for i := len(mw) - 1; i >= 0; i-- {
+		h = mw[i](h)
+	}
+	return h
+}
+
+func (s *Server) registerCustomFrames() {
+	customFramesMu.Lock()
+	defer customFramesMu.Unlock()
+	for t, route := range customFrames {
+		s.frames.Handle(t, route.handler, route.middleware...)
+	}
+}
+
+// recoverPanics keeps a bad frame from taking down the connection goroutine.
+func recoverPanics(next FrameHandler) FrameHandler {
+	return func(s *Server, c *Client, f Frame) {
+		defer func() {
+			if rec := recover(); rec != nil {
+				s.logger.Printf("PANIC handling %s from %s: %v\n%s", f.T, c.id, rec, debug.Stack())
+				s.sendError(c, f, ErrInternal, "Internal server error")
+			}
+		}()
+		next(s, c, f)
+	}
+}
+
+// requireAuth rejects frames from clients that have not completed AUTH.
+func requireAuth(next FrameHandler) FrameHandler {
+	return func(s *Server, c *Client, f Frame) {
+		if c.authedEmail() == "" {
+			s.sendError(c, f, ErrAuthRequired, "Auth required")
+			return
+		}
+		next(s, c, f)
+	}
+}
+
+// rateLimit caps how many frames of one type a client may send per second.
+func rateLimit(perSecond int) Middleware {
+	return func(next FrameHandler) FrameHandler {
+		return func(s *Server, c *Client, f Frame) {
+			if !c.allow(f.T, perSecond) {
+				s.sendRetryError(c, f, ErrRateLimited, "Rate limit exceeded: Too many messages per second", time.Second)
+				return
+			}
+			next(s, c, f)
+		}
+	}
+}
+
+// maxPayload rejects frames whose data field is larger than limit bytes.
+func maxPayload(limit int) Middleware {
+	return func(next FrameHandler) FrameHandler {
+		return func(s *Server, c *Client, f Frame) {
+			if len(f.Data) > limit {
+				s.sendError(c, f, ErrPayloadTooLarge, "Message payload too large")
+				return
+			}
+			next(s, c, f)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func init() {
+	RegisterFrame("TEST_ECHO", func(s *Server, c *Client, f Frame) {
+		s.send(c, Frame{T: "TEST_ECHO", Data: f.Data})
+	})
+	RegisterFrame("TEST_PANIC", func(s *Server, c *Client, f Frame) {
+		panic("boom")
+	})
+}
+
+func dialTestServer(t *testing.T, s *Server) *websocket.Conn {
+	t.Helper()
+	ts := httptest.NewServer(http.HandlerFunc(s.handle))
+	t.Cleanup(ts.Close)
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func readFrame(t *testing.T, conn *websocket.Conn) Frame {
+	t.Helper()
+	for {
+		var f Frame
+		if err := conn.ReadJSON(&f); err != nil {
+			t.Fatal(err)
+		}
+		if f.T != "PING" {
+			return f
+		}
+	}
+}
+
+func errorMessage(f Frame) string {
+	var d struct {
+		Message string `json:"message"`
+	}
+	json.Unmarshal(f.Data, &d)
+	return d.Message
+}
+
+func TestRegistryMiddlewareOrder(t *testing.T) {
+	var order []string
+	mark := func(name string) Middleware {
+		return func(next FrameHandler) FrameHandler {
+			return func(s *Server, c *Client, f Frame) {
+				order = append(order, name)
+				next(s, c, f)
+			}
+		}
+	}
+
+	r := NewFrameRegistry()
+	r.Use(mark("global"))
+	r.Handle("X", func(s *Server, c *Client, f Frame) { order = append(order, "handler") }, mark("a"), mark("b"))
+
+	if !r.Dispatch(nil, nil, Frame{T: "X"}) {
+		t.Fatal("X not dispatched")
+	}
+	if r.Dispatch(nil, nil, Frame{T: "Y"}) {
+		t.Fatal("unknown frame type was dispatched")
+	}
+	if got := strings.Join(order, ","); got != "global,a,b,handler" {
+		t.Fatalf("middleware order = %s", got)
+	}
+}
+
+func TestRegistryDuplicatePanics(t *testing.T) {
+	r := NewFrameRegistry()
+	r.Handle("X", func(*Server, *Client, Frame) {})
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expected panic on duplicate registration")
+		}
+	}()
+	r.Handle("X", func(*Server, *Client, Frame) {})
+}
+
+func TestCustomFramesAndBuiltinMiddleware(t *testing.T) {
+	s := newServer(testConfig(), newMemoryStore(), log.New(io.Discard, "", 0))
+	conn := dialTestServer(t, s)
+
+	conn.WriteJSON(Frame{T: "TEST_ECHO", Data: json.RawMessage(`{"v":1}`)})
+	if f := readFrame(t, conn); f.T != "TEST_ECHO" || string(f.Data) != `{"v":1}` {
+		t.Fatalf("unexpected echo reply %+v", f)
+	}
+
+	conn.WriteJSON(Frame{T: "MSG", SID: "abc"})
+	if f := readFrame(t, conn); f.T != "ERROR" || errorMessage(f) != "Auth required" {
+		t.Fatalf("expected auth error, got %+v", f)
+	}
+
+	conn.WriteJSON(Frame{T: "TEST_PANIC"})
+	if f := readFrame(t, conn); f.T != "ERROR" || errorMessage(f) != "Internal server error" {
+		t.Fatalf("expected internal error, got %+v", f)
+	}
+
+	// The connection must survive the panic.
+	conn.WriteJSON(Frame{T: "TEST_ECHO"})
+	if f := readFrame(t, conn); f.T != "TEST_ECHO" {
+		t.Fatalf("connection did not survive panic, got %+v", f)
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+)
+
+// A device rotates its key with UPDATE_PUBKEY: the new key, signed by the
+// old one over signedMessage("UPDATE_PUBKEY", emailHash, newKey). The device
+// keeps its ID, role and approval, and everything the server holds for the
+// old key (sockets, queued mail, notification acks, KeyPackages, a master
+// claim) moves to the new one in a single store transaction. Prekeys and
+// the cross-signature were made for the old key, so they are dropped; the
+// master is asked to sign the new key again.
+//
+// The old key is kept in the key history, so a peer holding a message from
+// it can still tell whose it was: KEY_DIRECTORY lists each device's previous
+// keys, and its signature chain runs through the rotation.
+
+func init() {
+	RegisterFrame("UPDATE_PUBKEY", (*Server).handleUpdatePubKey, requireAuth, requireApprovedDevice, rateLimit(defaultFramesPerSecond))
+}
+
+func (s *Server) handleUpdatePubKey(client *Client, frame Frame) {
+	var d struct {
+		PublicKey string `json:"publicKey"`
+		Signature string `json:"signature"`
+	}
+	if err := json.Unmarshal(frame.Data, &d); err != nil || d.PublicKey == "" {
+		s.sendError(client, frame, ErrInvalidFrame, "Invalid UPDATE_PUBKEY")
+		return
+	}
+	email, oldKey := client.identity()
+	eh := emailHash(email)
+	if oldKey == "" {
+		s.sendError(client, frame, ErrInvalidFrame, "Only a device with a key can rotate it")
+		return
+	}
+	if _, err := parseDeviceKey(d.PublicKey); err != nil || d.PublicKey == oldKey {
+		s.sendError(client, frame, ErrInvalidFrame, "Invalid new device key")
+		return
+	}
+	if verifyDeviceSignature(oldKey, signedMessage(frame.T, eh, d.PublicKey), d.Signature) != nil {
+		s.sendError(client, frame, ErrBadSignature, "Signature does not match the device key")
+		return
+	}
+	if _, err := s.store.Device(eh, d.PublicKey); err == nil {
+		s.sendError(client, frame, ErrInvalidFrame, "The new key is already a device of this account")
+		return
+	}
+	dev, err := s.store.Device(eh, oldKey)
+	if err != nil {
+		s.sendError(client, frame, ErrInvalidFrame, "No such device")
+		return
+	}
+	r := KeyRotation{EmailHash: eh, DeviceID: dev.DeviceID, OldKey: oldKey, NewKey: d.PublicKey, Signature: d.Signature, RotatedAt: time.Now()}
+	if err := s.store.RotateDeviceKey(r); err != nil {
+		log.Printf("[Error] Failed to rotate device key for %s: %v", client.id, err)
+		s.sendError(client, frame, ErrInternal, "Failed to rotate device key")
+		return
+	}
+
+	// Move this socket over before dropping whatever else is still on the
+	// old key, such as the same device connected through another node.
+	client.mu.Lock()
+	client.publicKey = d.PublicKey
+	client.mu.Unlock()
+	s.presence.Connect(client, eh, d.PublicKey)
+
+	s.logKey(eh, oldKey, KeyRemoved)
+	s.logKey(eh, d.PublicKey, KeyAdded)
+	if dev.IsMaster {
+		s.logKey(eh, d.PublicKey, KeyMaster)
+	}
+
+	data, _ := json.Marshal(map[string]any{
+		"deviceId":  dev.DeviceID,
+		"oldPubKey": oldKey,
+		"newPubKey": d.PublicKey,
+		"signature": d.Signature,
+		"keyProof":  s.keyProof(eh, []string{d.PublicKey}, 0),
+	})
+	s.dropDevice(eh, oldKey, Frame{T: "KEY_CHANGED", Data: data})
+	for _, sid := range s.userSessions(eh) {
+		s.sendToSession(sid, client, Frame{T: "KEY_CHANGED", SID: sid, SH: eh, Data: data})
+	}
+
+	reply, _ := json.Marshal(map[string]string{"deviceId": dev.DeviceID, "publicKey": d.PublicKey})
+	s.reply(client, frame, Frame{T: "PUBKEY_UPDATED", Data: reply})
+	s.broadcastDeviceList(eh)
+	if master, err := s.store.MasterDevice(eh); err == nil {
+		if f, ok := s.crossSignNeeded(eh, master.PublicKey); ok {
+			s.sendToDevice(eh, master.PublicKey, f)
+		}
+	}
+	log.Printf("[Server] Device %s of %s rotated its key", dev.DeviceID, eh)
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestKeyRotation(t *testing.T) {
+	s, store, url := newTestServer(t)
+	const alice, bob = "alice@example.com", "bob@example.com"
+	aliceHash, bobHash := emailHash(alice), emailHash(bob)
+	laptop, tablet, rotated := newTestDeviceKey(t), newTestDeviceKey(t), newTestDeviceKey(t)
+	store.AddFriendship(Friendship{User1Hash: aliceHash, User2Hash: bobHash, SID: "sid-ab", Since: time.Now()})
+
+	m := authDevice(t, url, alice, laptop.pub, protocolVersion)
+	tab := authDevice(t, url, alice, tablet.pub, protocolVersion)
+	d, _ := json.Marshal(map[string]string{
+		"targetPubKey":   tablet.pub,
+		"signature":      laptop.sign(signedMessage("DEVICE_LINK_ACCEPT", aliceHash, tablet.pub)),
+		"crossSignature": laptop.sign(crossSignMessage(aliceHash, tablet.pub)),
+	})
+	m.WriteJSON(Frame{T: "DEVICE_LINK_ACCEPT", ID: "a", Data: d})
+	waitFrame(t, m, "DEVICE_LINK_ACCEPTED")
+	tab.Close()
+	tab = authDevice(t, url, alice, tablet.pub, protocolVersion)
+	before, _ := store.Device(aliceHash, tablet.pub)
+
+	b := authDevice(t, url, bob, "pk-bob", protocolVersion)
+	waitFrame(t, b, "SESSION_LIST")
+
+	rotate := func(newKey, sig string) {
+		d, _ := json.Marshal(map[string]string{"publicKey": newKey, "signature": sig})
+		tab.WriteJSON(Frame{T: "UPDATE_PUBKEY", ID: "u", Data: d})
+	}
+	rotate(rotated.pub, rotated.sign(signedMessage("UPDATE_PUBKEY", aliceHash, rotated.pub)))
+	if e := errorOf(t, waitFrame(t, tab, "ERROR")); e.Code != ErrBadSignature {
+		t.Fatalf("rotation signed by the new key = %+v", e)
+	}
+	rotate(laptop.pub, tablet.sign(signedMessage("UPDATE_PUBKEY", aliceHash, laptop.pub)))
+	if e := errorOf(t, waitFrame(t, tab, "ERROR")); e.Code != ErrInvalidFrame {
+		t.Fatalf("rotation onto another device's key = %+v", e)
+	}
+
+	sig := tablet.sign(signedMessage("UPDATE_PUBKEY", aliceHash, rotated.pub))
+	rotate(rotated.pub, sig)
+	var updated struct{ DeviceID, PublicKey string }
+	json.Unmarshal(waitFrame(t, tab, "PUBKEY_UPDATED").Data, &updated)
+	if updated.DeviceID != before.DeviceID || updated.PublicKey != rotated.pub {
+		t.Fatalf("PUBKEY_UPDATED = %+v", updated)
+	}
+
+	// Friends hear about it with the old key's signature over the new one.
+	var changed struct {
+		DeviceID, OldPubKey, NewPubKey, Signature string
+		KeyProof                                  keyProof
+	}
+	f := waitFrame(t, b, "KEY_CHANGED")
+	json.Unmarshal(f.Data, &changed)
+	if f.SID != "sid-ab" || changed.DeviceID != before.DeviceID || changed.OldPubKey != tablet.pub || changed.NewPubKey != rotated.pub ||
+		verifyDeviceSignature(changed.OldPubKey, signedMessage("UPDATE_PUBKEY", aliceHash, changed.NewPubKey), changed.Signature) != nil {
+		t.Fatalf("KEY_CHANGED = %+v", changed)
+	}
+	checkKeyProof(t, changed.KeyProof, s.keyLog.publicKey(), aliceHash, rotated.pub)
+
+	// The new key needs a fresh cross-signature.
+	var needed struct{ PublicKeys []string }
+	json.Unmarshal(waitFrame(t, m, "CROSS_SIGN_NEEDED").Data, &needed)
+	if len(needed.PublicKeys) != 1 || needed.PublicKeys[0] != rotated.pub {
+		t.Fatalf("CROSS_SIGN_NEEDED = %+v", needed)
+	}
+
+	// The socket carries on under the new key.
+	if keys := s.onlineKeys(aliceHash); !slices.Contains(keys, rotated.pub) || slices.Contains(keys, tablet.pub) {
+		t.Fatalf("online keys = %v", keys)
+	}
+	dev, err := store.Device(aliceHash, rotated.pub)
+	if err != nil || dev.DeviceID != before.DeviceID || dev.Status != DeviceActive {
+		t.Fatalf("rotated device = %+v, %v", dev, err)
+	}
+
+	// The directory keeps the old key and chains the new one back to the
+	// approval.
+	d, _ = json.Marshal(map[string]string{"targetEmail": alice})
+	b.WriteJSON(Frame{T: "KEY_DIRECTORY", ID: "k", Data: d})
+	var dir struct {
+		Devices []struct {
+			PublicKey      string
+			SignatureChain []chainLink
+			PreviousKeys   []struct {
+				PublicKey string
+				RotatedAt int64
+			}
+		}
+	}
+	json.Unmarshal(waitFrame(t, b, "KEY_DIRECTORY").Data, &dir)
+	found := false
+	for _, dev := range dir.Devices {
+		if dev.PublicKey != rotated.pub {
+			continue
+		}
+		found = true
+		chain := dev.SignatureChain
+		if len(dev.PreviousKeys) != 1 || dev.PreviousKeys[0].PublicKey != tablet.pub || len(chain) != 2 ||
+			chain[0].Kind != "DEVICE_LINK_ACCEPT" || chain[0].SubjectPubKey != tablet.pub ||
+			chain[1].Kind != "UPDATE_PUBKEY" || chain[1].SignerPubKey != tablet.pub || chain[1].SubjectPubKey != rotated.pub {
+			t.Fatalf("rotated entry = %+v", dev)
+		}
+	}
+	if !found {
+		t.Fatalf("directory = %+v", dir.Devices)
+	}
+}
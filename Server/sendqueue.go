@@ -0,0 +1,276 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Outbound frames are never written by the goroutine that produces them.
+// Each client owns a sendQueue drained by its own writePump, so a handler
+// holding s.mu or sess.mu only ever appends to a slice and one slow socket
+// cannot stall anyone else.
+
+// Frame.P lanes: 0 realtime and control, 1 file metadata, 2 file chunks.
+const numPriorities = 3
+
+// Slow-consumer policies, applied when a client's queue is full.
+const (
+	// slowConsumerDrop evicts the newest frame of the least urgent lane, or
+	// the incoming frame if nothing queued is less urgent.
+	slowConsumerDrop = "drop"
+	// slowConsumerDisconnect closes the connection; the client reconnects
+	// and resyncs.
+	slowConsumerDisconnect = "disconnect"
+	// slowConsumerSpill moves overflow into a byte-capped backlog that is
+	// fed back in order, and disconnects once the backlog is full too.
+	slowConsumerSpill = "spill"
+)
+
+var (
+	errQueueClosed  = errors.New("client disconnected")
+	errQueueFull    = errors.New("send queue full, frame dropped")
+	errSlowConsumer = errors.New("client too slow, disconnected")
+)
+
+// queueMetrics aggregates send queue activity across all clients.
+type queueMetrics struct {
+	depth       atomic.Int64 // frames currently queued, spill included
+	enqueued    atomic.Int64
+	written     atomic.Int64
+	dropped     atomic.Int64
+	spilled     atomic.Int64
+	disconnects atomic.Int64
+	writeErrors atomic.Int64
+}
+
+type sendQueue struct {
+	mu    sync.Mutex
+	cond  *sync.Cond
+	lanes [numPriorities][]Frame
+	size  int
+
+	limit      int
+	policy     string
+	spill      []Frame
+	spillBytes int
+	spillLimit int
+
+	// closed stops new frames; flush lets the writer finish what is queued
+	// before it hangs up.
+	closed bool
+	flush  bool
+
+	metrics *queueMetrics
+}
+
+func newSendQueue(cfg *Config, metrics *queueMetrics) *sendQueue {
+	q := &sendQueue{
+		limit:      cfg.SendQueueSize,
+		policy:     cfg.SlowConsumerPolicy,
+		spillLimit: cfg.SpillBytes,
+		metrics:    metrics,
+	}
+	q.cond = sync.NewCond(&q.mu)
+	return q
+}
+
+func lane(f Frame) int {
+	return min(max(f.P, 0), numPriorities-1)
+}
+
+// frameCost approximates the encoded size of f for the spill budget.
+func frameCost(f Frame) int {
+	return len(f.T) + len(f.SID) + len(f.SH) + len(f.TargetPubKey) + len(f.Data) + 32
+}
+
+// push queues f without blocking.
+func (q *sendQueue) push(f Frame) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return errQueueClosed
+	}
+	q.metrics.enqueued.Add(1)
+
+	// Once anything has spilled, later frames queue behind it so the
+	// client still sees them in order.
+	if q.size < q.limit && len(q.spill) == 0 {
+		q.lanes[lane(f)] = append(q.lanes[lane(f)], f)
+		q.size++
+		q.metrics.depth.Add(1)
+		q.cond.Signal()
+		return nil
+	}
+
+	switch q.policy {
+	case slowConsumerSpill:
+		if cost := frameCost(f); q.spillBytes+cost <= q.spillLimit {
+			q.spill = append(q.spill, f)
+			q.spillBytes += cost
+			q.metrics.spilled.Add(1)
+			q.metrics.depth.Add(1)
+			return nil
+		}
+		q.hangUpLocked()
+		return errSlowConsumer
+	case slowConsumerDisconnect:
+		q.hangUpLocked()
+		return errSlowConsumer
+	default:
+		q.metrics.dropped.Add(1)
+		for p := numPriorities - 1; p > lane(f); p-- {
+			if n := len(q.lanes[p]); n > 0 {
+				q.lanes[p] = q.lanes[p][:n-1]
+				q.lanes[lane(f)] = append(q.lanes[lane(f)], f)
+				q.cond.Signal()
+				return nil
+			}
+		}
+		return errQueueFull
+	}
+}
+
+// hangUpLocked discards everything queued and wakes the writer so it closes
+// the connection.
+func (q *sendQueue) hangUpLocked() {
+	q.metrics.disconnects.Add(1)
+	q.discardLocked()
+	q.closed = true
+	q.flush = false
+	q.cond.Broadcast()
+}
+
+func (q *sendQueue) discardLocked() {
+	q.metrics.depth.Add(-int64(q.size + len(q.spill)))
+	q.lanes = [numPriorities][]Frame{}
+	q.size = 0
+	q.spill = nil
+	q.spillBytes = 0
+}
+
+// next blocks until a frame is available and returns the most urgent one.
+// It returns false once the queue is closed and, if flushing, empty.
+func (q *sendQueue) next() (Frame, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for q.size == 0 && !q.closed {
+		q.cond.Wait()
+	}
+	if q.size == 0 || (q.closed && !q.flush) {
+		return Frame{}, false
+	}
+
+	var f Frame
+	for p := range q.lanes {
+		if len(q.lanes[p]) > 0 {
+			f = q.lanes[p][0]
+			q.lanes[p][0] = Frame{}
+			q.lanes[p] = q.lanes[p][1:]
+			break
+		}
+	}
+	q.size--
+	q.metrics.depth.Add(-1)
+
+	if len(q.spill) > 0 {
+		g := q.spill[0]
+		q.spill[0] = Frame{}
+		q.spill = q.spill[1:]
+		q.spillBytes -= frameCost(g)
+		q.lanes[lane(g)] = append(q.lanes[lane(g)], g)
+		q.size++
+	}
+	return f, true
+}
+
+// depth reports how many frames are waiting, spill included.
+func (q *sendQueue) depth() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.size + len(q.spill)
+}
+
+// close stops the writer without sending what is still queued.
+func (q *sendQueue) close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if !q.closed {
+		q.discardLocked()
+		q.closed = true
+	}
+	q.flush = false
+	q.cond.Broadcast()
+}
+
+// closeAfterFlush stops new frames and lets the writer send the rest before
+// closing the connection, so a final ERROR reaches the client.
+func (q *sendQueue) closeAfterFlush() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if !q.closed {
+		q.closed = true
+		q.flush = true
+	}
+	q.cond.Broadcast()
+}
+
+// writePump is the only goroutine that writes to c.conn. It closes the
+// connection when the queue is closed or a write fails, which in turn ends
+// the read loop in handle.
+func (s *Server) writePump(c *Client) {
+	defer c.conn.Close()
+	timeout := time.Duration(s.cfg.WriteTimeoutSeconds) * time.Second
+	for {
+		f, ok := c.out.next()
+		if !ok {
+			return
+		}
+		msg, err := c.codec.encode(f)
+		if err != nil {
+			log.Printf("[Error] Could not encode %s for %s: %v", f.T, c.id, err)
+			continue
+		}
+		_ = c.conn.SetWriteDeadline(time.Now().Add(timeout))
+		if err := c.conn.WriteMessage(c.codec.messageType(), msg); err != nil {
+			s.queueMetrics.writeErrors.Add(1)
+			c.out.close()
+			return
+		}
+		s.queueMetrics.written.Add(1)
+	}
+}
+
+// handleMetrics serves send queue metrics in the Prometheus text format.
+func (s *Server) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	clients := len(s.clients)
+	maxDepth := 0
+	for _, c := range s.clients {
+		maxDepth = max(maxDepth, c.out.depth())
+	}
+	s.mu.Unlock()
+
+	m := s.queueMetrics
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	writeMetric(w, "relay_clients", "gauge", "Connected websocket clients.", int64(clients))
+	writeMetric(w, "relay_send_queue_depth", "gauge", "Frames queued across all clients.", m.depth.Load())
+	writeMetric(w, "relay_send_queue_depth_max", "gauge", "Deepest single client queue.", int64(maxDepth))
+	writeMetric(w, "relay_frames_enqueued_total", "counter", "Frames handed to send queues.", m.enqueued.Load())
+	writeMetric(w, "relay_frames_written_total", "counter", "Frames written to sockets.", m.written.Load())
+	writeMetric(w, "relay_frames_dropped_total", "counter", "Frames dropped by the drop policy.", m.dropped.Load())
+	writeMetric(w, "relay_frames_spilled_total", "counter", "Frames moved to a spill backlog.", m.spilled.Load())
+	writeMetric(w, "relay_slow_consumer_disconnects_total", "counter", "Clients disconnected for falling behind.", m.disconnects.Load())
+	writeMetric(w, "relay_write_errors_total", "counter", "Socket writes that failed or timed out.", m.writeErrors.Load())
+}
+
+func writeMetric(w io.Writer, name, kind, help string, v int64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %d\n", name, help, name, kind, name, v)
+}
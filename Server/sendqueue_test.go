@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testQueue(policy string, size int) *sendQueue {
+	cfg := testConfig()
+	cfg.SlowConsumerPolicy = policy
+	cfg.SendQueueSize = size
+	cfg.SpillBytes = 200
+	return newSendQueue(cfg, &queueMetrics{})
+}
+
+func drain(q *sendQueue) []string {
+	var out []string
+	for q.depth() > 0 {
+		f, ok := q.next()
+		if !ok {
+			break
+		}
+		out = append(out, f.T)
+	}
+	return out
+}
+
+func TestSendQueuePriority(t *testing.T) {
+	q := testQueue(slowConsumerDrop, 10)
+	q.push(Frame{T: "chunk1", P: 2})
+	q.push(Frame{T: "meta", P: 1})
+	q.push(Frame{T: "msg1"})
+	q.push(Frame{T: "chunk2", P: 2})
+	q.push(Frame{T: "msg2"})
+
+	if got := strings.Join(drain(q), ","); got != "msg1,msg2,meta,chunk1,chunk2" {
+		t.Fatalf("order = %s", got)
+	}
+	if d := q.metrics.depth.Load(); d != 0 {
+		t.Fatalf("depth gauge = %d after drain", d)
+	}
+}
+
+func TestSendQueueDropPolicy(t *testing.T) {
+	q := testQueue(slowConsumerDrop, 2)
+	q.push(Frame{T: "msg1"})
+	q.push(Frame{T: "chunk", P: 2})
+
+	// A realtime frame evicts the queued chunk.
+	if err := q.push(Frame{T: "msg2"}); err != nil {
+		t.Fatalf("push = %v", err)
+	}
+	// Nothing is less urgent than another chunk, so it is dropped.
+	if err := q.push(Frame{T: "chunk2", P: 2}); err != errQueueFull {
+		t.Fatalf("push = %v, want errQueueFull", err)
+	}
+	if got := strings.Join(drain(q), ","); got != "msg1,msg2" {
+		t.Fatalf("order = %s", got)
+	}
+	if n := q.metrics.dropped.Load(); n != 2 {
+		t.Fatalf("dropped = %d, want 2", n)
+	}
+}
+
+func TestSendQueueDisconnectPolicy(t *testing.T) {
+	q := testQueue(slowConsumerDisconnect, 1)
+	q.push(Frame{T: "msg1"})
+	if err := q.push(Frame{T: "msg2"}); err != errSlowConsumer {
+		t.Fatalf("push = %v, want errSlowConsumer", err)
+	}
+	if _, ok := q.next(); ok {
+		t.Fatal("writer should stop after a slow-consumer disconnect")
+	}
+	if err := q.push(Frame{T: "msg3"}); err != errQueueClosed {
+		t.Fatalf("push after disconnect = %v", err)
+	}
+	if n := q.metrics.disconnects.Load(); n != 1 {
+		t.Fatalf("disconnects = %d", n)
+	}
+}
+
+func TestSendQueueSpillPolicy(t *testing.T) {
+	q := testQueue(slowConsumerSpill, 2)
+	for _, name := range []string{"a", "b", "c", "d"} {
+		if err := q.push(Frame{T: name}); err != nil {
+			t.Fatalf("push %s = %v", name, err)
+		}
+	}
+	if q.depth() != 4 || q.metrics.spilled.Load() != 2 {
+		t.Fatalf("depth = %d, spilled = %d", q.depth(), q.metrics.spilled.Load())
+	}
+	if got := strings.Join(drain(q), ","); got != "a,b,c,d" {
+		t.Fatalf("spilled frames out of order: %s", got)
+	}
+
+	// Overflowing the spill budget disconnects.
+	big := Frame{T: "big", Data: json.RawMessage(strings.Repeat("x", 300))}
+	q.push(Frame{T: "a"})
+	q.push(Frame{T: "b"})
+	if err := q.push(big); err != errSlowConsumer {
+		t.Fatalf("push over spill budget = %v", err)
+	}
+}
+
+func TestSendQueueFlushBeforeClose(t *testing.T) {
+	q := testQueue(slowConsumerDrop, 4)
+	q.push(Frame{T: "ERROR"})
+	q.closeAfterFlush()
+	if err := q.push(Frame{T: "late"}); err != errQueueClosed {
+		t.Fatalf("push after close = %v", err)
+	}
+	if f, ok := q.next(); !ok || f.T != "ERROR" {
+		t.Fatalf("next = %+v, %v; want queued ERROR", f, ok)
+	}
+	if _, ok := q.next(); ok {
+		t.Fatal("queue should be finished")
+	}
+}
+
+// A client that never reads must not hold up sends to anyone else.
+func TestSlowClientDoesNotBlockSends(t *testing.T) {
+	cfg := testConfig()
+	cfg.SendQueueSize = 8
+	s := newServer(cfg, newMemoryStore(), log.New(io.Discard, "", 0))
+	dialTestServer(t, s) // never read from
+
+	var slow *Client
+	for deadline := time.Now().Add(2 * time.Second); slow == nil; {
+		if time.Now().After(deadline) {
+			t.Fatal("client did not register")
+		}
+		s.mu.Lock()
+		for _, c := range s.clients {
+			slow = c
+		}
+		s.mu.Unlock()
+	}
+
+	payload := json.RawMessage(`"` + strings.Repeat("x", 64*1024) + `"`)
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 1000; i++ {
+			s.send(slow, Frame{T: "MSG", Data: payload})
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("send blocked on a slow client")
+	}
+
+	rec := httptest.NewRecorder()
+	s.handleMetrics(rec, nil)
+	if !strings.Contains(rec.Body.String(), "relay_slow_consumer_disconnects_total 1") {
+		t.Fatalf("slow consumer not disconnected:\n%s", rec.Body.String())
+	}
+}
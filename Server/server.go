@@ -5,30 +5,118 @@ import (
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"log"
+	"slices"
 	"time"
 
 	crand "crypto/rand"
 )
 
-var maxMsgsPerSecond = 100
-
 func (s *Server) newID() string {
 	b := make([]byte, 8)
 	crand.Read(b)
 	return fmt.Sprintf("%d_%s", time.Now().UnixMilli(), hex.EncodeToString(b))
 }
 
-func (s *Server) allowMessage(c *Client) bool {
+func newServer(cfg *Config, store Store, logger *log.Logger) *Server {
+	s := &Server{
+		cfg:        cfg,
+		sessionKey: sessionKey(cfg.AuthSessionSecret),
+		store:      store,
+		clients:    make(map[string]*Client),
+		sessions:   newSessionIndex(),
+		presence:   newPresence(),
+		logger:     logger,
+		rateLimiter: &RateLimiter{
+			ipAttempts:  make(map[string][]time.Time),
+			preKeyTakes: make(map[string][]time.Time),
+		},
+		frames:       NewFrameRegistry(),
+		queueMetrics: &queueMetrics{},
+		keyLog:       newKeyLog(store, keyLogKey(cfg)),
+	}
+	if cfg.PersistPresence {
+		s.presence.Subscribe(persistPresence(store, logger.Printf))
+	}
+	s.registerFrames()
+	s.registerCustomFrames()
+	return s
+}
+
+// allow counts one frame of kind against a per-second budget.
+func (c *Client) allow(kind string, perSecond int) bool {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
+	if c.limits == nil {
+		c.limits = make(map[string]*rateWindow)
+	}
+	w, ok := c.limits[kind]
+	if !ok {
+		w = &rateWindow{}
+		c.limits[kind] = w
+	}
+	now := time.Now()
+	if w.start.IsZero() || now.Sub(w.start) >= time.Second {
+		w.start = now
+		w.count = 0
+	}
+	w.count++
+	return w.count <= perSecond
+}
+
+func (c *Client) authedEmail() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.email
+}
+
+// identity returns the email and device key c authenticated with.
+func (c *Client) identity() (email, publicKey string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.email, c.publicKey
+}
+
+// checkPreKeyQuota reports whether requester may take one-time prekeys of
+// target now, and counts the take if so. Each requester gets
+// preKeyTakesPerRequester an hour from a target, and a target gives out
+// preKeyTakesPerTarget an hour in all. Counts are per node. Once an hour
+// it also forgets every pair whose takes have all expired, so requesters
+// that never come back do not pile up.
+func (rl *RateLimiter) checkPreKeyQuota(requester, target string) bool {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
 	now := time.Now()
-	if c.msgWindow.IsZero() || now.Sub(c.msgWindow) >= time.Second {
-		c.msgWindow = now
-		c.msgCount = 0
+	if now.Sub(rl.preKeySwept) >= time.Hour {
+		for key, takes := range rl.preKeyTakes {
+			if now.Sub(takes[len(takes)-1]) >= time.Hour {
+				delete(rl.preKeyTakes, key)
+			}
+		}
+		rl.preKeySwept = now
+	}
+	keys := [2]string{target, requester + "/" + target}
+	limits := [2]int{preKeyTakesPerTarget, preKeyTakesPerRequester}
+	allowed := true
+	for i, key := range keys {
+		recent := slices.DeleteFunc(rl.preKeyTakes[key], func(t time.Time) bool { return now.Sub(t) >= time.Hour })
+		if len(recent) == 0 {
+			delete(rl.preKeyTakes, key)
+		} else {
+			rl.preKeyTakes[key] = recent
+		}
+		if len(recent) >= limits[i] {
+			allowed = false
+		}
 	}
-	c.msgCount++
-	return c.msgCount <= maxMsgsPerSecond
+	if allowed {
+		for _, key := range keys {
+			rl.preKeyTakes[key] = append(rl.preKeyTakes[key], now)
+		}
+	}
+	return allowed
 }
 
 func (rl *RateLimiter) checkAuthRateLimit(ip string) bool {
@@ -57,14 +145,13 @@ func (rl *RateLimiter) checkAuthRateLimit(ip string) bool {
 	return true
 }
 
+// send queues f for c's writer and returns immediately. An error means the
+// frame will not be delivered: the client is gone or too slow.
 func (s *Server) send(c *Client, f Frame) error {
 	if c == nil {
 		return nil
 	}
-	c.mu.Lock()
-	defer c.mu.Unlock()
-	_ = c.conn.SetWriteDeadline(time.Now().Add(2 * time.Second))
-	return c.conn.WriteJSON(f)
+	return c.out.push(f)
 }
 
 func (s *Server) logConnection(initiator, target string) {
@@ -77,44 +164,29 @@ func (s *Server) logConnection(initiator, target string) {
 	s.logger.Printf("CONNECTION: %s requested connection to %s on %s", iHash, tHash, time.Now().Format(time.RFC3339))
 }
 
+func deviceListFrame(devices []Device) Frame {
+	devicesList := make([]map[string]any, 0, len(devices))
+	for _, d := range devices {
+		devicesList = append(devicesList, map[string]any{
+			"publicKey":  d.PublicKey,
+			"deviceId":   d.DeviceID,
+			"lastActive": d.LastActive.Format(time.RFC3339),
+			"isMaster":   d.IsMaster,
+			"status":     d.Status,
+		})
+	}
+	respBytes, _ := json.Marshal(map[string]any{"devices": devicesList})
+	return Frame{T: "DEVICE_LIST", Data: json.RawMessage(respBytes)}
+}
+
 func (s *Server) broadcastDeviceList(emailHash string) {
-	rows, err := s.db.Query("SELECT public_key, last_active, is_master, status FROM devices WHERE email_hash = ?", emailHash)
+	devices, err := s.store.ListDevices(emailHash)
 	if err != nil {
 		s.logger.Printf("Failed to get devices for broadcast: %v", err)
 		return
 	}
-	var devicesList []map[string]any
-	for rows.Next() {
-		var pk, status string
-		var lastActive time.Time
-		var isMaster int
-		if err := rows.Scan(&pk, &lastActive, &isMaster, &status); err == nil {
-			devicesList = append(devicesList, map[string]any{
-				"publicKey": pk,
-				"lastActive": lastActive.Format(time.RFC3339),
-				"isMaster": isMaster == 1,
-				"status": status,
-			})
-		}
-	}
-	rows.Close()
-
-	if len(devicesList) == 0 {
+	if len(devices) == 0 {
 		return
 	}
-
-	respBytes, _ := json.Marshal(map[string]any{"devices": devicesList})
-	frame := Frame{T: "DEVICE_LIST", Data: json.RawMessage(respBytes)}
-
-	sockRows, _ := s.db.Query("SELECT socket_id FROM sockets WHERE email_hash = ?", emailHash)
-	for sockRows.Next() {
-		var socketID string
-		sockRows.Scan(&socketID)
-		s.mu.Lock()
-		if targetClient, ok := s.clients[socketID]; ok {
-			s.send(targetClient, frame)
-		}
-		s.mu.Unlock()
-	}
-	sockRows.Close()
+	s.sendToAccount(emailHash, deviceListFrame(devices))
 }
@@ -0,0 +1,191 @@
+package main
+
+import "sync"
+
+// sessionIndex records which clients are attached to which sessions, in
+// both directions, under one lock. A session exists only while it has
+// members: the last client to leave removes it, so Server.sessions never
+// accumulates dead entries.
+//
+// Methods return snapshots; callers send to the returned clients after the
+// lock is released.
+type sessionIndex struct {
+	mu       sync.RWMutex
+	members  map[string]map[string]*Client // sid -> client id -> client
+	sessions map[string]map[string]bool    // client id -> sids
+
+	// watch, if set, is told when a session gains its first local member
+	// or loses its last one. It is called without the lock held and must
+	// be set before the index is shared.
+	watch func(sid string, live bool)
+}
+
+type sessionChange struct {
+	sid  string
+	live bool
+}
+
+func newSessionIndex() *sessionIndex {
+	return &sessionIndex{
+		members:  make(map[string]map[string]*Client),
+		sessions: make(map[string]map[string]bool),
+	}
+}
+
+func (x *sessionIndex) notify(changes []sessionChange) {
+	if x.watch == nil {
+		return
+	}
+	for _, ch := range changes {
+		x.watch(ch.sid, ch.live)
+	}
+}
+
+// join attaches c to sid and returns the other members. When create is
+// false and sid has no members, nothing changes and ok is false. Clients that
+// already went through leaveAll are never attached again, so a handler
+// racing with disconnect cannot leave a dead client behind.
+func (x *sessionIndex) join(sid string, c *Client, create bool) (peers []*Client, ok bool) {
+	x.mu.Lock()
+	m, exists := x.members[sid]
+	if !exists && !create {
+		x.mu.Unlock()
+		return nil, false
+	}
+	for id, other := range m {
+		if id != c.id {
+			peers = append(peers, other)
+		}
+	}
+	created := x.addLocked(sid, c)
+	x.mu.Unlock()
+
+	if created {
+		x.notify([]sessionChange{{sid, true}})
+	}
+	return peers, true
+}
+
+// addLocked attaches c to sid and reports whether that created sid.
+func (x *sessionIndex) addLocked(sid string, c *Client) bool {
+	if c.detached {
+		return false
+	}
+	created := false
+	if x.members[sid] == nil {
+		x.members[sid] = make(map[string]*Client)
+		created = true
+	}
+	x.members[sid][c.id] = c
+	if x.sessions[c.id] == nil {
+		x.sessions[c.id] = make(map[string]bool)
+	}
+	x.sessions[c.id][sid] = true
+	return created
+}
+
+// ensure creates sid with c as its only member if it does not exist yet. It
+// reports whether c is a member afterwards and whether sid was created.
+func (x *sessionIndex) ensure(sid string, c *Client) (member, created bool) {
+	x.mu.Lock()
+	if m, exists := x.members[sid]; exists {
+		_, member = m[c.id]
+		x.mu.Unlock()
+		return member, false
+	}
+	created = x.addLocked(sid, c)
+	x.mu.Unlock()
+
+	if created {
+		x.notify([]sessionChange{{sid, true}})
+	}
+	return created, created
+}
+
+func (x *sessionIndex) isMember(sid string, c *Client) bool {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	_, ok := x.members[sid][c.id]
+	return ok
+}
+
+// peers returns the members of sid other than except.
+func (x *sessionIndex) peers(sid string, except *Client) []*Client {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	var out []*Client
+	for id, c := range x.members[sid] {
+		if except == nil || id != except.id {
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+// leave detaches c from sid. A session left without members is removed.
+func (x *sessionIndex) leave(sid string, c *Client) {
+	x.mu.Lock()
+	m := x.members[sid]
+	if _, ok := m[c.id]; !ok {
+		x.mu.Unlock()
+		return
+	}
+	delete(m, c.id)
+	delete(x.sessions[c.id], sid)
+	var changes []sessionChange
+	if len(m) == 0 {
+		delete(x.members, sid)
+		changes = append(changes, sessionChange{sid, false})
+	}
+	x.mu.Unlock()
+
+	x.notify(changes)
+}
+
+// leaveAll detaches c from every session it joined and returns the members
+// left behind in each; sessions that became empty map to no members and are
+// removed.
+func (x *sessionIndex) leaveAll(c *Client) map[string][]*Client {
+	x.mu.Lock()
+	left := make(map[string][]*Client, len(x.sessions[c.id]))
+	var changes []sessionChange
+	for sid := range x.sessions[c.id] {
+		m := x.members[sid]
+		delete(m, c.id)
+		if len(m) == 0 {
+			delete(x.members, sid)
+			left[sid] = nil
+			changes = append(changes, sessionChange{sid, false})
+			continue
+		}
+		rest := make([]*Client, 0, len(m))
+		for _, other := range m {
+			rest = append(rest, other)
+		}
+		left[sid] = rest
+	}
+	delete(x.sessions, c.id)
+	c.detached = true
+	x.mu.Unlock()
+
+	x.notify(changes)
+	return left
+}
+
+// sids returns every live session.
+func (x *sessionIndex) sids() []string {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	out := make([]string, 0, len(x.members))
+	for sid := range x.members {
+		out = append(out, sid)
+	}
+	return out
+}
+
+// len reports the number of live sessions.
+func (x *sessionIndex) len() int {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	return len(x.members)
+}
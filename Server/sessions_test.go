@@ -0,0 +1,186 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// These tests are meant to be run with -race.
+
+func TestSessionIndexJoinLeave(t *testing.T) {
+	x := newSessionIndex()
+	a, b := &Client{id: "a"}, &Client{id: "b"}
+
+	if _, ok := x.join("s1", a, false); ok {
+		t.Fatal("joined a session that does not exist")
+	}
+	x.join("s1", a, true)
+	if peers, _ := x.join("s1", b, false); len(peers) != 1 || peers[0] != a {
+		t.Fatalf("peers on join = %v", peers)
+	}
+	if member, created := x.ensure("s1", &Client{id: "c"}); member || created {
+		t.Fatal("ensure let an outsider into an existing session")
+	}
+	x.ensure("s2", a)
+
+	left := x.leaveAll(a)
+	if len(left["s1"]) != 1 || left["s1"][0] != b {
+		t.Fatalf("left behind in s1 = %v", left["s1"])
+	}
+	if peers, ok := left["s2"]; !ok || len(peers) != 0 {
+		t.Fatalf("emptied session s2 = %v, %v; want reported with no peers", peers, ok)
+	}
+	if x.len() != 1 {
+		t.Fatalf("sessions = %d, want only s1", x.len())
+	}
+	x.leaveAll(b)
+	if x.len() != 0 {
+		t.Fatalf("sessions = %d after everyone left", x.len())
+	}
+
+	// A client that already left can't be re-added by a late handler.
+	x.join("s3", a, true)
+	if x.len() != 0 {
+		t.Fatal("detached client was attached again")
+	}
+}
+
+func TestSessionIndexConcurrent(t *testing.T) {
+	const (
+		numSessions = 5000
+		numClients  = 200
+		perClient   = 50
+	)
+	x := newSessionIndex()
+
+	var wg sync.WaitGroup
+	for i := 0; i < numClients; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			c := &Client{id: fmt.Sprint("c", i)}
+			r := rand.New(rand.NewSource(int64(i)))
+			for j := 0; j < perClient; j++ {
+				sid := fmt.Sprint("s", r.Intn(numSessions))
+				switch j % 4 {
+				case 0:
+					x.join(sid, c, true)
+				case 1:
+					x.ensure(sid, c)
+				case 2:
+					x.peers(sid, c)
+				case 3:
+					x.isMember(sid, c)
+				}
+			}
+			x.leaveAll(c)
+		}(i)
+	}
+	wg.Wait()
+
+	if n := x.len(); n != 0 {
+		t.Fatalf("%d sessions left after every client disconnected", n)
+	}
+	if len(x.sessions) != 0 {
+		t.Fatalf("%d clients left in reverse index", len(x.sessions))
+	}
+}
+
+// authedTestClient connects, authenticates as email and waits until the
+// server has attached it to its sessions.
+func authedTestClient(url, email string) (*websocket.Conn, error) {
+	conn, _, err := authedTestDevice(url, email, "pk-"+email)
+	return conn, err
+}
+
+// authedTestDevice is authedTestClient for a specific device key. It also
+// returns the SESSION_LIST the server answered with.
+func authedTestDevice(url, email, publicKey string) (*websocket.Conn, Frame, error) {
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		return nil, Frame{}, err
+	}
+	auth, _ := json.Marshal(map[string]string{
+		"token":     getTestSessionToken(email),
+		"publicKey": publicKey,
+	})
+	conn.WriteJSON(Frame{T: "AUTH", Data: auth})
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	for {
+		var f Frame
+		if err := conn.ReadJSON(&f); err != nil {
+			conn.Close()
+			return nil, Frame{}, err
+		}
+		if f.T == "SESSION_LIST" {
+			conn.SetReadDeadline(time.Time{})
+			return conn, f, nil
+		}
+	}
+}
+
+func waitForNoSessions(t *testing.T, s *Server) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for s.sessions.len() > 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d sessions never collected", s.sessions.len())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Users connect, message every friend and disconnect, all at once. Every
+// session must be gone once the last client has left.
+func TestConcurrentConnectMsgDisconnect(t *testing.T) {
+	const (
+		numUsers       = 100
+		friendsPerUser = 40
+	)
+	s, store, url := newTestServer(t)
+
+	email := func(i int) string { return fmt.Sprintf("user%d@example.com", i) }
+	sids := make([][]string, numUsers)
+	for i := 0; i < numUsers; i++ {
+		for k := 1; k <= friendsPerUser/2; k++ {
+			j := (i + k) % numUsers
+			sid := fmt.Sprintf("sid-%d-%d", i, j)
+			store.AddFriendship(Friendship{User1Hash: emailHash(email(i)), User2Hash: emailHash(email(j)), SID: sid, Since: time.Now()})
+			sids[i] = append(sids[i], sid)
+			sids[j] = append(sids[j], sid)
+		}
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < numUsers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			conn, err := authedTestClient(url, email(i))
+			if err != nil {
+				t.Errorf("user %d: %v", i, err)
+				return
+			}
+			go func() {
+				for {
+					if _, _, err := conn.ReadMessage(); err != nil {
+						return
+					}
+				}
+			}()
+			for _, sid := range sids[i] {
+				conn.WriteJSON(Frame{T: "MSG", SID: sid, C: true, Data: json.RawMessage(`{"payloads":{"k":"hello"}}`)})
+			}
+			conn.Close()
+		}(i)
+	}
+	wg.Wait()
+
+	waitForNoSessions(t, s)
+}
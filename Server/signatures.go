@@ -0,0 +1,72 @@
+package main
+
+import (
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"math/big"
+)
+
+// Device keys are P-256 points, sent as base64 of the uncompressed (raw)
+// encoding WebCrypto exports. Clients use them for ECDH, and the same key
+// pair signs with ECDSA over SHA-256 when the server has to check that a
+// device really asked for something, such as the master approving a new
+// device. Signatures are base64 of either the raw r||s form WebCrypto
+// produces or ASN.1 DER.
+
+var errBadSignature = errors.New("bad signature")
+
+// parseDeviceKey decodes a device key for ECDSA verification.
+func parseDeviceKey(publicKey string) (*ecdsa.PublicKey, error) {
+	raw, err := base64.StdEncoding.DecodeString(publicKey)
+	if err != nil {
+		return nil, err
+	}
+	// ecdh checks that the point is on the curve.
+	if _, err := ecdh.P256().NewPublicKey(raw); err != nil {
+		return nil, err
+	}
+	return &ecdsa.PublicKey{
+		Curve: elliptic.P256(),
+		X:     new(big.Int).SetBytes(raw[1:33]),
+		Y:     new(big.Int).SetBytes(raw[33:65]),
+	}, nil
+}
+
+// verifyDeviceSignature checks that sig is publicKey's signature of msg.
+func verifyDeviceSignature(publicKey string, msg []byte, sig string) error {
+	pub, err := parseDeviceKey(publicKey)
+	if err != nil {
+		return errBadSignature
+	}
+	b, err := base64.StdEncoding.DecodeString(sig)
+	if err != nil {
+		return errBadSignature
+	}
+	digest := sha256.Sum256(msg)
+	if len(b) == 64 {
+		r := new(big.Int).SetBytes(b[:32])
+		s := new(big.Int).SetBytes(b[32:])
+		if ecdsa.Verify(pub, digest[:], r, s) {
+			return nil
+		}
+	}
+	if ecdsa.VerifyASN1(pub, digest[:], b) {
+		return nil
+	}
+	return errBadSignature
+}
+
+// signedMessage joins the parts of a signed request, one per line, after
+// the frame type it authorises, so a signature for one request can never
+// pass as another.
+func signedMessage(frameType string, parts ...string) []byte {
+	msg := "cryptnode:" + frameType
+	for _, p := range parts {
+		msg += "\n" + p
+	}
+	return []byte(msg)
+}
@@ -0,0 +1,374 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrNotFound is returned by Store lookups that match no rows.
+var ErrNotFound = errors.New("not found")
+
+// Device statuses stored in devices.status.
+const (
+	DeviceActive  = "active"
+	DevicePending = "pending" // waiting for the master device to approve it
+)
+
+// Device is one key a user has signed in with. DeviceID names the device
+// for its whole life; AddDevice assigns one when it is empty, and CreatedAt
+// defaults to LastActive. An account has at most one master. LinkSpecs is
+// the encrypted description a pending device sent with its
+// DEVICE_LINK_REQUEST, for the master to decrypt.
+// CrossSignature is a master's signature over the key, by CrossSignedBy.
+type Device struct {
+	EmailHash      string
+	PublicKey      string
+	DeviceID       string
+	CreatedAt      time.Time
+	LastActive     time.Time
+	IsMaster       bool
+	Status         string
+	LinkSpecs      string
+	CrossSignature string
+	CrossSignedBy  string
+}
+
+func newDeviceID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return "d_" + hex.EncodeToString(b)
+}
+
+// DeviceSignature is a signature one device of an account made over
+// another's key: Kind is the signed frame, DEVICE_LINK_ACCEPT when Signer
+// approved Subject, or TRANSFER_MASTER when Signer handed it the master
+// role. The message is signedMessage(Kind, EmailHash, Subject).
+type DeviceSignature struct {
+	EmailHash string
+	Signer    string
+	Subject   string
+	Kind      string
+	Signature string
+	CreatedAt time.Time
+}
+
+// KeyRotation records that a device replaced OldKey with NewKey, signing
+// signedMessage("UPDATE_PUBKEY", EmailHash, NewKey) with OldKey.
+type KeyRotation struct {
+	EmailHash string
+	DeviceID  string
+	OldKey    string
+	NewKey    string
+	Signature string
+	RotatedAt time.Time
+}
+
+// MasterClaim is a device's request to become master of an account whose
+// master device has gone quiet. It is granted once the master has stayed
+// offline for the recovery period after ClaimedAt.
+type MasterClaim struct {
+	EmailHash string
+	PublicKey string
+	ClaimedAt time.Time
+}
+
+// Key log actions.
+const (
+	KeyAdded   = "add"
+	KeyRemoved = "remove"
+	KeyMaster  = "master"
+)
+
+// KeyLogEntry is one leaf of the key transparency log: a device key of an
+// account was added, removed or made master. Index counts from 0 with no
+// gaps.
+type KeyLogEntry struct {
+	Index     int64
+	EmailHash string
+	PublicKey string
+	Action    string
+	CreatedAt time.Time
+}
+
+type FriendRequest struct {
+	SenderHash      string
+	TargetHash      string
+	EncryptedPacket string
+	Timestamp       time.Time
+}
+
+type Friendship struct {
+	User1Hash string
+	User2Hash string
+	SID       string
+	Since     time.Time
+}
+
+// Peer returns the other side of the friendship as seen by emailHash.
+func (f Friendship) Peer(emailHash string) string {
+	if f.User1Hash == emailHash {
+		return f.User2Hash
+	}
+	return f.User1Hash
+}
+
+// Group member roles stored in group_members.role.
+const (
+	RoleAdmin  = "admin"
+	RoleMember = "member"
+)
+
+// Group is a session with server-managed membership; its ID is also its
+// sid. Epoch goes up with every membership change, which is when clients
+// rotate the group key. MLSEpoch is the epoch of the group's MLS state: the
+// number of commits accepted so far.
+type Group struct {
+	ID        string
+	CreatedBy string
+	CreatedAt time.Time
+	Epoch     int64
+	MLSEpoch  int64
+}
+
+type GroupMember struct {
+	GroupID   string
+	EmailHash string
+	Role      string
+	JoinedAt  time.Time
+}
+
+// KeyPackage is an opaque MLS KeyPackage a device published so others can
+// add it to groups.
+type KeyPackage struct {
+	ID        int64
+	EmailHash string
+	PublicKey string
+	Data      string
+	CreatedAt time.Time
+}
+
+// PreKey is a public X3DH prekey of a device (PublicKey). Signature is set
+// for signed prekeys only.
+type PreKey struct {
+	EmailHash string
+	PublicKey string
+	KeyID     int64
+	Key       string
+	Signature string
+	CreatedAt time.Time
+}
+
+// GroupCommit is an opaque MLS Commit that moved a group from Epoch to
+// Epoch+1.
+type GroupCommit struct {
+	GroupID    string
+	Epoch      int64
+	SenderHash string
+	Data       string
+	CreatedAt  time.Time
+}
+
+// OfflineNotification is a frame kept for a user until each of their devices
+// acknowledges it. ID doubles as the sequence number clients see.
+type OfflineNotification struct {
+	ID        int64
+	EmailHash string
+	EventData string
+	Timestamp time.Time
+}
+
+// Mail is one device's ciphertext from a MSG, held for a device that was
+// offline when it was sent. The relay cannot read Payload.
+type Mail struct {
+	ID            int64
+	RecipientHash string
+	PublicKey     string
+	SID           string
+	SenderHash    string
+	Payload       string
+	Priority      int
+	CreatedAt     time.Time
+	ExpiresAt     time.Time
+}
+
+// Store is everything the relay persists. Implementations must be safe for
+// concurrent use.
+type Store interface {
+	// Devices
+	Device(emailHash, publicKey string) (Device, error)
+	CountActiveDevices(emailHash string, since time.Time) (int, error)
+	AddDevice(d Device) error
+	// RegisterDevice adds d unless its key is already a device of the
+	// account, and returns the stored device and whether it was added. A
+	// new device is the master when the account has none and pending
+	// otherwise; the check and the insert are one step, so devices that
+	// sign in at the same time cannot both become master.
+	RegisterDevice(d Device) (Device, bool, error)
+	TouchDevice(emailHash, publicKey string, at time.Time) error
+	ListDevices(emailHash string) ([]Device, error)
+	// PrimaryDeviceKey returns the master device key, or the most recently
+	// active one when there is no master.
+	PrimaryDeviceKey(emailHash string) (string, error)
+	// MasterDevice returns the device with is_master set.
+	MasterDevice(emailHash string) (Device, error)
+	// SetDeviceStatus, SetLinkSpecs, SetCrossSignature and SetMaster return
+	// ErrNotFound for unknown devices. SetMaster makes publicKey the only
+	// master of emailHash and marks it active.
+	SetDeviceStatus(emailHash, publicKey, status string) error
+	SetLinkSpecs(emailHash, publicKey, specs string) error
+	SetCrossSignature(emailHash, publicKey, signer, signature string) error
+	// ApproveDevice activates the pending device approval.Subject, clears
+	// its link specs, stores crossSignature by approval.Signer on it and
+	// adds approval to its signatures, all or nothing. It returns
+	// ErrNotFound when there is no such pending device.
+	ApproveDevice(approval DeviceSignature, crossSignature string) error
+	SetMaster(emailHash, publicKey string) error
+	DeleteDevice(emailHash, publicKey string) error
+	DeleteDevices(emailHash string) error
+
+	// Device signatures are kept while the account has any device.
+	// DeviceSignatures returns them oldest first.
+	AddDeviceSignature(sig DeviceSignature) error
+	DeviceSignatures(emailHash string) ([]DeviceSignature, error)
+
+	// RotateDeviceKey moves a device from r.OldKey to r.NewKey in one
+	// transaction: the device keeps its ID, role and status, and its
+	// sockets, mail, notification acks, KeyPackages and master claim follow
+	// it. Its prekeys and cross-signature were made for the old key and are
+	// dropped. r goes into the key history, and its signature into the
+	// device signatures as an UPDATE_PUBKEY. It returns ErrNotFound when
+	// the old key is unknown. KeyRotations returns the history of
+	// emailHash, oldest first.
+	RotateDeviceKey(r KeyRotation) error
+	KeyRotations(emailHash string) ([]KeyRotation, error)
+
+	// Sockets mirror presence when persistPresence is enabled. The relay
+	// itself reads presence from memory, never from here.
+	AddSocket(emailHash, socketID, publicKey string) error
+	RemoveSocket(socketID string) error
+	RemoveSockets(emailHash string) error
+	RemoveDeviceSockets(emailHash, publicKey string) error
+	SocketIDs(emailHash string) ([]string, error)
+
+	// Remote wipes wait here for revoked devices that were offline.
+	// TakeWipe deletes the wipe for a device and reports whether there was
+	// one.
+	AddWipe(emailHash, publicKey string, at time.Time) error
+	TakeWipe(emailHash, publicKey string) (bool, error)
+
+	// Master claims, at most one per account. PutMasterClaim replaces the
+	// account's claim.
+	PutMasterClaim(c MasterClaim) error
+	MasterClaim(emailHash string) (MasterClaim, error)
+	DeleteMasterClaim(emailHash string) error
+
+	// Key log, append-only. AppendKeyLog gives e the next index and returns
+	// it. KeyLogEntries returns the entries from index from on, in order.
+	// LastKeyAdded returns the newest KeyAdded entry of a key.
+	AppendKeyLog(e KeyLogEntry) (KeyLogEntry, error)
+	KeyLogEntries(from int64) ([]KeyLogEntry, error)
+	LastKeyAdded(emailHash, publicKey string) (KeyLogEntry, error)
+
+	// Friend requests
+	PutRequest(r FriendRequest) error
+	DeleteRequest(senderHash, targetHash string) error
+	PendingRequests(targetHash string) ([]FriendRequest, error)
+
+	// Friendships
+	AddFriendship(f Friendship) error
+	RemoveFriendship(a, b string) error
+	RemoveFriendships(emailHash string) error
+	Friendships(emailHash string) ([]Friendship, error)
+	// IsSessionMember reports whether emailHash is one of the friends in sid
+	// or a member of the group sid.
+	IsSessionMember(sid, emailHash string) (bool, error)
+
+	// Groups. CreateGroup stores g at epoch 1 together with its first
+	// members. Adding or removing a member bumps the epoch and returns the
+	// new one.
+	CreateGroup(g Group, members []GroupMember) error
+	Group(id string) (Group, error)
+	// GroupMembers returns the members of id in the order they joined.
+	GroupMembers(id string) ([]GroupMember, error)
+	UserGroups(emailHash string) ([]Group, error)
+	AddGroupMember(m GroupMember) (int64, error)
+	RemoveGroupMember(groupID, emailHash string) (int64, error)
+	SetGroupRole(groupID, emailHash, role string) error
+	DeleteGroup(id string) error
+
+	// MLS delivery service. TakeKeyPackage removes and returns a device's
+	// oldest KeyPackage, except that the last one is returned without
+	// being removed, as the device's last-resort package. AppendCommit
+	// stores c and advances the group's MLS epoch only if the group is at
+	// c.Epoch, and reports whether it did.
+	AddKeyPackages(emailHash, publicKey string, data []string, at time.Time) error
+	CountKeyPackages(emailHash, publicKey string) (int, error)
+	TakeKeyPackage(emailHash, publicKey string) (KeyPackage, error)
+	AppendCommit(c GroupCommit) (bool, error)
+	// Commits returns up to limit commits of groupID from epoch since on,
+	// in epoch order.
+	Commits(groupID string, since int64, limit int) ([]GroupCommit, error)
+
+	// X3DH prekeys. A device has one signed prekey, replaced by each put,
+	// and a pool of one-time prekeys; adding a key ID the pool already has
+	// is ignored. TakeOneTimePreKey removes and returns the oldest one, and
+	// unlike TakeKeyPackage has no last resort.
+	PutSignedPreKey(k PreKey) error
+	SignedPreKey(emailHash, publicKey string) (PreKey, error)
+	AddOneTimePreKeys(emailHash, publicKey string, keys []PreKey) error
+	CountOneTimePreKeys(emailHash, publicKey string) (int, error)
+	TakeOneTimePreKey(emailHash, publicKey string) (PreKey, error)
+
+	// Offline notifications are kept until every active device of the user
+	// has acknowledged them, or until they are pruned. IDs increase with
+	// each notification added.
+	AddNotification(emailHash, eventData string, at time.Time) (int64, error)
+	// PendingNotifications returns the notifications publicKey has not
+	// acknowledged, oldest first.
+	PendingNotifications(emailHash, publicKey string) ([]OfflineNotification, error)
+	AckNotification(emailHash, publicKey string, id int64) error
+
+	// Mailbox. PutMail stores m unless the recipient's unexpired mail
+	// would then exceed quotaBytes of payload, and reports whether it did.
+	PutMail(m Mail, quotaBytes int) (bool, error)
+	// PendingMail returns the unexpired mail for one device, oldest first.
+	PendingMail(recipientHash, publicKey string, now time.Time) ([]Mail, error)
+	DeleteMail(recipientHash, publicKey string, id int64) error
+	PruneMail(now time.Time) error
+
+	// Prune deletes devices other than masters, requests, notifications,
+	// group commits, remote wipes and master claims older than before; the
+	// KeyPackages and prekeys of devices that are gone; and the device
+	// signatures and key rotations of accounts with no devices left. Retired
+	// keys are kept as long as the account, so late messages from them can
+	// still be attributed. Masters are kept so a stale one can only be
+	// replaced through a master claim.
+	Prune(before time.Time) error
+	Close() error
+}
+
+// openStore opens the store named by driver. dsn is a file path for sqlite
+// and a connection string for postgres; it is ignored for memory.
+func openStore(driver, dsn string) (Store, error) {
+	switch driver {
+	case "sqlite", "sqlite3", "":
+		s, err := openSQLiteStore(dsn)
+		if err != nil {
+			return nil, err
+		}
+		return s, nil
+	case "postgres", "postgresql":
+		s, err := openPostgresStore(dsn)
+		if err != nil {
+			return nil, err
+		}
+		return s, nil
+	case "memory":
+		return newMemoryStore(), nil
+	default:
+		return nil, fmt.Errorf("unknown store driver %q", driver)
+	}
+}
@@ -0,0 +1,943 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type memSocket struct {
+	emailHash string
+	publicKey string
+}
+
+// memoryStore is a Store kept entirely in process memory. It is meant for
+// tests and throwaway deployments; nothing survives a restart.
+type memoryStore struct {
+	mu            sync.Mutex
+	devices       map[string]map[string]*Device // email hash -> public key
+	sockets       map[string]memSocket          // socket id
+	requests      map[[2]string]FriendRequest   // sender, target
+	friends       map[[2]string]Friendship      // user1, user2
+	notifications []OfflineNotification
+	notifAcks     map[int64]map[string]bool // notification id -> public keys
+	nextNotifID   int64
+	mail          []Mail
+	nextMailID    int64
+	groups        map[string]*Group                 // group id
+	groupMembers  map[string]map[string]GroupMember // group id -> email hash
+	keyPackages   []KeyPackage
+	nextKPID      int64
+	commits       map[string][]GroupCommit // group id, in epoch order
+	wipes         map[[2]string]time.Time  // email hash, public key
+	claims        map[string]MasterClaim   // email hash
+	keyLog        []KeyLogEntry
+	signedPreKeys map[[2]string]PreKey // email hash, public key
+	oneTimeKeys   []PreKey
+	deviceSigs    []DeviceSignature
+	keyHistory    []KeyRotation
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		devices:       make(map[string]map[string]*Device),
+		sockets:       make(map[string]memSocket),
+		requests:      make(map[[2]string]FriendRequest),
+		friends:       make(map[[2]string]Friendship),
+		notifAcks:     make(map[int64]map[string]bool),
+		groups:        make(map[string]*Group),
+		groupMembers:  make(map[string]map[string]GroupMember),
+		commits:       make(map[string][]GroupCommit),
+		wipes:         make(map[[2]string]time.Time),
+		claims:        make(map[string]MasterClaim),
+		signedPreKeys: make(map[[2]string]PreKey),
+	}
+}
+
+func (m *memoryStore) Device(emailHash, publicKey string) (Device, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if d, ok := m.devices[emailHash][publicKey]; ok {
+		return *d, nil
+	}
+	return Device{EmailHash: emailHash, PublicKey: publicKey}, ErrNotFound
+}
+
+func (m *memoryStore) CountActiveDevices(emailHash string, since time.Time) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n := 0
+	for _, d := range m.devices[emailHash] {
+		if !d.LastActive.Before(since) {
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (m *memoryStore) AddDevice(d Device) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	byKey, ok := m.devices[d.EmailHash]
+	if !ok {
+		byKey = make(map[string]*Device)
+		m.devices[d.EmailHash] = byKey
+	}
+	if d.Status == "" {
+		d.Status = DeviceActive
+	}
+	if d.DeviceID == "" {
+		d.DeviceID = newDeviceID()
+	}
+	if d.CreatedAt.IsZero() {
+		d.CreatedAt = d.LastActive
+	}
+	if _, exists := byKey[d.PublicKey]; !exists && !(d.IsMaster && hasMaster(byKey)) {
+		byKey[d.PublicKey] = &d
+	}
+	return nil
+}
+
+func (m *memoryStore) RegisterDevice(d Device) (Device, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	byKey, ok := m.devices[d.EmailHash]
+	if !ok {
+		byKey = make(map[string]*Device)
+		m.devices[d.EmailHash] = byKey
+	}
+	if existing, ok := byKey[d.PublicKey]; ok {
+		return *existing, false, nil
+	}
+	if d.DeviceID == "" {
+		d.DeviceID = newDeviceID()
+	}
+	if d.CreatedAt.IsZero() {
+		d.CreatedAt = d.LastActive
+	}
+	d.IsMaster = !hasMaster(byKey)
+	d.Status = DevicePending
+	if d.IsMaster {
+		d.Status = DeviceActive
+	}
+	stored := d
+	byKey[d.PublicKey] = &stored
+	return d, true, nil
+}
+
+func hasMaster(byKey map[string]*Device) bool {
+	for _, d := range byKey {
+		if d.IsMaster {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *memoryStore) TouchDevice(emailHash, publicKey string, at time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if d, ok := m.devices[emailHash][publicKey]; ok {
+		d.LastActive = at
+	}
+	return nil
+}
+
+func (m *memoryStore) ListDevices(emailHash string) ([]Device, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var out []Device
+	for _, d := range m.devices[emailHash] {
+		out = append(out, *d)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].PublicKey < out[j].PublicKey })
+	return out, nil
+}
+
+func (m *memoryStore) PrimaryDeviceKey(emailHash string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var best *Device
+	for _, d := range m.devices[emailHash] {
+		switch {
+		case best == nil,
+			d.IsMaster && !best.IsMaster,
+			d.IsMaster == best.IsMaster && d.LastActive.After(best.LastActive):
+			best = d
+		}
+	}
+	if best == nil {
+		return "", ErrNotFound
+	}
+	return best.PublicKey, nil
+}
+
+func (m *memoryStore) MasterDevice(emailHash string) (Device, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, d := range m.devices[emailHash] {
+		if d.IsMaster {
+			return *d, nil
+		}
+	}
+	return Device{}, ErrNotFound
+}
+
+func (m *memoryStore) SetDeviceStatus(emailHash, publicKey, status string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	d, ok := m.devices[emailHash][publicKey]
+	if !ok {
+		return ErrNotFound
+	}
+	d.Status = status
+	return nil
+}
+
+func (m *memoryStore) SetLinkSpecs(emailHash, publicKey, specs string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	d, ok := m.devices[emailHash][publicKey]
+	if !ok {
+		return ErrNotFound
+	}
+	d.LinkSpecs = specs
+	return nil
+}
+
+func (m *memoryStore) SetCrossSignature(emailHash, publicKey, signer, signature string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	d, ok := m.devices[emailHash][publicKey]
+	if !ok {
+		return ErrNotFound
+	}
+	d.CrossSignedBy, d.CrossSignature = signer, signature
+	return nil
+}
+
+func (m *memoryStore) SetMaster(emailHash, publicKey string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	target, ok := m.devices[emailHash][publicKey]
+	if !ok {
+		return ErrNotFound
+	}
+	for _, d := range m.devices[emailHash] {
+		d.IsMaster = false
+	}
+	target.IsMaster = true
+	target.Status = DeviceActive
+	return nil
+}
+
+func (m *memoryStore) DeleteDevice(emailHash, publicKey string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.devices[emailHash], publicKey)
+	if len(m.devices[emailHash]) == 0 {
+		delete(m.devices, emailHash)
+	}
+	return nil
+}
+
+func (m *memoryStore) DeleteDevices(emailHash string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.devices, emailHash)
+	return nil
+}
+
+func (m *memoryStore) ApproveDevice(approval DeviceSignature, crossSignature string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	d, ok := m.devices[approval.EmailHash][approval.Subject]
+	if !ok || d.Status != DevicePending {
+		return ErrNotFound
+	}
+	d.Status, d.LinkSpecs = DeviceActive, ""
+	d.CrossSignature, d.CrossSignedBy = crossSignature, approval.Signer
+	m.deviceSigs = append(m.deviceSigs, approval)
+	return nil
+}
+
+func (m *memoryStore) AddDeviceSignature(sig DeviceSignature) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.deviceSigs = append(m.deviceSigs, sig)
+	return nil
+}
+
+func (m *memoryStore) DeviceSignatures(emailHash string) ([]DeviceSignature, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var out []DeviceSignature
+	for _, sig := range m.deviceSigs {
+		if sig.EmailHash == emailHash {
+			out = append(out, sig)
+		}
+	}
+	sort.SliceStable(out, func(i, j int) bool { return out[i].CreatedAt.Before(out[j].CreatedAt) })
+	return out, nil
+}
+
+func (m *memoryStore) RotateDeviceKey(r KeyRotation) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	byKey := m.devices[r.EmailHash]
+	d, ok := byKey[r.OldKey]
+	if !ok {
+		return ErrNotFound
+	}
+	if _, taken := byKey[r.NewKey]; taken {
+		return fmt.Errorf("device key %s already in use", r.NewKey)
+	}
+	delete(byKey, r.OldKey)
+	d.PublicKey, d.CrossSignature, d.CrossSignedBy = r.NewKey, "", ""
+	byKey[r.NewKey] = d
+
+	for id, sock := range m.sockets {
+		if sock.emailHash == r.EmailHash && sock.publicKey == r.OldKey {
+			m.sockets[id] = memSocket{emailHash: r.EmailHash, publicKey: r.NewKey}
+		}
+	}
+	for i := range m.mail {
+		if m.mail[i].RecipientHash == r.EmailHash && m.mail[i].PublicKey == r.OldKey {
+			m.mail[i].PublicKey = r.NewKey
+		}
+	}
+	for _, n := range m.notifications {
+		if acks := m.notifAcks[n.ID]; n.EmailHash == r.EmailHash && acks[r.OldKey] {
+			delete(acks, r.OldKey)
+			acks[r.NewKey] = true
+		}
+	}
+	for i := range m.keyPackages {
+		if m.keyPackages[i].EmailHash == r.EmailHash && m.keyPackages[i].PublicKey == r.OldKey {
+			m.keyPackages[i].PublicKey = r.NewKey
+		}
+	}
+	if c, ok := m.claims[r.EmailHash]; ok && c.PublicKey == r.OldKey {
+		c.PublicKey = r.NewKey
+		m.claims[r.EmailHash] = c
+	}
+	delete(m.signedPreKeys, [2]string{r.EmailHash, r.OldKey})
+	m.oneTimeKeys = slices.DeleteFunc(m.oneTimeKeys, func(k PreKey) bool { return k.EmailHash == r.EmailHash && k.PublicKey == r.OldKey })
+
+	m.keyHistory = append(m.keyHistory, r)
+	m.deviceSigs = append(m.deviceSigs, DeviceSignature{
+		EmailHash: r.EmailHash,
+		Signer:    r.OldKey,
+		Subject:   r.NewKey,
+		Kind:      "UPDATE_PUBKEY",
+		Signature: r.Signature,
+		CreatedAt: r.RotatedAt,
+	})
+	return nil
+}
+
+func (m *memoryStore) KeyRotations(emailHash string) ([]KeyRotation, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var out []KeyRotation
+	for _, r := range m.keyHistory {
+		if r.EmailHash == emailHash {
+			out = append(out, r)
+		}
+	}
+	sort.SliceStable(out, func(i, j int) bool { return out[i].RotatedAt.Before(out[j].RotatedAt) })
+	return out, nil
+}
+
+func (m *memoryStore) AddSocket(emailHash, socketID, publicKey string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sockets[socketID] = memSocket{emailHash: emailHash, publicKey: publicKey}
+	return nil
+}
+
+func (m *memoryStore) RemoveSocket(socketID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.sockets, socketID)
+	return nil
+}
+
+func (m *memoryStore) RemoveSockets(emailHash string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for id, sock := range m.sockets {
+		if sock.emailHash == emailHash {
+			delete(m.sockets, id)
+		}
+	}
+	return nil
+}
+
+func (m *memoryStore) RemoveDeviceSockets(emailHash, publicKey string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for id, sock := range m.sockets {
+		if sock.emailHash == emailHash && sock.publicKey == publicKey {
+			delete(m.sockets, id)
+		}
+	}
+	return nil
+}
+
+func (m *memoryStore) SocketIDs(emailHash string) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var out []string
+	for id, sock := range m.sockets {
+		if sock.emailHash == emailHash {
+			out = append(out, id)
+		}
+	}
+	sort.Strings(out)
+	return out, nil
+}
+
+func (m *memoryStore) AddWipe(emailHash, publicKey string, at time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.wipes[[2]string{emailHash, publicKey}] = at
+	return nil
+}
+
+func (m *memoryStore) TakeWipe(emailHash, publicKey string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := [2]string{emailHash, publicKey}
+	_, ok := m.wipes[key]
+	delete(m.wipes, key)
+	return ok, nil
+}
+
+func (m *memoryStore) PutMasterClaim(c MasterClaim) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.claims[c.EmailHash] = c
+	return nil
+}
+
+func (m *memoryStore) MasterClaim(emailHash string) (MasterClaim, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c, ok := m.claims[emailHash]
+	if !ok {
+		return MasterClaim{EmailHash: emailHash}, ErrNotFound
+	}
+	return c, nil
+}
+
+func (m *memoryStore) DeleteMasterClaim(emailHash string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.claims, emailHash)
+	return nil
+}
+
+func (m *memoryStore) AppendKeyLog(e KeyLogEntry) (KeyLogEntry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e.Index = int64(len(m.keyLog))
+	m.keyLog = append(m.keyLog, e)
+	return e, nil
+}
+
+func (m *memoryStore) KeyLogEntries(from int64) ([]KeyLogEntry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if from >= int64(len(m.keyLog)) {
+		return nil, nil
+	}
+	return slices.Clone(m.keyLog[from:]), nil
+}
+
+func (m *memoryStore) LastKeyAdded(emailHash, publicKey string) (KeyLogEntry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i := len(m.keyLog) - 1; i >= 0; i-- {
+		if e := m.keyLog[i]; e.EmailHash == emailHash && e.PublicKey == publicKey && e.Action == KeyAdded {
+			return e, nil
+		}
+	}
+	return KeyLogEntry{EmailHash: emailHash, PublicKey: publicKey, Action: KeyAdded}, ErrNotFound
+}
+
+func (m *memoryStore) PutRequest(r FriendRequest) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.requests[[2]string{r.SenderHash, r.TargetHash}] = r
+	return nil
+}
+
+func (m *memoryStore) DeleteRequest(senderHash, targetHash string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.requests, [2]string{senderHash, targetHash})
+	return nil
+}
+
+func (m *memoryStore) PendingRequests(targetHash string) ([]FriendRequest, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var out []FriendRequest
+	for _, r := range m.requests {
+		if r.TargetHash == targetHash {
+			out = append(out, r)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Timestamp.Before(out[j].Timestamp) })
+	return out, nil
+}
+
+func (m *memoryStore) AddFriendship(f Friendship) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := [2]string{f.User1Hash, f.User2Hash}
+	if _, exists := m.friends[key]; !exists {
+		m.friends[key] = f
+	}
+	return nil
+}
+
+func (m *memoryStore) RemoveFriendship(a, b string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.friends, [2]string{a, b})
+	delete(m.friends, [2]string{b, a})
+	return nil
+}
+
+func (m *memoryStore) RemoveFriendships(emailHash string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for key := range m.friends {
+		if key[0] == emailHash || key[1] == emailHash {
+			delete(m.friends, key)
+		}
+	}
+	return nil
+}
+
+func (m *memoryStore) Friendships(emailHash string) ([]Friendship, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var out []Friendship
+	for _, f := range m.friends {
+		if (f.User1Hash == emailHash || f.User2Hash == emailHash) && f.SID != "" {
+			out = append(out, f)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].SID < out[j].SID })
+	return out, nil
+}
+
+func (m *memoryStore) IsSessionMember(sid, emailHash string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, f := range m.friends {
+		if f.SID == sid && (f.User1Hash == emailHash || f.User2Hash == emailHash) {
+			return true, nil
+		}
+	}
+	_, ok := m.groupMembers[sid][emailHash]
+	return ok, nil
+}
+
+func (m *memoryStore) CreateGroup(g Group, members []GroupMember) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.groups[g.ID]; ok {
+		return fmt.Errorf("group %s already exists", g.ID)
+	}
+	g.Epoch = 1
+	m.groups[g.ID] = &g
+	m.groupMembers[g.ID] = make(map[string]GroupMember, len(members))
+	for _, gm := range members {
+		gm.GroupID = g.ID
+		m.groupMembers[g.ID][gm.EmailHash] = gm
+	}
+	return nil
+}
+
+func (m *memoryStore) Group(id string) (Group, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if g, ok := m.groups[id]; ok {
+		return *g, nil
+	}
+	return Group{}, ErrNotFound
+}
+
+func (m *memoryStore) GroupMembers(id string) ([]GroupMember, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var out []GroupMember
+	for _, gm := range m.groupMembers[id] {
+		out = append(out, gm)
+	}
+	slices.SortFunc(out, func(a, b GroupMember) int {
+		if c := a.JoinedAt.Compare(b.JoinedAt); c != 0 {
+			return c
+		}
+		return strings.Compare(a.EmailHash, b.EmailHash)
+	})
+	return out, nil
+}
+
+func (m *memoryStore) UserGroups(emailHash string) ([]Group, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var out []Group
+	for id, members := range m.groupMembers {
+		if _, ok := members[emailHash]; ok {
+			out = append(out, *m.groups[id])
+		}
+	}
+	slices.SortFunc(out, func(a, b Group) int {
+		if c := a.CreatedAt.Compare(b.CreatedAt); c != 0 {
+			return c
+		}
+		return strings.Compare(a.ID, b.ID)
+	})
+	return out, nil
+}
+
+func (m *memoryStore) AddGroupMember(gm GroupMember) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	g, ok := m.groups[gm.GroupID]
+	if !ok {
+		return 0, ErrNotFound
+	}
+	if _, ok := m.groupMembers[gm.GroupID][gm.EmailHash]; ok {
+		return 0, fmt.Errorf("%s is already in group %s", gm.EmailHash, gm.GroupID)
+	}
+	m.groupMembers[gm.GroupID][gm.EmailHash] = gm
+	g.Epoch++
+	return g.Epoch, nil
+}
+
+func (m *memoryStore) RemoveGroupMember(groupID, emailHash string) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	g, ok := m.groups[groupID]
+	if _, member := m.groupMembers[groupID][emailHash]; !ok || !member {
+		return 0, ErrNotFound
+	}
+	delete(m.groupMembers[groupID], emailHash)
+	g.Epoch++
+	return g.Epoch, nil
+}
+
+func (m *memoryStore) SetGroupRole(groupID, emailHash, role string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	gm, ok := m.groupMembers[groupID][emailHash]
+	if !ok {
+		return ErrNotFound
+	}
+	gm.Role = role
+	m.groupMembers[groupID][emailHash] = gm
+	return nil
+}
+
+func (m *memoryStore) DeleteGroup(id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.groups, id)
+	delete(m.groupMembers, id)
+	delete(m.commits, id)
+	return nil
+}
+
+func (m *memoryStore) AddKeyPackages(emailHash, publicKey string, data []string, at time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, d := range data {
+		m.nextKPID++
+		m.keyPackages = append(m.keyPackages, KeyPackage{ID: m.nextKPID, EmailHash: emailHash, PublicKey: publicKey, Data: d, CreatedAt: at})
+	}
+	return nil
+}
+
+func (m *memoryStore) CountKeyPackages(emailHash, publicKey string) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n := 0
+	for _, kp := range m.keyPackages {
+		if kp.EmailHash == emailHash && kp.PublicKey == publicKey {
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (m *memoryStore) TakeKeyPackage(emailHash, publicKey string) (KeyPackage, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	first, n := -1, 0
+	for i, kp := range m.keyPackages {
+		if kp.EmailHash == emailHash && kp.PublicKey == publicKey {
+			if first < 0 {
+				first = i
+			}
+			n++
+		}
+	}
+	if first < 0 {
+		return KeyPackage{}, ErrNotFound
+	}
+	kp := m.keyPackages[first]
+	if n > 1 {
+		m.keyPackages = slices.Delete(m.keyPackages, first, first+1)
+	}
+	return kp, nil
+}
+
+func (m *memoryStore) PutSignedPreKey(k PreKey) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.signedPreKeys[[2]string{k.EmailHash, k.PublicKey}] = k
+	return nil
+}
+
+func (m *memoryStore) SignedPreKey(emailHash, publicKey string) (PreKey, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	k, ok := m.signedPreKeys[[2]string{emailHash, publicKey}]
+	if !ok {
+		return PreKey{EmailHash: emailHash, PublicKey: publicKey}, ErrNotFound
+	}
+	return k, nil
+}
+
+func (m *memoryStore) AddOneTimePreKeys(emailHash, publicKey string, keys []PreKey) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, k := range keys {
+		k.EmailHash, k.PublicKey = emailHash, publicKey
+		if !slices.ContainsFunc(m.oneTimeKeys, func(o PreKey) bool {
+			return o.EmailHash == emailHash && o.PublicKey == publicKey && o.KeyID == k.KeyID
+		}) {
+			m.oneTimeKeys = append(m.oneTimeKeys, k)
+		}
+	}
+	return nil
+}
+
+func (m *memoryStore) CountOneTimePreKeys(emailHash, publicKey string) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n := 0
+	for _, k := range m.oneTimeKeys {
+		if k.EmailHash == emailHash && k.PublicKey == publicKey {
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (m *memoryStore) TakeOneTimePreKey(emailHash, publicKey string) (PreKey, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	i := slices.IndexFunc(m.oneTimeKeys, func(k PreKey) bool { return k.EmailHash == emailHash && k.PublicKey == publicKey })
+	if i < 0 {
+		return PreKey{}, ErrNotFound
+	}
+	k := m.oneTimeKeys[i]
+	m.oneTimeKeys = slices.Delete(m.oneTimeKeys, i, i+1)
+	return k, nil
+}
+
+func (m *memoryStore) AppendCommit(c GroupCommit) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	g, ok := m.groups[c.GroupID]
+	if !ok || g.MLSEpoch != c.Epoch {
+		return false, nil
+	}
+	g.MLSEpoch++
+	m.commits[c.GroupID] = append(m.commits[c.GroupID], c)
+	return true, nil
+}
+
+func (m *memoryStore) Commits(groupID string, since int64, limit int) ([]GroupCommit, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var out []GroupCommit
+	for _, c := range m.commits[groupID] {
+		if c.Epoch >= since && len(out) < limit {
+			out = append(out, c)
+		}
+	}
+	return out, nil
+}
+
+func (m *memoryStore) AddNotification(emailHash, eventData string, at time.Time) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.nextNotifID++
+	m.notifications = append(m.notifications, OfflineNotification{
+		ID:        m.nextNotifID,
+		EmailHash: emailHash,
+		EventData: eventData,
+		Timestamp: at,
+	})
+	return m.nextNotifID, nil
+}
+
+func (m *memoryStore) PendingNotifications(emailHash, publicKey string) ([]OfflineNotification, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var out []OfflineNotification
+	for _, n := range m.notifications {
+		if n.EmailHash == emailHash && !m.notifAcks[n.ID][publicKey] {
+			out = append(out, n)
+		}
+	}
+	return out, nil
+}
+
+func (m *memoryStore) AckNotification(emailHash, publicKey string, id int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	i := slices.IndexFunc(m.notifications, func(n OfflineNotification) bool {
+		return n.ID == id && n.EmailHash == emailHash
+	})
+	if i < 0 {
+		return nil
+	}
+	if m.notifAcks[id] == nil {
+		m.notifAcks[id] = make(map[string]bool)
+	}
+	m.notifAcks[id][publicKey] = true
+	for pk, d := range m.devices[emailHash] {
+		if d.Status == DeviceActive && !m.notifAcks[id][pk] {
+			return nil
+		}
+	}
+	m.notifications = slices.Delete(m.notifications, i, i+1)
+	delete(m.notifAcks, id)
+	return nil
+}
+
+func (m *memoryStore) PutMail(mail Mail, quotaBytes int) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	used := 0
+	for _, other := range m.mail {
+		if other.RecipientHash == mail.RecipientHash && other.ExpiresAt.After(mail.CreatedAt) {
+			used += len(other.Payload)
+		}
+	}
+	if used+len(mail.Payload) > quotaBytes {
+		return false, nil
+	}
+	m.nextMailID++
+	mail.ID = m.nextMailID
+	m.mail = append(m.mail, mail)
+	return true, nil
+}
+
+func (m *memoryStore) PendingMail(recipientHash, publicKey string, now time.Time) ([]Mail, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var out []Mail
+	for _, mail := range m.mail {
+		if mail.RecipientHash == recipientHash && mail.PublicKey == publicKey && mail.ExpiresAt.After(now) {
+			out = append(out, mail)
+		}
+	}
+	return out, nil
+}
+
+func (m *memoryStore) DeleteMail(recipientHash, publicKey string, id int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.mail = slices.DeleteFunc(m.mail, func(mail Mail) bool {
+		return mail.ID == id && mail.RecipientHash == recipientHash && mail.PublicKey == publicKey
+	})
+	return nil
+}
+
+func (m *memoryStore) PruneMail(now time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.mail = slices.DeleteFunc(m.mail, func(mail Mail) bool { return !mail.ExpiresAt.After(now) })
+	return nil
+}
+
+func (m *memoryStore) Prune(before time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for eh, byKey := range m.devices {
+		for pk, d := range byKey {
+			if d.LastActive.Before(before) && !d.IsMaster {
+				delete(byKey, pk)
+			}
+		}
+		if len(byKey) == 0 {
+			delete(m.devices, eh)
+		}
+	}
+	for key, r := range m.requests {
+		if r.Timestamp.Before(before) {
+			delete(m.requests, key)
+		}
+	}
+	kept := m.notifications[:0]
+	for _, n := range m.notifications {
+		if !n.Timestamp.Before(before) {
+			kept = append(kept, n)
+		} else {
+			delete(m.notifAcks, n.ID)
+		}
+	}
+	m.notifications = kept
+	for key, at := range m.wipes {
+		if at.Before(before) {
+			delete(m.wipes, key)
+		}
+	}
+	for eh, c := range m.claims {
+		if c.ClaimedAt.Before(before) {
+			delete(m.claims, eh)
+		}
+	}
+	for id, commits := range m.commits {
+		m.commits[id] = slices.DeleteFunc(commits, func(c GroupCommit) bool { return c.CreatedAt.Before(before) })
+	}
+	m.keyPackages = slices.DeleteFunc(m.keyPackages, func(kp KeyPackage) bool {
+		_, ok := m.devices[kp.EmailHash][kp.PublicKey]
+		return !ok
+	})
+	for key := range m.signedPreKeys {
+		if _, ok := m.devices[key[0]][key[1]]; !ok {
+			delete(m.signedPreKeys, key)
+		}
+	}
+	m.oneTimeKeys = slices.DeleteFunc(m.oneTimeKeys, func(k PreKey) bool {
+		_, ok := m.devices[k.EmailHash][k.PublicKey]
+		return !ok
+	})
+	m.deviceSigs = slices.DeleteFunc(m.deviceSigs, func(sig DeviceSignature) bool {
+		_, ok := m.devices[sig.EmailHash]
+		return !ok
+	})
+	m.keyHistory = slices.DeleteFunc(m.keyHistory, func(r KeyRotation) bool {
+		_, ok := m.devices[r.EmailHash]
+		return !ok
+	})
+	return nil
+}
+
+func (m *memoryStore) Close() error {
+	return nil
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+
+	_ "github.com/lib/pq"
+)
+
+func connectPostgres(dsn string) (*sqlStore, error) {
+	if dsn == "" {
+		return nil, fmt.Errorf("postgres store needs a connection string")
+	}
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &sqlStore{db: db, dialect: dialectPostgres}, nil
+}
+
+func openPostgresStore(dsn string) (*sqlStore, error) {
+	s, err := connectPostgres(dsn)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.prepare(); err != nil {
+		s.Close()
+		return nil, err
+	}
+	return s, nil
+}
@@ -0,0 +1,911 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	dialectSQLite   = "sqlite"
+	dialectPostgres = "postgres"
+)
+
+// sqlStore implements Store on top of database/sql. The queries are written
+// with ? placeholders and the subset of SQL shared by SQLite and Postgres;
+// rebind rewrites placeholders for drivers that need numbered ones.
+type sqlStore struct {
+	db      *sql.DB
+	dialect string
+}
+
+// connectSQLStore opens the database without touching the schema.
+func connectSQLStore(driver, dsn string) (*sqlStore, error) {
+	switch driver {
+	case "sqlite", "sqlite3", "":
+		return connectSQLite(dsn)
+	case "postgres", "postgresql":
+		return connectPostgres(dsn)
+	default:
+		return nil, fmt.Errorf("store driver %q has no SQL schema", driver)
+	}
+}
+
+// prepare brings the schema up to date and clears presence left over from
+// the previous run.
+func (s *sqlStore) prepare() error {
+	if _, err := s.migrateUp(latestSchemaVersion()); err != nil {
+		return err
+	}
+	return s.exec("DELETE FROM sockets")
+}
+
+func (s *sqlStore) rebind(query string) string {
+	if s.dialect != dialectPostgres {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+func (s *sqlStore) exec(query string, args ...any) error {
+	_, err := s.db.Exec(s.rebind(query), args...)
+	return err
+}
+
+func (s *sqlStore) queryStrings(query string, args ...any) ([]string, error) {
+	rows, err := s.db.Query(s.rebind(query), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []string
+	for rows.Next() {
+		var v string
+		if err := rows.Scan(&v); err != nil {
+			return nil, err
+		}
+		out = append(out, v)
+	}
+	return out, rows.Err()
+}
+
+func (s *sqlStore) Device(emailHash, publicKey string) (Device, error) {
+	d := Device{EmailHash: emailHash, PublicKey: publicKey}
+	err := s.db.QueryRow(s.rebind(`SELECT device_id, created_at, last_active, is_master, status, link_specs, cross_signature, cross_signed_by
+		FROM devices WHERE email_hash = ? AND public_key = ?`), emailHash, publicKey).
+		Scan(&d.DeviceID, &d.CreatedAt, &d.LastActive, &d.IsMaster, &d.Status, &d.LinkSpecs, &d.CrossSignature, &d.CrossSignedBy)
+	if errors.Is(err, sql.ErrNoRows) {
+		return d, ErrNotFound
+	}
+	return d, err
+}
+
+func (s *sqlStore) CountActiveDevices(emailHash string, since time.Time) (int, error) {
+	var n int
+	err := s.db.QueryRow(s.rebind("SELECT COUNT(*) FROM devices WHERE email_hash = ? AND last_active >= ?"), emailHash, since).Scan(&n)
+	return n, err
+}
+
+func (s *sqlStore) AddDevice(d Device) error {
+	if d.Status == "" {
+		d.Status = DeviceActive
+	}
+	if d.DeviceID == "" {
+		d.DeviceID = newDeviceID()
+	}
+	if d.CreatedAt.IsZero() {
+		d.CreatedAt = d.LastActive
+	}
+	return s.exec(`INSERT INTO devices (email_hash, public_key, device_id, created_at, last_active, is_master, status, link_specs, cross_signature, cross_signed_by)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?) ON CONFLICT DO NOTHING`,
+		d.EmailHash, d.PublicKey, d.DeviceID, d.CreatedAt, d.LastActive, d.IsMaster, d.Status, d.LinkSpecs, d.CrossSignature, d.CrossSignedBy)
+}
+
+func (s *sqlStore) RegisterDevice(d Device) (Device, bool, error) {
+	if d.DeviceID == "" {
+		d.DeviceID = newDeviceID()
+	}
+	if d.CreatedAt.IsZero() {
+		d.CreatedAt = d.LastActive
+	}
+	// The devices_one_master index turns the master insert into a no-op
+	// when the account already has one.
+	for _, master := range []bool{true, false} {
+		d.IsMaster, d.Status = master, DevicePending
+		if master {
+			d.Status = DeviceActive
+		}
+		res, err := s.db.Exec(s.rebind(`INSERT INTO devices (email_hash, public_key, device_id, created_at, last_active, is_master, status, link_specs, cross_signature, cross_signed_by)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?) ON CONFLICT DO NOTHING`),
+			d.EmailHash, d.PublicKey, d.DeviceID, d.CreatedAt, d.LastActive, d.IsMaster, d.Status, d.LinkSpecs, d.CrossSignature, d.CrossSignedBy)
+		if err != nil {
+			return Device{}, false, err
+		}
+		if n, _ := res.RowsAffected(); n == 1 {
+			return d, true, nil
+		}
+	}
+	existing, err := s.Device(d.EmailHash, d.PublicKey)
+	return existing, false, err
+}
+
+func (s *sqlStore) TouchDevice(emailHash, publicKey string, at time.Time) error {
+	return s.exec("UPDATE devices SET last_active = ? WHERE email_hash = ? AND public_key = ?", at, emailHash, publicKey)
+}
+
+func (s *sqlStore) ListDevices(emailHash string) ([]Device, error) {
+	rows, err := s.db.Query(s.rebind(`SELECT public_key, device_id, created_at, last_active, is_master, status, link_specs, cross_signature, cross_signed_by
+		FROM devices WHERE email_hash = ?`), emailHash)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []Device
+	for rows.Next() {
+		d := Device{EmailHash: emailHash}
+		if err := rows.Scan(&d.PublicKey, &d.DeviceID, &d.CreatedAt, &d.LastActive, &d.IsMaster, &d.Status, &d.LinkSpecs, &d.CrossSignature, &d.CrossSignedBy); err != nil {
+			return nil, err
+		}
+		out = append(out, d)
+	}
+	return out, rows.Err()
+}
+
+func (s *sqlStore) PrimaryDeviceKey(emailHash string) (string, error) {
+	var pk string
+	err := s.db.QueryRow(s.rebind("SELECT public_key FROM devices WHERE email_hash = ? ORDER BY is_master DESC, last_active DESC LIMIT 1"), emailHash).Scan(&pk)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", ErrNotFound
+	}
+	return pk, err
+}
+
+func (s *sqlStore) MasterDevice(emailHash string) (Device, error) {
+	d := Device{EmailHash: emailHash, IsMaster: true}
+	err := s.db.QueryRow(s.rebind(`SELECT public_key, device_id, created_at, last_active, status, link_specs, cross_signature, cross_signed_by
+		FROM devices WHERE email_hash = ? AND is_master = ?`), emailHash, true).
+		Scan(&d.PublicKey, &d.DeviceID, &d.CreatedAt, &d.LastActive, &d.Status, &d.LinkSpecs, &d.CrossSignature, &d.CrossSignedBy)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Device{}, ErrNotFound
+	}
+	return d, err
+}
+
+func (s *sqlStore) SetDeviceStatus(emailHash, publicKey, status string) error {
+	return s.updateDevice("UPDATE devices SET status = ? WHERE email_hash = ? AND public_key = ?", status, emailHash, publicKey)
+}
+
+func (s *sqlStore) SetLinkSpecs(emailHash, publicKey, specs string) error {
+	return s.updateDevice("UPDATE devices SET link_specs = ? WHERE email_hash = ? AND public_key = ?", specs, emailHash, publicKey)
+}
+
+func (s *sqlStore) SetCrossSignature(emailHash, publicKey, signer, signature string) error {
+	return s.updateDevice("UPDATE devices SET cross_signed_by = ?, cross_signature = ? WHERE email_hash = ? AND public_key = ?", signer, signature, emailHash, publicKey)
+}
+
+func (s *sqlStore) SetMaster(emailHash, publicKey string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var n int
+	if err := tx.QueryRow(s.rebind("SELECT COUNT(*) FROM devices WHERE email_hash = ? AND public_key = ?"), emailHash, publicKey).Scan(&n); err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+	// Two statements, because devices_one_master is checked row by row.
+	if _, err := tx.Exec(s.rebind("UPDATE devices SET is_master = FALSE WHERE email_hash = ? AND public_key <> ?"), emailHash, publicKey); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(s.rebind("UPDATE devices SET is_master = TRUE, status = ? WHERE email_hash = ? AND public_key = ?"),
+		DeviceActive, emailHash, publicKey); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// updateDevice runs an update of one device row and returns ErrNotFound when
+// there is no such row.
+func (s *sqlStore) updateDevice(query string, args ...any) error {
+	res, err := s.db.Exec(s.rebind(query), args...)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *sqlStore) DeleteDevice(emailHash, publicKey string) error {
+	return s.exec("DELETE FROM devices WHERE email_hash = ? AND public_key = ?", emailHash, publicKey)
+}
+
+func (s *sqlStore) DeleteDevices(emailHash string) error {
+	return s.exec("DELETE FROM devices WHERE email_hash = ?", emailHash)
+}
+
+func (s *sqlStore) ApproveDevice(approval DeviceSignature, crossSignature string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	res, err := tx.Exec(s.rebind(`UPDATE devices SET status = ?, link_specs = '', cross_signature = ?, cross_signed_by = ?
+		WHERE email_hash = ? AND public_key = ? AND status = ?`),
+		DeviceActive, crossSignature, approval.Signer, approval.EmailHash, approval.Subject, DevicePending)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	if _, err := tx.Exec(s.rebind("INSERT INTO device_signatures (email_hash, signer, subject, kind, signature, created_at) VALUES (?, ?, ?, ?, ?, ?)"),
+		approval.EmailHash, approval.Signer, approval.Subject, approval.Kind, approval.Signature, approval.CreatedAt); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *sqlStore) AddDeviceSignature(sig DeviceSignature) error {
+	return s.exec("INSERT INTO device_signatures (email_hash, signer, subject, kind, signature, created_at) VALUES (?, ?, ?, ?, ?, ?)",
+		sig.EmailHash, sig.Signer, sig.Subject, sig.Kind, sig.Signature, sig.CreatedAt)
+}
+
+func (s *sqlStore) DeviceSignatures(emailHash string) ([]DeviceSignature, error) {
+	rows, err := s.db.Query(s.rebind("SELECT signer, subject, kind, signature, created_at FROM device_signatures WHERE email_hash = ? ORDER BY created_at, id"), emailHash)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []DeviceSignature
+	for rows.Next() {
+		sig := DeviceSignature{EmailHash: emailHash}
+		if err := rows.Scan(&sig.Signer, &sig.Subject, &sig.Kind, &sig.Signature, &sig.CreatedAt); err != nil {
+			return nil, err
+		}
+		out = append(out, sig)
+	}
+	return out, rows.Err()
+}
+
+func (s *sqlStore) RotateDeviceKey(r KeyRotation) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	res, err := tx.Exec(s.rebind("UPDATE devices SET public_key = ?, cross_signature = '', cross_signed_by = '' WHERE email_hash = ? AND public_key = ?"),
+		r.NewKey, r.EmailHash, r.OldKey)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	for _, st := range []struct {
+		query string
+		args  []any
+	}{
+		{"UPDATE sockets SET public_key = ? WHERE email_hash = ? AND public_key = ?", []any{r.NewKey, r.EmailHash, r.OldKey}},
+		{"UPDATE mailbox SET public_key = ? WHERE recipient_hash = ? AND public_key = ?", []any{r.NewKey, r.EmailHash, r.OldKey}},
+		{`UPDATE notification_acks SET public_key = ? WHERE public_key = ?
+			AND notification_id IN (SELECT id FROM offline_notifications WHERE email_hash = ?)`, []any{r.NewKey, r.OldKey, r.EmailHash}},
+		{"UPDATE key_packages SET public_key = ? WHERE email_hash = ? AND public_key = ?", []any{r.NewKey, r.EmailHash, r.OldKey}},
+		{"UPDATE master_claims SET public_key = ? WHERE email_hash = ? AND public_key = ?", []any{r.NewKey, r.EmailHash, r.OldKey}},
+		{"DELETE FROM signed_prekeys WHERE email_hash = ? AND public_key = ?", []any{r.EmailHash, r.OldKey}},
+		{"DELETE FROM one_time_prekeys WHERE email_hash = ? AND public_key = ?", []any{r.EmailHash, r.OldKey}},
+		{"INSERT INTO key_history (email_hash, device_id, old_key, new_key, signature, rotated_at) VALUES (?, ?, ?, ?, ?, ?)",
+			[]any{r.EmailHash, r.DeviceID, r.OldKey, r.NewKey, r.Signature, r.RotatedAt}},
+		{"INSERT INTO device_signatures (email_hash, signer, subject, kind, signature, created_at) VALUES (?, ?, ?, ?, ?, ?)",
+			[]any{r.EmailHash, r.OldKey, r.NewKey, "UPDATE_PUBKEY", r.Signature, r.RotatedAt}},
+	} {
+		if _, err := tx.Exec(s.rebind(st.query), st.args...); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *sqlStore) KeyRotations(emailHash string) ([]KeyRotation, error) {
+	rows, err := s.db.Query(s.rebind("SELECT device_id, old_key, new_key, signature, rotated_at FROM key_history WHERE email_hash = ? ORDER BY rotated_at, id"), emailHash)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []KeyRotation
+	for rows.Next() {
+		r := KeyRotation{EmailHash: emailHash}
+		if err := rows.Scan(&r.DeviceID, &r.OldKey, &r.NewKey, &r.Signature, &r.RotatedAt); err != nil {
+			return nil, err
+		}
+		out = append(out, r)
+	}
+	return out, rows.Err()
+}
+
+func (s *sqlStore) AddSocket(emailHash, socketID, publicKey string) error {
+	return s.exec("INSERT INTO sockets (email_hash, socket_id, public_key) VALUES (?, ?, ?)", emailHash, socketID, publicKey)
+}
+
+func (s *sqlStore) RemoveSocket(socketID string) error {
+	return s.exec("DELETE FROM sockets WHERE socket_id = ?", socketID)
+}
+
+func (s *sqlStore) RemoveSockets(emailHash string) error {
+	return s.exec("DELETE FROM sockets WHERE email_hash = ?", emailHash)
+}
+
+func (s *sqlStore) RemoveDeviceSockets(emailHash, publicKey string) error {
+	return s.exec("DELETE FROM sockets WHERE email_hash = ? AND public_key = ?", emailHash, publicKey)
+}
+
+func (s *sqlStore) SocketIDs(emailHash string) ([]string, error) {
+	return s.queryStrings("SELECT socket_id FROM sockets WHERE email_hash = ?", emailHash)
+}
+
+func (s *sqlStore) AddWipe(emailHash, publicKey string, at time.Time) error {
+	return s.exec(`INSERT INTO device_wipes (email_hash, public_key, requested_at) VALUES (?, ?, ?)
+		ON CONFLICT (email_hash, public_key) DO UPDATE SET requested_at = excluded.requested_at`,
+		emailHash, publicKey, at)
+}
+
+func (s *sqlStore) TakeWipe(emailHash, publicKey string) (bool, error) {
+	res, err := s.db.Exec(s.rebind("DELETE FROM device_wipes WHERE email_hash = ? AND public_key = ?"), emailHash, publicKey)
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n > 0, nil
+}
+
+func (s *sqlStore) PutMasterClaim(c MasterClaim) error {
+	return s.exec(`INSERT INTO master_claims (email_hash, public_key, claimed_at) VALUES (?, ?, ?)
+		ON CONFLICT (email_hash) DO UPDATE SET public_key = excluded.public_key, claimed_at = excluded.claimed_at`,
+		c.EmailHash, c.PublicKey, c.ClaimedAt)
+}
+
+func (s *sqlStore) MasterClaim(emailHash string) (MasterClaim, error) {
+	c := MasterClaim{EmailHash: emailHash}
+	err := s.db.QueryRow(s.rebind("SELECT public_key, claimed_at FROM master_claims WHERE email_hash = ?"), emailHash).
+		Scan(&c.PublicKey, &c.ClaimedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return c, ErrNotFound
+	}
+	return c, err
+}
+
+func (s *sqlStore) DeleteMasterClaim(emailHash string) error {
+	return s.exec("DELETE FROM master_claims WHERE email_hash = ?", emailHash)
+}
+
+func (s *sqlStore) AppendKeyLog(e KeyLogEntry) (KeyLogEntry, error) {
+	// Concurrent appends from other nodes may take the same index; the
+	// primary key turns that into an error and we try again.
+	var err error
+	for attempt := 0; attempt < 3; attempt++ {
+		err = s.db.QueryRow(s.rebind(`INSERT INTO key_log (idx, email_hash, public_key, action, created_at)
+			SELECT COALESCE(MAX(idx) + 1, 0), ?, ?, ?, ? FROM key_log RETURNING idx`),
+			e.EmailHash, e.PublicKey, e.Action, e.CreatedAt).Scan(&e.Index)
+		if err == nil {
+			return e, nil
+		}
+	}
+	return e, err
+}
+
+func (s *sqlStore) KeyLogEntries(from int64) ([]KeyLogEntry, error) {
+	rows, err := s.db.Query(s.rebind("SELECT idx, email_hash, public_key, action, created_at FROM key_log WHERE idx >= ? ORDER BY idx"), from)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []KeyLogEntry
+	for rows.Next() {
+		var e KeyLogEntry
+		if err := rows.Scan(&e.Index, &e.EmailHash, &e.PublicKey, &e.Action, &e.CreatedAt); err != nil {
+			return nil, err
+		}
+		out = append(out, e)
+	}
+	return out, rows.Err()
+}
+
+func (s *sqlStore) LastKeyAdded(emailHash, publicKey string) (KeyLogEntry, error) {
+	e := KeyLogEntry{EmailHash: emailHash, PublicKey: publicKey, Action: KeyAdded}
+	err := s.db.QueryRow(s.rebind("SELECT idx, created_at FROM key_log WHERE email_hash = ? AND public_key = ? AND action = ? ORDER BY idx DESC LIMIT 1"),
+		emailHash, publicKey, KeyAdded).Scan(&e.Index, &e.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return e, ErrNotFound
+	}
+	return e, err
+}
+
+func (s *sqlStore) PutRequest(r FriendRequest) error {
+	return s.exec(`INSERT INTO requests (sender_hash, target_hash, encrypted_packet, timestamp)
+		VALUES (?, ?, ?, ?)
+		ON CONFLICT (sender_hash, target_hash) DO UPDATE
+		SET encrypted_packet = excluded.encrypted_packet, timestamp = excluded.timestamp`,
+		r.SenderHash, r.TargetHash, r.EncryptedPacket, r.Timestamp)
+}
+
+func (s *sqlStore) DeleteRequest(senderHash, targetHash string) error {
+	return s.exec("DELETE FROM requests WHERE sender_hash = ? AND target_hash = ?", senderHash, targetHash)
+}
+
+func (s *sqlStore) PendingRequests(targetHash string) ([]FriendRequest, error) {
+	rows, err := s.db.Query(s.rebind("SELECT sender_hash, encrypted_packet, timestamp FROM requests WHERE target_hash = ?"), targetHash)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []FriendRequest
+	for rows.Next() {
+		r := FriendRequest{TargetHash: targetHash}
+		if err := rows.Scan(&r.SenderHash, &r.EncryptedPacket, &r.Timestamp); err != nil {
+			return nil, err
+		}
+		out = append(out, r)
+	}
+	return out, rows.Err()
+}
+
+func (s *sqlStore) AddFriendship(f Friendship) error {
+	return s.exec("INSERT INTO friends (user1_hash, user2_hash, since, sid) VALUES (?, ?, ?, ?) ON CONFLICT DO NOTHING",
+		f.User1Hash, f.User2Hash, f.Since, f.SID)
+}
+
+func (s *sqlStore) RemoveFriendship(a, b string) error {
+	return s.exec("DELETE FROM friends WHERE (user1_hash = ? AND user2_hash = ?) OR (user1_hash = ? AND user2_hash = ?)", a, b, b, a)
+}
+
+func (s *sqlStore) RemoveFriendships(emailHash string) error {
+	return s.exec("DELETE FROM friends WHERE user1_hash = ? OR user2_hash = ?", emailHash, emailHash)
+}
+
+func (s *sqlStore) Friendships(emailHash string) ([]Friendship, error) {
+	rows, err := s.db.Query(s.rebind(`SELECT user1_hash, user2_hash, sid, since FROM friends
+		WHERE (user1_hash = ? OR user2_hash = ?) AND sid IS NOT NULL`), emailHash, emailHash)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []Friendship
+	for rows.Next() {
+		var f Friendship
+		if err := rows.Scan(&f.User1Hash, &f.User2Hash, &f.SID, &f.Since); err != nil {
+			return nil, err
+		}
+		out = append(out, f)
+	}
+	return out, rows.Err()
+}
+
+func (s *sqlStore) IsSessionMember(sid, emailHash string) (bool, error) {
+	var n int
+	err := s.db.QueryRow(s.rebind(`SELECT
+		(SELECT COUNT(*) FROM friends WHERE sid = ? AND (user1_hash = ? OR user2_hash = ?)) +
+		(SELECT COUNT(*) FROM group_members WHERE group_id = ? AND email_hash = ?)`),
+		sid, emailHash, emailHash, sid, emailHash).Scan(&n)
+	return n > 0, err
+}
+
+func (s *sqlStore) CreateGroup(g Group, members []GroupMember) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(s.rebind("INSERT INTO groups (id, created_by, created_at, epoch) VALUES (?, ?, ?, 1)"), g.ID, g.CreatedBy, g.CreatedAt); err != nil {
+		return err
+	}
+	for _, m := range members {
+		if _, err := tx.Exec(s.rebind("INSERT INTO group_members (group_id, email_hash, role, joined_at) VALUES (?, ?, ?, ?)"),
+			g.ID, m.EmailHash, m.Role, m.JoinedAt); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *sqlStore) Group(id string) (Group, error) {
+	g := Group{ID: id}
+	err := s.db.QueryRow(s.rebind("SELECT created_by, created_at, epoch, mls_epoch FROM groups WHERE id = ?"), id).Scan(&g.CreatedBy, &g.CreatedAt, &g.Epoch, &g.MLSEpoch)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Group{}, ErrNotFound
+	}
+	return g, err
+}
+
+func (s *sqlStore) GroupMembers(id string) ([]GroupMember, error) {
+	rows, err := s.db.Query(s.rebind("SELECT email_hash, role, joined_at FROM group_members WHERE group_id = ? ORDER BY joined_at, email_hash"), id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []GroupMember
+	for rows.Next() {
+		m := GroupMember{GroupID: id}
+		if err := rows.Scan(&m.EmailHash, &m.Role, &m.JoinedAt); err != nil {
+			return nil, err
+		}
+		out = append(out, m)
+	}
+	return out, rows.Err()
+}
+
+func (s *sqlStore) UserGroups(emailHash string) ([]Group, error) {
+	rows, err := s.db.Query(s.rebind(`SELECT g.id, g.created_by, g.created_at, g.epoch, g.mls_epoch FROM groups g
+		JOIN group_members m ON m.group_id = g.id WHERE m.email_hash = ? ORDER BY g.created_at, g.id`), emailHash)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []Group
+	for rows.Next() {
+		var g Group
+		if err := rows.Scan(&g.ID, &g.CreatedBy, &g.CreatedAt, &g.Epoch, &g.MLSEpoch); err != nil {
+			return nil, err
+		}
+		out = append(out, g)
+	}
+	return out, rows.Err()
+}
+
+func (s *sqlStore) AddGroupMember(m GroupMember) (int64, error) {
+	return s.changeGroupMembers(m.GroupID, "INSERT INTO group_members (group_id, email_hash, role, joined_at) VALUES (?, ?, ?, ?)",
+		m.GroupID, m.EmailHash, m.Role, m.JoinedAt)
+}
+
+func (s *sqlStore) RemoveGroupMember(groupID, emailHash string) (int64, error) {
+	return s.changeGroupMembers(groupID, "DELETE FROM group_members WHERE group_id = ? AND email_hash = ?", groupID, emailHash)
+}
+
+// changeGroupMembers runs one membership change and bumps the group's epoch
+// in the same transaction.
+func (s *sqlStore) changeGroupMembers(groupID, query string, args ...any) (int64, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	res, err := tx.Exec(s.rebind(query), args...)
+	if err != nil {
+		return 0, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return 0, ErrNotFound
+	}
+	var epoch int64
+	if err := tx.QueryRow(s.rebind("UPDATE groups SET epoch = epoch + 1 WHERE id = ? RETURNING epoch"), groupID).Scan(&epoch); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, ErrNotFound
+		}
+		return 0, err
+	}
+	return epoch, tx.Commit()
+}
+
+func (s *sqlStore) SetGroupRole(groupID, emailHash, role string) error {
+	res, err := s.db.Exec(s.rebind("UPDATE group_members SET role = ? WHERE group_id = ? AND email_hash = ?"), role, groupID, emailHash)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *sqlStore) DeleteGroup(id string) error {
+	return errors.Join(
+		s.exec("DELETE FROM group_commits WHERE group_id = ?", id),
+		s.exec("DELETE FROM group_members WHERE group_id = ?", id),
+		s.exec("DELETE FROM groups WHERE id = ?", id),
+	)
+}
+
+func (s *sqlStore) AddKeyPackages(emailHash, publicKey string, data []string, at time.Time) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, d := range data {
+		if _, err := tx.Exec(s.rebind("INSERT INTO key_packages (email_hash, public_key, data, created_at) VALUES (?, ?, ?, ?)"),
+			emailHash, publicKey, d, at); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *sqlStore) CountKeyPackages(emailHash, publicKey string) (int, error) {
+	var n int
+	err := s.db.QueryRow(s.rebind("SELECT COUNT(*) FROM key_packages WHERE email_hash = ? AND public_key = ?"), emailHash, publicKey).Scan(&n)
+	return n, err
+}
+
+func (s *sqlStore) TakeKeyPackage(emailHash, publicKey string) (KeyPackage, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return KeyPackage{}, err
+	}
+	defer tx.Rollback()
+	rows, err := tx.Query(s.rebind("SELECT id, data, created_at FROM key_packages WHERE email_hash = ? AND public_key = ? ORDER BY id LIMIT 2"),
+		emailHash, publicKey)
+	if err != nil {
+		return KeyPackage{}, err
+	}
+	var kps []KeyPackage
+	for rows.Next() {
+		kp := KeyPackage{EmailHash: emailHash, PublicKey: publicKey}
+		if err := rows.Scan(&kp.ID, &kp.Data, &kp.CreatedAt); err != nil {
+			rows.Close()
+			return KeyPackage{}, err
+		}
+		kps = append(kps, kp)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return KeyPackage{}, err
+	}
+	switch len(kps) {
+	case 0:
+		return KeyPackage{}, ErrNotFound
+	case 1:
+		return kps[0], nil
+	}
+	res, err := tx.Exec(s.rebind("DELETE FROM key_packages WHERE id = ?"), kps[0].ID)
+	if err != nil {
+		return KeyPackage{}, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		// Someone else took it first.
+		tx.Rollback()
+		return s.TakeKeyPackage(emailHash, publicKey)
+	}
+	return kps[0], tx.Commit()
+}
+
+func (s *sqlStore) PutSignedPreKey(k PreKey) error {
+	return s.exec(`INSERT INTO signed_prekeys (email_hash, public_key, key_id, prekey, signature, created_at) VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT (email_hash, public_key) DO UPDATE SET key_id = excluded.key_id, prekey = excluded.prekey,
+		signature = excluded.signature, created_at = excluded.created_at`,
+		k.EmailHash, k.PublicKey, k.KeyID, k.Key, k.Signature, k.CreatedAt)
+}
+
+func (s *sqlStore) SignedPreKey(emailHash, publicKey string) (PreKey, error) {
+	k := PreKey{EmailHash: emailHash, PublicKey: publicKey}
+	err := s.db.QueryRow(s.rebind("SELECT key_id, prekey, signature, created_at FROM signed_prekeys WHERE email_hash = ? AND public_key = ?"),
+		emailHash, publicKey).Scan(&k.KeyID, &k.Key, &k.Signature, &k.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return k, ErrNotFound
+	}
+	return k, err
+}
+
+func (s *sqlStore) AddOneTimePreKeys(emailHash, publicKey string, keys []PreKey) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, k := range keys {
+		if _, err := tx.Exec(s.rebind(`INSERT INTO one_time_prekeys (email_hash, public_key, key_id, prekey, created_at) VALUES (?, ?, ?, ?, ?)
+			ON CONFLICT DO NOTHING`), emailHash, publicKey, k.KeyID, k.Key, k.CreatedAt); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *sqlStore) CountOneTimePreKeys(emailHash, publicKey string) (int, error) {
+	var n int
+	err := s.db.QueryRow(s.rebind("SELECT COUNT(*) FROM one_time_prekeys WHERE email_hash = ? AND public_key = ?"), emailHash, publicKey).Scan(&n)
+	return n, err
+}
+
+func (s *sqlStore) TakeOneTimePreKey(emailHash, publicKey string) (PreKey, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return PreKey{}, err
+	}
+	defer tx.Rollback()
+	k := PreKey{EmailHash: emailHash, PublicKey: publicKey}
+	err = tx.QueryRow(s.rebind("SELECT key_id, prekey, created_at FROM one_time_prekeys WHERE email_hash = ? AND public_key = ? ORDER BY created_at, key_id LIMIT 1"),
+		emailHash, publicKey).Scan(&k.KeyID, &k.Key, &k.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return PreKey{}, ErrNotFound
+	}
+	if err != nil {
+		return PreKey{}, err
+	}
+	res, err := tx.Exec(s.rebind("DELETE FROM one_time_prekeys WHERE email_hash = ? AND public_key = ? AND key_id = ?"), emailHash, publicKey, k.KeyID)
+	if err != nil {
+		return PreKey{}, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		// Someone else took it first.
+		tx.Rollback()
+		return s.TakeOneTimePreKey(emailHash, publicKey)
+	}
+	return k, tx.Commit()
+}
+
+func (s *sqlStore) AppendCommit(c GroupCommit) (bool, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+	res, err := tx.Exec(s.rebind("UPDATE groups SET mls_epoch = mls_epoch + 1 WHERE id = ? AND mls_epoch = ?"), c.GroupID, c.Epoch)
+	if err != nil {
+		return false, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return false, nil
+	}
+	if _, err := tx.Exec(s.rebind("INSERT INTO group_commits (group_id, epoch, sender_hash, data, created_at) VALUES (?, ?, ?, ?, ?)"),
+		c.GroupID, c.Epoch, c.SenderHash, c.Data, c.CreatedAt); err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+func (s *sqlStore) Commits(groupID string, since int64, limit int) ([]GroupCommit, error) {
+	rows, err := s.db.Query(s.rebind(`SELECT epoch, sender_hash, data, created_at FROM group_commits
+		WHERE group_id = ? AND epoch >= ? ORDER BY epoch LIMIT ?`), groupID, since, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []GroupCommit
+	for rows.Next() {
+		c := GroupCommit{GroupID: groupID}
+		if err := rows.Scan(&c.Epoch, &c.SenderHash, &c.Data, &c.CreatedAt); err != nil {
+			return nil, err
+		}
+		out = append(out, c)
+	}
+	return out, rows.Err()
+}
+
+func (s *sqlStore) AddNotification(emailHash, eventData string, at time.Time) (int64, error) {
+	var id int64
+	err := s.db.QueryRow(s.rebind("INSERT INTO offline_notifications (email_hash, event_data, timestamp) VALUES (?, ?, ?) RETURNING id"),
+		emailHash, eventData, at).Scan(&id)
+	return id, err
+}
+
+func (s *sqlStore) PendingNotifications(emailHash, publicKey string) ([]OfflineNotification, error) {
+	rows, err := s.db.Query(s.rebind(`SELECT id, event_data, timestamp FROM offline_notifications n
+		WHERE email_hash = ?
+		AND NOT EXISTS (SELECT 1 FROM notification_acks a WHERE a.notification_id = n.id AND a.public_key = ?)
+		ORDER BY id`), emailHash, publicKey)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []OfflineNotification
+	for rows.Next() {
+		n := OfflineNotification{EmailHash: emailHash}
+		if err := rows.Scan(&n.ID, &n.EventData, &n.Timestamp); err != nil {
+			return nil, err
+		}
+		out = append(out, n)
+	}
+	return out, rows.Err()
+}
+
+// AckNotification records the ack and deletes the notification once no
+// active device of its user is still missing one.
+func (s *sqlStore) AckNotification(emailHash, publicKey string, id int64) error {
+	err := s.exec(`INSERT INTO notification_acks (notification_id, public_key)
+		SELECT id, ? FROM offline_notifications WHERE id = ? AND email_hash = ?
+		ON CONFLICT DO NOTHING`, publicKey, id, emailHash)
+	if err != nil {
+		return err
+	}
+	err = s.exec(`DELETE FROM offline_notifications WHERE id = ? AND NOT EXISTS (
+		SELECT 1 FROM devices d WHERE d.email_hash = offline_notifications.email_hash AND d.status = ?
+		AND NOT EXISTS (SELECT 1 FROM notification_acks a WHERE a.notification_id = offline_notifications.id AND a.public_key = d.public_key))`,
+		id, DeviceActive)
+	if err != nil {
+		return err
+	}
+	return s.exec("DELETE FROM notification_acks WHERE notification_id = ? AND NOT EXISTS (SELECT 1 FROM offline_notifications WHERE id = ?)", id, id)
+}
+
+func (s *sqlStore) PutMail(m Mail, quotaBytes int) (bool, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+	var used int
+	err = tx.QueryRow(s.rebind("SELECT COALESCE(SUM(size), 0) FROM mailbox WHERE recipient_hash = ? AND expires_at > ?"),
+		m.RecipientHash, m.CreatedAt).Scan(&used)
+	if err != nil {
+		return false, err
+	}
+	if used+len(m.Payload) > quotaBytes {
+		return false, nil
+	}
+	_, err = tx.Exec(s.rebind(`INSERT INTO mailbox
+		(recipient_hash, public_key, sid, sender_hash, payload, size, priority, created_at, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`),
+		m.RecipientHash, m.PublicKey, m.SID, m.SenderHash, m.Payload, len(m.Payload), m.Priority, m.CreatedAt, m.ExpiresAt)
+	if err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+func (s *sqlStore) PendingMail(recipientHash, publicKey string, now time.Time) ([]Mail, error) {
+	rows, err := s.db.Query(s.rebind(`SELECT id, sid, sender_hash, payload, priority, created_at, expires_at FROM mailbox
+		WHERE recipient_hash = ? AND public_key = ? AND expires_at > ? ORDER BY id`), recipientHash, publicKey, now)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []Mail
+	for rows.Next() {
+		m := Mail{RecipientHash: recipientHash, PublicKey: publicKey}
+		if err := rows.Scan(&m.ID, &m.SID, &m.SenderHash, &m.Payload, &m.Priority, &m.CreatedAt, &m.ExpiresAt); err != nil {
+			return nil, err
+		}
+		out = append(out, m)
+	}
+	return out, rows.Err()
+}
+
+func (s *sqlStore) DeleteMail(recipientHash, publicKey string, id int64) error {
+	return s.exec("DELETE FROM mailbox WHERE id = ? AND recipient_hash = ? AND public_key = ?", id, recipientHash, publicKey)
+}
+
+func (s *sqlStore) PruneMail(now time.Time) error {
+	return s.exec("DELETE FROM mailbox WHERE expires_at <= ?", now)
+}
+
+func (s *sqlStore) Prune(before time.Time) error {
+	return errors.Join(
+		s.exec("DELETE FROM devices WHERE last_active < ? AND NOT is_master", before),
+		s.exec("DELETE FROM requests WHERE timestamp < ?", before),
+		s.exec("DELETE FROM offline_notifications WHERE timestamp < ?", before),
+		s.exec("DELETE FROM notification_acks WHERE notification_id NOT IN (SELECT id FROM offline_notifications)"),
+		s.exec("DELETE FROM group_commits WHERE created_at < ?", before),
+		s.exec("DELETE FROM device_wipes WHERE requested_at < ?", before),
+		s.exec("DELETE FROM master_claims WHERE claimed_at < ?", before),
+		s.exec(`DELETE FROM key_packages WHERE NOT EXISTS
+			(SELECT 1 FROM devices d WHERE d.email_hash = key_packages.email_hash AND d.public_key = key_packages.public_key)`),
+		s.exec(`DELETE FROM signed_prekeys WHERE NOT EXISTS
+			(SELECT 1 FROM devices d WHERE d.email_hash = signed_prekeys.email_hash AND d.public_key = signed_prekeys.public_key)`),
+		s.exec(`DELETE FROM one_time_prekeys WHERE NOT EXISTS
+			(SELECT 1 FROM devices d WHERE d.email_hash = one_time_prekeys.email_hash AND d.public_key = one_time_prekeys.public_key)`),
+		s.exec(`DELETE FROM device_signatures WHERE NOT EXISTS
+			(SELECT 1 FROM devices d WHERE d.email_hash = device_signatures.email_hash)`),
+		s.exec(`DELETE FROM key_history WHERE NOT EXISTS
+			(SELECT 1 FROM devices d WHERE d.email_hash = key_history.email_hash)`),
+	)
+}
+
+func (s *sqlStore) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"database/sql"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func connectSQLite(path string) (*sqlStore, error) {
+	if path == "" {
+		path = "./server.db"
+	}
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return nil, err
+	}
+	return &sqlStore{db: db, dialect: dialectSQLite}, nil
+}
+
+func openSQLiteStore(path string) (*sqlStore, error) {
+	s, err := connectSQLite(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.prepare(); err != nil {
+		s.Close()
+		return nil, err
+	}
+	return s, nil
+}
@@ -0,0 +1,697 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// storeImpls returns every Store implementation available in this
+// environment. Postgres runs only when RELAY_TEST_POSTGRES_DSN is set.
+func storeImpls(t *testing.T) map[string]func(t *testing.T) Store {
+	impls := map[string]func(t *testing.T) Store{
+		"memory": func(t *testing.T) Store { return newMemoryStore() },
+		"sqlite": func(t *testing.T) Store {
+			s, err := openSQLiteStore(filepath.Join(t.TempDir(), "test.db"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			return s
+		},
+	}
+	if dsn := os.Getenv("RELAY_TEST_POSTGRES_DSN"); dsn != "" {
+		impls["postgres"] = func(t *testing.T) Store {
+			s, err := openPostgresStore(dsn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, table := range []string{"devices", "requests", "friends", "sockets", "offline_notifications", "notification_acks", "mailbox", "groups", "group_members", "key_packages", "group_commits", "device_wipes", "master_claims", "key_log", "signed_prekeys", "one_time_prekeys", "device_signatures", "key_history"} {
+				s.db.Exec("DELETE FROM " + table)
+			}
+			return s
+		}
+	}
+	return impls
+}
+
+func TestStoreConformance(t *testing.T) {
+	for name, open := range storeImpls(t) {
+		t.Run(name, func(t *testing.T) {
+			st := open(t)
+			defer st.Close()
+
+			t.Run("devices", func(t *testing.T) { testStoreDevices(t, st) })
+			t.Run("register devices", func(t *testing.T) { testStoreRegisterDevice(t, st) })
+			t.Run("presence", func(t *testing.T) { testStorePresence(t, st) })
+			t.Run("requests", func(t *testing.T) { testStoreRequests(t, st) })
+			t.Run("friendships", func(t *testing.T) { testStoreFriendships(t, st) })
+			t.Run("notifications", func(t *testing.T) { testStoreNotifications(t, st) })
+			t.Run("mailbox", func(t *testing.T) { testStoreMailbox(t, st) })
+			t.Run("groups", func(t *testing.T) { testStoreGroups(t, st) })
+			t.Run("mls", func(t *testing.T) { testStoreMLS(t, st) })
+			t.Run("keylog", func(t *testing.T) { testStoreKeyLog(t, st) })
+			t.Run("prekeys", func(t *testing.T) { testStorePreKeys(t, st) })
+			t.Run("device signatures", func(t *testing.T) { testStoreDeviceSignatures(t, st) })
+			t.Run("approve device", func(t *testing.T) { testStoreApproveDevice(t, st) })
+			t.Run("key rotation", func(t *testing.T) { testStoreKeyRotation(t, st) })
+		})
+	}
+}
+
+func testStoreDevices(t *testing.T, st Store) {
+	now := time.Now().Truncate(time.Second)
+	if _, err := st.Device("alice", "k1"); err != ErrNotFound {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+	if _, err := st.PrimaryDeviceKey("alice"); err != ErrNotFound {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+
+	st.AddDevice(Device{EmailHash: "alice", PublicKey: "k1", LastActive: now.Add(-time.Hour), IsMaster: true})
+	st.AddDevice(Device{EmailHash: "alice", PublicKey: "k2", LastActive: now})
+	st.AddDevice(Device{EmailHash: "alice", PublicKey: "k2", LastActive: now, IsMaster: true}) // duplicate is ignored
+
+	d, err := st.Device("alice", "k2")
+	if err != nil || d.IsMaster || d.DeviceID == "" || !d.CreatedAt.Equal(now) {
+		t.Fatalf("Device(k2) = %+v, %v", d, err)
+	}
+	if k1, _ := st.Device("alice", "k1"); k1.DeviceID == d.DeviceID {
+		t.Fatalf("two devices share the ID %s", d.DeviceID)
+	}
+	if pk, _ := st.PrimaryDeviceKey("alice"); pk != "k1" {
+		t.Fatalf("primary key = %q, want master k1", pk)
+	}
+	if n, _ := st.CountActiveDevices("alice", now.Add(-time.Minute)); n != 1 {
+		t.Fatalf("active devices = %d, want 1", n)
+	}
+
+	st.TouchDevice("alice", "k1", now.Add(time.Minute))
+	if n, _ := st.CountActiveDevices("alice", now.Add(-time.Minute)); n != 2 {
+		t.Fatalf("active devices after touch = %d, want 2", n)
+	}
+	if devices, _ := st.ListDevices("alice"); len(devices) != 2 {
+		t.Fatalf("ListDevices = %d devices, want 2", len(devices))
+	}
+
+	if m, err := st.MasterDevice("alice"); err != nil || m.PublicKey != "k1" {
+		t.Fatalf("MasterDevice = %+v, %v", m, err)
+	}
+	st.AddDevice(Device{EmailHash: "alice", PublicKey: "k3", LastActive: now, Status: DevicePending})
+	if err := st.SetLinkSpecs("alice", "k3", "specs"); err != nil {
+		t.Fatal(err)
+	}
+	if d, _ := st.Device("alice", "k3"); d.Status != DevicePending || d.LinkSpecs != "specs" {
+		t.Fatalf("pending device = %+v", d)
+	}
+	if err := st.SetCrossSignature("alice", "k3", "k1", "xsig"); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.SetDeviceStatus("alice", "k3", DeviceActive); err != nil {
+		t.Fatal(err)
+	}
+	if d, _ := st.Device("alice", "k3"); d.Status != DeviceActive || d.CrossSignedBy != "k1" || d.CrossSignature != "xsig" {
+		t.Fatalf("approved device = %+v", d)
+	}
+	if err := st.SetDeviceStatus("alice", "nope", DeviceActive); err != ErrNotFound {
+		t.Fatalf("SetDeviceStatus(unknown) = %v, want ErrNotFound", err)
+	}
+	if err := st.SetCrossSignature("alice", "nope", "k1", "xsig"); err != ErrNotFound {
+		t.Fatalf("SetCrossSignature(unknown) = %v, want ErrNotFound", err)
+	}
+	if err := st.SetMaster("alice", "k3"); err != nil {
+		t.Fatal(err)
+	}
+	if m, _ := st.MasterDevice("alice"); m.PublicKey != "k3" {
+		t.Fatalf("master after SetMaster = %+v", m)
+	}
+	if d, _ := st.Device("alice", "k1"); d.IsMaster {
+		t.Fatal("old master kept the flag")
+	}
+	if err := st.SetMaster("alice", "nope"); err != ErrNotFound {
+		t.Fatalf("SetMaster(unknown) = %v, want ErrNotFound", err)
+	}
+	st.SetMaster("alice", "k1")
+	st.DeleteDevice("alice", "k3")
+	if _, err := st.Device("alice", "k3"); err != ErrNotFound {
+		t.Fatalf("deleted device: %v", err)
+	}
+
+	st.DeleteDevices("alice")
+	if devices, _ := st.ListDevices("alice"); len(devices) != 0 {
+		t.Fatalf("devices left after delete: %+v", devices)
+	}
+	st.AddWipe("alice", "k3", now)
+	if ok, _ := st.TakeWipe("alice", "k3"); !ok {
+		t.Fatal("TakeWipe = false, want the queued wipe")
+	}
+	if ok, _ := st.TakeWipe("alice", "k3"); ok {
+		t.Fatal("wipe taken twice")
+	}
+
+	if _, err := st.MasterClaim("alice"); err != ErrNotFound {
+		t.Fatalf("MasterClaim = %v, want ErrNotFound", err)
+	}
+	st.PutMasterClaim(MasterClaim{EmailHash: "alice", PublicKey: "k2", ClaimedAt: now})
+	st.PutMasterClaim(MasterClaim{EmailHash: "alice", PublicKey: "k3", ClaimedAt: now.Add(time.Minute)})
+	if c, err := st.MasterClaim("alice"); err != nil || c.PublicKey != "k3" || !c.ClaimedAt.Equal(now.Add(time.Minute)) {
+		t.Fatalf("MasterClaim = %+v, %v", c, err)
+	}
+	st.DeleteMasterClaim("alice")
+	if _, err := st.MasterClaim("alice"); err != ErrNotFound {
+		t.Fatalf("deleted claim: %v", err)
+	}
+
+	// Prune keeps a stale master.
+	st.AddDevice(Device{EmailHash: "dave", PublicKey: "d1", LastActive: now.Add(-48 * time.Hour), IsMaster: true})
+	st.AddDevice(Device{EmailHash: "dave", PublicKey: "d2", LastActive: now.Add(-48 * time.Hour)})
+	st.Prune(now.Add(-24 * time.Hour))
+	if devices, _ := st.ListDevices("dave"); len(devices) != 1 || devices[0].PublicKey != "d1" {
+		t.Fatalf("devices after prune = %+v", devices)
+	}
+	st.DeleteDevices("dave")
+}
+
+func testStoreRegisterDevice(t *testing.T, st Store) {
+	now := time.Now().Truncate(time.Second)
+	d, added, err := st.RegisterDevice(Device{EmailHash: "reg", PublicKey: "first", LastActive: now})
+	if err != nil || !added || !d.IsMaster || d.Status != DeviceActive || d.DeviceID == "" {
+		t.Fatalf("first device = %+v, %v, %v", d, added, err)
+	}
+	d, added, err = st.RegisterDevice(Device{EmailHash: "reg", PublicKey: "second", LastActive: now})
+	if err != nil || !added || d.IsMaster || d.Status != DevicePending {
+		t.Fatalf("second device = %+v, %v, %v", d, added, err)
+	}
+	if d, added, err := st.RegisterDevice(Device{EmailHash: "reg", PublicKey: "first", LastActive: now}); err != nil || added || !d.IsMaster {
+		t.Fatalf("known device = %+v, %v, %v", d, added, err)
+	}
+	if err := st.SetMaster("reg", "second"); err != nil {
+		t.Fatal(err)
+	}
+	if m, err := st.MasterDevice("reg"); err != nil || m.PublicKey != "second" {
+		t.Fatalf("MasterDevice after SetMaster = %+v, %v", m, err)
+	}
+
+	// Devices signing in to a new account at once get one master.
+	var wg sync.WaitGroup
+	for _, pk := range []string{"a", "b", "c", "d", "e", "f", "g", "h"} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, _, err := st.RegisterDevice(Device{EmailHash: "race", PublicKey: pk, LastActive: now}); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	devices, _ := st.ListDevices("race")
+	masters := 0
+	for _, d := range devices {
+		if d.IsMaster {
+			masters++
+		}
+	}
+	if len(devices) != 8 || masters != 1 {
+		t.Fatalf("%d devices with %d masters", len(devices), masters)
+	}
+}
+
+func testStorePresence(t *testing.T, st Store) {
+	st.AddDevice(Device{EmailHash: "bob", PublicKey: "b1", LastActive: time.Now()})
+	st.AddSocket("bob", "s1", "b1")
+	st.AddSocket("bob", "s2", "b1")
+	st.AddSocket("bob", "s3", "unregistered")
+	st.AddSocket("bob", "s4", "")
+
+	if ids, _ := st.SocketIDs("bob"); !sameStrings(ids, []string{"s1", "s2", "s3", "s4"}) {
+		t.Fatalf("SocketIDs = %v", ids)
+	}
+
+	st.RemoveSocket("s1")
+	if ids, _ := st.SocketIDs("bob"); !sameStrings(ids, []string{"s2", "s3", "s4"}) {
+		t.Fatalf("SocketIDs after remove = %v", ids)
+	}
+	st.RemoveDeviceSockets("bob", "b1")
+	if ids, _ := st.SocketIDs("bob"); !sameStrings(ids, []string{"s3", "s4"}) {
+		t.Fatalf("SocketIDs after removing device = %v", ids)
+	}
+	st.RemoveSockets("bob")
+	if ids, _ := st.SocketIDs("bob"); len(ids) != 0 {
+		t.Fatalf("sockets left: %v", ids)
+	}
+}
+
+func testStoreRequests(t *testing.T, st Store) {
+	now := time.Now()
+	st.PutRequest(FriendRequest{SenderHash: "a", TargetHash: "c", EncryptedPacket: "p1", Timestamp: now})
+	st.PutRequest(FriendRequest{SenderHash: "a", TargetHash: "c", EncryptedPacket: "p2", Timestamp: now})
+	st.PutRequest(FriendRequest{SenderHash: "b", TargetHash: "c", EncryptedPacket: "p3", Timestamp: now})
+
+	reqs, _ := st.PendingRequests("c")
+	if len(reqs) != 2 {
+		t.Fatalf("PendingRequests = %+v", reqs)
+	}
+	for _, r := range reqs {
+		if r.SenderHash == "a" && r.EncryptedPacket != "p2" {
+			t.Fatalf("request was not replaced: %+v", r)
+		}
+	}
+
+	st.DeleteRequest("a", "c")
+	if reqs, _ := st.PendingRequests("c"); len(reqs) != 1 {
+		t.Fatalf("PendingRequests after delete = %+v", reqs)
+	}
+}
+
+func testStoreFriendships(t *testing.T, st Store) {
+	st.AddFriendship(Friendship{User1Hash: "a", User2Hash: "b", SID: "sid-ab", Since: time.Now()})
+	st.AddFriendship(Friendship{User1Hash: "a", User2Hash: "c", SID: "sid-ac", Since: time.Now()})
+
+	fs, _ := st.Friendships("a")
+	if len(fs) != 2 {
+		t.Fatalf("Friendships = %+v", fs)
+	}
+	if ok, _ := st.IsSessionMember("sid-ab", "b"); !ok {
+		t.Fatal("b should be a member of sid-ab")
+	}
+	if ok, _ := st.IsSessionMember("sid-ab", "c"); ok {
+		t.Fatal("c should not be a member of sid-ab")
+	}
+
+	st.RemoveFriendship("b", "a")
+	if ok, _ := st.IsSessionMember("sid-ab", "b"); ok {
+		t.Fatal("friendship survived RemoveFriendship")
+	}
+	st.RemoveFriendships("a")
+	if fs, _ := st.Friendships("c"); len(fs) != 0 {
+		t.Fatalf("friendships left: %+v", fs)
+	}
+}
+
+func testStoreNotifications(t *testing.T, st Store) {
+	now := time.Now()
+	st.AddDevice(Device{EmailHash: "n", PublicKey: "phone", LastActive: now})
+	st.AddDevice(Device{EmailHash: "n", PublicKey: "desktop", LastActive: now})
+
+	old, _ := st.AddNotification("n", `{"t":"ONE"}`, now.Add(-48*time.Hour))
+	id, err := st.AddNotification("n", `{"t":"TWO"}`, now)
+	if err != nil || id <= old {
+		t.Fatalf("AddNotification = %d, %v after %d", id, err, old)
+	}
+
+	notifs, _ := st.PendingNotifications("n", "phone")
+	if len(notifs) != 2 || notifs[0].EventData != `{"t":"ONE"}` || notifs[1].ID != id {
+		t.Fatalf("PendingNotifications = %+v", notifs)
+	}
+
+	st.Prune(now.Add(-24 * time.Hour))
+	notifs, _ = st.PendingNotifications("n", "phone")
+	if len(notifs) != 1 || notifs[0].EventData != `{"t":"TWO"}` {
+		t.Fatalf("PendingNotifications after prune = %+v", notifs)
+	}
+
+	// Acks are per device, and only the user's own count.
+	st.AckNotification("someone-else", "desktop", id)
+	st.AckNotification("n", "phone", id)
+	st.AckNotification("n", "phone", id)
+	if notifs, _ := st.PendingNotifications("n", "phone"); len(notifs) != 0 {
+		t.Fatalf("acked notification still pending for the phone: %+v", notifs)
+	}
+	if notifs, _ := st.PendingNotifications("n", "desktop"); len(notifs) != 1 {
+		t.Fatalf("desktop lost a notification it never acked: %+v", notifs)
+	}
+
+	// Once every device has acked, the notification is gone for good, even
+	// for a device that shows up later.
+	st.AckNotification("n", "desktop", id)
+	if notifs, _ := st.PendingNotifications("n", "tablet"); len(notifs) != 0 {
+		t.Fatalf("notifications left: %+v", notifs)
+	}
+}
+
+func testStoreMailbox(t *testing.T, st Store) {
+	now := time.Now()
+	mail := func(pk, payload string, ttl time.Duration) Mail {
+		return Mail{RecipientHash: "m", PublicKey: pk, SID: "sid-m", SenderHash: "s", Payload: payload, CreatedAt: now, ExpiresAt: now.Add(ttl)}
+	}
+
+	for _, m := range []Mail{mail("phone", "one", time.Hour), mail("phone", "two", time.Hour), mail("desktop", "three", time.Hour)} {
+		if ok, err := st.PutMail(m, 16); !ok || err != nil {
+			t.Fatalf("PutMail(%s) = %v, %v", m.Payload, ok, err)
+		}
+	}
+	// The quota covers all of the user's devices.
+	if ok, err := st.PutMail(mail("tablet", "four-five", time.Hour), 16); ok || err != nil {
+		t.Fatalf("PutMail over quota = %v, %v", ok, err)
+	}
+
+	pending, _ := st.PendingMail("m", "phone", now)
+	if len(pending) != 2 || pending[0].Payload != "one" || pending[1].Payload != "two" || pending[0].SenderHash != "s" {
+		t.Fatalf("PendingMail = %+v", pending)
+	}
+
+	// Only the recipient can delete its mail.
+	st.DeleteMail("someone-else", "phone", pending[0].ID)
+	st.DeleteMail("m", "phone", pending[0].ID)
+	if left, _ := st.PendingMail("m", "phone", now); len(left) != 1 || left[0].ID != pending[1].ID {
+		t.Fatalf("PendingMail after delete = %+v", left)
+	}
+
+	// Expired mail is never delivered and does not count against the quota.
+	if ok, _ := st.PutMail(mail("tablet", "stale", -time.Minute), 16); !ok {
+		t.Fatal("PutMail under quota refused")
+	}
+	if left, _ := st.PendingMail("m", "tablet", now); len(left) != 0 {
+		t.Fatalf("expired mail pending: %+v", left)
+	}
+	if ok, _ := st.PutMail(mail("tablet", "fresh", time.Hour), 16); !ok {
+		t.Fatal("expired mail counted against the quota")
+	}
+
+	st.PruneMail(now.Add(2 * time.Hour))
+	for _, pk := range []string{"phone", "desktop", "tablet"} {
+		if left, _ := st.PendingMail("m", pk, now); len(left) != 0 {
+			t.Fatalf("mail left for %s after prune: %+v", pk, left)
+		}
+	}
+}
+
+func testStoreGroups(t *testing.T, st Store) {
+	now := time.Now().Truncate(time.Second)
+	err := st.CreateGroup(Group{ID: "g1", CreatedBy: "a", CreatedAt: now}, []GroupMember{
+		{EmailHash: "a", Role: RoleAdmin, JoinedAt: now},
+		{EmailHash: "b", Role: RoleMember, JoinedAt: now},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g, err := st.Group("g1"); err != nil || g.Epoch != 1 || g.CreatedBy != "a" {
+		t.Fatalf("Group = %+v, %v", g, err)
+	}
+	if _, err := st.Group("nope"); err != ErrNotFound {
+		t.Fatalf("Group(nope) err = %v", err)
+	}
+
+	epoch, err := st.AddGroupMember(GroupMember{GroupID: "g1", EmailHash: "c", Role: RoleMember, JoinedAt: now.Add(time.Second)})
+	if err != nil || epoch != 2 {
+		t.Fatalf("AddGroupMember = %d, %v", epoch, err)
+	}
+	if _, err := st.AddGroupMember(GroupMember{GroupID: "g1", EmailHash: "c", Role: RoleMember, JoinedAt: now}); err == nil {
+		t.Fatal("added c twice")
+	}
+	if err := st.SetGroupRole("g1", "c", RoleAdmin); err != nil {
+		t.Fatal(err)
+	}
+	members, _ := st.GroupMembers("g1")
+	if len(members) != 3 || members[0].EmailHash != "a" || members[2].EmailHash != "c" || members[2].Role != RoleAdmin {
+		t.Fatalf("GroupMembers = %+v", members)
+	}
+
+	for _, eh := range []string{"a", "c"} {
+		if ok, _ := st.IsSessionMember("g1", eh); !ok {
+			t.Fatalf("%s is not a member of g1", eh)
+		}
+	}
+	if groups, _ := st.UserGroups("c"); len(groups) != 1 || groups[0].ID != "g1" || groups[0].Epoch != 2 {
+		t.Fatalf("UserGroups = %+v", groups)
+	}
+
+	if epoch, err := st.RemoveGroupMember("g1", "b"); err != nil || epoch != 3 {
+		t.Fatalf("RemoveGroupMember = %d, %v", epoch, err)
+	}
+	if _, err := st.RemoveGroupMember("g1", "b"); err != ErrNotFound {
+		t.Fatalf("removing b twice: %v", err)
+	}
+	if ok, _ := st.IsSessionMember("g1", "b"); ok {
+		t.Fatal("b is still a member")
+	}
+
+	st.DeleteGroup("g1")
+	if groups, _ := st.UserGroups("a"); len(groups) != 0 {
+		t.Fatalf("groups left: %+v", groups)
+	}
+	if ok, _ := st.IsSessionMember("g1", "a"); ok {
+		t.Fatal("deleted group still has members")
+	}
+}
+
+func testStoreMLS(t *testing.T, st Store) {
+	now := time.Now()
+	st.AddDevice(Device{EmailHash: "k", PublicKey: "phone", LastActive: now})
+	st.AddKeyPackages("k", "phone", []string{"kp1", "kp2"}, now)
+
+	// KeyPackages are handed out oldest first; the last one stays.
+	for _, want := range []string{"kp1", "kp2", "kp2"} {
+		if kp, err := st.TakeKeyPackage("k", "phone"); err != nil || kp.Data != want {
+			t.Fatalf("TakeKeyPackage = %+v, %v, want %s", kp, err, want)
+		}
+	}
+	if n, _ := st.CountKeyPackages("k", "phone"); n != 1 {
+		t.Fatalf("CountKeyPackages = %d", n)
+	}
+	if _, err := st.TakeKeyPackage("k", "laptop"); err != ErrNotFound {
+		t.Fatalf("TakeKeyPackage for a device without any: %v", err)
+	}
+
+	st.CreateGroup(Group{ID: "mls", CreatedBy: "k", CreatedAt: now}, []GroupMember{{EmailHash: "k", Role: RoleAdmin, JoinedAt: now}})
+	commit := func(epoch int64, data string) (bool, error) {
+		return st.AppendCommit(GroupCommit{GroupID: "mls", Epoch: epoch, SenderHash: "k", Data: data, CreatedAt: now})
+	}
+	if ok, err := commit(0, "c0"); !ok || err != nil {
+		t.Fatalf("AppendCommit(0) = %v, %v", ok, err)
+	}
+	// Only one commit wins each epoch.
+	if ok, err := commit(0, "late"); ok || err != nil {
+		t.Fatalf("stale AppendCommit = %v, %v", ok, err)
+	}
+	if ok, _ := commit(2, "early"); ok {
+		t.Fatal("AppendCommit skipped an epoch")
+	}
+	commit(1, "c1")
+	if g, _ := st.Group("mls"); g.MLSEpoch != 2 {
+		t.Fatalf("MLSEpoch = %d", g.MLSEpoch)
+	}
+	commits, _ := st.Commits("mls", 1, 10)
+	if len(commits) != 1 || commits[0].Data != "c1" || commits[0].Epoch != 1 {
+		t.Fatalf("Commits = %+v", commits)
+	}
+	if commits, _ := st.Commits("mls", 0, 1); len(commits) != 1 || commits[0].Data != "c0" {
+		t.Fatalf("Commits with limit = %+v", commits)
+	}
+
+	st.Prune(now.Add(time.Hour))
+	if commits, _ := st.Commits("mls", 0, 10); len(commits) != 0 {
+		t.Fatalf("commits left after prune: %+v", commits)
+	}
+	if n, _ := st.CountKeyPackages("k", "phone"); n != 0 {
+		t.Fatalf("KeyPackages of a pruned device left: %d", n)
+	}
+}
+
+func sameStrings(a, b []string) bool {
+	if len(a) == 0 && len(b) == 0 {
+		return true
+	}
+	count := func(s []string) map[string]int {
+		m := make(map[string]int)
+		for _, v := range s {
+			m[v]++
+		}
+		return m
+	}
+	return reflect.DeepEqual(count(a), count(b))
+}
+
+func testStoreKeyLog(t *testing.T, st Store) {
+	now := time.Now().Truncate(time.Second)
+	if _, err := st.LastKeyAdded("erin", "e1"); err != ErrNotFound {
+		t.Fatalf("LastKeyAdded = %v, want ErrNotFound", err)
+	}
+	for i, action := range []string{KeyAdded, KeyMaster, KeyRemoved, KeyAdded} {
+		e, err := st.AppendKeyLog(KeyLogEntry{EmailHash: "erin", PublicKey: "e1", Action: action, CreatedAt: now.Add(time.Duration(i) * time.Second)})
+		if err != nil || e.Index != int64(i) {
+			t.Fatalf("AppendKeyLog #%d = %+v, %v", i, e, err)
+		}
+	}
+	entries, _ := st.KeyLogEntries(1)
+	if len(entries) != 3 || entries[0].Index != 1 || entries[0].Action != KeyMaster || !entries[2].CreatedAt.Equal(now.Add(3*time.Second)) {
+		t.Fatalf("KeyLogEntries(1) = %+v", entries)
+	}
+	if e, err := st.LastKeyAdded("erin", "e1"); err != nil || e.Index != 3 {
+		t.Fatalf("LastKeyAdded = %+v, %v", e, err)
+	}
+	st.Prune(now.Add(time.Hour))
+	if entries, _ := st.KeyLogEntries(0); len(entries) != 4 {
+		t.Fatalf("prune touched the key log: %d entries", len(entries))
+	}
+}
+
+func testStorePreKeys(t *testing.T, st Store) {
+	now := time.Now().Truncate(time.Second)
+	st.AddDevice(Device{EmailHash: "p", PublicKey: "phone", LastActive: now})
+	if _, err := st.SignedPreKey("p", "phone"); err != ErrNotFound {
+		t.Fatalf("SignedPreKey = %v, want ErrNotFound", err)
+	}
+	st.PutSignedPreKey(PreKey{EmailHash: "p", PublicKey: "phone", KeyID: 1, Key: "spk1", Signature: "sig1", CreatedAt: now})
+	st.PutSignedPreKey(PreKey{EmailHash: "p", PublicKey: "phone", KeyID: 2, Key: "spk2", Signature: "sig2", CreatedAt: now})
+	if k, err := st.SignedPreKey("p", "phone"); err != nil || k.KeyID != 2 || k.Key != "spk2" || k.Signature != "sig2" {
+		t.Fatalf("SignedPreKey = %+v, %v", k, err)
+	}
+
+	st.AddOneTimePreKeys("p", "phone", []PreKey{{KeyID: 1, Key: "otk1", CreatedAt: now}, {KeyID: 2, Key: "otk2", CreatedAt: now}})
+	// A key ID the pool already has is ignored.
+	st.AddOneTimePreKeys("p", "phone", []PreKey{{KeyID: 1, Key: "again", CreatedAt: now}})
+	if n, _ := st.CountOneTimePreKeys("p", "phone"); n != 2 {
+		t.Fatalf("CountOneTimePreKeys = %d", n)
+	}
+	for _, want := range []string{"otk1", "otk2"} {
+		if k, err := st.TakeOneTimePreKey("p", "phone"); err != nil || k.Key != want {
+			t.Fatalf("TakeOneTimePreKey = %+v, %v, want %s", k, err, want)
+		}
+	}
+	if _, err := st.TakeOneTimePreKey("p", "phone"); err != ErrNotFound {
+		t.Fatalf("TakeOneTimePreKey from an empty pool: %v", err)
+	}
+
+	st.AddOneTimePreKeys("p", "phone", []PreKey{{KeyID: 3, Key: "otk3", CreatedAt: now}})
+	st.Prune(now.Add(time.Hour))
+	if _, err := st.SignedPreKey("p", "phone"); err != ErrNotFound {
+		t.Fatalf("signed prekey of a pruned device left: %v", err)
+	}
+	if n, _ := st.CountOneTimePreKeys("p", "phone"); n != 0 {
+		t.Fatalf("one-time prekeys of a pruned device left: %d", n)
+	}
+}
+
+func testStoreDeviceSignatures(t *testing.T, st Store) {
+	now := time.Now().Truncate(time.Second)
+	st.AddDevice(Device{EmailHash: "s", PublicKey: "m", LastActive: now, IsMaster: true})
+	st.AddDevice(Device{EmailHash: "s", PublicKey: "t", LastActive: now})
+	st.AddDeviceSignature(DeviceSignature{EmailHash: "s", Signer: "m", Subject: "t", Kind: "TRANSFER_MASTER", Signature: "sig2", CreatedAt: now.Add(time.Second)})
+	st.AddDeviceSignature(DeviceSignature{EmailHash: "s", Signer: "m", Subject: "t", Kind: "DEVICE_LINK_ACCEPT", Signature: "sig1", CreatedAt: now})
+	sigs, err := st.DeviceSignatures("s")
+	if err != nil || len(sigs) != 2 || sigs[0].Signature != "sig1" || sigs[1].Kind != "TRANSFER_MASTER" || !sigs[1].CreatedAt.Equal(now.Add(time.Second)) {
+		t.Fatalf("DeviceSignatures = %+v, %v", sigs, err)
+	}
+
+	// They outlive a pruned device, but not the account.
+	st.DeleteDevice("s", "t")
+	st.Prune(now.Add(-time.Hour))
+	if sigs, _ := st.DeviceSignatures("s"); len(sigs) != 2 {
+		t.Fatalf("signatures after a device went = %+v", sigs)
+	}
+	st.DeleteDevices("s")
+	st.Prune(now.Add(-time.Hour))
+	if sigs, _ := st.DeviceSignatures("s"); len(sigs) != 0 {
+		t.Fatalf("signatures of a deleted account = %+v", sigs)
+	}
+}
+
+func testStoreApproveDevice(t *testing.T, st Store) {
+	now := time.Now().Truncate(time.Second)
+	st.AddDevice(Device{EmailHash: "ap", PublicKey: "m", LastActive: now, IsMaster: true})
+	st.AddDevice(Device{EmailHash: "ap", PublicKey: "p", LastActive: now, Status: DevicePending, LinkSpecs: "specs"})
+	approval := DeviceSignature{EmailHash: "ap", Signer: "m", Subject: "p", Kind: "DEVICE_LINK_ACCEPT", Signature: "sig", CreatedAt: now}
+	if err := st.ApproveDevice(approval, "xsig"); err != nil {
+		t.Fatal(err)
+	}
+	d, _ := st.Device("ap", "p")
+	if d.Status != DeviceActive || d.LinkSpecs != "" || d.CrossSignature != "xsig" || d.CrossSignedBy != "m" {
+		t.Fatalf("approved device = %+v", d)
+	}
+	if sigs, _ := st.DeviceSignatures("ap"); len(sigs) != 1 || sigs[0].Signature != "sig" || sigs[0].Subject != "p" || !sigs[0].CreatedAt.Equal(now) {
+		t.Fatalf("DeviceSignatures = %+v", sigs)
+	}
+
+	// Only a pending device can be approved, and a refused approval
+	// leaves no signature behind.
+	for _, pk := range []string{"p", "nope"} {
+		approval.Subject = pk
+		if err := st.ApproveDevice(approval, "xsig"); err != ErrNotFound {
+			t.Fatalf("ApproveDevice(%s) = %v", pk, err)
+		}
+	}
+	if sigs, _ := st.DeviceSignatures("ap"); len(sigs) != 1 {
+		t.Fatalf("DeviceSignatures after refused approvals = %+v", sigs)
+	}
+}
+
+func testStoreKeyRotation(t *testing.T, st Store) {
+	now := time.Now().Truncate(time.Second)
+	st.AddDevice(Device{EmailHash: "r", PublicKey: "m", LastActive: now, IsMaster: true})
+	st.AddDevice(Device{EmailHash: "r", PublicKey: "old", LastActive: now, Status: DeviceActive})
+	st.SetCrossSignature("r", "old", "m", "xsig")
+	st.AddSocket("r", "sock", "old")
+	st.PutMail(Mail{RecipientHash: "r", PublicKey: "old", SID: "sid", SenderHash: "x", Payload: "p", CreatedAt: now, ExpiresAt: now.Add(time.Hour)}, 16)
+	id, _ := st.AddNotification("r", "{}", now)
+	st.AckNotification("r", "old", id)
+	st.AddKeyPackages("r", "old", []string{"kp"}, now)
+	st.PutMasterClaim(MasterClaim{EmailHash: "r", PublicKey: "old", ClaimedAt: now})
+	st.PutSignedPreKey(PreKey{EmailHash: "r", PublicKey: "old", KeyID: 1, Key: "spk", Signature: "s", CreatedAt: now})
+	st.AddOneTimePreKeys("r", "old", []PreKey{{KeyID: 1, Key: "otk", CreatedAt: now}})
+	before, _ := st.Device("r", "old")
+
+	if err := st.RotateDeviceKey(KeyRotation{EmailHash: "r", DeviceID: before.DeviceID, OldKey: "nope", NewKey: "new", RotatedAt: now}); err != ErrNotFound {
+		t.Fatalf("RotateDeviceKey(unknown) = %v", err)
+	}
+	r := KeyRotation{EmailHash: "r", DeviceID: before.DeviceID, OldKey: "old", NewKey: "new", Signature: "sig", RotatedAt: now}
+	if err := st.RotateDeviceKey(r); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := st.Device("r", "old"); err != ErrNotFound {
+		t.Fatalf("old key still a device: %v", err)
+	}
+	d, err := st.Device("r", "new")
+	if err != nil || d.DeviceID != before.DeviceID || d.Status != DeviceActive || d.CrossSignature != "" || d.CrossSignedBy != "" {
+		t.Fatalf("rotated device = %+v, %v", d, err)
+	}
+
+	// What the server holds for the old key follows it...
+	if err := st.RemoveDeviceSockets("r", "new"); err != nil {
+		t.Fatal(err)
+	}
+	if ids, _ := st.SocketIDs("r"); len(ids) != 0 {
+		t.Fatalf("sockets left on the old key = %v", ids)
+	}
+	if mail, _ := st.PendingMail("r", "new", now); len(mail) != 1 {
+		t.Fatalf("mail for the new key = %+v", mail)
+	}
+	if pending, _ := st.PendingNotifications("r", "new"); len(pending) != 0 {
+		t.Fatalf("acked notification pending again: %+v", pending)
+	}
+	if n, _ := st.CountKeyPackages("r", "new"); n != 1 {
+		t.Fatalf("key packages for the new key = %d", n)
+	}
+	if c, err := st.MasterClaim("r"); err != nil || c.PublicKey != "new" {
+		t.Fatalf("master claim = %+v, %v", c, err)
+	}
+	// ...except prekeys, which were signed by it.
+	if _, err := st.SignedPreKey("r", "new"); err != ErrNotFound {
+		t.Fatalf("signed prekey survived rotation: %v", err)
+	}
+	if n, _ := st.CountOneTimePreKeys("r", "old"); n != 0 {
+		t.Fatalf("one-time prekeys of the old key = %d", n)
+	}
+
+	history, err := st.KeyRotations("r")
+	if err != nil || len(history) != 1 || history[0].OldKey != "old" || history[0].NewKey != "new" || history[0].DeviceID != before.DeviceID || !history[0].RotatedAt.Equal(now) {
+		t.Fatalf("KeyRotations = %+v, %v", history, err)
+	}
+	sigs, _ := st.DeviceSignatures("r")
+	if len(sigs) != 1 || sigs[0].Kind != "UPDATE_PUBKEY" || sigs[0].Signer != "old" || sigs[0].Subject != "new" || sigs[0].Signature != "sig" {
+		t.Fatalf("DeviceSignatures = %+v", sigs)
+	}
+
+	// A retired key outlives the normal retention, but not the account.
+	st.Prune(now.Add(time.Hour))
+	if history, _ := st.KeyRotations("r"); len(history) != 1 || history[0].OldKey != "old" {
+		t.Fatalf("history after prune = %+v", history)
+	}
+	st.DeleteDevices("r")
+	st.Prune(now.Add(time.Hour))
+	if history, _ := st.KeyRotations("r"); len(history) != 0 {
+		t.Fatalf("history of a deleted account = %+v", history)
+	}
+}
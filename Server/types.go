@@ -1,7 +1,6 @@
 package main
 
 import (
-	"database/sql"
 	"encoding/json"
 	"log"
 	"sync"
@@ -12,6 +11,8 @@ import (
 
 type Frame struct {
 	T            string          `json:"t"`
+	ID           string          `json:"id,omitempty"`
+	Seq          int64           `json:"seq,omitempty"`
 	SID          string          `json:"sid,omitempty"`
 	C            bool            `json:"c,omitempty"`
 	P            int             `json:"p,omitempty"`
@@ -22,30 +23,56 @@ type Frame struct {
 
 type Client struct {
 	id          string
+	ip          string
 	email       string
+	publicKey   string
 	conn        *websocket.Conn
+	codec       frameCodec
+	out         *sendQueue
 	mu          sync.Mutex
-	msgCount    int
-	msgWindow   time.Time
+	limits      map[string]*rateWindow
 	lastConnect time.Time
+	hello       *clientHello
+	// deviceStatus is the status of publicKey's device when it
+	// authenticated; a device that gets approved authenticates again.
+	deviceStatus string
+
+	// syncMu serialises delivery of stored frames to this connection;
+	// notifSent and mailSent hold the notifications and mail sent and not
+	// yet acked.
+	syncMu    sync.Mutex
+	notifSent map[int64]bool
+	mailSent  map[int64]bool
+
+	// detached is set once the client has left all sessions; guarded by
+	// the sessionIndex lock.
+	detached bool
 }
 
-type Session struct {
-	id      string
-	clients map[string]*Client
-	mu      sync.Mutex
+type rateWindow struct {
+	start time.Time
+	count int
 }
 
 type RateLimiter struct {
-	ipAttempts map[string][]time.Time
-	mu         sync.Mutex
+	ipAttempts  map[string][]time.Time
+	preKeyTakes map[string][]time.Time // by target, and by requester and target
+	preKeySwept time.Time              // when preKeyTakes was last cleared of expired takes
+	mu          sync.Mutex
 }
 
 type Server struct {
-	clients     map[string]*Client
-	sessions    map[string]*Session
-	mu          sync.Mutex
-	logger      *log.Logger
-	rateLimiter *RateLimiter
-	db          *sql.DB
+	clients      map[string]*Client
+	sessions     *sessionIndex
+	presence     *Presence
+	cluster      *Cluster
+	mu           sync.Mutex
+	logger       *log.Logger
+	rateLimiter  *RateLimiter
+	store        Store
+	frames       *FrameRegistry
+	cfg          *Config
+	queueMetrics *queueMetrics
+	sessionKey   []byte
+	keyLog       *keyLog
 }